@@ -4,6 +4,7 @@
 package llmclient
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -28,12 +29,38 @@ const (
 	ModelBase = "base"
 	// ModelLarge is the large model, for more advanced tasks with longer context windows
 	ModelLarge = "large"
+
+	// The following tiers are only available if they have been declared by the
+	// Grafana admin. Requests for undeclared tiers use the default model.
+
+	// ModelSmall is the small model, for simple tasks where latency matters most
+	ModelSmall = "small"
+	// ModelReasoning is the reasoning model, for tasks requiring multi-step reasoning
+	ModelReasoning = "reasoning"
+	// ModelVision is the vision model, for tasks involving images
+	ModelVision = "vision"
+	// ModelLongContext is the long context model, for tasks with very large inputs
+	ModelLongContext = "long-context"
 )
 
 // ChatCompletionRequest is a request for chat completions using an abstract model.
 type ChatCompletionRequest struct {
 	openai.ChatCompletionRequest
 	Model Model `json:"model"`
+	// GrafanaTools are the Grafana MCP toolsets, such as "prometheus" or
+	// "loki", whose tools the model may use. The LLM app executes those tool
+	// calls itself and only returns the final answer.
+	GrafanaTools []string `json:"grafana_tools,omitempty"`
+	// GrafanaCache allows the response to be served from the LLM app's
+	// response cache even if the temperature is not 0.
+	GrafanaCache bool `json:"grafana_cache,omitempty"`
+}
+
+// EmbeddingRequest is a request for embeddings using an abstract embedding model,
+// either ModelBase or ModelLarge.
+type EmbeddingRequest struct {
+	openai.EmbeddingRequest
+	Model Model `json:"model"`
 }
 
 // LLMProvider is an interface for talking to LLM providers via the Grafana LLM app.
@@ -47,6 +74,8 @@ type LLMProvider interface {
 	ChatCompletions(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error)
 	// ChatCompletionsStream makes a streaming request to the LLM provider Chat Completion API.
 	ChatCompletionsStream(ctx context.Context, req ChatCompletionRequest) (*openai.ChatCompletionStream, error)
+	// Embeddings makes a request to the LLM provider Embeddings API.
+	Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error)
 }
 
 type llmProvider struct {
@@ -70,7 +99,11 @@ func NewLLMProviderWithClient(grafanaURL, grafanaAPIKey string, httpClient *http
 	url := grafanaURL + llmAPIPrefix
 	cfg := openai.DefaultConfig(grafanaAPIKey)
 	cfg.BaseURL = url
-	cfg.HTTPClient = httpClient
+	// go-openai only sends the fields of its own requests, so the Grafana
+	// fields of chat completions requests are added to the body on the way out.
+	openAIClient := *httpClient
+	openAIClient.Transport = grafanaFieldsTransport{next: httpClient.Transport}
+	cfg.HTTPClient = &openAIClient
 	client := openai.NewClientWithConfig(cfg)
 	return &llmProvider{
 		httpClient:    httpClient,
@@ -151,11 +184,79 @@ func (o *llmProvider) Enabled(ctx context.Context) (bool, error) {
 func (o *llmProvider) ChatCompletions(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
 	r := req.ChatCompletionRequest
 	r.Model = string(req.Model)
-	return o.client.CreateChatCompletion(ctx, r)
+	return o.client.CreateChatCompletion(withGrafanaFields(ctx, req), r)
 }
 
 func (o *llmProvider) ChatCompletionsStream(ctx context.Context, req ChatCompletionRequest) (*openai.ChatCompletionStream, error) {
 	r := req.ChatCompletionRequest
 	r.Model = string(req.Model)
-	return o.client.CreateChatCompletionStream(ctx, r)
+	return o.client.CreateChatCompletionStream(withGrafanaFields(ctx, req), r)
+}
+
+// grafanaFields are the fields of a ChatCompletionRequest which are specific
+// to the Grafana LLM app.
+type grafanaFields struct {
+	GrafanaTools []string `json:"grafana_tools,omitempty"`
+	GrafanaCache bool     `json:"grafana_cache,omitempty"`
+}
+
+type grafanaFieldsKey struct{}
+
+// withGrafanaFields returns a context carrying the Grafana fields of req, if
+// any are set, for grafanaFieldsTransport to add to the request body.
+func withGrafanaFields(ctx context.Context, req ChatCompletionRequest) context.Context {
+	if len(req.GrafanaTools) == 0 && !req.GrafanaCache {
+		return ctx
+	}
+	return context.WithValue(ctx, grafanaFieldsKey{}, grafanaFields{GrafanaTools: req.GrafanaTools, GrafanaCache: req.GrafanaCache})
+}
+
+// grafanaFieldsTransport adds the Grafana fields in the context of a request
+// to its JSON body before sending it with next.
+type grafanaFieldsTransport struct {
+	next http.RoundTripper
+}
+
+func (t grafanaFieldsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	fields, ok := req.Context().Value(grafanaFieldsKey{}).(grafanaFields)
+	if !ok || req.Body == nil {
+		return next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read request body: %w", err)
+	}
+	var r map[string]json.RawMessage
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal request body: %w", err)
+	}
+	extra, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("marshal Grafana fields: %w", err)
+	}
+	if err := json.Unmarshal(extra, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal Grafana fields: %w", err)
+	}
+	if body, err = json.Marshal(r); err != nil {
+		return nil, fmt.Errorf("marshal request body: %w", err)
+	}
+	// RoundTrippers must not modify the request they are given.
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return next.RoundTrip(req)
+}
+
+func (o *llmProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	r := req.EmbeddingRequest
+	r.Model = openai.EmbeddingModel(req.Model)
+	return o.client.CreateEmbeddings(ctx, r)
 }
@@ -138,3 +138,108 @@ func TestChatCompletionsStream(t *testing.T) {
 		t.Errorf("expected streamed content to be 'hello there', got '%s'", content)
 	}
 }
+
+func TestChatCompletionsGrafanaFields(t *testing.T) {
+	ctx := context.Background()
+	var body map[string]any
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if body["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		j, _ := json.Marshal(openai.ChatCompletionResponse{ID: "test"})
+		w.Write(j)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := NewLLMProvider(server.URL, "test")
+	req := ChatCompletionRequest{
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "Which services have high error rates?"}},
+		},
+		Model:        ModelBase,
+		GrafanaTools: []string{"prometheus", "loki"},
+		GrafanaCache: true,
+	}
+	check := func(name string) {
+		t.Helper()
+		if tools, _ := json.Marshal(body["grafana_tools"]); string(tools) != `["prometheus","loki"]` {
+			t.Errorf("%s: expected grafana_tools to be sent, got %s", name, tools)
+		}
+		if body["grafana_cache"] != true {
+			t.Errorf("%s: expected grafana_cache to be sent, got %v", name, body["grafana_cache"])
+		}
+		if body["model"] != ModelBase || body["messages"] == nil {
+			t.Errorf("%s: expected the rest of the request to be sent, got %v", name, body)
+		}
+	}
+
+	if _, err := client.ChatCompletions(ctx, req); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	check("ChatCompletions")
+
+	stream, err := client.ChatCompletionsStream(ctx, req)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	stream.Close()
+	check("ChatCompletionsStream")
+
+	// Requests without Grafana fields are sent as is.
+	if _, err := client.ChatCompletions(ctx, ChatCompletionRequest{ChatCompletionRequest: req.ChatCompletionRequest, Model: ModelBase}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if _, ok := body["grafana_tools"]; ok {
+		t.Errorf("expected grafana_tools to be omitted, got %v", body)
+	}
+}
+
+func TestEmbeddings(t *testing.T) {
+	ctx := context.Background()
+	key := "test"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/plugins/grafana-llm-app/resources/llm/v1/embeddings" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 page not found"))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+key {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := openai.EmbeddingRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != ModelLarge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response := openai.EmbeddingResponse{
+			Object: "list",
+			Model:  "test",
+			Data:   []openai.Embedding{{Object: "embedding", Embedding: []float32{0.5, 0.25}}},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		j, _ := json.Marshal(response)
+		w.Write(j)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := NewLLMProvider(server.URL, key)
+	resp, err := client.Embeddings(ctx, EmbeddingRequest{
+		EmbeddingRequest: openai.EmbeddingRequest{Input: []string{"hello"}},
+		Model:            ModelLarge,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(resp.Data) != 1 || len(resp.Data[0].Embedding) != 2 {
+		t.Errorf("expected one embedding with 2 dimensions, got %+v", resp.Data)
+	}
+}
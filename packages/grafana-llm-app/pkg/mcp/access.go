@@ -0,0 +1,69 @@
+package mcp
+
+import (
+	"context"
+	"fmt"
+
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// ToolAuthorizer reports whether a user may use a tool of a toolset. write is
+// whether the tool modifies Grafana.
+type ToolAuthorizer func(toolset Toolset, tool string, write bool) bool
+
+type toolAuthorizerKey struct{}
+
+// withToolAuthorizer returns a context carrying the tools the user making a
+// request may use, so that they are only determined once per request.
+func withToolAuthorizer(ctx context.Context, authorize ToolAuthorizer) context.Context {
+	return context.WithValue(ctx, toolAuthorizerKey{}, authorize)
+}
+
+// toolAuthorizer returns the tools the user making a request may use, or nil
+// if they may use all tools. The user is identified by the plugin context in
+// ctx, which both transports add for each request.
+func (s Settings) toolAuthorizer(ctx context.Context) ToolAuthorizer {
+	if authorize, ok := ctx.Value(toolAuthorizerKey{}).(ToolAuthorizer); ok {
+		return authorize
+	}
+	if s.AuthorizeTools == nil {
+		return nil
+	}
+	return s.AuthorizeTools(ctx)
+}
+
+// filterTools returns a tool filter hiding the tools the user making a
+// request may not use from tools/list.
+func filterTools(settings Settings, toolsets map[string]Toolset, writeTools map[string]bool) server.ToolFilterFunc {
+	return func(ctx context.Context, tools []mcpgo.Tool) []mcpgo.Tool {
+		authorize := settings.toolAuthorizer(ctx)
+		if authorize == nil {
+			return tools
+		}
+		allowed := make([]mcpgo.Tool, 0, len(tools))
+		for _, tool := range tools {
+			if authorize(toolsets[tool.Name], tool.Name, writeTools[tool.Name]) {
+				allowed = append(allowed, tool)
+			}
+		}
+		return allowed
+	}
+}
+
+// authorizeToolCalls returns middleware rejecting calls to tools the user
+// making the request may not use.
+func authorizeToolCalls(settings Settings, toolsets map[string]Toolset, writeTools map[string]bool) server.ToolHandlerMiddleware {
+	return func(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+		if settings.AuthorizeTools == nil {
+			return next
+		}
+		return func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+			name := req.Params.Name
+			if authorize := settings.toolAuthorizer(ctx); authorize != nil && !authorize(toolsets[name], name, writeTools[name]) {
+				return mcpgo.NewToolResultError(fmt.Sprintf("You do not have permission to use the tool %s.", name)), nil
+			}
+			return next(ctx, req)
+		}
+	}
+}
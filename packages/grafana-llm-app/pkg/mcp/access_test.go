@@ -0,0 +1,169 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+)
+
+// newAuthorizedMCP returns an MCP server with a read-only tool, a write tool
+// and an admin tool, which viewers may only use the first of.
+func newAuthorizedMCP(t *testing.T) *MCP {
+	t.Helper()
+	m, err := New(Settings{
+		IsToolsetEnabled: func(Toolset) bool { return false },
+		AuthorizeTools: func(ctx context.Context) ToolAuthorizer {
+			user := backend.PluginConfigFromContext(ctx).User
+			if user == nil {
+				return func(Toolset, string, bool) bool { return false }
+			}
+			switch user.Role {
+			case "Admin":
+				return nil
+			case "Editor":
+				return func(toolset Toolset, _ string, _ bool) bool { return toolset != ToolsetAdmin }
+			default:
+				return func(toolset Toolset, _ string, write bool) bool { return toolset != ToolsetAdmin && !write }
+			}
+		},
+	}, "test")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(m.Close)
+	handler := func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultText("ok"), nil
+	}
+	m.AddTool(ToolsetLoki, mcpgo.NewTool("query_loki_logs", mcpgo.WithReadOnlyHintAnnotation(true)), handler)
+	m.AddTool(ToolsetDashboard, mcpgo.NewTool("update_dashboard"), handler)
+	m.AddTool(ToolsetAdmin, mcpgo.NewTool("list_users", mcpgo.WithReadOnlyHintAnnotation(true)), handler)
+	return m
+}
+
+func pluginContextForRole(role string) backend.PluginContext {
+	return backend.PluginContext{OrgID: 1, User: &backend.User{Login: strings.ToLower(role), Role: role}}
+}
+
+var allowedToolsByRole = map[string][]string{
+	"":       nil,
+	"Viewer": {"query_loki_logs"},
+	"Editor": {"query_loki_logs", "update_dashboard"},
+	"Admin":  {"list_users", "query_loki_logs", "update_dashboard"},
+}
+
+func toolNames(tools []mcpgo.Tool) []string {
+	names := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestAllowedTools(t *testing.T) {
+	m := newAuthorizedMCP(t)
+	for role, want := range allowedToolsByRole {
+		pCtx := pluginContextForRole(role)
+		if role == "" {
+			pCtx.User = nil
+		}
+		got := toolNames(m.AllowedTools(backend.WithPluginContext(context.Background(), pCtx), ToolsetLoki, ToolsetDashboard, ToolsetAdmin))
+		if !slices.Equal(got, want) {
+			t.Errorf("%q: AllowedTools() = %v, want %v", role, got, want)
+		}
+
+		for _, tool := range []string{"query_loki_logs", "update_dashboard", "list_users"} {
+			result, err := m.CallTool(context.Background(), &pCtx, "", tool, "")
+			if err != nil {
+				t.Fatalf("CallTool(%s) error = %v", tool, err)
+			}
+			if allowed := slices.Contains(want, tool); result.IsError == allowed {
+				t.Errorf("%q: CallTool(%s) = %q, want allowed = %v", role, tool, ToolResultText(result), allowed)
+			}
+		}
+	}
+}
+
+func TestToolAuthorizationOverLive(t *testing.T) {
+	m := newAuthorizedMCP(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	packets := make(chanPacketSender, 10)
+	go func() {
+		//nolint:errcheck
+		m.LiveServer.HandleStream(ctx, &backend.RunStreamRequest{Path: "mcp/1/subscribe"}, backend.NewStreamSender(packets))
+	}()
+	for {
+		if _, ok := m.LiveServer.sessions.Load("mcp/1"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	send := func(role, msg string) *mcpgo.JSONRPCResponse {
+		t.Helper()
+		req := &backend.PublishStreamRequest{Path: "mcp/1/publish", Data: json.RawMessage(msg), PluginContext: pluginContextForRole(role)}
+		if err := m.LiveServer.HandleMessage(ctx, req); err != nil {
+			t.Fatalf("HandleMessage() error = %v", err)
+		}
+		select {
+		case data := <-packets:
+			var resp mcpgo.JSONRPCResponse
+			if err := json.Unmarshal(data, &resp); err != nil {
+				t.Fatalf("invalid response %s: %v", data, err)
+			}
+			return &resp
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a response")
+			return nil
+		}
+	}
+
+	// The same session is used by users with different roles, so access must
+	// be determined for each message.
+	for _, role := range []string{"Viewer", "Admin", "Editor"} {
+		resp := send(role, `{"jsonrpc": "2.0", "id": 1, "method": "tools/list"}`)
+		b, _ := json.Marshal(resp.Result)
+		var result mcpgo.ListToolsResult
+		if err := json.Unmarshal(b, &result); err != nil {
+			t.Fatalf("invalid tools/list result %s: %v", b, err)
+		}
+		if got := toolNames(result.Tools); !slices.Equal(got, allowedToolsByRole[role]) {
+			t.Errorf("%s: tools/list = %v, want %v", role, got, allowedToolsByRole[role])
+		}
+	}
+
+	resp := send("Viewer", `{"jsonrpc": "2.0", "id": 2, "method": "tools/call", "params": {"name": "update_dashboard", "arguments": {}}}`)
+	b, _ := json.Marshal(resp.Result)
+	if !strings.Contains(string(b), "You do not have permission to use the tool update_dashboard.") {
+		t.Errorf("viewer call to update_dashboard = %s, want a permission error", b)
+	}
+}
+
+func TestToolAuthorizationOverHTTP(t *testing.T) {
+	m := newAuthorizedMCP(t)
+	for _, role := range []string{"Viewer", "Admin"} {
+		ctx := backend.WithPluginContext(context.Background(), pluginContextForRole(role))
+		req := httptest.NewRequest(http.MethodPost, "/mcp", strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "tools/list"}`)).WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json, text/event-stream")
+		rec := httptest.NewRecorder()
+		m.HTTPServer.ServeHTTP(rec, req)
+		var resp struct {
+			Result mcpgo.ListToolsResult `json:"result"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: invalid response %s: %v", role, rec.Body, err)
+		}
+		if got := toolNames(resp.Result.Tools); !slices.Equal(got, allowedToolsByRole[role]) {
+			t.Errorf("%s: tools/list = %v, want %v", role, got, allowedToolsByRole[role])
+		}
+	}
+}
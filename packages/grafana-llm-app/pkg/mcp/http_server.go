@@ -131,6 +131,13 @@ func (m *MCP) extractIncidentClientFromHTTPRequest(ctx context.Context, req *htt
 	return mcpgrafana.WithIncidentClient(ctx, client)
 }
 
+// authorizeHTTPRequest determines which tools the user making the request may
+// use, from the plugin context added to the request by the plugin SDK.
+func (m *MCP) authorizeHTTPRequest(ctx context.Context, req *http.Request) context.Context {
+	ctx = backend.WithPluginContext(ctx, backend.PluginConfigFromContext(req.Context()))
+	return withToolAuthorizer(ctx, m.Settings.toolAuthorizer(ctx))
+}
+
 // httpContextFunc returns a function that can be used to extract
 // information from the HTTP request.
 // It is a method of the MCP struct, because it needs access to extra state than is
@@ -140,5 +147,6 @@ func (m *MCP) httpContextFunc() server.HTTPContextFunc {
 		m.extractGrafanaInfoFromHTTPRequest,
 		m.extractGrafanaClientFromHTTPRequest,
 		m.extractIncidentClientFromHTTPRequest,
+		m.authorizeHTTPRequest,
 	)
 }
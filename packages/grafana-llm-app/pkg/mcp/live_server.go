@@ -8,15 +8,20 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/grafana/grafana-openapi-client-go/client"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/grafana/incident-go"
 	mcpgrafana "github.com/grafana/mcp-grafana"
 
 	"github.com/go-openapi/strfmt"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -64,6 +69,12 @@ type GrafanaLiveServer struct {
 	// done is a channel that will be closed when the Grafana Live server is
 	// shutting down.
 	done chan struct{}
+	// requiresConfirmation, if set, returns whether calls to a tool must be
+	// confirmed by the user.
+	requiresConfirmation func(tool string) bool
+	// authorizeTools, if set, returns which tools the user making a request
+	// may use.
+	authorizeTools func(ctx context.Context) ToolAuthorizer
 }
 
 // GrafanaLiveOption defines a function type for configuring the GrafanaLiveServer.
@@ -77,6 +88,23 @@ func WithIsGrafanaCloud(enabled bool) GrafanaLiveOption {
 	}
 }
 
+// withConfirmation returns a GrafanaLiveOption setting which tools must be
+// confirmed by the user. Calls to them are handled in the background, since
+// the user's response arrives as another message.
+func withConfirmation(requiresConfirmation func(tool string) bool) GrafanaLiveOption {
+	return func(s *GrafanaLiveServer) {
+		s.requiresConfirmation = requiresConfirmation
+	}
+}
+
+// withToolAuthorization returns a GrafanaLiveOption setting how the tools the
+// user sending each message may use are determined.
+func withToolAuthorization(authorizeTools func(ctx context.Context) ToolAuthorizer) GrafanaLiveOption {
+	return func(s *GrafanaLiveServer) {
+		s.authorizeTools = authorizeTools
+	}
+}
+
 // NewGrafanaLiveServer creates a new GrafanaLiveServer.
 func NewGrafanaLiveServer(server *server.MCPServer, acc *accessTokenClient, opts ...GrafanaLiveOption) *GrafanaLiveServer {
 	s := &GrafanaLiveServer{
@@ -107,14 +135,110 @@ type liveSession struct {
 	// sender is the StreamSender for the Grafana Live session. It is used to send
 	// JSON-RPC responses back to the client.
 	sender *backend.StreamSender
+	// ctx is cancelled when the session ends, stopping tool calls handled in
+	// the background for it.
+	ctx context.Context
+
+	// confirmations holds a channel for each request sent to the client to
+	// confirm a tool call, keyed by the request's ID, to which the client's
+	// response is delivered.
+	confirmations sync.Map
+	// nextConfirmation is the number of the next confirmation request.
+	nextConfirmation atomic.Int64
+}
+
+// confirm asks the client to have the user confirm something described by
+// message, using an MCP elicitation request, and waits for the response.
+func (ls *liveSession) confirm(ctx context.Context, message string) (bool, error) {
+	id := fmt.Sprintf("confirm-%d", ls.nextConfirmation.Add(1))
+	responses := make(chan clientResponse, 1)
+	ls.confirmations.Store(id, responses)
+	defer ls.confirmations.Delete(id)
+
+	req, err := json.Marshal(mcpgo.JSONRPCRequest{
+		JSONRPC: mcpgo.JSONRPC_VERSION,
+		ID:      mcpgo.NewRequestId(id),
+		Request: mcpgo.Request{Method: string(mcpgo.MethodElicitationCreate)},
+		Params: mcpgo.ElicitationParams{
+			Message:         message,
+			RequestedSchema: map[string]any{"type": "object", "properties": map[string]any{}},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := ls.sender.SendJSON(req); err != nil {
+		return false, fmt.Errorf("send confirmation request: %w", err)
+	}
+	select {
+	case resp := <-responses:
+		if resp.Error != nil {
+			return false, fmt.Errorf("client responded with an error: %s", resp.Error.Message)
+		}
+		var result mcpgo.ElicitationResult
+		if err := json.Unmarshal(resp.Result, &result); err != nil {
+			return false, fmt.Errorf("invalid confirmation response: %w", err)
+		}
+		return result.Action == mcpgo.ElicitationResponseActionAccept, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// clientResponse is a JSON-RPC response from the client to a request sent by
+// the server.
+type clientResponse struct {
+	ID     any             `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// detach returns a copy of ctx which is no longer cancelled with ctx, but is
+// cancelled when the session ends, for handling messages in the background.
+func (ls *liveSession) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ls.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// handleResponse delivers data to the confirmation it responds to, if it is
+// a response to one, and returns whether it was.
+func (ls *liveSession) handleResponse(data []byte) bool {
+	var resp clientResponse
+	if err := json.Unmarshal(data, &resp); err != nil || resp.Method != "" || resp.ID == nil {
+		return false
+	}
+	id, ok := resp.ID.(string)
+	if !ok {
+		return false
+	}
+	responses, ok := ls.confirmations.Load(id)
+	if !ok {
+		return false
+	}
+	select {
+	case responses.(chan clientResponse) <- resp:
+	default:
+	}
+	return true
 }
 
 // HandleStream handles a new Grafana Live session for MCP communication.
 // It creates a session, stores it in the sessions map, and blocks until the stream
-// is closed or the server is shutting down.
+// is closed or the server is shutting down, when the session's context is
+// cancelled.
 func (s *GrafanaLiveServer) HandleStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	ls := &liveSession{
 		sender: sender,
+		ctx:    sessionCtx,
 	}
 
 	// Store the session in the sessions map.
@@ -136,21 +260,30 @@ func (s *GrafanaLiveServer) HandleStream(ctx context.Context, req *backend.RunSt
 // It processes MCP JSON-RPC messages from clients and sends responses back through
 // the corresponding Live session.
 func (s *GrafanaLiveServer) HandleMessage(ctx context.Context, req *backend.PublishStreamRequest) error {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "GrafanaLiveServer.HandleMessage", trace.WithAttributes(
+		attribute.String("grafana_llm.mcp.method", jsonRPCMethod(req.Data)),
+	))
+	defer span.End()
 	path := strings.TrimSuffix(req.Path, publishSuffix)
 	// Get the session from the sessions map.
 	sessionI, ok := s.sessions.Load(path)
 	if !ok {
-		return ErrStreamNotFound
+		return tracing.Error(span, ErrStreamNotFound)
 	}
 	session := sessionI.(*liveSession)
+	// Responses to confirmation requests are delivered to the tool call
+	// waiting for them, rather than being handled by the MCP server.
+	if session.handleResponse(req.Data) {
+		return nil
+	}
 
 	accessToken, err := s.acc.getAccessToken(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get access token: %w", err)
+		return tracing.Errorf(span, "failed to get access token: %w", err)
 	}
 	grafanaIdToken := req.GetHTTPHeader(backend.GrafanaUserSignInTokenHeaderName)
 	if s.isGrafanaCloud && grafanaIdToken == "" {
-		return fmt.Errorf("grafana id token not found in request headers")
+		return tracing.Errorf(span, "grafana id token not found in request headers")
 	}
 
 	// Modify the context if a context function is set.
@@ -158,10 +291,39 @@ func (s *GrafanaLiveServer) HandleMessage(ctx context.Context, req *backend.Publ
 		ctx = s.contextFunc(ctx, &req.PluginContext, accessToken, grafanaIdToken)
 	}
 
+	// Identify the user who sent the message, so that the tools they may use
+	// are determined by their identity rather than that of the session.
+	ctx = backend.WithPluginContext(ctx, req.PluginContext)
+	if s.authorizeTools != nil {
+		ctx = withToolAuthorizer(ctx, s.authorizeTools(ctx))
+	}
+
+	// Let tools which must be confirmed ask the user over this session.
+	ctx = withConfirmFunc(ctx, session.confirm)
+
 	log.DefaultLogger.Info("Handling message", "len_access_token", len(accessToken), "len_grafana_id_token", len(grafanaIdToken))
 
+	if s.requiresConfirmation != nil && s.requiresConfirmation(toolCallName(req.Data)) {
+		// Grafana Live may not deliver the client's response to the
+		// confirmation request until this message has been handled, so the
+		// call is handled in the background, until the session ends.
+		ctx, cancel := session.detach(ctx)
+		go func() {
+			defer cancel()
+			if err := s.handleMessage(ctx, session, req.Data); err != nil {
+				log.DefaultLogger.Error("Error handling MCP message", "err", err)
+			}
+		}()
+		return nil
+	}
+	return s.handleMessage(ctx, session, req.Data)
+}
+
+// handleMessage processes an MCP message and sends the response, if any, to
+// the session.
+func (s *GrafanaLiveServer) handleMessage(ctx context.Context, session *liveSession, data []byte) error {
 	// Process the message through the MCPServer.
-	response := s.server.HandleMessage(ctx, req.Data)
+	response := s.server.HandleMessage(ctx, data)
 
 	// Only send response if there is one (not for notifications).
 	if response != nil {
@@ -1,10 +1,13 @@
 package mcp
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/mcp-grafana/tools"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 )
 
@@ -55,6 +58,41 @@ type Settings struct {
 
 	// If nil, all toolsets are enabled.
 	IsToolsetEnabled func(toolset Toolset) bool
+
+	// IsToolsetReadOnly, if set, returns whether only the tools of a toolset
+	// which don't modify Grafana are registered. If nil, no toolset is
+	// read-only.
+	IsToolsetReadOnly func(toolset Toolset) bool
+
+	// ObserveToolCall, if set, is called after each tool call with the
+	// toolset of the tool, how long the call took, and whether it failed by
+	// returning an error or an error result.
+	ObserveToolCall func(toolset Toolset, tool string, duration time.Duration, failed bool)
+
+	// AuditToolCall, if set, is called after each tool call with the context
+	// of the request, which identifies the user, and the details of the call.
+	AuditToolCall func(ctx context.Context, call ToolCall)
+
+	// Guard configures guardrails for tool calls.
+	Guard GuardSettings
+
+	// AuthorizeTools, if set, returns which tools the user making a request
+	// may use, identified by the plugin context in ctx. It is called for each
+	// request; tools the user may not use are hidden from tools/list and
+	// calls to them are rejected. A nil ToolAuthorizer allows all tools.
+	AuthorizeTools func(ctx context.Context) ToolAuthorizer
+}
+
+// ToolCall describes a completed tool call.
+type ToolCall struct {
+	Toolset   Toolset
+	Tool      string
+	Arguments any
+	// Result is the result of the call, and Err the error if the call
+	// failed without a result.
+	Result   *mcpgo.CallToolResult
+	Err      error
+	Duration time.Duration
 }
 
 func (s Settings) isToolsetEnabled(toolset Toolset) bool {
@@ -64,6 +102,13 @@ func (s Settings) isToolsetEnabled(toolset Toolset) bool {
 	return s.IsToolsetEnabled(toolset)
 }
 
+func (s Settings) isToolsetReadOnly(toolset Toolset) bool {
+	if s.IsToolsetReadOnly == nil {
+		return false
+	}
+	return s.IsToolsetReadOnly(toolset)
+}
+
 // MCP represents the complete MCP (Model Context Protocol) infrastructure for Grafana.
 // It manages both the core MCP server and the Grafana Live server for handling
 // real-time communication with MCP clients.
@@ -81,6 +126,11 @@ type MCP struct {
 	// accessTokenClient is the client for exchanging access policy tokens.
 	// This is stored here because it may be shared by different Transports in the future.
 	accessTokenClient *accessTokenClient
+	// toolsets maps the name of each registered tool to its toolset.
+	toolsets map[string]Toolset
+	// writeTools is the set of tools which modify Grafana, whether or not
+	// they are registered.
+	writeTools map[string]bool
 }
 
 // New creates a new MCP instance with the provided settings and plugin version.
@@ -88,70 +138,103 @@ type MCP struct {
 // for handling real-time MCP communication.
 func New(settings Settings, pluginVersion string) (*MCP, error) {
 	log.DefaultLogger.Debug("Initializing MCP server")
-	srv := server.NewMCPServer("grafana-llm-app", pluginVersion)
+	// Record which toolset each tool was registered by, so that tools can be
+	// looked up by toolset later.
+	toolsets := map[string]Toolset{}
+	writeTools := map[string]bool{}
+	srv := server.NewMCPServer("grafana-llm-app", pluginVersion,
+		server.WithToolHandlerMiddleware(observeToolCalls(settings.ObserveToolCall, toolsets)),
+		server.WithToolHandlerMiddleware(auditToolCalls(settings.AuditToolCall, toolsets)),
+		server.WithToolHandlerMiddleware(traceToolCalls(toolsets)),
+		server.WithToolHandlerMiddleware(authorizeToolCalls(settings, toolsets, writeTools)),
+		server.WithToolHandlerMiddleware(rejectWriteTools(settings, toolsets, writeTools)),
+		// Guardrails run innermost, so that tool calls the user declines are
+		// still observed and audited, and the audit log records results as
+		// they are passed to the model.
+		server.WithToolHandlerMiddleware(guardToolCalls(settings.Guard, toolsets)),
+		server.WithToolFilter(filterTools(settings, toolsets, writeTools)),
+	)
+	addTools := func(toolset Toolset, add func(*server.MCPServer)) {
+		before := srv.ListTools()
+		add(srv)
+		for name := range srv.ListTools() {
+			if _, ok := before[name]; !ok {
+				toolsets[name] = toolset
+			}
+		}
+	}
+	// addWritableTools registers the tools of a toolset which can modify
+	// Grafana, only registering those which don't if the toolset is
+	// read-only.
+	addWritableTools := func(toolset Toolset, add func(*server.MCPServer, bool)) {
+		for _, name := range writeToolNames(add) {
+			writeTools[name] = true
+		}
+		addTools(toolset, func(s *server.MCPServer) { add(s, !settings.isToolsetReadOnly(toolset)) })
+	}
 	if settings.isToolsetEnabled(ToolsetSearch) {
-		tools.AddSearchTools(srv)
+		addTools(ToolsetSearch, tools.AddSearchTools)
 	}
 	if settings.isToolsetEnabled(ToolsetDatasource) {
-		tools.AddDatasourceTools(srv)
+		addTools(ToolsetDatasource, tools.AddDatasourceTools)
 	}
 	// Incident, asserts, and sift toolsets require Grafana Cloud.
 	if settings.IsGrafanaCloud && settings.isToolsetEnabled(ToolsetIncident) {
-		tools.AddIncidentTools(srv, true)
+		addWritableTools(ToolsetIncident, tools.AddIncidentTools)
 	}
 	if settings.isToolsetEnabled(ToolsetPrometheus) {
-		tools.AddPrometheusTools(srv)
+		addTools(ToolsetPrometheus, tools.AddPrometheusTools)
 	}
 	if settings.isToolsetEnabled(ToolsetLoki) {
-		tools.AddLokiTools(srv)
+		addTools(ToolsetLoki, tools.AddLokiTools)
 	}
 	if settings.isToolsetEnabled(ToolsetAlerting) {
-		tools.AddAlertingTools(srv, true)
+		addWritableTools(ToolsetAlerting, tools.AddAlertingTools)
 	}
 	if settings.isToolsetEnabled(ToolsetDashboard) {
-		tools.AddDashboardTools(srv, true)
+		addWritableTools(ToolsetDashboard, tools.AddDashboardTools)
 	}
 	if settings.isToolsetEnabled(ToolsetOnCall) {
-		tools.AddOnCallTools(srv)
+		addTools(ToolsetOnCall, tools.AddOnCallTools)
 	}
 	if settings.IsGrafanaCloud && settings.isToolsetEnabled(ToolsetAsserts) {
-		tools.AddAssertsTools(srv)
+		addTools(ToolsetAsserts, tools.AddAssertsTools)
 	}
 	if settings.IsGrafanaCloud && settings.isToolsetEnabled(ToolsetSift) {
-		tools.AddSiftTools(srv, true)
+		addWritableTools(ToolsetSift, tools.AddSiftTools)
 	}
 	if settings.isToolsetEnabled(ToolsetPyroscope) {
-		tools.AddPyroscopeTools(srv)
+		addTools(ToolsetPyroscope, tools.AddPyroscopeTools)
 	}
 	if settings.isToolsetEnabled(ToolsetNavigation) {
-		tools.AddNavigationTools(srv)
+		addTools(ToolsetNavigation, tools.AddNavigationTools)
 	}
 	if settings.isToolsetEnabled(ToolsetAnnotations) {
-		tools.AddAnnotationTools(srv, true)
+		addWritableTools(ToolsetAnnotations, tools.AddAnnotationTools)
 	}
 	if settings.isToolsetEnabled(ToolsetRendering) {
-		tools.AddRenderingTools(srv)
+		addTools(ToolsetRendering, tools.AddRenderingTools)
 	}
 	if settings.isToolsetEnabled(ToolsetAdmin) {
-		tools.AddAdminTools(srv)
+		addTools(ToolsetAdmin, tools.AddAdminTools)
 	}
 	if settings.isToolsetEnabled(ToolsetClickHouse) {
-		tools.AddClickHouseTools(srv)
+		addTools(ToolsetClickHouse, tools.AddClickHouseTools)
 	}
 	if settings.isToolsetEnabled(ToolsetCloudWatch) {
-		tools.AddCloudWatchTools(srv)
+		addTools(ToolsetCloudWatch, tools.AddCloudWatchTools)
 	}
 	if settings.isToolsetEnabled(ToolsetElasticsearch) {
-		tools.AddElasticsearchTools(srv)
+		addTools(ToolsetElasticsearch, tools.AddElasticsearchTools)
 	}
 	if settings.isToolsetEnabled(ToolsetExamples) {
-		tools.AddExamplesTools(srv)
+		addTools(ToolsetExamples, tools.AddExamplesTools)
 	}
 	if settings.isToolsetEnabled(ToolsetSearchLogs) {
-		tools.AddSearchLogsTools(srv)
+		addTools(ToolsetSearchLogs, tools.AddSearchLogsTools)
 	}
 	if settings.isToolsetEnabled(ToolsetFolder) {
-		tools.AddFolderTools(srv, true)
+		addWritableTools(ToolsetFolder, tools.AddFolderTools)
 	}
 
 	acc, err := newAccessTokenClient(settings.AccessToken, settings.Tenant, settings.IsGrafanaCloud)
@@ -159,7 +242,14 @@ func New(settings Settings, pluginVersion string) (*MCP, error) {
 		return nil, fmt.Errorf("failed to create access token client: %w", err)
 	}
 
-	liveServer := NewGrafanaLiveServer(srv, acc, WithIsGrafanaCloud(settings.IsGrafanaCloud))
+	liveServer := NewGrafanaLiveServer(srv, acc,
+		WithIsGrafanaCloud(settings.IsGrafanaCloud),
+		withConfirmation(func(tool string) bool {
+			toolset, ok := toolsets[tool]
+			return ok && settings.Guard.requiresConfirmation(toolset, tool)
+		}),
+		withToolAuthorization(settings.toolAuthorizer),
+	)
 	// We need to create the MCP struct before the HTTP server, because we need to
 	// pass use a context func returned by one of the MCP struct's methods to the
 	// HTTP server.
@@ -168,6 +258,8 @@ func New(settings Settings, pluginVersion string) (*MCP, error) {
 		LiveServer:        liveServer,
 		Settings:          settings,
 		accessTokenClient: acc,
+		toolsets:          toolsets,
+		writeTools:        writeTools,
 	}
 	m.HTTPServer = server.NewStreamableHTTPServer(srv,
 		// Only allow Stateless mode.
@@ -178,6 +270,76 @@ func New(settings Settings, pluginVersion string) (*MCP, error) {
 	return m, nil
 }
 
+// observeToolCalls returns middleware passing each tool call to observe, if
+// set. toolsets maps tool names to their toolsets, and may be added to until
+// the server starts handling requests.
+func observeToolCalls(observe func(Toolset, string, time.Duration, bool), toolsets map[string]Toolset) server.ToolHandlerMiddleware {
+	return func(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+		if observe == nil {
+			return next
+		}
+		return func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+			start := time.Now()
+			result, err := next(ctx, req)
+			observe(toolsets[req.Params.Name], req.Params.Name, time.Since(start), err != nil || result != nil && result.IsError)
+			return result, err
+		}
+	}
+}
+
+// auditToolCalls returns middleware passing each tool call to audit, if set.
+func auditToolCalls(audit func(context.Context, ToolCall), toolsets map[string]Toolset) server.ToolHandlerMiddleware {
+	return func(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+		if audit == nil {
+			return next
+		}
+		return func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+			start := time.Now()
+			result, err := next(ctx, req)
+			audit(ctx, ToolCall{
+				Toolset:   toolsets[req.Params.Name],
+				Tool:      req.Params.Name,
+				Arguments: req.Params.Arguments,
+				Result:    result,
+				Err:       err,
+				Duration:  time.Since(start),
+			})
+			return result, err
+		}
+	}
+}
+
+// writeToolNames returns the names of the tools which add only registers
+// when write tools are enabled.
+func writeToolNames(add func(*server.MCPServer, bool)) []string {
+	read, write := server.NewMCPServer("", ""), server.NewMCPServer("", "")
+	add(read, false)
+	add(write, true)
+	readTools := read.ListTools()
+	var names []string
+	for name := range write.ListTools() {
+		if _, ok := readTools[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// rejectWriteTools returns middleware rejecting calls to tools which modify
+// Grafana if their toolset is read-only. Such tools aren't registered, so this
+// is a safeguard in case one is registered by other means.
+func rejectWriteTools(settings Settings, toolsets map[string]Toolset, writeTools map[string]bool) server.ToolHandlerMiddleware {
+	return func(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+		return func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+			name := req.Params.Name
+			if toolset := toolsets[name]; writeTools[name] && settings.isToolsetReadOnly(toolset) {
+				return mcpgo.NewToolResultError(fmt.Sprintf("The tool %s modifies Grafana, but the %s toolset is read-only.", name, toolset)), nil
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
 // Close shuts down the MCP instance, closing the Live server and cleaning up resources.
 func (m *MCP) Close() {
 	m.LiveServer.Close()
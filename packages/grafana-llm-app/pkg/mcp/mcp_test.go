@@ -1,6 +1,13 @@
 package mcp
 
-import "testing"
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+)
 
 var allToolsets = []Toolset{
 	ToolsetSearch, ToolsetDatasource, ToolsetIncident, ToolsetPrometheus,
@@ -94,3 +101,68 @@ func TestNewGrafanaCloudGating(t *testing.T) {
 		})
 	}
 }
+
+func TestReadOnlyToolsets(t *testing.T) {
+	readOnly := map[Toolset]bool{ToolsetDashboard: true, ToolsetAlerting: true, ToolsetAnnotations: false}
+	m, err := New(Settings{
+		IsToolsetEnabled: func(ts Toolset) bool {
+			_, ok := readOnly[ts]
+			return ok
+		},
+		IsToolsetReadOnly: func(ts Toolset) bool { return readOnly[ts] },
+	}, "test")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(m.Close)
+
+	for ts, ro := range readOnly {
+		var reads, writes int
+		for _, tool := range m.Tools(ts) {
+			if m.writeTools[tool.Name] {
+				writes++
+			} else {
+				reads++
+			}
+		}
+		if reads == 0 {
+			t.Errorf("toolset %q: no read tools registered", ts)
+		}
+		if ro && writes > 0 {
+			t.Errorf("toolset %q is read-only but %d write tools are registered", ts, writes)
+		}
+		if !ro && writes == 0 {
+			t.Errorf("toolset %q is writable but no write tools are registered", ts)
+		}
+	}
+	if !m.writeTools["update_dashboard"] {
+		t.Error("update_dashboard should be known as a write tool")
+	}
+
+	// Write tools registered by other means are rejected when called.
+	m.Server.AddTool(mcpgo.NewTool("update_dashboard"), func(context.Context, mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		t.Error("update_dashboard should not be called")
+		return mcpgo.NewToolResultText("updated"), nil
+	})
+	m.toolsets["update_dashboard"] = ToolsetDashboard
+	result, err := m.CallTool(context.Background(), &backend.PluginContext{}, "", "update_dashboard", `{}`)
+	if err != nil {
+		t.Fatalf("CallTool() error = %v", err)
+	}
+	if !result.IsError || !strings.Contains(ToolResultText(result), "read-only") {
+		t.Errorf("result = %q, want the call to be rejected", ToolResultText(result))
+	}
+
+	// Only tools annotated as read-only can be added to read-only toolsets.
+	handler := func(context.Context, mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultText("ok"), nil
+	}
+	m.AddTool(ToolsetDashboard, mcpgo.NewTool("star_dashboard"), handler)
+	m.AddTool(ToolsetDashboard, mcpgo.NewTool("list_starred_dashboards", mcpgo.WithReadOnlyHintAnnotation(true)), handler)
+	if _, ok := m.Toolset("star_dashboard"); ok {
+		t.Error("star_dashboard should not be registered in a read-only toolset")
+	}
+	if _, ok := m.Toolset("list_starred_dashboards"); !ok {
+		t.Error("list_starred_dashboards should be registered")
+	}
+}
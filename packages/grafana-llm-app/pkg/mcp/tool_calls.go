@@ -0,0 +1,136 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// AddTool registers an additional tool as part of the given toolset. It must
+// not be called once the MCP server has started handling requests. If the
+// toolset is read-only, the tool is only registered if it is annotated as
+// read-only. Tools which aren't annotated as read-only are treated as
+// modifying Grafana.
+func (m *MCP) AddTool(toolset Toolset, tool mcpgo.Tool, handler server.ToolHandlerFunc) {
+	if tool.Annotations.ReadOnlyHint == nil || !*tool.Annotations.ReadOnlyHint {
+		m.writeTools[tool.Name] = true
+		if m.Settings.isToolsetReadOnly(toolset) {
+			return
+		}
+	}
+	m.toolsets[tool.Name] = toolset
+	m.Server.AddTool(tool, handler)
+}
+
+// Tools returns the registered tools belonging to any of the given toolsets,
+// sorted by name.
+func (m *MCP) Tools(toolsets ...Toolset) []mcpgo.Tool {
+	var tools []mcpgo.Tool
+	for name, tool := range m.Server.ListTools() {
+		if slices.Contains(toolsets, m.toolsets[name]) {
+			tools = append(tools, tool.Tool)
+		}
+	}
+	slices.SortFunc(tools, func(a, b mcpgo.Tool) int { return strings.Compare(a.Name, b.Name) })
+	return tools
+}
+
+// AllowedTools returns the tools of the given toolsets which the user making
+// the request, identified by the plugin context in ctx, may use with CallTool.
+// Tools which must be confirmed by the user are left out, since calls made with
+// CallTool have no way to ask for confirmation.
+func (m *MCP) AllowedTools(ctx context.Context, toolsets ...Toolset) []mcpgo.Tool {
+	authorize := m.Settings.toolAuthorizer(ctx)
+	return slices.DeleteFunc(m.Tools(toolsets...), func(tool mcpgo.Tool) bool {
+		toolset := m.toolsets[tool.Name]
+		if m.Settings.Guard.requiresConfirmation(toolset, tool.Name) {
+			return true
+		}
+		return authorize != nil && !authorize(toolset, tool.Name, m.writeTools[tool.Name])
+	})
+}
+
+// Toolset returns the toolset a registered tool belongs to, and whether the
+// tool is registered.
+func (m *MCP) Toolset(tool string) (Toolset, bool) {
+	toolset, ok := m.toolsets[tool]
+	return toolset, ok
+}
+
+// CallTool calls a tool in-process on the MCP server. The tool is called with
+// the identity of the user who made the request, in the same way as tool calls
+// made over the Grafana Live transport.
+// arguments must be a JSON object; an empty string is treated as no arguments.
+func (m *MCP) CallTool(ctx context.Context, pCtx *backend.PluginContext, grafanaIdToken, name, arguments string) (*mcpgo.CallToolResult, error) {
+	if arguments == "" {
+		arguments = "{}"
+	}
+	if !json.Valid([]byte(arguments)) {
+		return nil, fmt.Errorf("invalid arguments for tool %s", name)
+	}
+
+	accessToken, err := m.accessTokenClient.getAccessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %w", err)
+	}
+	if m.Settings.IsGrafanaCloud && grafanaIdToken == "" {
+		return nil, fmt.Errorf("grafana id token not found in request headers")
+	}
+	ctx = composedGrafanaLiveContextFunc(ctx, pCtx, accessToken, grafanaIdToken)
+	// Let hooks such as AuditToolCall identify the user.
+	ctx = backend.WithPluginContext(ctx, *pCtx)
+
+	// Go through HandleMessage rather than calling the tool's handler directly,
+	// so that any hooks and middleware registered on the server also apply.
+	msg, err := json.Marshal(mcpgo.JSONRPCRequest{
+		JSONRPC: mcpgo.JSONRPC_VERSION,
+		ID:      mcpgo.NewRequestId(1),
+		Request: mcpgo.Request{Method: string(mcpgo.MethodToolsCall)},
+		Params:  mcpgo.CallToolParams{Name: name, Arguments: json.RawMessage(arguments)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal tool call: %w", err)
+	}
+	switch resp := m.Server.HandleMessage(ctx, msg).(type) {
+	case mcpgo.JSONRPCResponse:
+		result, ok := resp.Result.(*mcpgo.CallToolResult)
+		if !ok {
+			return nil, fmt.Errorf("unexpected result type %T from tool %s", resp.Result, name)
+		}
+		return result, nil
+	case mcpgo.JSONRPCError:
+		return nil, fmt.Errorf("call tool %s: %s", name, resp.Error.Message)
+	default:
+		return nil, errors.New("no response from MCP server")
+	}
+}
+
+// ToolResultText returns the content of a tool result as text, for passing
+// back to an LLM. Non-text content is included as JSON.
+func ToolResultText(result *mcpgo.CallToolResult) string {
+	parts := make([]string, 0, len(result.Content))
+	for _, c := range result.Content {
+		if text, ok := c.(mcpgo.TextContent); ok {
+			parts = append(parts, text.Text)
+			continue
+		}
+		b, err := json.Marshal(c)
+		if err != nil {
+			continue
+		}
+		parts = append(parts, string(b))
+	}
+	if len(parts) == 0 && result.StructuredContent != nil {
+		if b, err := json.Marshal(result.StructuredContent); err == nil {
+			parts = append(parts, string(b))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,202 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+)
+
+func newTestMCP(t *testing.T, enabled ...Toolset) *MCP {
+	t.Helper()
+	m, err := New(Settings{
+		IsToolsetEnabled: func(toolset Toolset) bool {
+			for _, ts := range enabled {
+				if ts == toolset {
+					return true
+				}
+			}
+			return false
+		},
+	}, "test")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestTools(t *testing.T) {
+	m := newTestMCP(t, ToolsetPrometheus, ToolsetLoki)
+
+	prometheus := m.Tools(ToolsetPrometheus)
+	if len(prometheus) == 0 {
+		t.Fatal("Tools(prometheus) returned no tools")
+	}
+	for _, tool := range prometheus {
+		if ts, _ := m.Toolset(tool.Name); ts != ToolsetPrometheus {
+			t.Errorf("tool %q has toolset %q, want %q", tool.Name, ts, ToolsetPrometheus)
+		}
+	}
+
+	both := m.Tools(ToolsetPrometheus, ToolsetLoki)
+	if len(both) <= len(prometheus) {
+		t.Errorf("Tools(prometheus, loki) returned %d tools, want more than %d", len(both), len(prometheus))
+	}
+	for i := 1; i < len(both); i++ {
+		if both[i-1].Name > both[i].Name {
+			t.Errorf("tools are not sorted: %q before %q", both[i-1].Name, both[i].Name)
+		}
+	}
+
+	if tools := m.Tools(ToolsetSearch); len(tools) != 0 {
+		t.Errorf("Tools(search) returned %d tools for a disabled toolset", len(tools))
+	}
+}
+
+func TestCallTool(t *testing.T) {
+	m := newTestMCP(t)
+	m.AddTool(ToolsetExamples, mcpgo.NewTool("echo"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		b, _ := json.Marshal(req.GetArguments())
+		return mcpgo.NewToolResultText(string(b)), nil
+	})
+	pCtx := &backend.PluginContext{}
+
+	for _, tc := range []struct {
+		name      string
+		tool      string
+		arguments string
+		expText   string
+		expErr    bool
+	}{
+		{name: "with arguments", tool: "echo", arguments: `{"query":"up"}`, expText: `{"query":"up"}`},
+		{name: "empty arguments", tool: "echo", arguments: "", expText: `{}`},
+		{name: "invalid arguments", tool: "echo", arguments: `{"query":`, expErr: true},
+		{name: "unknown tool", tool: "missing", arguments: `{}`, expErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := m.CallTool(context.Background(), pCtx, "", tc.tool, tc.arguments)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("CallTool() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CallTool() error = %v", err)
+			}
+			if got := ToolResultText(result); got != tc.expText {
+				t.Errorf("ToolResultText() = %q, want %q", got, tc.expText)
+			}
+		})
+	}
+}
+
+func TestAddTool(t *testing.T) {
+	m := newTestMCP(t)
+	m.AddTool(ToolsetExamples, mcpgo.NewTool("echo"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultText("ok"), nil
+	})
+	tools := m.Tools(ToolsetExamples)
+	if len(tools) != 1 || tools[0].Name != "echo" {
+		t.Fatalf("Tools(examples) = %v, want only echo", tools)
+	}
+	if ts, ok := m.Toolset("echo"); !ok || ts != ToolsetExamples {
+		t.Errorf("Toolset(echo) = %q, %v, want %q, true", ts, ok, ToolsetExamples)
+	}
+}
+
+func TestCallToolRequiresIDTokenInGrafanaCloud(t *testing.T) {
+	m := newTestMCP(t)
+	m.Settings.IsGrafanaCloud = true
+	m.accessTokenClient = &accessTokenClient{}
+	if _, err := m.CallTool(context.Background(), &backend.PluginContext{}, "", "echo", "{}"); err == nil {
+		t.Fatal("CallTool() error = nil, want error for missing id token")
+	}
+}
+
+func TestObserveToolCall(t *testing.T) {
+	type call struct {
+		toolset Toolset
+		tool    string
+		failed  bool
+	}
+	var calls []call
+	m, err := New(Settings{
+		IsToolsetEnabled: func(Toolset) bool { return false },
+		ObserveToolCall: func(toolset Toolset, tool string, duration time.Duration, failed bool) {
+			if duration < 0 {
+				t.Errorf("negative duration %v", duration)
+			}
+			calls = append(calls, call{toolset, tool, failed})
+		},
+	}, "test")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(m.Close)
+	m.AddTool(ToolsetExamples, mcpgo.NewTool("ok"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultText("ok"), nil
+	})
+	m.AddTool(ToolsetLoki, mcpgo.NewTool("fail"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultError("no logs"), nil
+	})
+
+	for _, tool := range []string{"ok", "fail"} {
+		if _, err := m.CallTool(context.Background(), &backend.PluginContext{}, "", tool, ""); err != nil {
+			t.Fatalf("CallTool(%s) error = %v", tool, err)
+		}
+	}
+	want := []call{{ToolsetExamples, "ok", false}, {ToolsetLoki, "fail", true}}
+	if len(calls) != len(want) {
+		t.Fatalf("observed %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("call %d = %v, want %v", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestAuditToolCall(t *testing.T) {
+	var calls []ToolCall
+	var users []string
+	m, err := New(Settings{
+		IsToolsetEnabled: func(Toolset) bool { return false },
+		AuditToolCall: func(ctx context.Context, call ToolCall) {
+			calls = append(calls, call)
+			users = append(users, backend.PluginConfigFromContext(ctx).User.Login)
+		},
+	}, "test")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(m.Close)
+	m.AddTool(ToolsetLoki, mcpgo.NewTool("query_loki_logs"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultText("no logs"), nil
+	})
+
+	pCtx := &backend.PluginContext{OrgID: 1, User: &backend.User{Login: "alice"}}
+	if _, err := m.CallTool(context.Background(), pCtx, "", "query_loki_logs", `{"query": "{job=\"api\"}"}`); err != nil {
+		t.Fatalf("CallTool() error = %v", err)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("audited %d calls, want 1", len(calls))
+	}
+	call := calls[0]
+	if call.Toolset != ToolsetLoki || call.Tool != "query_loki_logs" || call.Err != nil {
+		t.Errorf("audited %+v, want a successful query_loki_logs call in the loki toolset", call)
+	}
+	if args, _ := json.Marshal(call.Arguments); string(args) != `{"query":"{job=\"api\"}"}` {
+		t.Errorf("arguments = %s", args)
+	}
+	if call.Result == nil || call.Result.IsError {
+		t.Errorf("result = %+v, want a successful result", call.Result)
+	}
+	if users[0] != "alice" {
+		t.Errorf("user = %q, want alice", users[0])
+	}
+}
@@ -0,0 +1,98 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// toolsetAttribute is the span attribute holding the toolset of a tool.
+const toolsetAttribute = attribute.Key("grafana_llm.mcp.toolset")
+
+// jsonRPCMethod returns the method of a JSON-RPC message, or an empty string if
+// it isn't a request or notification.
+func jsonRPCMethod(data []byte) string {
+	var msg struct {
+		Method string `json:"method"`
+	}
+	//nolint:errcheck
+	json.Unmarshal(data, &msg)
+	return msg.Method
+}
+
+// toolCallName returns the name of the tool called by a JSON-RPC message, or
+// an empty string if it isn't a tool call.
+func toolCallName(data []byte) string {
+	var msg struct {
+		Method string `json:"method"`
+		Params struct {
+			Name string `json:"name"`
+		} `json:"params"`
+	}
+	//nolint:errcheck
+	json.Unmarshal(data, &msg)
+	if msg.Method != string(mcpgo.MethodToolsCall) {
+		return ""
+	}
+	return msg.Params.Name
+}
+
+// originatingSpan returns the span context in the traceparent field of the
+// _meta of a tool call, if any. Clients set it to the traceparent of the
+// request which led to the tool call, such as the chat completions request in
+// which the model asked for it, since tool calls made over Grafana Live or HTTP
+// are separate requests with their own traces.
+func originatingSpan(meta *mcpgo.Meta) trace.SpanContext {
+	if meta == nil {
+		return trace.SpanContext{}
+	}
+	carrier := propagation.MapCarrier{}
+	for _, key := range (propagation.TraceContext{}).Fields() {
+		if v, ok := meta.AdditionalFields[key].(string); ok {
+			carrier[key] = v
+		}
+	}
+	return trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+}
+
+// traceToolCalls returns middleware creating a span for each tool call, using
+// the attributes of the OpenTelemetry semantic conventions for generative AI.
+// The span is linked to the originating request given in the _meta of the call,
+// if any. toolsets maps tool names to their toolsets, and may be added to until
+// the server starts handling requests.
+func traceToolCalls(toolsets map[string]Toolset) server.ToolHandlerMiddleware {
+	return func(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+		return func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+			opts := []trace.SpanStartOption{
+				trace.WithAttributes(
+					semconv.GenAIOperationNameExecuteTool,
+					semconv.GenAIToolName(req.Params.Name),
+					semconv.GenAIToolType("function"),
+					toolsetAttribute.String(string(toolsets[req.Params.Name])),
+				),
+			}
+			if origin := originatingSpan(req.Params.Meta); origin.IsValid() {
+				opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+			}
+			ctx, span := tracing.DefaultTracer().Start(ctx, "execute_tool "+req.Params.Name, opts...)
+			defer span.End()
+			result, err := next(ctx, req)
+			switch {
+			case err != nil:
+				//nolint:errcheck
+				tracing.Error(span, err)
+			case result != nil && result.IsError:
+				span.SetStatus(codes.Error, "tool returned an error")
+			}
+			return result, err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanRecorder returns the recorder of the global tracer provider, which the
+// SDK's default tracer delegates to. It can only be set once per process.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	r := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(r)))
+	return r
+})
+
+// endedSpan returns the ended span with the given name in the trace of ctx.
+func endedSpan(t *testing.T, ctx context.Context, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	traceID := trace.SpanContextFromContext(ctx).TraceID()
+	for _, s := range spanRecorder().Ended() {
+		if s.Name() == name && s.SpanContext().TraceID() == traceID {
+			return s
+		}
+	}
+	t.Fatalf("no span %q in trace %s", name, traceID)
+	return nil
+}
+
+func spanAttribute(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceToolCalls(t *testing.T) {
+	spanRecorder()
+	m := newTestMCP(t)
+	m.AddTool(ToolsetLoki, mcpgo.NewTool("query_logs"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultError("no logs"), nil
+	})
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "request")
+	defer root.End()
+	if _, err := m.CallTool(ctx, &backend.PluginContext{}, "", "query_logs", ""); err != nil {
+		t.Fatalf("CallTool() error = %v", err)
+	}
+
+	span := endedSpan(t, ctx, "execute_tool query_logs")
+	if got := span.Parent().SpanID(); got != root.SpanContext().SpanID() {
+		t.Errorf("parent = %s, want the calling span %s", got, root.SpanContext().SpanID())
+	}
+	if got := spanAttribute(span, "gen_ai.operation.name").AsString(); got != "execute_tool" {
+		t.Errorf("gen_ai.operation.name = %q, want execute_tool", got)
+	}
+	if got := spanAttribute(span, "gen_ai.tool.name").AsString(); got != "query_logs" {
+		t.Errorf("gen_ai.tool.name = %q, want query_logs", got)
+	}
+	if got := spanAttribute(span, toolsetAttribute).AsString(); got != string(ToolsetLoki) {
+		t.Errorf("toolset = %q, want %q", got, ToolsetLoki)
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("status = %v, want error for a failed tool", span.Status().Code)
+	}
+}
+
+func TestTraceToolCalls_LinksOriginatingRequest(t *testing.T) {
+	spanRecorder()
+	m := newTestMCP(t)
+	m.AddTool(ToolsetExamples, mcpgo.NewTool("ok"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultText("ok"), nil
+	})
+
+	// The chat completions request which led to the tool call, in another trace.
+	_, origin := otel.Tracer("test").Start(context.Background(), "chat")
+	origin.End()
+	sc := origin.SpanContext()
+	traceparent := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"
+
+	msg, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "tools/call",
+		"params": map[string]any{
+			"name":  "ok",
+			"_meta": map[string]any{"traceparent": traceparent},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, root := otel.Tracer("test").Start(context.Background(), "live message")
+	defer root.End()
+	if _, ok := m.Server.HandleMessage(ctx, msg).(mcpgo.JSONRPCResponse); !ok {
+		t.Fatal("tool call failed")
+	}
+
+	span := endedSpan(t, ctx, "execute_tool ok")
+	links := span.Links()
+	if len(links) != 1 {
+		t.Fatalf("got %d links, want 1", len(links))
+	}
+	if got := links[0].SpanContext; got.TraceID() != sc.TraceID() || got.SpanID() != sc.SpanID() {
+		t.Errorf("link = %s/%s, want %s/%s", got.TraceID(), got.SpanID(), sc.TraceID(), sc.SpanID())
+	}
+	if span.Status().Code == codes.Error {
+		t.Errorf("status = error, want unset for a successful tool")
+	}
+}
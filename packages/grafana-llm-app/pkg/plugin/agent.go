@@ -0,0 +1,202 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// errAgentBudgetExceeded is returned when a request using Grafana tools reaches
+// its iteration or token limit before the model has given a final answer.
+var errAgentBudgetExceeded = errors.New("grafana tools budget exceeded")
+
+// GrafanaToolStep describes a Grafana tool call executed on behalf of the model.
+type GrafanaToolStep struct {
+	// Iteration is the iteration of the agent loop in which the model made
+	// the tool call, starting at 1.
+	Iteration  int         `json:"iteration"`
+	ToolCallID string      `json:"tool_call_id"`
+	Toolset    mcp.Toolset `json:"toolset"`
+	Name       string      `json:"name"`
+	Arguments  string      `json:"arguments"`
+	Result     string      `json:"result"`
+	IsError    bool        `json:"is_error,omitempty"`
+}
+
+// grafanaToolsResponse is the response to a non-streaming chat completions
+// request using Grafana tools.
+type grafanaToolsResponse struct {
+	chatCompletionResponse
+	GrafanaToolSteps []GrafanaToolStep `json:"grafana_tool_steps"`
+}
+
+// toolAgent runs the agent loop for chat completions requests using Grafana
+// tools. It offers the tools to the model, executes the tool calls the model
+// makes against the MCP server and feeds the results back, until the model
+// gives a final answer.
+type toolAgent struct {
+	provider LLMProvider
+	mcp      *mcp.MCP
+	limits   MCPAgentSettings
+
+	// pCtx and grafanaIdToken identify the user making the request, who the
+	// tools are called as.
+	pCtx           *backend.PluginContext
+	grafanaIdToken string
+}
+
+func (a *App) newToolAgent(provider LLMProvider, pCtx *backend.PluginContext, grafanaIdToken string) (*toolAgent, error) {
+	if a.mcpServer == nil {
+		return nil, fmt.Errorf("%w: grafana_tools requires the MCP server to be enabled", errBadRequest)
+	}
+	return &toolAgent{
+		provider:       provider,
+		mcp:            a.mcpServer,
+		limits:         a.settings.MCP.Agent,
+		pCtx:           pCtx,
+		grafanaIdToken: grafanaIdToken,
+	}, nil
+}
+
+// tools returns the tools of the given toolsets which the user may use as
+// OpenAI function definitions.
+func (t *toolAgent) tools(ctx context.Context, toolsets []mcp.Toolset) ([]openai.Tool, error) {
+	mcpTools := t.mcp.AllowedTools(backend.WithPluginContext(ctx, *t.pCtx), toolsets...)
+	if len(mcpTools) == 0 {
+		return nil, fmt.Errorf("%w: no Grafana tools are enabled, or available to the user, for toolsets %v", errBadRequest, toolsets)
+	}
+	tools := make([]openai.Tool, 0, len(mcpTools))
+	for _, mt := range mcpTools {
+		// Marshal the tool rather than using InputSchema directly, since tools
+		// may define their schema using RawInputSchema instead.
+		b, err := json.Marshal(mt)
+		if err != nil {
+			return nil, fmt.Errorf("marshal tool %s: %w", mt.Name, err)
+		}
+		var schema struct {
+			InputSchema json.RawMessage `json:"inputSchema"`
+		}
+		if err := json.Unmarshal(b, &schema); err != nil {
+			return nil, fmt.Errorf("unmarshal tool %s: %w", mt.Name, err)
+		}
+		tools = append(tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        mt.Name,
+				Description: mt.Description,
+				Parameters:  schema.InputSchema,
+			},
+		})
+	}
+	return tools, nil
+}
+
+// run runs the agent loop, calling onStep after each tool call, and returns
+// the model's final response with the usage of all iterations.
+//
+// If the model calls a tool which is not a Grafana tool, e.g. one provided by
+// the caller, that response is returned so the caller can handle it. Any
+// Grafana tool calls made alongside are removed from it, since the caller
+// can't execute them, and the model can make them again once the caller has
+// sent back its results.
+func (t *toolAgent) run(ctx context.Context, req ChatCompletionRequest, onStep func(GrafanaToolStep) error) (openai.ChatCompletionResponse, error) {
+	tools, err := t.tools(ctx, req.GrafanaTools)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	grafanaTools := make(map[string]bool, len(tools))
+	for _, tool := range tools {
+		grafanaTools[tool.Function.Name] = true
+	}
+	req.Tools = append(req.Tools, tools...)
+	req.GrafanaTools = nil
+	// Each iteration needs the complete response to know which tools to call,
+	// so the provider is never streamed from.
+	req.Stream = false
+	req.StreamOptions = nil
+
+	var usage openai.Usage
+	for iteration := 1; ; iteration++ {
+		resp, err := t.provider.ChatCompletion(ctx, req)
+		if err != nil {
+			return openai.ChatCompletionResponse{}, err
+		}
+		usage.PromptTokens += resp.Usage.PromptTokens
+		usage.CompletionTokens += resp.Usage.CompletionTokens
+		usage.TotalTokens += resp.Usage.TotalTokens
+		resp.Usage = usage
+
+		if len(resp.Choices) == 0 || len(resp.Choices[0].Message.ToolCalls) == 0 {
+			return resp, nil
+		}
+		message := resp.Choices[0].Message
+		if callerToolCalls := slices.DeleteFunc(slices.Clone(message.ToolCalls), func(tc openai.ToolCall) bool {
+			return grafanaTools[tc.Function.Name]
+		}); len(callerToolCalls) > 0 {
+			resp.Choices[0].Message.ToolCalls = callerToolCalls
+			return resp, nil
+		}
+		if iteration >= t.limits.MaxIterations {
+			return openai.ChatCompletionResponse{}, fmt.Errorf("%w: reached the limit of %d iterations", errAgentBudgetExceeded, t.limits.MaxIterations)
+		}
+		if usage.TotalTokens >= t.limits.MaxTokens {
+			return openai.ChatCompletionResponse{}, fmt.Errorf("%w: used %d of %d tokens", errAgentBudgetExceeded, usage.TotalTokens, t.limits.MaxTokens)
+		}
+
+		req.Messages = append(req.Messages, message)
+		for _, tc := range message.ToolCalls {
+			step := t.callTool(ctx, iteration, tc)
+			if err := onStep(step); err != nil {
+				return openai.ChatCompletionResponse{}, err
+			}
+			req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    step.Result,
+				ToolCallID: tc.ID,
+			})
+		}
+	}
+}
+
+// callTool executes a single tool call. Failures are reported to the model in
+// the result rather than returned, so that it has a chance to recover.
+func (t *toolAgent) callTool(ctx context.Context, iteration int, tc openai.ToolCall) GrafanaToolStep {
+	toolset, _ := t.mcp.Toolset(tc.Function.Name)
+	step := GrafanaToolStep{
+		Iteration:  iteration,
+		ToolCallID: tc.ID,
+		Toolset:    toolset,
+		Name:       tc.Function.Name,
+		Arguments:  tc.Function.Arguments,
+	}
+	log.DefaultLogger.Debug("Calling Grafana tool", "tool", step.Name, "iteration", iteration)
+	result, err := t.mcp.CallTool(ctx, t.pCtx, t.grafanaIdToken, tc.Function.Name, tc.Function.Arguments)
+	if err != nil {
+		log.DefaultLogger.Warn("Grafana tool call failed", "tool", step.Name, "err", err)
+		step.Result = fmt.Sprintf("error: %s", err)
+		step.IsError = true
+		return step
+	}
+	step.Result = mcp.ToolResultText(result)
+	step.IsError = result.IsError
+	return step
+}
+
+// toolStepStreamResponse returns the stream chunk reporting a tool call. It has
+// an empty delta so that clients which only read content can ignore it.
+func toolStepStreamResponse(step GrafanaToolStep) ChatCompletionStreamResponse {
+	return ChatCompletionStreamResponse{
+		ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+			Object:  "chat.completion.chunk",
+			Choices: []openai.ChatCompletionStreamChoice{{}},
+		},
+		GrafanaToolStep: &step,
+	}
+}
@@ -0,0 +1,292 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedProvider is an LLMProvider which returns responses in order,
+// recording the requests it receives.
+type scriptedProvider struct {
+	fakeBackend
+	responses []openai.ChatCompletionResponse
+	requests  []ChatCompletionRequest
+}
+
+func (p *scriptedProvider) ChatCompletion(_ context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	p.requests = append(p.requests, req)
+	resp := p.responses[0]
+	p.responses = p.responses[1:]
+	return resp, nil
+}
+
+func toolCallResponse(calls ...openai.ToolCall) openai.ChatCompletionResponse {
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, ToolCalls: calls},
+			FinishReason: openai.FinishReasonToolCalls,
+		}},
+		Usage: openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+	}
+}
+
+func answerResponse(content string) openai.ChatCompletionResponse {
+	return openai.ChatCompletionResponse{
+		ID: "final",
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+			FinishReason: openai.FinishReasonStop,
+		}},
+		Usage: openai.Usage{PromptTokens: 20, CompletionTokens: 5, TotalTokens: 25},
+	}
+}
+
+func toolCall(id, name, arguments string) openai.ToolCall {
+	return openai.ToolCall{
+		ID:       id,
+		Type:     openai.ToolTypeFunction,
+		Function: openai.FunctionCall{Name: name, Arguments: arguments},
+	}
+}
+
+// newAgentTestApp returns an App whose MCP server only has fake Prometheus
+// and Loki tools, which echo their arguments.
+func newAgentTestApp(t *testing.T, limits MCPAgentSettings) *App {
+	t.Helper()
+	m, err := mcp.New(mcp.Settings{IsToolsetEnabled: func(mcp.Toolset) bool { return false }}, "test")
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+	echo := func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		b, _ := json.Marshal(req.GetArguments())
+		return mcpgo.NewToolResultText(req.Params.Name + ": " + string(b)), nil
+	}
+	m.AddTool(mcp.ToolsetPrometheus, mcpgo.NewTool("query_prometheus", mcpgo.WithString("expr")), echo)
+	m.AddTool(mcp.ToolsetLoki, mcpgo.NewTool("query_loki_logs", mcpgo.WithString("logql")), echo)
+	return &App{
+		settings:              &Settings{MCP: MCPSettings{Agent: limits}},
+		mcpServer:             m,
+		ignoreResponsePadding: true,
+	}
+}
+
+var defaultAgentLimits = MCPAgentSettings{MaxIterations: defaultAgentMaxIterations, MaxTokens: defaultAgentMaxTokens}
+
+func agentRequest(toolsets ...mcp.Toolset) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Is anything down?"}},
+		},
+		GrafanaTools: toolsets,
+	}
+}
+
+func TestToolAgent_Run(t *testing.T) {
+	app := newAgentTestApp(t, defaultAgentLimits)
+	provider := &scriptedProvider{responses: []openai.ChatCompletionResponse{
+		toolCallResponse(toolCall("call_1", "query_prometheus", `{"expr":"up == 0"}`)),
+		answerResponse("Nothing is down."),
+	}}
+	agent, err := app.newToolAgent(provider, &backend.PluginContext{}, "")
+	require.NoError(t, err)
+
+	var steps []GrafanaToolStep
+	resp, err := agent.run(context.Background(), agentRequest(mcp.ToolsetPrometheus), func(step GrafanaToolStep) error {
+		steps = append(steps, step)
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Nothing is down.", resp.Choices[0].Message.Content)
+	assert.Equal(t, openai.Usage{PromptTokens: 30, CompletionTokens: 10, TotalTokens: 40}, resp.Usage)
+	assert.Equal(t, []GrafanaToolStep{{
+		Iteration:  1,
+		ToolCallID: "call_1",
+		Toolset:    mcp.ToolsetPrometheus,
+		Name:       "query_prometheus",
+		Arguments:  `{"expr":"up == 0"}`,
+		Result:     `query_prometheus: {"expr":"up == 0"}`,
+	}}, steps)
+
+	require.Len(t, provider.requests, 2)
+	first := provider.requests[0]
+	require.Len(t, first.Tools, 1, "only tools of the requested toolsets are offered")
+	assert.Equal(t, "query_prometheus", first.Tools[0].Function.Name)
+	assert.False(t, first.Stream)
+	assert.Nil(t, first.GrafanaTools)
+
+	messages := provider.requests[1].Messages
+	require.Len(t, messages, 3)
+	assert.Equal(t, openai.ChatMessageRoleAssistant, messages[1].Role)
+	assert.Equal(t, openai.ChatMessageRoleTool, messages[2].Role)
+	assert.Equal(t, "call_1", messages[2].ToolCallID)
+	assert.Equal(t, `query_prometheus: {"expr":"up == 0"}`, messages[2].Content)
+}
+
+func TestToolAgent_RunReportsToolErrors(t *testing.T) {
+	app := newAgentTestApp(t, defaultAgentLimits)
+	provider := &scriptedProvider{responses: []openai.ChatCompletionResponse{
+		toolCallResponse(toolCall("call_1", "query_prometheus", `{"expr":`)),
+		answerResponse("Sorry."),
+	}}
+	agent, err := app.newToolAgent(provider, &backend.PluginContext{}, "")
+	require.NoError(t, err)
+
+	var steps []GrafanaToolStep
+	_, err = agent.run(context.Background(), agentRequest(mcp.ToolsetPrometheus), func(step GrafanaToolStep) error {
+		steps = append(steps, step)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.True(t, steps[0].IsError)
+	assert.Contains(t, provider.requests[1].Messages[2].Content, "error:")
+}
+
+func TestToolAgent_RunReturnsCallerToolCalls(t *testing.T) {
+	app := newAgentTestApp(t, defaultAgentLimits)
+	callerToolCall := toolCallResponse(toolCall("call_1", "get_weather", `{}`))
+	provider := &scriptedProvider{responses: []openai.ChatCompletionResponse{callerToolCall}}
+	agent, err := app.newToolAgent(provider, &backend.PluginContext{}, "")
+	require.NoError(t, err)
+
+	resp, err := agent.run(context.Background(), agentRequest(mcp.ToolsetPrometheus), func(GrafanaToolStep) error {
+		t.Fatal("caller tools must not be executed")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, callerToolCall, resp)
+}
+
+func TestToolAgent_RunRemovesGrafanaToolCallsFromCallerToolCalls(t *testing.T) {
+	app := newAgentTestApp(t, defaultAgentLimits)
+	provider := &scriptedProvider{responses: []openai.ChatCompletionResponse{toolCallResponse(
+		toolCall("call_1", "query_prometheus", `{"expr":"up == 0"}`),
+		toolCall("call_2", "get_weather", `{}`),
+	)}}
+	agent, err := app.newToolAgent(provider, &backend.PluginContext{}, "")
+	require.NoError(t, err)
+
+	resp, err := agent.run(context.Background(), agentRequest(mcp.ToolsetPrometheus), func(GrafanaToolStep) error {
+		t.Fatal("tools must not be executed once the caller has to handle the response")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []openai.ToolCall{toolCall("call_2", "get_weather", `{}`)}, resp.Choices[0].Message.ToolCalls,
+		"the caller should only receive the tool calls it can execute")
+	assert.Equal(t, openai.FinishReasonToolCalls, resp.Choices[0].FinishReason)
+}
+
+func TestToolAgent_RunBudget(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		limits MCPAgentSettings
+	}{
+		{name: "iterations", limits: MCPAgentSettings{MaxIterations: 2, MaxTokens: defaultAgentMaxTokens}},
+		{name: "tokens", limits: MCPAgentSettings{MaxIterations: defaultAgentMaxIterations, MaxTokens: 20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newAgentTestApp(t, tc.limits)
+			call := toolCallResponse(toolCall("call_1", "query_prometheus", `{}`))
+			provider := &scriptedProvider{responses: []openai.ChatCompletionResponse{call, call, call}}
+			agent, err := app.newToolAgent(provider, &backend.PluginContext{}, "")
+			require.NoError(t, err)
+
+			_, err = agent.run(context.Background(), agentRequest(mcp.ToolsetPrometheus), func(GrafanaToolStep) error { return nil })
+			assert.ErrorIs(t, err, errAgentBudgetExceeded)
+			assert.Len(t, provider.requests, 2)
+		})
+	}
+}
+
+func TestToolAgent_Errors(t *testing.T) {
+	t.Run("no tools for toolsets", func(t *testing.T) {
+		app := newAgentTestApp(t, defaultAgentLimits)
+		agent, err := app.newToolAgent(&scriptedProvider{}, &backend.PluginContext{}, "")
+		require.NoError(t, err)
+		_, err = agent.run(context.Background(), agentRequest(mcp.ToolsetSearch), func(GrafanaToolStep) error { return nil })
+		assert.ErrorIs(t, err, errBadRequest)
+	})
+
+	t.Run("mcp disabled", func(t *testing.T) {
+		app := &App{settings: &Settings{}}
+		_, err := app.newToolAgent(&scriptedProvider{}, &backend.PluginContext{}, "")
+		assert.ErrorIs(t, err, errBadRequest)
+	})
+}
+
+func TestHandleChatCompletionsWithTools(t *testing.T) {
+	newProvider := func() *scriptedProvider {
+		return &scriptedProvider{responses: []openai.ChatCompletionResponse{
+			toolCallResponse(
+				toolCall("call_1", "query_prometheus", `{"expr":"up"}`),
+				toolCall("call_2", "query_loki_logs", `{"logql":"{job=\"api\"}"}`),
+			),
+			answerResponse("All good."),
+		}}
+	}
+
+	t.Run("non-streaming", func(t *testing.T) {
+		app := newAgentTestApp(t, defaultAgentLimits)
+		w := httptest.NewRecorder()
+		app.handleChatCompletionsWithTools(context.Background(), newProvider(), agentRequest(mcp.ToolsetPrometheus, mcp.ToolsetLoki), &backend.PluginContext{}, "", w)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp grafanaToolsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "All good.", resp.Choices[0].Message.Content)
+		require.Len(t, resp.GrafanaToolSteps, 2)
+		assert.Equal(t, "query_prometheus", resp.GrafanaToolSteps[0].Name)
+		assert.Equal(t, mcp.ToolsetLoki, resp.GrafanaToolSteps[1].Toolset)
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		app := newAgentTestApp(t, defaultAgentLimits)
+		req := agentRequest(mcp.ToolsetPrometheus, mcp.ToolsetLoki)
+		req.Stream = true
+		w := httptest.NewRecorder()
+		app.handleChatCompletionsWithTools(context.Background(), newProvider(), req, &backend.PluginContext{}, "", w)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+		var events []string
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				events = append(events, data)
+			}
+		}
+		require.Len(t, events, 4)
+		for i, name := range []string{"query_prometheus", "query_loki_logs"} {
+			var chunk ChatCompletionStreamResponse
+			require.NoError(t, json.Unmarshal([]byte(events[i]), &chunk))
+			require.NotNil(t, chunk.GrafanaToolStep)
+			assert.Equal(t, name, chunk.GrafanaToolStep.Name)
+		}
+		var final ChatCompletionStreamResponse
+		require.NoError(t, json.Unmarshal([]byte(events[2]), &final))
+		assert.Nil(t, final.GrafanaToolStep)
+		assert.Equal(t, "All good.", final.Choices[0].Delta.Content)
+		assert.Equal(t, openai.FinishReasonStop, final.Choices[0].FinishReason)
+		assert.Equal(t, "[DONE]", events[3])
+	})
+
+	t.Run("budget exceeded", func(t *testing.T) {
+		app := newAgentTestApp(t, MCPAgentSettings{MaxIterations: 1, MaxTokens: defaultAgentMaxTokens})
+		w := httptest.NewRecorder()
+		app.handleChatCompletionsWithTools(context.Background(), newProvider(), agentRequest(mcp.ToolsetPrometheus, mcp.ToolsetLoki), &backend.PluginContext{}, "", w)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+}
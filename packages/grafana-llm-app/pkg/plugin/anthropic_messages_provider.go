@@ -0,0 +1,680 @@
+package plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// anthropicMessagesProvider implements the LLMProvider interface using Anthropic's
+// native Messages API, translating requests and responses to and from the
+// OpenAI-shaped types used by the rest of the plugin.
+// See: https://docs.anthropic.com/en/api/messages
+type anthropicMessagesProvider struct {
+	settings AnthropicSettings
+	models   *ModelSettings
+	client   anthropic.Client
+}
+
+func NewAnthropicMessagesProvider(settings AnthropicSettings, models *ModelSettings) (LLMProvider, error) {
+	if settings.thinking == nil {
+		settings.thinking = newThinkingBlocks()
+	}
+	client := &http.Client{
+		Transport: withHeaders(settings.Headers, providerTransport(settings.retries, settings.httpTransport)),
+	}
+	return &anthropicMessagesProvider{
+		settings: settings,
+		models:   models,
+		client: anthropic.NewClient(
+			option.WithBaseURL(settings.URL),
+			option.WithAPIKey(settings.apiKey),
+			option.WithHTTPClient(client),
+			// Retries are handled by the plugin's retrying transport,
+			// consistent with the other providers.
+			option.WithMaxRetries(0),
+		),
+	}, nil
+}
+
+func (p *anthropicMessagesProvider) Models(ctx context.Context) (ModelResponse, error) {
+	return ModelResponse{Data: modelInfos(p.models)}, nil
+}
+
+func (p *anthropicMessagesProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	params, err := p.messageParams(req)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	log.DefaultLogger.Debug("model", "model", params.Model)
+
+	msg, err := p.client.Messages.New(ctx, params)
+	if err != nil {
+		log.DefaultLogger.Error("error creating anthropic message", "err", err)
+		return openai.ChatCompletionResponse{}, anthropicToOpenAIError(err)
+	}
+	p.settings.thinking.remember(anthropicThinkingBlocks(msg.Content))
+	responseMetadataFromContext(ctx).setCompletionDetails(msg.StopSequence, anthropicCitations(msg.Content))
+	return anthropicMessageToOpenAI(msg), nil
+}
+
+func (p *anthropicMessagesProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	params, err := p.messageParams(req)
+	if err != nil {
+		return nil, err
+	}
+	log.DefaultLogger.Debug("model", "model", params.Model)
+
+	stream := p.client.Messages.NewStreaming(ctx, params)
+	// The initial request is made synchronously, so any error establishing
+	// the stream (e.g. authentication or validation errors) is available here.
+	if err := stream.Err(); err != nil {
+		log.DefaultLogger.Error("error establishing anthropic stream", "err", err)
+		return nil, anthropicToOpenAIError(err)
+	}
+
+	c := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer stream.Close() //nolint:errcheck
+		defer close(c)
+
+		var (
+			id    string
+			model string
+			usage openai.Usage
+			// toolIndexes maps the Anthropic content block index to the
+			// OpenAI tool call index, which only counts tool calls.
+			toolIndexes = map[int64]int{}
+			// thinking and firstToolCall are the thinking blocks and the ID
+			// of the first tool call, for sending the thinking blocks back
+			// when the conversation continues after the tool calls.
+			thinking      []anthropic.ContentBlockParamUnion
+			firstToolCall string
+			// contentLen is the length of the content streamed so far, and
+			// citations the citations of the text block being streamed,
+			// which starts at textStart.
+			contentLen int
+			textStart  int
+			citations  []Citation
+		)
+		chunk := func(choice openai.ChatCompletionStreamChoice) ChatCompletionStreamResponse {
+			return ChatCompletionStreamResponse{
+				ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+					ID:      id,
+					Object:  "chat.completion.chunk",
+					Created: time.Now().Unix(),
+					Model:   model,
+					Choices: []openai.ChatCompletionStreamChoice{choice},
+				},
+			}
+		}
+
+		for stream.Next() {
+			event := stream.Current()
+			switch event.Type {
+			case "message_start":
+				start := event.AsMessageStart()
+				id = start.Message.ID
+				model = string(start.Message.Model)
+				usage = anthropicUsageToOpenAI(start.Message.Usage.InputTokens, start.Message.Usage.CacheReadInputTokens, start.Message.Usage.CacheCreationInputTokens, start.Message.Usage.OutputTokens)
+				c <- chunk(openai.ChatCompletionStreamChoice{
+					Delta: openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant},
+				})
+			case "content_block_start":
+				start := event.AsContentBlockStart()
+				switch start.ContentBlock.Type {
+				case "text":
+					textStart, citations = contentLen, nil
+					continue
+				case "thinking":
+					thinking = append(thinking, anthropic.NewThinkingBlock(start.ContentBlock.Signature, start.ContentBlock.Thinking))
+					continue
+				case "redacted_thinking":
+					thinking = append(thinking, anthropic.NewRedactedThinkingBlock(start.ContentBlock.Data))
+					continue
+				case "tool_use":
+					if firstToolCall == "" {
+						firstToolCall = start.ContentBlock.ID
+					}
+				default:
+					continue
+				}
+				idx := len(toolIndexes)
+				toolIndexes[start.Index] = idx
+				c <- chunk(openai.ChatCompletionStreamChoice{
+					Delta: openai.ChatCompletionStreamChoiceDelta{
+						ToolCalls: []openai.ToolCall{{
+							Index: &idx,
+							ID:    start.ContentBlock.ID,
+							Type:  openai.ToolTypeFunction,
+							Function: openai.FunctionCall{
+								Name: start.ContentBlock.Name,
+							},
+						}},
+					},
+				})
+			case "content_block_delta":
+				delta := event.AsContentBlockDelta()
+				switch delta.Delta.Type {
+				case "text_delta":
+					contentLen += len(delta.Delta.Text)
+					c <- chunk(openai.ChatCompletionStreamChoice{
+						Delta: openai.ChatCompletionStreamChoiceDelta{Content: delta.Delta.Text},
+					})
+				case "thinking_delta":
+					if n := len(thinking); n > 0 && thinking[n-1].OfThinking != nil {
+						thinking[n-1].OfThinking.Thinking += delta.Delta.Thinking
+					}
+					c <- chunk(openai.ChatCompletionStreamChoice{
+						Delta: openai.ChatCompletionStreamChoiceDelta{ReasoningContent: delta.Delta.Thinking},
+					})
+				case "citations_delta":
+					citations = append(citations, Citation{Source: json.RawMessage(delta.Delta.Citation.RawJSON())})
+				case "signature_delta":
+					if n := len(thinking); n > 0 && thinking[n-1].OfThinking != nil {
+						thinking[n-1].OfThinking.Signature += delta.Delta.Signature
+					}
+				case "input_json_delta":
+					idx := toolIndexes[delta.Index]
+					c <- chunk(openai.ChatCompletionStreamChoice{
+						Delta: openai.ChatCompletionStreamChoiceDelta{
+							ToolCalls: []openai.ToolCall{{
+								Index:    &idx,
+								Type:     openai.ToolTypeFunction,
+								Function: openai.FunctionCall{Arguments: delta.Delta.PartialJSON},
+							}},
+						},
+					})
+				}
+			case "content_block_stop":
+				// A text block's citations apply to the whole block, so they
+				// are sent once it is complete.
+				if len(citations) == 0 {
+					continue
+				}
+				for i := range citations {
+					citations[i].Start, citations[i].End = textStart, contentLen
+				}
+				resp := chunk(openai.ChatCompletionStreamChoice{})
+				resp.Citations = citations
+				citations = nil
+				c <- resp
+			case "message_delta":
+				delta := event.AsMessageDelta()
+				usage.CompletionTokens = int(delta.Usage.OutputTokens)
+				usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+				resp := chunk(openai.ChatCompletionStreamChoice{
+					FinishReason: anthropicStopReasonToOpenAI(delta.Delta.StopReason),
+				})
+				resp.StopSequence = delta.Delta.StopSequence
+				u := usage
+				resp.Usage = &u
+				c <- resp
+			}
+		}
+		if err := stream.Err(); err != nil {
+			log.DefaultLogger.Error("anthropic stream error", "err", err)
+			c <- ChatCompletionStreamResponse{Error: anthropicToOpenAIError(err)}
+			return
+		}
+		p.settings.thinking.remember(firstToolCall, thinking)
+	}()
+	return c, nil
+}
+
+// Embeddings is not supported by the Anthropic provider.
+func (p *anthropicMessagesProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	return openai.EmbeddingResponse{}, errEmbeddingsNotSupported
+}
+
+// messageParams translates an OpenAI-shaped chat completion request into
+// Anthropic Messages API parameters.
+func (p *anthropicMessagesProvider) messageParams(req ChatCompletionRequest) (anthropic.MessageNewParams, error) {
+	r := req.ChatCompletionRequest
+	ForceUserMessage(&r)
+
+	params := anthropic.MessageNewParams{
+		Model:         anthropic.Model(req.Model.toAnthropic(p.models)),
+		MaxTokens:     int64(r.MaxCompletionTokens),
+		StopSequences: r.Stop,
+	}
+	// Anthropic requires a max tokens value
+	if params.MaxTokens == 0 {
+		params.MaxTokens = int64(r.MaxTokens)
+	}
+	if params.MaxTokens == 0 {
+		params.MaxTokens = DefaultMaxCompletionTokens
+	}
+
+	system, messages, err := openAIMessagesToAnthropic(r.Messages, p.settings.thinking.get)
+	if err != nil {
+		return anthropic.MessageNewParams{}, err
+	}
+
+	// With thinking enabled, Anthropic requires the thinking blocks which
+	// preceded the last tool calls to be sent back with them. If they aren't
+	// known, e.g. because the tool calls were made by another model, the
+	// request is made without thinking rather than failing.
+	if p.settings.ThinkingBudgetTokens > 0 && !missingThinkingBlocks(messages) {
+		// Extended thinking can't be combined with a temperature or top_p,
+		// which includes the tiny temperature an explicit temperature of 0
+		// is decoded as, so they are left to their defaults.
+		params.Thinking = anthropic.ThinkingConfigParamOfEnabled(p.settings.ThinkingBudgetTokens)
+		// The thinking budget counts towards max tokens, so make sure there is
+		// still room for the response itself.
+		if params.MaxTokens <= p.settings.ThinkingBudgetTokens {
+			params.MaxTokens += p.settings.ThinkingBudgetTokens
+		}
+	} else {
+		if r.Temperature != 0 {
+			params.Temperature = anthropic.Float(float64(r.Temperature))
+		}
+		if r.TopP != 0 {
+			params.TopP = anthropic.Float(float64(r.TopP))
+		}
+	}
+	if p.settings.PromptCaching && len(system) > 0 {
+		// Cache everything up to and including the system prompt, which is
+		// typically large and shared between requests.
+		system[len(system)-1].CacheControl = anthropic.NewCacheControlEphemeralParam()
+	}
+	params.System = system
+	params.Messages = messages
+
+	for _, t := range r.Tools {
+		tool, err := openAIToolToAnthropic(t)
+		if err != nil {
+			return anthropic.MessageNewParams{}, err
+		}
+		params.Tools = append(params.Tools, tool)
+	}
+	if r.ToolChoice != nil {
+		params.ToolChoice, err = openAIToolChoiceToAnthropic(r.ToolChoice)
+		if err != nil {
+			return anthropic.MessageNewParams{}, err
+		}
+	}
+	return params, nil
+}
+
+// openAIMessagesToAnthropic converts OpenAI chat messages to Anthropic system
+// blocks and messages. System messages are extracted into the system prompt,
+// tool results are sent as user messages, and consecutive messages with the same
+// role are merged since the Messages API requires alternating roles. thinking
+// returns the thinking blocks which preceded a tool call, if they are known.
+func openAIMessagesToAnthropic(msgs []openai.ChatCompletionMessage, thinking func(toolCallID string) []anthropic.ContentBlockParamUnion) ([]anthropic.TextBlockParam, []anthropic.MessageParam, error) {
+	var (
+		system   []anthropic.TextBlockParam
+		messages []anthropic.MessageParam
+	)
+	appendBlocks := func(role anthropic.MessageParamRole, blocks []anthropic.ContentBlockParamUnion) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(messages); n > 0 && messages[n-1].Role == role {
+			messages[n-1].Content = append(messages[n-1].Content, blocks...)
+			return
+		}
+		messages = append(messages, anthropic.MessageParam{Role: role, Content: blocks})
+	}
+
+	for _, m := range msgs {
+		switch m.Role {
+		case openai.ChatMessageRoleSystem, openai.ChatMessageRoleDeveloper:
+			if m.Content != "" {
+				system = append(system, anthropic.TextBlockParam{Text: m.Content})
+			}
+			for _, part := range m.MultiContent {
+				if part.Type == openai.ChatMessagePartTypeText && part.Text != "" {
+					system = append(system, anthropic.TextBlockParam{Text: part.Text})
+				}
+			}
+		case openai.ChatMessageRoleUser:
+			blocks, err := openAIContentToAnthropic(m)
+			if err != nil {
+				return nil, nil, err
+			}
+			appendBlocks(anthropic.MessageParamRoleUser, blocks)
+		case openai.ChatMessageRoleAssistant:
+			blocks, err := openAIContentToAnthropic(m)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(m.ToolCalls) > 0 {
+				// Thinking blocks must come first.
+				blocks = append(slices.Clone(thinking(m.ToolCalls[0].ID)), blocks...)
+			}
+			for _, tc := range m.ToolCalls {
+				args := json.RawMessage(tc.Function.Arguments)
+				if len(strings.TrimSpace(tc.Function.Arguments)) == 0 {
+					args = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropic.NewToolUseBlock(tc.ID, args, tc.Function.Name))
+			}
+			appendBlocks(anthropic.MessageParamRoleAssistant, blocks)
+		case openai.ChatMessageRoleTool:
+			appendBlocks(anthropic.MessageParamRoleUser, []anthropic.ContentBlockParamUnion{
+				anthropic.NewToolResultBlock(m.ToolCallID, m.Content, false),
+			})
+		default:
+			return nil, nil, fmt.Errorf("%w: unsupported message role: %s", errBadRequest, m.Role)
+		}
+	}
+	return system, messages, nil
+}
+
+// missingThinkingBlocks returns whether the last assistant message has tool
+// calls without the thinking blocks which preceded them.
+func missingThinkingBlocks(messages []anthropic.MessageParam) bool {
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		if m.Role != anthropic.MessageParamRoleAssistant {
+			continue
+		}
+		hasToolUse := slices.ContainsFunc(m.Content, func(b anthropic.ContentBlockParamUnion) bool { return b.OfToolUse != nil })
+		hasThinking := len(m.Content) > 0 && (m.Content[0].OfThinking != nil || m.Content[0].OfRedactedThinking != nil)
+		return hasToolUse && !hasThinking
+	}
+	return false
+}
+
+// openAIContentToAnthropic converts the text and image content of an OpenAI
+// message into Anthropic content blocks.
+func openAIContentToAnthropic(m openai.ChatCompletionMessage) ([]anthropic.ContentBlockParamUnion, error) {
+	var blocks []anthropic.ContentBlockParamUnion
+	if m.Content != "" {
+		blocks = append(blocks, anthropic.NewTextBlock(m.Content))
+	}
+	for _, part := range m.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			if part.Text != "" {
+				blocks = append(blocks, anthropic.NewTextBlock(part.Text))
+			}
+		case openai.ChatMessagePartTypeImageURL:
+			if part.ImageURL == nil {
+				continue
+			}
+			block, err := imageURLToAnthropic(part.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+// imageURLToAnthropic converts an OpenAI image URL, which may be a data URL,
+// to an Anthropic image block.
+func imageURLToAnthropic(u string) (anthropic.ContentBlockParamUnion, error) {
+	if !strings.HasPrefix(u, "data:") {
+		return anthropic.NewImageBlock(anthropic.URLImageSourceParam{URL: u}), nil
+	}
+	mediaType, data, err := parseImageDataURL(u)
+	if err != nil {
+		return anthropic.ContentBlockParamUnion{}, err
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		return anthropic.ContentBlockParamUnion{}, fmt.Errorf("%w: invalid image data: %s", errBadRequest, err)
+	}
+	return anthropic.NewImageBlockBase64(mediaType, data), nil
+}
+
+// openAIToolToAnthropic converts an OpenAI function tool definition to an
+// Anthropic custom tool.
+func openAIToolToAnthropic(t openai.Tool) (anthropic.ToolUnionParam, error) {
+	if t.Type != openai.ToolTypeFunction || t.Function == nil {
+		return anthropic.ToolUnionParam{}, fmt.Errorf("%w: unsupported tool type: %s", errBadRequest, t.Type)
+	}
+	// Parameters may be any JSON schema representation, so round-trip it
+	// through JSON to get a generic map.
+	schema := map[string]any{}
+	if t.Function.Parameters != nil {
+		b, err := json.Marshal(t.Function.Parameters)
+		if err != nil {
+			return anthropic.ToolUnionParam{}, fmt.Errorf("%w: invalid tool parameters: %s", errBadRequest, err)
+		}
+		if err := json.Unmarshal(b, &schema); err != nil {
+			return anthropic.ToolUnionParam{}, fmt.Errorf("%w: invalid tool parameters: %s", errBadRequest, err)
+		}
+	}
+	input := anthropic.ToolInputSchemaParam{
+		Properties:  schema["properties"],
+		ExtraFields: map[string]any{},
+	}
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			if s, ok := r.(string); ok {
+				input.Required = append(input.Required, s)
+			}
+		}
+	}
+	for k, v := range schema {
+		if k != "type" && k != "properties" && k != "required" {
+			input.ExtraFields[k] = v
+		}
+	}
+	tool := anthropic.ToolUnionParamOfTool(input, t.Function.Name)
+	if t.Function.Description != "" {
+		tool.OfTool.Description = anthropic.String(t.Function.Description)
+	}
+	return tool, nil
+}
+
+// openAIToolChoiceToAnthropic converts an OpenAI tool choice, which is either a
+// string or a tool choice object, to an Anthropic tool choice.
+func openAIToolChoiceToAnthropic(choice any) (anthropic.ToolChoiceUnionParam, error) {
+	switch c := choice.(type) {
+	case string:
+		switch c {
+		case "none":
+			return anthropic.ToolChoiceUnionParam{OfNone: &anthropic.ToolChoiceNoneParam{}}, nil
+		case "auto":
+			return anthropic.ToolChoiceUnionParam{OfAuto: &anthropic.ToolChoiceAutoParam{}}, nil
+		case "required":
+			return anthropic.ToolChoiceUnionParam{OfAny: &anthropic.ToolChoiceAnyParam{}}, nil
+		}
+		return anthropic.ToolChoiceUnionParam{}, fmt.Errorf("%w: unsupported tool choice: %s", errBadRequest, c)
+	default:
+		b, err := json.Marshal(choice)
+		if err != nil {
+			return anthropic.ToolChoiceUnionParam{}, fmt.Errorf("%w: invalid tool choice: %s", errBadRequest, err)
+		}
+		var tc openai.ToolChoice
+		if err := json.Unmarshal(b, &tc); err != nil || tc.Function.Name == "" {
+			return anthropic.ToolChoiceUnionParam{}, fmt.Errorf("%w: invalid tool choice: %s", errBadRequest, string(b))
+		}
+		return anthropic.ToolChoiceParamOfTool(tc.Function.Name), nil
+	}
+}
+
+// anthropicMessageToOpenAI converts an Anthropic message to an OpenAI chat completion response.
+func anthropicMessageToOpenAI(msg *anthropic.Message) openai.ChatCompletionResponse {
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	var content, reasoning strings.Builder
+	for _, block := range msg.Content {
+		switch block.Type {
+		case "text":
+			content.WriteString(block.Text)
+		case "thinking":
+			reasoning.WriteString(block.Thinking)
+		case "tool_use":
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:   block.ID,
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      block.Name,
+					Arguments: string(block.Input),
+				},
+			})
+		}
+	}
+	message.Content = content.String()
+	message.ReasoningContent = reasoning.String()
+
+	return openai.ChatCompletionResponse{
+		ID:      msg.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   string(msg.Model),
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      message,
+			FinishReason: anthropicStopReasonToOpenAI(msg.StopReason),
+		}},
+		Usage: anthropicUsageToOpenAI(msg.Usage.InputTokens, msg.Usage.CacheReadInputTokens, msg.Usage.CacheCreationInputTokens, msg.Usage.OutputTokens),
+	}
+}
+
+// anthropicCitations returns the citations of a response's text blocks, with
+// offsets into the response content as returned by anthropicMessageToOpenAI.
+func anthropicCitations(content []anthropic.ContentBlockUnion) []Citation {
+	var (
+		citations []Citation
+		offset    int
+	)
+	for _, block := range content {
+		if block.Type != "text" {
+			continue
+		}
+		for _, c := range block.Citations {
+			citations = append(citations, Citation{Start: offset, End: offset + len(block.Text), Source: json.RawMessage(c.RawJSON())})
+		}
+		offset += len(block.Text)
+	}
+	return citations
+}
+
+// anthropicThinkingBlocks returns the thinking blocks of a response and the ID
+// of its first tool call, if it has any.
+func anthropicThinkingBlocks(content []anthropic.ContentBlockUnion) (string, []anthropic.ContentBlockParamUnion) {
+	var (
+		firstToolCall string
+		thinking      []anthropic.ContentBlockParamUnion
+	)
+	for _, block := range content {
+		switch block.Type {
+		case "thinking":
+			thinking = append(thinking, anthropic.NewThinkingBlock(block.Signature, block.Thinking))
+		case "redacted_thinking":
+			thinking = append(thinking, anthropic.NewRedactedThinkingBlock(block.Data))
+		case "tool_use":
+			if firstToolCall == "" {
+				firstToolCall = block.ID
+			}
+		}
+	}
+	return firstToolCall, thinking
+}
+
+// maxThinkingBlocks is the number of responses whose thinking blocks are
+// remembered.
+const maxThinkingBlocks = 1000
+
+// thinkingBlocks remembers the signed thinking blocks which preceded tool
+// calls in responses, keyed by the ID of the first tool call. OpenAI messages
+// have nowhere to carry them, but Anthropic requires them to be sent back
+// with the tool calls when thinking is enabled. All methods are safe to call
+// on a nil *thinkingBlocks.
+type thinkingBlocks struct {
+	mu     sync.Mutex
+	blocks map[string][]anthropic.ContentBlockParamUnion
+	// order is the order tool call IDs were added in, for evicting the
+	// oldest.
+	order []string
+}
+
+func newThinkingBlocks() *thinkingBlocks {
+	return &thinkingBlocks{blocks: map[string][]anthropic.ContentBlockParamUnion{}}
+}
+
+// remember records the thinking blocks which preceded a tool call.
+func (t *thinkingBlocks) remember(toolCallID string, blocks []anthropic.ContentBlockParamUnion) {
+	if t == nil || toolCallID == "" || len(blocks) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.blocks[toolCallID]; !ok {
+		t.order = append(t.order, toolCallID)
+	}
+	t.blocks[toolCallID] = blocks
+	for len(t.order) > maxThinkingBlocks {
+		delete(t.blocks, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// get returns the thinking blocks which preceded a tool call, if known.
+func (t *thinkingBlocks) get(toolCallID string) []anthropic.ContentBlockParamUnion {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.blocks[toolCallID]
+}
+
+// anthropicUsageToOpenAI converts Anthropic token counts to OpenAI usage.
+// Anthropic reports cached input tokens separately, whereas OpenAI includes
+// them in the prompt tokens.
+func anthropicUsageToOpenAI(input, cacheRead, cacheCreation, output int64) openai.Usage {
+	prompt := int(input + cacheRead + cacheCreation)
+	return openai.Usage{
+		PromptTokens:        prompt,
+		CompletionTokens:    int(output),
+		TotalTokens:         prompt + int(output),
+		PromptTokensDetails: &openai.PromptTokensDetails{CachedTokens: int(cacheRead)},
+	}
+}
+
+func anthropicStopReasonToOpenAI(reason anthropic.StopReason) openai.FinishReason {
+	switch reason {
+	case anthropic.StopReasonEndTurn, anthropic.StopReasonStopSequence, anthropic.StopReasonPauseTurn:
+		return openai.FinishReasonStop
+	case anthropic.StopReasonMaxTokens:
+		return openai.FinishReasonLength
+	case anthropic.StopReasonToolUse:
+		return openai.FinishReasonToolCalls
+	case anthropic.StopReasonRefusal:
+		return openai.FinishReasonContentFilter
+	}
+	return openai.FinishReasonNull
+}
+
+// anthropicToOpenAIError converts Anthropic API errors into OpenAI API errors so
+// they are reported to clients in the same way as other providers' errors.
+func anthropicToOpenAIError(err error) error {
+	var aErr *anthropic.Error
+	if !errors.As(err, &aErr) {
+		return err
+	}
+	body := struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	message := err.Error()
+	if json.Unmarshal([]byte(aErr.RawJSON()), &body) == nil && body.Error.Message != "" {
+		message = body.Error.Message
+	}
+	return &openai.APIError{
+		Code:           aErr.StatusCode,
+		Message:        message,
+		Type:           body.Error.Type,
+		HTTPStatusCode: aErr.StatusCode,
+	}
+}
@@ -0,0 +1,528 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMockAnthropicMessagesServer returns a server which captures the request body
+// sent to the Messages API and responds with the given body.
+func newMockAnthropicMessagesServer(t *testing.T, status int, contentType, body string, captured *map[string]any) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/messages", r.URL.Path)
+		assert.Equal(t, "test-key", r.Header.Get("X-Api-Key"))
+		if captured != nil {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(captured))
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		_, _ = fmt.Fprint(w, body)
+	}))
+}
+
+func newTestAnthropicMessagesProvider(t *testing.T, url string, settings AnthropicSettings) LLMProvider {
+	t.Helper()
+	settings.URL = url
+	settings.apiKey = "test-key"
+	settings.UseMessagesAPI = true
+	provider, err := createProvider(&Settings{Provider: ProviderTypeAnthropic, Anthropic: settings})
+	require.NoError(t, err)
+	require.IsType(t, &anthropicMessagesProvider{}, provider)
+	return provider
+}
+
+func TestAnthropicMessagesProvider_ChatCompletion(t *testing.T) {
+	var captured map[string]any
+	server := newMockAnthropicMessagesServer(t, http.StatusOK, "application/json", `{
+		"id": "msg_123",
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-sonnet-4-20250514",
+		"content": [
+			{"type": "thinking", "thinking": "Let me check.", "signature": "sig"},
+			{"type": "text", "text": "Checking the weather."},
+			{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "London"}}
+		],
+		"stop_reason": "tool_use",
+		"stop_sequence": null,
+		"usage": {"input_tokens": 10, "cache_read_input_tokens": 5, "cache_creation_input_tokens": 0, "output_tokens": 7}
+	}`, &captured)
+	defer server.Close()
+
+	provider := newTestAnthropicMessagesProvider(t, server.URL, AnthropicSettings{PromptCaching: true})
+
+	resp, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model: ModelLarge,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: "You are helpful."},
+				{Role: openai.ChatMessageRoleUser, Content: "What's the weather in Paris?"},
+				{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{
+					ID:       "toolu_0",
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+				}}},
+				{Role: openai.ChatMessageRoleTool, ToolCallID: "toolu_0", Content: "sunny"},
+				{Role: openai.ChatMessageRoleUser, Content: "And London?"},
+			},
+			Tools: []openai.Tool{{
+				Type: openai.ToolTypeFunction,
+				Function: &openai.FunctionDefinition{
+					Name:        "get_weather",
+					Description: "Get the weather",
+					Parameters: map[string]any{
+						"type":       "object",
+						"properties": map[string]any{"city": map[string]any{"type": "string"}},
+						"required":   []string{"city"},
+					},
+				},
+			}},
+			ToolChoice: "required",
+			Stop:       []string{"STOP"},
+		},
+	})
+	require.NoError(t, err)
+
+	// Request translation.
+	assert.Equal(t, defaultModelSettings(ProviderTypeAnthropic).Mapping[ModelLarge], captured["model"])
+	assert.EqualValues(t, DefaultMaxCompletionTokens, captured["max_tokens"])
+	assert.Equal(t, []any{"STOP"}, captured["stop_sequences"])
+	assert.Equal(t, []any{map[string]any{
+		"type":          "text",
+		"text":          "You are helpful.",
+		"cache_control": map[string]any{"type": "ephemeral"},
+	}}, captured["system"])
+	assert.Equal(t, map[string]any{"type": "any"}, captured["tool_choice"])
+
+	messages := captured["messages"].([]any)
+	require.Len(t, messages, 3)
+	assert.Equal(t, "user", messages[0].(map[string]any)["role"])
+	assistant := messages[1].(map[string]any)
+	assert.Equal(t, "assistant", assistant["role"])
+	assert.Equal(t, []any{map[string]any{
+		"type":  "tool_use",
+		"id":    "toolu_0",
+		"name":  "get_weather",
+		"input": map[string]any{"city": "Paris"},
+	}}, assistant["content"])
+	// The tool result and the following user message are merged into a single user turn.
+	user := messages[2].(map[string]any)
+	assert.Equal(t, "user", user["role"])
+	content := user["content"].([]any)
+	require.Len(t, content, 2)
+	assert.Equal(t, "tool_result", content[0].(map[string]any)["type"])
+	assert.Equal(t, "toolu_0", content[0].(map[string]any)["tool_use_id"])
+	assert.Equal(t, map[string]any{"type": "text", "text": "And London?"}, content[1])
+
+	tools := captured["tools"].([]any)
+	require.Len(t, tools, 1)
+	tool := tools[0].(map[string]any)
+	assert.Equal(t, "get_weather", tool["name"])
+	assert.Equal(t, "Get the weather", tool["description"])
+	assert.Equal(t, map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"city": map[string]any{"type": "string"}},
+		"required":   []any{"city"},
+	}, tool["input_schema"])
+
+	// Response translation.
+	assert.Equal(t, "msg_123", resp.ID)
+	assert.Equal(t, "claude-sonnet-4-20250514", resp.Model)
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, openai.FinishReasonToolCalls, resp.Choices[0].FinishReason)
+	assert.Equal(t, "Checking the weather.", resp.Choices[0].Message.Content)
+	assert.Equal(t, "Let me check.", resp.Choices[0].Message.ReasoningContent)
+	assert.Equal(t, []openai.ToolCall{{
+		ID:       "toolu_1",
+		Type:     openai.ToolTypeFunction,
+		Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city": "London"}`},
+	}}, resp.Choices[0].Message.ToolCalls)
+	assert.Equal(t, 15, resp.Usage.PromptTokens)
+	assert.Equal(t, 7, resp.Usage.CompletionTokens)
+	assert.Equal(t, 22, resp.Usage.TotalTokens)
+	assert.Equal(t, 5, resp.Usage.PromptTokensDetails.CachedTokens)
+}
+
+func TestAnthropicMessagesProvider_Thinking(t *testing.T) {
+	var captured map[string]any
+	server := newMockAnthropicMessagesServer(t, http.StatusOK, "application/json", `{
+		"id": "msg_123", "type": "message", "role": "assistant", "model": "m",
+		"content": [{"type": "text", "text": "hi"}],
+		"stop_reason": "max_tokens",
+		"usage": {"input_tokens": 1, "output_tokens": 1}
+	}`, &captured)
+	defer server.Close()
+
+	provider := newTestAnthropicMessagesProvider(t, server.URL, AnthropicSettings{ThinkingBudgetTokens: 5000})
+	// An explicit temperature of 0 is decoded as a tiny non-zero temperature,
+	// which Anthropic rejects along with top_p when thinking is enabled.
+	var req ChatCompletionRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"model": "base", "temperature": 0, "top_p": 0.9, "messages": [{"role": "user", "content": "hi"}]}`), &req))
+	resp, err := provider.ChatCompletion(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"type": "enabled", "budget_tokens": float64(5000)}, captured["thinking"])
+	assert.EqualValues(t, DefaultMaxCompletionTokens+5000, captured["max_tokens"])
+	assert.NotContains(t, captured, "temperature")
+	assert.NotContains(t, captured, "top_p")
+	assert.Equal(t, openai.FinishReasonLength, resp.Choices[0].FinishReason)
+}
+
+func TestAnthropicMessagesProvider_ThinkingToolContinuation(t *testing.T) {
+	var captured map[string]any
+	server := newMockAnthropicMessagesServer(t, http.StatusOK, "application/json", `{
+		"id": "msg_123", "type": "message", "role": "assistant", "model": "m",
+		"content": [
+			{"type": "thinking", "thinking": "Let me check.", "signature": "sig"},
+			{"type": "redacted_thinking", "data": "opaque"},
+			{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "London"}}
+		],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 1, "output_tokens": 1}
+	}`, &captured)
+	defer server.Close()
+
+	provider := newTestAnthropicMessagesProvider(t, server.URL, AnthropicSettings{ThinkingBudgetTokens: 5000})
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "What's the weather in London?"}}
+	resp, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model:                 ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{Messages: messages},
+	})
+	require.NoError(t, err)
+
+	// The thinking blocks are sent back before the tool calls they preceded.
+	continuation := func(toolCallID string) {
+		t.Helper()
+		captured = nil
+		_, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+			Model: ModelBase,
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Temperature: 0.5,
+				Messages: append(slices.Clone(messages),
+					openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{
+						ID:       toolCallID,
+						Type:     openai.ToolTypeFunction,
+						Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"London"}`},
+					}}},
+					openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, ToolCallID: toolCallID, Content: "rainy"},
+				),
+			},
+		})
+		require.NoError(t, err)
+	}
+	continuation(resp.Choices[0].Message.ToolCalls[0].ID)
+	assert.Contains(t, captured, "thinking")
+	content := captured["messages"].([]any)[1].(map[string]any)["content"].([]any)
+	require.Len(t, content, 3)
+	assert.Equal(t, map[string]any{"type": "thinking", "thinking": "Let me check.", "signature": "sig"}, content[0])
+	assert.Equal(t, map[string]any{"type": "redacted_thinking", "data": "opaque"}, content[1])
+	assert.Equal(t, "tool_use", content[2].(map[string]any)["type"])
+
+	// If the thinking blocks aren't known, thinking is disabled rather than
+	// the request failing.
+	continuation("toolu_unknown")
+	assert.NotContains(t, captured, "thinking")
+	assert.EqualValues(t, 0.5, captured["temperature"])
+	content = captured["messages"].([]any)[1].(map[string]any)["content"].([]any)
+	require.Len(t, content, 1)
+	assert.Equal(t, "tool_use", content[0].(map[string]any)["type"])
+}
+
+func TestAnthropicMessagesProvider_StreamThinkingBlocks(t *testing.T) {
+	events := []string{
+		`event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"m","content":[],"stop_reason":null,"usage":{"input_tokens":1,"output_tokens":1}}}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":"","signature":""}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Let me "}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"check."}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":1}`,
+		`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":20}}`,
+		`event: message_stop
+data: {"type":"message_stop"}`,
+	}
+	server := newMockAnthropicMessagesServer(t, http.StatusOK, "text/event-stream", strings.Join(events, "\n\n")+"\n\n", nil)
+	defer server.Close()
+
+	thinking := newThinkingBlocks()
+	provider := newTestAnthropicMessagesProvider(t, server.URL, AnthropicSettings{ThinkingBudgetTokens: 5000, thinking: thinking})
+	c, err := provider.ChatCompletionStream(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		},
+	})
+	require.NoError(t, err)
+	var reasoning string
+	for resp := range c {
+		require.NoError(t, resp.Error)
+		reasoning += resp.Choices[0].Delta.ReasoningContent
+	}
+	assert.Equal(t, "Let me check.", reasoning)
+	blocks := thinking.get("toolu_1")
+	require.Len(t, blocks, 1)
+	require.NotNil(t, blocks[0].OfThinking)
+	assert.Equal(t, "Let me check.", blocks[0].OfThinking.Thinking)
+	assert.Equal(t, "sig", blocks[0].OfThinking.Signature)
+}
+
+func TestAnthropicMessagesProvider_ChatCompletionStream(t *testing.T) {
+	events := []string{
+		`event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[],"stop_reason":null,"usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" there"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"London\"}"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":1}`,
+		`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":20}}`,
+		`event: message_stop
+data: {"type":"message_stop"}`,
+	}
+	var captured map[string]any
+	server := newMockAnthropicMessagesServer(t, http.StatusOK, "text/event-stream", strings.Join(events, "\n\n")+"\n\n", &captured)
+	defer server.Close()
+
+	provider := newTestAnthropicMessagesProvider(t, server.URL, AnthropicSettings{})
+	c, err := provider.ChatCompletionStream(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		},
+	})
+	require.NoError(t, err)
+
+	var (
+		content      string
+		toolCalls    []openai.ToolCall
+		finishReason openai.FinishReason
+		usage        *openai.Usage
+	)
+	for resp := range c {
+		require.NoError(t, resp.Error)
+		assert.Equal(t, "msg_1", resp.ID)
+		require.Len(t, resp.Choices, 1)
+		delta := resp.Choices[0].Delta
+		content += delta.Content
+		for _, tc := range delta.ToolCalls {
+			require.NotNil(t, tc.Index)
+			if *tc.Index == len(toolCalls) {
+				toolCalls = append(toolCalls, tc)
+				continue
+			}
+			toolCalls[*tc.Index].Function.Arguments += tc.Function.Arguments
+		}
+		if resp.Choices[0].FinishReason != "" {
+			finishReason = resp.Choices[0].FinishReason
+		}
+		if resp.Usage != nil {
+			usage = resp.Usage
+		}
+	}
+	assert.Equal(t, true, captured["stream"])
+	assert.Equal(t, "Hello there", content)
+	require.Len(t, toolCalls, 1)
+	assert.Equal(t, "toolu_1", toolCalls[0].ID)
+	assert.Equal(t, "get_weather", toolCalls[0].Function.Name)
+	assert.Equal(t, `{"city":"London"}`, toolCalls[0].Function.Arguments)
+	assert.Equal(t, openai.FinishReasonToolCalls, finishReason)
+	require.NotNil(t, usage)
+	assert.Equal(t, 12, usage.PromptTokens)
+	assert.Equal(t, 20, usage.CompletionTokens)
+}
+
+func TestAnthropicMessagesProvider_StopSequenceAndCitations(t *testing.T) {
+	const citation = `{"type": "char_location", "cited_text": "The sky is blue.", "document_index": 0, "document_title": "Sky", "start_char_index": 0, "end_char_index": 16}`
+	server := newMockAnthropicMessagesServer(t, http.StatusOK, "application/json", `{
+		"id": "msg_123", "type": "message", "role": "assistant", "model": "m",
+		"content": [
+			{"type": "text", "text": "According to the document, "},
+			{"type": "text", "text": "the sky is blue", "citations": [`+citation+`]},
+			{"type": "text", "text": "."}
+		],
+		"stop_reason": "stop_sequence",
+		"stop_sequence": "STOP",
+		"usage": {"input_tokens": 1, "output_tokens": 1}
+	}`, nil)
+	defer server.Close()
+
+	provider := newTestAnthropicMessagesProvider(t, server.URL, AnthropicSettings{})
+	ctx, md := withResponseMetadata(context.Background())
+	resp, err := provider.ChatCompletion(ctx, ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "What colour is the sky?"}},
+			Stop:     []string{"STOP"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, openai.FinishReasonStop, resp.Choices[0].FinishReason)
+
+	b, err := json.Marshal(newChatCompletionResponse(resp, md))
+	require.NoError(t, err)
+	var body struct {
+		Choices      []openai.ChatCompletionChoice `json:"choices"`
+		StopSequence string                        `json:"stop_sequence"`
+		Citations    []Citation                    `json:"citations"`
+	}
+	require.NoError(t, json.Unmarshal(b, &body))
+	assert.Equal(t, "STOP", body.StopSequence)
+	require.Len(t, body.Citations, 1)
+	content := body.Choices[0].Message.Content
+	assert.Equal(t, "the sky is blue", content[body.Citations[0].Start:body.Citations[0].End])
+	assert.JSONEq(t, citation, string(body.Citations[0].Source))
+}
+
+func TestAnthropicMessagesProvider_StreamStopSequenceAndCitations(t *testing.T) {
+	const citation = `{"type":"char_location","cited_text":"The sky is blue.","document_index":0,"document_title":"Sky","start_char_index":0,"end_char_index":16}`
+	events := []string{
+		`event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"m","content":[],"stop_reason":null,"usage":{"input_tokens":1,"output_tokens":1}}}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"According to the document, "}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"text","text":"","citations":[]}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"citations_delta","citation":` + citation + `}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"the sky "}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"is blue"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":1}`,
+		`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"stop_sequence","stop_sequence":"STOP"},"usage":{"output_tokens":20}}`,
+		`event: message_stop
+data: {"type":"message_stop"}`,
+	}
+	server := newMockAnthropicMessagesServer(t, http.StatusOK, "text/event-stream", strings.Join(events, "\n\n")+"\n\n", nil)
+	defer server.Close()
+
+	provider := newTestAnthropicMessagesProvider(t, server.URL, AnthropicSettings{})
+	c, err := provider.ChatCompletionStream(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "What colour is the sky?"}},
+		},
+	})
+	require.NoError(t, err)
+	var (
+		content      string
+		stopSequence string
+		citations    []Citation
+	)
+	for resp := range c {
+		require.NoError(t, resp.Error)
+		for _, choice := range resp.Choices {
+			content += choice.Delta.Content
+		}
+		if resp.StopSequence != "" {
+			stopSequence = resp.StopSequence
+		}
+		citations = append(citations, resp.Citations...)
+	}
+	assert.Equal(t, "STOP", stopSequence)
+	require.Len(t, citations, 1)
+	assert.Equal(t, "the sky is blue", content[citations[0].Start:citations[0].End])
+	assert.JSONEq(t, citation, string(citations[0].Source))
+}
+
+func TestAnthropicMessagesProvider_ErrorHandling(t *testing.T) {
+	server := newMockAnthropicMessagesServer(t, http.StatusBadRequest, "application/json",
+		`{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: too large"}}`, nil)
+	defer server.Close()
+
+	provider := newTestAnthropicMessagesProvider(t, server.URL, AnthropicSettings{})
+	req := ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		},
+	}
+
+	_, err := provider.ChatCompletion(context.Background(), req)
+	var apiErr *openai.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.HTTPStatusCode)
+	assert.Equal(t, "invalid_request_error", apiErr.Type)
+	assert.Equal(t, "max_tokens: too large", apiErr.Message)
+
+	_, err = provider.ChatCompletionStream(context.Background(), req)
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.HTTPStatusCode)
+}
+
+func TestAnthropicMessagesProvider_InvalidRequest(t *testing.T) {
+	provider := newTestAnthropicMessagesProvider(t, "http://localhost", AnthropicSettings{})
+	for _, tc := range []struct {
+		name string
+		req  openai.ChatCompletionRequest
+	}{
+		{
+			name: "unsupported tool choice",
+			req: openai.ChatCompletionRequest{
+				Messages:   []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+				ToolChoice: "sometimes",
+			},
+		},
+		{
+			name: "unsupported role",
+			req: openai.ChatCompletionRequest{
+				Messages: []openai.ChatCompletionMessage{
+					{Role: openai.ChatMessageRoleUser, Content: "hi"},
+					{Role: "narrator", Content: "hi"},
+				},
+			},
+		},
+		{
+			name: "invalid data URL",
+			req: openai.ChatCompletionRequest{
+				Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{{
+					Type:     openai.ChatMessagePartTypeImageURL,
+					ImageURL: &openai.ChatMessageImageURL{URL: "data:image/png,notbase64"},
+				}}}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{Model: ModelBase, ChatCompletionRequest: tc.req})
+			require.ErrorIs(t, err, errBadRequest)
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/sashabaranov/go-openai"
@@ -25,7 +24,7 @@ type anthropicProvider struct {
 
 func NewAnthropicProvider(settings AnthropicSettings, models *ModelSettings) (LLMProvider, error) {
 	client := &http.Client{
-		Timeout: 2 * time.Minute,
+		Transport: withHeaders(settings.Headers, providerTransport(settings.retries, settings.httpTransport)),
 	}
 	config := openai.DefaultConfig(settings.apiKey)
 	base, err := url.JoinPath(settings.URL, "/v1")
@@ -43,12 +42,7 @@ func NewAnthropicProvider(settings AnthropicSettings, models *ModelSettings) (LL
 }
 
 func (p *anthropicProvider) Models(ctx context.Context) (ModelResponse, error) {
-	return ModelResponse{
-		Data: []ModelInfo{
-			{ID: ModelBase},
-			{ID: ModelLarge},
-		},
-	}, nil
+	return ModelResponse{Data: modelInfos(p.models)}, nil
 }
 
 func (p *anthropicProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
@@ -86,3 +80,8 @@ func (p *anthropicProvider) ChatCompletionStream(ctx context.Context, req ChatCo
 
 	return streamOpenAIRequest(ctx, r, p.client)
 }
+
+// Embeddings is not supported by the Anthropic provider.
+func (p *anthropicProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	return openai.EmbeddingResponse{}, errEmbeddingsNotSupported
+}
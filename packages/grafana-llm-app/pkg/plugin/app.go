@@ -5,8 +5,10 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
 	"github.com/grafana/grafana-llm-app/pkg/plugin/vector"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
@@ -48,6 +50,32 @@ type App struct {
 	ignoreResponsePadding bool
 
 	mcpServer *mcp.MCP
+
+	// responseCache stores chat completions responses, if caching is enabled.
+	responseCache ResponseCache
+	// semanticCache stores chat completions responses by the meaning of the
+	// final user message, if semantic caching is enabled.
+	semanticCache *semanticCache
+
+	// usageStore records the tokens used by chat completions requests, if
+	// usage metering is enabled.
+	usageStore *usageStore
+	// quotas enforces request and token quotas, if any are configured.
+	quotas *quotaLimiter
+
+	// budget tracks spend against the monthly budget, if one is configured.
+	budget *budgetTracker
+
+	// metrics are the Prometheus metrics served by the plugin.
+	metrics *metrics
+
+	// audit records chat completions requests and MCP tool calls, if the
+	// audit log is enabled.
+	audit *auditLog
+
+	// redactor redacts personal data and secrets from chat completions
+	// requests, if redaction is enabled.
+	redactor *redactor
 }
 
 // NewApp creates a new example *App instance.
@@ -56,6 +84,8 @@ func NewApp(ctx context.Context, appSettings backend.AppInstanceSettings) (insta
 	var app App
 	var err error
 
+	app.metrics = defaultMetrics()
+
 	log.DefaultLogger.Debug("Loading settings")
 	app.settings, err = loadSettings(appSettings)
 	if err != nil {
@@ -88,7 +118,7 @@ func NewApp(ctx context.Context, appSettings backend.AppInstanceSettings) (insta
 
 	if app.settings.Vector.Enabled {
 		log.DefaultLogger.Debug("Creating vector service")
-		app.vectorService, err = vector.NewService(
+		vectorService, err := vector.NewService(
 			app.settings.Vector,
 			appSettings.DecryptedSecureJSONData,
 		)
@@ -96,10 +126,63 @@ func NewApp(ctx context.Context, appSettings backend.AppInstanceSettings) (insta
 			log.DefaultLogger.Error("Error creating vector service", "err", err)
 			return nil, err
 		}
+		// The service is nil if no embedder or store is configured.
+		if vectorService != nil {
+			app.vectorService = &instrumentedVectorService{Service: vectorService, metrics: app.metrics}
+		}
 	}
 
 	app.healthCheckMutex = sync.Mutex{}
 
+	if app.settings.Cache.Enabled {
+		app.responseCache = newResponseCache(app.settings.Cache)
+		if app.settings.Cache.Semantic.Enabled {
+			log.DefaultLogger.Debug("Creating semantic cache")
+			app.semanticCache, err = newSemanticCache(app.settings, appSettings.DecryptedSecureJSONData)
+			if err != nil {
+				// The semantic cache is an optimisation, so don't fail to
+				// start without it.
+				log.DefaultLogger.Warn("Semantic cache disabled", "err", err)
+			}
+		}
+	}
+
+	if !app.settings.Usage.Disabled {
+		app.usageStore, err = newUsageStore(app.settings.Usage)
+		if err != nil {
+			log.DefaultLogger.Error("Error creating usage store", "err", err)
+			return nil, err
+		}
+	}
+
+	if app.settings.Quotas.enabled() {
+		app.quotas = newQuotaLimiter(app.settings.Quotas)
+	}
+
+	if app.settings.Anthropic.UseMessagesAPI && app.settings.Anthropic.ThinkingBudgetTokens > 0 {
+		app.settings.Anthropic.thinking = newThinkingBlocks()
+	}
+
+	app.settings.Local.discovered = newDiscoveredModels()
+
+	if !app.settings.CircuitBreaker.Disabled {
+		app.settings.breakers = newCircuitBreakers(app.settings.CircuitBreaker, app.metrics)
+	}
+
+	if app.settings.Pricing.Budget.Monthly > 0 {
+		app.budget = newBudgetTracker(app.settings.Pricing.Budget, app.usageStore, backend.PluginConfigFromContext(ctx).OrgID)
+	}
+
+	if app.settings.Redaction.Enabled {
+		app.redactor = newRedactor(app.settings.Redaction)
+	}
+
+	if app.settings.Audit.Enabled {
+		app.audit = newAuditLog(app.settings.Audit, app.auditSinks()...)
+		app.audit.provider = app.settings.Provider
+		app.audit.redactor = app.redactor
+	}
+
 	// Only instantiate the MCP server if it is not disabled.
 	if !app.settings.MCP.Disabled {
 		mcpSettings := mcp.Settings{
@@ -108,6 +191,19 @@ func NewApp(ctx context.Context, appSettings backend.AppInstanceSettings) (insta
 			IsGrafanaCloud:      app.settings.EnableGrafanaManagedLLM,
 			Tenant:              app.settings.Tenant,
 			IsToolsetEnabled:    app.settings.MCP.Toolsets.IsEnabled,
+			IsToolsetReadOnly:   app.settings.MCP.IsToolsetReadOnly,
+			ObserveToolCall:     app.metrics.observeToolCall,
+			Guard:               app.settings.MCP.Guard.mcpSettings(),
+		}
+		mcpSettings.Guard.OnInjection = func(_ context.Context, toolset mcp.Toolset, tool string, patterns []string) {
+			log.DefaultLogger.Warn("MCP tool result looks like a prompt injection", "tool", tool, "patterns", patterns)
+			app.metrics.observeInjection(toolset, patterns)
+		}
+		if app.audit != nil {
+			mcpSettings.AuditToolCall = app.audit.recordToolCall
+		}
+		if app.settings.MCP.Access.Enabled {
+			mcpSettings.AuthorizeTools = newMCPAccess(app.settings.MCP.Access, app.grafanaAppURL, app.saToken, outboundTransport(app.settings.httpTransport)).authorize
 		}
 		app.mcpServer, err = mcp.New(mcpSettings, PluginVersion)
 		if err != nil {
@@ -132,7 +228,27 @@ func (a *App) Dispose() {
 	if a.vectorService != nil {
 		a.vectorService.Cancel()
 	}
+	if a.semanticCache != nil {
+		a.semanticCache.Cancel()
+	}
 	if a.mcpServer != nil {
 		a.mcpServer.Close()
 	}
+	a.audit.close()
+}
+
+// auditSinks returns the sinks the audit log is written to.
+func (a *App) auditSinks() []auditSink {
+	var sinks []auditSink
+	if a.settings.Audit.File.Path != "" {
+		sinks = append(sinks, newAuditFile(a.settings.Audit))
+	}
+	if a.settings.Audit.Loki.URL != "" {
+		client := &http.Client{
+			Transport: transport.NewRetrying(a.settings.Retries, outboundTransport(a.settings.httpTransport)),
+			Timeout:   30 * time.Second,
+		}
+		sinks = append(sinks, newAuditLoki(a.settings.Audit.Loki, client))
+	}
+	return sinks
 }
@@ -0,0 +1,370 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Events recorded in the audit log.
+const (
+	auditEventChatCompletion = "chat_completion"
+	auditEventToolCall       = "tool_call"
+)
+
+// Outcomes of audited events.
+const (
+	auditOutcomeSuccess = "success"
+	auditOutcomeError   = "error"
+	// auditOutcomeRejected is recorded for requests which weren't sent to a
+	// provider, e.g. because they exceeded a quota.
+	auditOutcomeRejected = "rejected"
+	auditOutcomeCanceled = "canceled"
+)
+
+// auditRecord is a single event in the audit log, and the format of each line
+// of the audit file.
+type auditRecord struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// RequestID links the chat completions made by a request and the tool
+	// calls they led to.
+	RequestID string `json:"request_id,omitempty"`
+	OrgID     int64  `json:"org_id,omitempty"`
+	User      string `json:"user,omitempty"`
+	Caller    string `json:"caller,omitempty"`
+
+	// Model is the abstract model requested, and Provider and ProviderModel
+	// the provider and model which served the request.
+	Model         Model          `json:"model,omitempty"`
+	Provider      ProviderType   `json:"provider,omitempty"`
+	ProviderModel string         `json:"provider_model,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	Cache         string         `json:"cache,omitempty"`
+	Degraded      string         `json:"degraded,omitempty"`
+	Messages      []auditMessage `json:"messages,omitempty"`
+	Completion    *auditMessage  `json:"completion,omitempty"`
+	Usage         *openai.Usage  `json:"usage,omitempty"`
+	// Redactions is the number of values redacted from the messages by each
+	// detector. Messages and the completion are recorded as redacted.
+	Redactions map[string]int `json:"redactions,omitempty"`
+
+	Toolset   mcp.Toolset `json:"toolset,omitempty"`
+	Tool      string      `json:"tool,omitempty"`
+	Arguments string      `json:"arguments,omitempty"`
+	Result    string      `json:"result,omitempty"`
+
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// auditMessage is a chat message as recorded in the audit log, with its
+// content recorded according to the content mode.
+type auditMessage struct {
+	Role      string          `json:"role"`
+	Content   string          `json:"content,omitempty"`
+	ToolCalls []auditToolCall `json:"tool_calls,omitempty"`
+}
+
+// auditToolCall is a tool call requested by the model.
+type auditToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// auditSink is somewhere the audit log is written.
+type auditSink interface {
+	// write writes a record, given its JSON encoding.
+	write(r auditRecord, line []byte) error
+	// close flushes any buffered records.
+	close() error
+}
+
+// auditLog records chat completions requests and MCP tool calls to the
+// configured sinks. It is safe for concurrent use, and all methods are safe to
+// call on a nil *auditLog.
+type auditLog struct {
+	settings AuditSettings
+	sinks    []auditSink
+	// provider is the configured provider, recorded for requests when a
+	// router or fallback didn't record which provider served them.
+	provider ProviderType
+	// redactor, if set, redacts requests which were rejected before reaching
+	// the redacting provider.
+	redactor *redactor
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+func newAuditLog(settings AuditSettings, sinks ...auditSink) *auditLog {
+	return &auditLog{settings: settings, sinks: sinks, now: time.Now}
+}
+
+// record fills in who made the request in ctx and writes r to each sink.
+func (a *auditLog) record(ctx context.Context, r auditRecord) {
+	if a == nil {
+		return
+	}
+	pCtx := backend.PluginConfigFromContext(ctx)
+	r.Time = a.now()
+	r.RequestID = auditRequestIDFromContext(ctx)
+	r.OrgID = pCtx.OrgID
+	if pCtx.User != nil {
+		r.User = pCtx.User.Login
+	}
+	r.Caller = callerFromContext(ctx)
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to encode audit record", "err", err)
+		return
+	}
+	for _, s := range a.sinks {
+		if err := s.write(r, line); err != nil {
+			log.DefaultLogger.Warn("Failed to write audit record", "err", err)
+		}
+	}
+}
+
+// close flushes and closes the sinks.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	for _, s := range a.sinks {
+		if err := s.close(); err != nil {
+			log.DefaultLogger.Warn("Failed to close audit log", "err", err)
+		}
+	}
+}
+
+// content returns s as recorded according to the content mode.
+func (a *auditLog) content(s string) string {
+	if s == "" {
+		return ""
+	}
+	switch a.settings.Content {
+	case AuditContentFull:
+		return s
+	case AuditContentHashed:
+		sum := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	default:
+		if utf8.RuneCountInString(s) <= a.settings.MaxContentLength {
+			return s
+		}
+		return string([]rune(s)[:a.settings.MaxContentLength]) + "…"
+	}
+}
+
+// message returns m as recorded in the audit log.
+func (a *auditLog) message(m openai.ChatCompletionMessage) auditMessage {
+	am := auditMessage{Role: m.Role, Content: m.Content}
+	if len(m.MultiContent) > 0 {
+		parts := make([]string, 0, len(m.MultiContent))
+		for _, p := range m.MultiContent {
+			if p.Type == openai.ChatMessagePartTypeText {
+				parts = append(parts, p.Text)
+			} else {
+				parts = append(parts, "["+string(p.Type)+"]")
+			}
+		}
+		am.Content = strings.Join(parts, "\n")
+	}
+	am.Content = a.content(am.Content)
+	for _, tc := range m.ToolCalls {
+		am.ToolCalls = append(am.ToolCalls, auditToolCall{Name: tc.Function.Name, Arguments: a.content(tc.Function.Arguments)})
+	}
+	return am
+}
+
+// chatCompletionRecord returns the record of a chat completions request.
+func (a *auditLog) chatCompletionRecord(ctx context.Context, req ChatCompletionRequest) auditRecord {
+	md := responseMetadataFromContext(ctx)
+	provider := md.Provider()
+	if provider == "" {
+		provider = a.provider
+	}
+	r := auditRecord{
+		Event:      auditEventChatCompletion,
+		Model:      req.Model,
+		Provider:   provider,
+		Stream:     req.Stream,
+		Cache:      md.Cache(),
+		Degraded:   md.Degraded(),
+		Messages:   make([]auditMessage, 0, len(req.Messages)),
+		Redactions: redactionCountsFromContext(ctx),
+	}
+	for _, m := range req.Messages {
+		r.Messages = append(r.Messages, a.message(m))
+	}
+	return r
+}
+
+// recordChatCompletion records a chat completions request which was sent to
+// the provider, along with its response or error.
+func (a *auditLog) recordChatCompletion(ctx context.Context, req ChatCompletionRequest, resp openai.ChatCompletionResponse, err error, duration time.Duration) {
+	if a == nil {
+		return
+	}
+	r := a.chatCompletionRecord(ctx, req)
+	r.DurationMs = duration.Milliseconds()
+	r.Outcome = auditOutcome(err)
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.ProviderModel = resp.Model
+		if len(resp.Choices) > 0 {
+			completion := a.message(resp.Choices[0].Message)
+			r.Completion = &completion
+		}
+		if resp.Usage.TotalTokens > 0 {
+			r.Usage = &resp.Usage
+		}
+	}
+	a.record(ctx, r)
+}
+
+// recordRejected records a chat completions request which was rejected
+// before being sent to the provider.
+func (a *auditLog) recordRejected(ctx context.Context, req ChatCompletionRequest, err error) {
+	if a == nil {
+		return
+	}
+	if a.redactor != nil {
+		var rd *redaction
+		req, rd = a.redactor.redact(req)
+		if len(rd.counts) > 0 {
+			ctx = withRedactionCounts(ctx, rd.counts)
+		}
+	}
+	r := a.chatCompletionRecord(ctx, req)
+	r.Outcome = auditOutcomeRejected
+	r.Error = err.Error()
+	a.record(ctx, r)
+}
+
+// recordToolCall records an MCP tool call.
+func (a *auditLog) recordToolCall(ctx context.Context, call mcp.ToolCall) {
+	if a == nil {
+		return
+	}
+	r := auditRecord{
+		Event:      auditEventToolCall,
+		Toolset:    call.Toolset,
+		Tool:       call.Tool,
+		Outcome:    auditOutcome(call.Err),
+		DurationMs: call.Duration.Milliseconds(),
+	}
+	if call.Arguments != nil {
+		if args, err := json.Marshal(call.Arguments); err == nil {
+			r.Arguments = a.content(string(args))
+		}
+	}
+	if call.Err != nil {
+		r.Error = call.Err.Error()
+	}
+	if call.Result != nil {
+		r.Result = a.content(mcp.ToolResultText(call.Result))
+		if call.Result.IsError {
+			r.Outcome = auditOutcomeError
+		}
+	}
+	a.record(ctx, r)
+}
+
+func auditOutcome(err error) string {
+	switch {
+	case err == nil:
+		return auditOutcomeSuccess
+	case errors.Is(err, context.Canceled):
+		return auditOutcomeCanceled
+	default:
+		return auditOutcomeError
+	}
+}
+
+type auditRequestIDKey struct{}
+
+// withAuditRequestID returns a context carrying a new ID for the request,
+// linking its audit records.
+func withAuditRequestID(ctx context.Context) context.Context {
+	b := make([]byte, 8)
+	//nolint:errcheck // crypto/rand.Read never returns an error.
+	rand.Read(b)
+	return context.WithValue(ctx, auditRequestIDKey{}, hex.EncodeToString(b))
+}
+
+func auditRequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(auditRequestIDKey{}).(string)
+	return id
+}
+
+// auditingProvider is an LLMProvider which records each chat completions
+// request in the audit log.
+type auditingProvider struct {
+	LLMProvider
+	audit *auditLog
+}
+
+func (p *auditingProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	start := p.audit.now()
+	resp, err := p.LLMProvider.ChatCompletion(ctx, req)
+	p.audit.recordChatCompletion(ctx, req, resp, err, p.audit.now().Sub(start))
+	return resp, err
+}
+
+// ChatCompletionStream records a stream once it finishes, with the completion
+// built from its chunks.
+func (p *auditingProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	start := p.audit.now()
+	c, err := p.LLMProvider.ChatCompletionStream(ctx, req)
+	if err != nil {
+		p.audit.recordChatCompletion(ctx, req, openai.ChatCompletionResponse{}, err, p.audit.now().Sub(start))
+		return nil, err
+	}
+	out := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		var acc streamAccumulator
+		var streamErr error
+		for resp := range c {
+			if resp.Error != nil {
+				streamErr = resp.Error
+			} else {
+				acc.add(resp.ChatCompletionStreamResponse)
+			}
+			if !forwardStreamResponse(ctx, out, resp, c) {
+				break
+			}
+		}
+		if streamErr == nil && !acc.complete() {
+			// The stream ended early, most likely because the request was
+			// canceled.
+			streamErr = ctx.Err()
+		}
+		p.audit.recordChatCompletion(ctx, req, acc.resp, streamErr, p.audit.now().Sub(start))
+	}()
+	return out, nil
+}
+
+// withAudit wraps provider so that chat completions requests are recorded in
+// the audit log, if it is enabled.
+func (a *App) withAudit(provider LLMProvider) LLMProvider {
+	if a.audit == nil || provider == nil {
+		return provider
+	}
+	return &auditingProvider{LLMProvider: provider, audit: a.audit}
+}
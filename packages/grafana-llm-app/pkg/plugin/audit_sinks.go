@@ -0,0 +1,280 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// auditFileTimeFormat is the format of the time appended to the names of
+// rotated audit files.
+const auditFileTimeFormat = "20060102T150405.000000000Z"
+
+// auditFile is an auditSink writing each record as a line of a local file. The
+// file is rotated daily or when it reaches a maximum size, and rotated files
+// are deleted once they're older than the retention period.
+type auditFile struct {
+	path      string
+	maxSize   int64
+	retention time.Duration
+
+	mu sync.Mutex
+	f  *os.File
+	// size is the size of the open file, and day the UTC day it was started.
+	size int64
+	day  time.Time
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+func newAuditFile(settings AuditSettings) *auditFile {
+	return &auditFile{
+		path:      settings.File.Path,
+		maxSize:   int64(settings.File.MaxSizeMB) << 20,
+		retention: time.Duration(settings.RetentionDays) * 24 * time.Hour,
+		now:       time.Now,
+	}
+}
+
+func (w *auditFile) write(_ auditRecord, line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now().UTC()
+	if w.f != nil && (w.size+int64(len(line))+1 > w.maxSize || !w.day.Equal(now.Truncate(24*time.Hour))) {
+		if err := w.rotate(now); err != nil {
+			return err
+		}
+	}
+	if w.f == nil {
+		if err := w.open(now); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(append(line, '\n'))
+	w.size += int64(n)
+	return err
+}
+
+// open opens the audit file for appending. If it already exists and was
+// started on an earlier day, it is rotated first. The caller must hold w.mu.
+func (w *auditFile) open(now time.Time) error {
+	if info, err := os.Stat(w.path); err == nil && info.ModTime().UTC().Truncate(24*time.Hour).Before(now.Truncate(24*time.Hour)) {
+		if err := w.rename(info.ModTime()); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("open audit file: %w", err)
+	}
+	w.f, w.size, w.day = f, info.Size(), now.Truncate(24*time.Hour)
+	w.deleteExpired()
+	return nil
+}
+
+// rotate closes the audit file and moves it aside. The caller must hold w.mu.
+func (w *auditFile) rotate(now time.Time) error {
+	err := w.f.Close()
+	w.f = nil
+	if err != nil {
+		return fmt.Errorf("close audit file: %w", err)
+	}
+	return w.rename(now)
+}
+
+// rename moves the audit file aside with the given time in its name. The
+// caller must hold w.mu.
+func (w *auditFile) rename(t time.Time) error {
+	if err := os.Rename(w.path, w.path+"."+t.UTC().Format(auditFileTimeFormat)); err != nil {
+		return fmt.Errorf("rotate audit file: %w", err)
+	}
+	return nil
+}
+
+// deleteExpired deletes rotated audit files older than the retention period.
+func (w *auditFile) deleteExpired() {
+	rotated, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return
+	}
+	cutoff := w.now().Add(-w.retention)
+	for _, path := range rotated {
+		t, err := time.Parse(auditFileTimeFormat, strings.TrimPrefix(path, w.path+"."))
+		if err != nil || !t.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.DefaultLogger.Warn("Failed to delete expired audit file", "path", path, "err", err)
+		}
+	}
+}
+
+func (w *auditFile) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+const (
+	// auditLokiBatchSize is the number of records pushed to Loki at once.
+	auditLokiBatchSize = 100
+	// auditLokiFlushInterval is how often records are pushed to Loki if a
+	// batch hasn't filled up.
+	auditLokiFlushInterval = 5 * time.Second
+	// auditLokiQueueSize is the number of records waiting to be pushed above
+	// which new records are dropped, so that a slow Loki doesn't hold up
+	// requests.
+	auditLokiQueueSize = 10000
+)
+
+// auditLoki is an auditSink pushing records to Loki in batches, in the
+// background.
+type auditLoki struct {
+	settings AuditLokiSettings
+	client   *http.Client
+	labels   map[string]string
+
+	// mu guards closing queue, so that records written while the plugin
+	// shuts down are dropped rather than sent on a closed channel.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan lokiEntry
+	done   chan struct{}
+}
+
+type lokiEntry struct {
+	time time.Time
+	line string
+}
+
+func newAuditLoki(settings AuditLokiSettings, client *http.Client) *auditLoki {
+	labels := map[string]string{"service_name": "grafana-llm-app"}
+	maps.Copy(labels, settings.Labels)
+	l := &auditLoki{
+		settings: settings,
+		client:   client,
+		labels:   labels,
+		queue:    make(chan lokiEntry, auditLokiQueueSize),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *auditLoki) write(r auditRecord, line []byte) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return errors.New("audit log for Loki is closed, dropping record")
+	}
+	select {
+	case l.queue <- lokiEntry{time: r.Time, line: string(line)}:
+		return nil
+	default:
+		return errors.New("audit log queue for Loki is full, dropping record")
+	}
+}
+
+// run pushes batches of queued records until the queue is closed.
+func (l *auditLoki) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(auditLokiFlushInterval)
+	defer ticker.Stop()
+	batch := make([]lokiEntry, 0, auditLokiBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := l.push(context.Background(), batch); err != nil {
+			log.DefaultLogger.Warn("Failed to push audit log to Loki", "records", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e, ok := <-l.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= auditLokiBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// push sends a batch of records to Loki's push API.
+func (l *auditLoki) push(ctx context.Context, batch []lokiEntry) error {
+	values := make([][2]string, 0, len(batch))
+	for _, e := range batch {
+		values = append(values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.line})
+	}
+	body, err := json.Marshal(map[string]any{
+		"streams": []map[string]any{{"stream": l.labels, "values": values}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.settings.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.settings.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.settings.TenantID)
+	}
+	if l.settings.Username != "" || l.settings.password != "" {
+		req.SetBasicAuth(l.settings.Username, l.settings.password)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("loki responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// close pushes any queued records and stops pushing.
+func (l *auditLoki) close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+	<-l.done
+	return nil
+}
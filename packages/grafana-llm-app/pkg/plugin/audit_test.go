@@ -0,0 +1,281 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryAuditSink is an auditSink keeping records in memory.
+type memoryAuditSink struct {
+	records []auditRecord
+}
+
+func (s *memoryAuditSink) write(r auditRecord, _ []byte) error {
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *memoryAuditSink) close() error { return nil }
+
+// readAuditFile returns the records in an audit file.
+func readAuditFile(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close() //nolint:errcheck
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r auditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestAuditContent(t *testing.T) {
+	prompt := "Why is my dashboard slow?"
+	for mode, want := range map[AuditContentMode]string{
+		AuditContentFull:      prompt,
+		AuditContentTruncated: "Why is my …",
+		AuditContentHashed:    "sha256:",
+	} {
+		t.Run(string(mode), func(t *testing.T) {
+			a := newAuditLog(AuditSettings{Content: mode, MaxContentLength: 10})
+			msg := a.message(openai.ChatCompletionMessage{
+				Role:      openai.ChatMessageRoleAssistant,
+				Content:   prompt,
+				ToolCalls: []openai.ToolCall{{Function: openai.FunctionCall{Name: "search_dashboards", Arguments: `{"query": "slow"}`}}},
+			})
+			assert.Equal(t, openai.ChatMessageRoleAssistant, msg.Role)
+			assert.True(t, strings.HasPrefix(msg.Content, want), "%q should start with %q", msg.Content, want)
+			require.Len(t, msg.ToolCalls, 1)
+			assert.Equal(t, "search_dashboards", msg.ToolCalls[0].Name)
+			if mode == AuditContentHashed {
+				assert.Len(t, msg.Content, len("sha256:")+64)
+				assert.NotContains(t, msg.ToolCalls[0].Arguments, "slow")
+			}
+		})
+	}
+
+	a := newAuditLog(AuditSettings{Content: AuditContentFull})
+	msg := a.message(openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: "What's in this panel?"},
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/png;base64,AAAA"}},
+		},
+	})
+	assert.Equal(t, "What's in this panel?\n[image_url]", msg.Content)
+}
+
+func TestAuditingProvider(t *testing.T) {
+	sink := &memoryAuditSink{}
+	audit := newAuditLog(AuditSettings{Content: AuditContentFull}, sink)
+	inner := &fakeBackend{}
+	p := &auditingProvider{LLMProvider: inner, audit: audit}
+	ctx := withAuditRequestID(backend.WithPluginContext(context.Background(), backend.PluginContext{OrgID: 2, User: &backend.User{Login: "alice"}}))
+	ctx = withCaller(ctx, "grafana-assistant-app")
+	req := ChatCompletionRequest{
+		Model:                 ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}},
+	}
+
+	_, err := p.ChatCompletion(ctx, req)
+	require.NoError(t, err)
+	inner.err = errors.New("overloaded")
+	_, err = p.ChatCompletion(ctx, req)
+	require.Error(t, err)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	inner.err = context.Canceled
+	_, err = p.ChatCompletion(canceled, req)
+	require.Error(t, err)
+
+	require.Len(t, sink.records, 3)
+	r := sink.records[0]
+	assert.Equal(t, auditEventChatCompletion, r.Event)
+	assert.Equal(t, int64(2), r.OrgID)
+	assert.Equal(t, "alice", r.User)
+	assert.Equal(t, "grafana-assistant-app", r.Caller)
+	assert.NotEmpty(t, r.RequestID)
+	assert.EqualValues(t, ModelBase, r.Model)
+	assert.Equal(t, []auditMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}, r.Messages)
+	assert.Equal(t, auditOutcomeSuccess, r.Outcome)
+	assert.Equal(t, auditOutcomeError, sink.records[1].Outcome)
+	assert.Equal(t, "overloaded", sink.records[1].Error)
+	assert.Equal(t, auditOutcomeCanceled, sink.records[2].Outcome)
+	assert.Equal(t, r.RequestID, sink.records[1].RequestID, "records of the same request should share its ID")
+}
+
+func TestAuditToolCall(t *testing.T) {
+	sink := &memoryAuditSink{}
+	audit := newAuditLog(AuditSettings{Content: AuditContentFull}, sink)
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{OrgID: 1, User: &backend.User{Login: "bob"}})
+
+	audit.recordToolCall(ctx, mcp.ToolCall{
+		Toolset:   mcp.ToolsetLoki,
+		Tool:      "query_loki_logs",
+		Arguments: map[string]any{"query": `{job="api"}`},
+		Result:    mcpgo.NewToolResultText("no logs"),
+		Duration:  1500 * time.Millisecond,
+	})
+	audit.recordToolCall(ctx, mcp.ToolCall{Toolset: mcp.ToolsetLoki, Tool: "query_loki_logs", Result: mcpgo.NewToolResultError("bad query")})
+
+	require.Len(t, sink.records, 2)
+	r := sink.records[0]
+	assert.Equal(t, auditEventToolCall, r.Event)
+	assert.Equal(t, "bob", r.User)
+	assert.Equal(t, mcp.ToolsetLoki, r.Toolset)
+	assert.Equal(t, "query_loki_logs", r.Tool)
+	assert.Equal(t, `{"query":"{job=\"api\"}"}`, r.Arguments)
+	assert.Equal(t, "no logs", r.Result)
+	assert.Equal(t, auditOutcomeSuccess, r.Outcome)
+	assert.Equal(t, int64(1500), r.DurationMs)
+	assert.Equal(t, auditOutcomeError, sink.records[1].Outcome, "error results should be recorded as errors")
+}
+
+func TestAuditFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	w := newAuditFile(AuditSettings{File: AuditFileSettings{Path: path, MaxSizeMB: 1}, RetentionDays: 2})
+	w.now = func() time.Time { return now }
+	line := []byte(`{"event":"chat_completion"}`)
+
+	require.NoError(t, w.write(auditRecord{}, line))
+	require.NoError(t, w.write(auditRecord{}, line))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(line)+"\n"+string(line)+"\n", string(b))
+
+	// The file is rotated when it would exceed the maximum size.
+	require.NoError(t, w.write(auditRecord{}, make([]byte, 1<<20)))
+	rotated, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+	assert.Equal(t, path+".20240101T120000.000000000Z", rotated[0])
+
+	// The file is rotated daily, and rotated files are deleted once expired.
+	for range 3 {
+		now = now.Add(24 * time.Hour)
+		require.NoError(t, w.write(auditRecord{}, line))
+	}
+	rotated, err = filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		path + ".20240102T120000.000000000Z",
+		path + ".20240103T120000.000000000Z",
+		path + ".20240104T120000.000000000Z",
+	}, rotated, "the file rotated on the first day should have been deleted")
+	require.NoError(t, w.close())
+}
+
+func TestAuditLoki(t *testing.T) {
+	type push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	var pushes []push
+	var tenant, user, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.Header.Get("X-Scope-OrgID")
+		user, password, _ = r.BasicAuth()
+		var p push
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &p))
+		pushes = append(pushes, p)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	settings := AuditLokiSettings{URL: server.URL, TenantID: "1234", Username: "loki", Labels: map[string]string{"env": "prod"}, password: "s3cret"}
+	sink := newAuditLoki(settings, server.Client())
+	audit := newAuditLog(AuditSettings{Content: AuditContentHashed}, sink)
+	for range 3 {
+		audit.recordToolCall(context.Background(), mcp.ToolCall{Tool: "list_datasources"})
+	}
+	audit.close()
+	audit.recordToolCall(context.Background(), mcp.ToolCall{Tool: "list_datasources"})
+
+	require.Len(t, pushes, 1, "records should be pushed in a batch when the log is closed")
+	assert.Equal(t, "1234", tenant)
+	assert.Equal(t, "loki", user)
+	assert.Equal(t, "s3cret", password)
+	require.Len(t, pushes[0].Streams, 1)
+	assert.Equal(t, map[string]string{"service_name": "grafana-llm-app", "env": "prod"}, pushes[0].Streams[0].Stream)
+	require.Len(t, pushes[0].Streams[0].Values, 3)
+	var r auditRecord
+	require.NoError(t, json.Unmarshal([]byte(pushes[0].Streams[0].Values[0][1]), &r))
+	assert.Equal(t, "list_datasources", r.Tool)
+}
+
+func TestChatCompletionsAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{JSONData: []byte(fmt.Sprintf(`{
+		"provider": "test",
+		"quotas": {"user": {"requestsPerMinute": 2}},
+		"audit": {"enabled": true, "content": "full", "file": {"path": %q}}
+	}`, path))}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	for _, body := range []string{
+		`{"model": "base", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`,
+		`{"model": "large", "messages": [{"role": "user", "content": "hello"}]}`,
+		`{"model": "base", "messages": [{"role": "user", "content": "over quota"}]}`,
+	} {
+		var r mockCallResourceResponseSender
+		err = app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{OrgID: 1, User: &backend.User{Login: "alice"}, AppInstanceSettings: &settings},
+			Method:        http.MethodPost,
+			Path:          "/llm/v1/chat/completions",
+			Body:          []byte(body),
+		}, &r)
+		require.NoError(t, err)
+	}
+	app.Dispose()
+
+	records := readAuditFile(t, path)
+	require.Len(t, records, 3)
+	stream := records[0]
+	assert.Equal(t, "alice", stream.User)
+	assert.Equal(t, int64(1), stream.OrgID)
+	assert.True(t, stream.Stream)
+	assert.Equal(t, ProviderTypeTest, stream.Provider)
+	assert.Equal(t, []auditMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}, stream.Messages)
+	require.NotNil(t, stream.Completion)
+	assert.Equal(t, "Hello there.", stream.Completion.Content)
+	assert.Equal(t, auditOutcomeSuccess, stream.Outcome)
+
+	assert.EqualValues(t, ModelLarge, records[1].Model)
+	assert.Equal(t, "tiny", records[1].ProviderModel)
+	require.NotNil(t, records[1].Usage)
+	assert.Equal(t, 10, records[1].Usage.TotalTokens)
+
+	assert.Equal(t, auditOutcomeRejected, records[2].Outcome)
+	assert.Equal(t, "over quota", records[2].Messages[0].Content)
+	assert.NotEqual(t, records[1].RequestID, records[2].RequestID)
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/sashabaranov/go-openai"
@@ -18,7 +17,7 @@ type azure struct {
 
 func NewAzureProvider(settings OpenAISettings, defaultModel Model) (LLMProvider, error) {
 	client := &http.Client{
-		Timeout: 2 * time.Minute,
+		Transport: withHeaders(settings.Headers, providerTransport(settings.retries, settings.httpTransport)),
 	}
 	p := &azure{
 		settings:     settings,
@@ -100,9 +99,38 @@ func (p *azure) ChatCompletionStream(ctx context.Context, req ChatCompletionRequ
 	return streamOpenAIRequest(ctx, r, p.oc)
 }
 
+func (p *azure) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	mapping, err := parseAzureMapping(p.settings.AzureEmbeddingMapping)
+	if err != nil {
+		return openai.EmbeddingResponse{}, err
+	}
+	deployment, ok := mapping[req.Model]
+	if !ok {
+		deployment = mapping[ModelBase]
+	}
+	if deployment == "" {
+		return openai.EmbeddingResponse{}, fmt.Errorf("%w: no embedding deployment found for model: %s", errBadRequest, req.Model)
+	}
+
+	r := req.EmbeddingRequest
+	r.Model = openai.EmbeddingModel(deployment)
+
+	resp, err := p.oc.CreateEmbeddings(ctx, r)
+	if err != nil {
+		log.DefaultLogger.Error("error creating azure embeddings", "err", err)
+		return openai.EmbeddingResponse{}, err
+	}
+	return resp, nil
+}
+
 func (p *azure) getAzureMapping() (map[Model]string, error) {
-	result := make(map[Model]string, len(p.settings.AzureMapping))
-	for _, v := range p.settings.AzureMapping {
+	return parseAzureMapping(p.settings.AzureMapping)
+}
+
+// parseAzureMapping parses a list of [model, deployment] pairs.
+func parseAzureMapping(azureMapping [][]string) (map[Model]string, error) {
+	result := make(map[Model]string, len(azureMapping))
+	for _, v := range azureMapping {
 		if len(v) != 2 {
 			return nil, fmt.Errorf("%w: expected 2 entries in a mapping, got %d", errBadRequest, len(v))
 		}
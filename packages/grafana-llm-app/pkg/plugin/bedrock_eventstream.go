@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// eventStreamMessage is a single message of the AWS event stream encoding
+// used by Bedrock's streaming APIs. Only string headers are retained.
+// See: https://docs.aws.amazon.com/AWSJavaScriptSDK/v3/latest/Package/-aws-sdk-eventstream-codec/
+type eventStreamMessage struct {
+	Headers map[string]string
+	Payload []byte
+}
+
+const (
+	eventStreamPreludeLen = 12
+	eventStreamCRCLen     = 4
+	// eventStreamMaxMessageLen is the maximum message size allowed by AWS.
+	eventStreamMaxMessageLen = 16 * 1024 * 1024
+)
+
+// eventStreamDecoder reads AWS event stream messages from a reader.
+type eventStreamDecoder struct {
+	r io.Reader
+}
+
+// Decode reads the next message, returning io.EOF when the stream ends cleanly.
+func (d *eventStreamDecoder) Decode() (eventStreamMessage, error) {
+	prelude := make([]byte, eventStreamPreludeLen)
+	if _, err := io.ReadFull(d.r, prelude); err != nil {
+		return eventStreamMessage{}, err
+	}
+	totalLen := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[0:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return eventStreamMessage{}, errors.New("event stream prelude checksum mismatch")
+	}
+	if totalLen > eventStreamMaxMessageLen || totalLen < eventStreamPreludeLen+eventStreamCRCLen+headersLen {
+		return eventStreamMessage{}, fmt.Errorf("invalid event stream message length: %d", totalLen)
+	}
+
+	msg := make([]byte, totalLen)
+	copy(msg, prelude)
+	if _, err := io.ReadFull(d.r, msg[eventStreamPreludeLen:]); err != nil {
+		return eventStreamMessage{}, fmt.Errorf("read event stream message: %w", err)
+	}
+	crcOffset := totalLen - eventStreamCRCLen
+	if crc32.ChecksumIEEE(msg[:crcOffset]) != binary.BigEndian.Uint32(msg[crcOffset:]) {
+		return eventStreamMessage{}, errors.New("event stream message checksum mismatch")
+	}
+
+	headers, err := decodeEventStreamHeaders(msg[eventStreamPreludeLen : eventStreamPreludeLen+headersLen])
+	if err != nil {
+		return eventStreamMessage{}, err
+	}
+	return eventStreamMessage{
+		Headers: headers,
+		Payload: msg[eventStreamPreludeLen+headersLen : crcOffset],
+	}, nil
+}
+
+// decodeEventStreamHeaders decodes the header section of a message.
+func decodeEventStreamHeaders(b []byte) (map[string]string, error) {
+	headers := map[string]string{}
+	errTruncated := errors.New("truncated event stream header")
+	for len(b) > 0 {
+		nameLen := int(b[0])
+		if len(b) < 1+nameLen+1 {
+			return nil, errTruncated
+		}
+		name := string(b[1 : 1+nameLen])
+		valueType := b[1+nameLen]
+		b = b[1+nameLen+1:]
+
+		var valueLen int
+		switch valueType {
+		case 0, 1: // bool true, bool false
+			valueLen = 0
+		case 2: // byte
+			valueLen = 1
+		case 3: // short
+			valueLen = 2
+		case 4: // int
+			valueLen = 4
+		case 5, 8: // long, timestamp
+			valueLen = 8
+		case 9: // uuid
+			valueLen = 16
+		case 6, 7: // bytes, string
+			if len(b) < 2 {
+				return nil, errTruncated
+			}
+			valueLen = int(binary.BigEndian.Uint16(b[0:2]))
+			b = b[2:]
+		default:
+			return nil, fmt.Errorf("unknown event stream header type: %d", valueType)
+		}
+		if len(b) < valueLen {
+			return nil, errTruncated
+		}
+		if valueType == 7 {
+			headers[name] = string(b[:valueLen])
+		}
+		b = b[valueLen:]
+	}
+	return headers, nil
+}
@@ -0,0 +1,652 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// bedrockProvider implements the LLMProvider interface using the Amazon Bedrock
+// Converse and ConverseStream APIs.
+// See: https://docs.aws.amazon.com/bedrock/latest/APIReference/API_runtime_Converse.html
+type bedrockProvider struct {
+	settings BedrockSettings
+	models   *ModelSettings
+	client   *http.Client
+}
+
+func NewBedrockProvider(settings BedrockSettings, models *ModelSettings) (LLMProvider, error) {
+	if settings.Region == "" {
+		return nil, errors.New("bedrock region is required")
+	}
+	client := &http.Client{
+		Transport: providerTransport(settings.retries, &sigV4Transport{
+			base:    outboundTransport(settings.httpTransport),
+			signer:  v4.NewSigner(),
+			service: "bedrock",
+			region:  settings.Region,
+			credentials: aws.Credentials{
+				AccessKeyID:     settings.accessKeyID,
+				SecretAccessKey: settings.secretAccessKey,
+				SessionToken:    settings.sessionToken,
+			},
+		}),
+	}
+	return &bedrockProvider{
+		settings: settings,
+		models:   models,
+		client:   client,
+	}, nil
+}
+
+// sigV4Transport signs outgoing requests with AWS Signature Version 4.
+type sigV4Transport struct {
+	base        http.RoundTripper
+	signer      *v4.Signer
+	service     string
+	region      string
+	credentials aws.Credentials
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request.
+	req = req.Clone(req.Context())
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read request body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	hash := sha256.Sum256(body)
+	if err := t.signer.SignHTTP(req.Context(), t.credentials, req, hex.EncodeToString(hash[:]), t.service, t.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("sign request: %w", err)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (p *bedrockProvider) Models(ctx context.Context) (ModelResponse, error) {
+	return ModelResponse{Data: modelInfos(p.models)}, nil
+}
+
+// endpoint returns the URL of the given operation for the given model.
+func (p *bedrockProvider) endpoint(model, operation string) (*url.URL, error) {
+	base := p.settings.URL
+	if base == "" {
+		base = fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", p.settings.Region)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	// Model IDs and ARNs contain characters such as ':' and '/' which must be
+	// escaped consistently for the signature to match.
+	escaped := strings.ReplaceAll(url.PathEscape(model), ":", "%3A")
+	basePath, baseRawPath := strings.TrimSuffix(u.Path, "/"), strings.TrimSuffix(u.EscapedPath(), "/")
+	u.Path = basePath + "/model/" + model + "/" + operation
+	u.RawPath = baseRawPath + "/model/" + escaped + "/" + operation
+	return u, nil
+}
+
+func (p *bedrockProvider) doRequest(ctx context.Context, req ChatCompletionRequest, operation string) (*http.Response, error) {
+	r := req.ChatCompletionRequest
+	ForceUserMessage(&r)
+	model := req.Model.toBedrock(p.models)
+	log.DefaultLogger.Debug("model", "model", model)
+
+	body, err := openAIRequestToBedrock(r)
+	if err != nil {
+		return nil, err
+	}
+	u, err := p.endpoint(model, operation)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close() //nolint:errcheck
+		return nil, bedrockError(resp)
+	}
+	return resp, nil
+}
+
+func (p *bedrockProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := p.doRequest(ctx, req, "converse")
+	if err != nil {
+		log.DefaultLogger.Error("error creating bedrock chat completion", "err", err)
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var bResp bedrockConverseResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bResp); err != nil {
+		return openai.ChatCompletionResponse{}, fmt.Errorf("decode response: %w", err)
+	}
+	return bedrockResponseToOpenAI(bResp, req.Model.toBedrock(p.models)), nil
+}
+
+func (p *bedrockProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	resp, err := p.doRequest(ctx, req, "converse-stream")
+	if err != nil {
+		log.DefaultLogger.Error("error establishing bedrock stream", "err", err)
+		return nil, err
+	}
+	model := req.Model.toBedrock(p.models)
+
+	c := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer resp.Body.Close() //nolint:errcheck
+		defer close(c)
+
+		id := fmt.Sprintf("chatcmpl-bedrock-%d", time.Now().UnixNano())
+		created := time.Now().Unix()
+		chunk := func(delta openai.ChatCompletionStreamChoiceDelta, finishReason openai.FinishReason) openai.ChatCompletionStreamResponse {
+			return openai.ChatCompletionStreamResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   model,
+				Choices: []openai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: finishReason}},
+			}
+		}
+
+		// Bedrock indexes all content blocks, whereas OpenAI only indexes tool
+		// calls, so map from content block index to tool call index.
+		toolCallIndexes := map[int]int{}
+		decoder := eventStreamDecoder{r: resp.Body}
+		for {
+			msg, err := decoder.Decode()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				log.DefaultLogger.Error("bedrock stream error", "err", err)
+				c <- ChatCompletionStreamResponse{Error: err}
+				return
+			}
+			if msg.Headers[":message-type"] != "event" {
+				c <- ChatCompletionStreamResponse{Error: bedrockStreamException(msg)}
+				return
+			}
+
+			var event bedrockStreamEvent
+			if err := json.Unmarshal(msg.Payload, &event); err != nil {
+				c <- ChatCompletionStreamResponse{Error: fmt.Errorf("decode stream event: %w", err)}
+				return
+			}
+			var out openai.ChatCompletionStreamResponse
+			switch msg.Headers[":event-type"] {
+			case "messageStart":
+				out = chunk(openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant}, "")
+			case "contentBlockStart":
+				if event.Start == nil || event.Start.ToolUse == nil {
+					continue
+				}
+				idx := len(toolCallIndexes)
+				toolCallIndexes[event.ContentBlockIndex] = idx
+				out = chunk(openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{{
+					Index:    &idx,
+					ID:       event.Start.ToolUse.ToolUseID,
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: event.Start.ToolUse.Name},
+				}}}, "")
+			case "contentBlockDelta":
+				switch {
+				case event.Delta == nil:
+					continue
+				case event.Delta.ToolUse != nil:
+					idx := toolCallIndexes[event.ContentBlockIndex]
+					out = chunk(openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{{
+						Index:    &idx,
+						Function: openai.FunctionCall{Arguments: event.Delta.ToolUse.Input},
+					}}}, "")
+				case event.Delta.ReasoningContent != nil:
+					out = chunk(openai.ChatCompletionStreamChoiceDelta{ReasoningContent: event.Delta.ReasoningContent.Text}, "")
+				default:
+					out = chunk(openai.ChatCompletionStreamChoiceDelta{Content: event.Delta.Text}, "")
+				}
+			case "messageStop":
+				out = chunk(openai.ChatCompletionStreamChoiceDelta{}, bedrockStopReasonToOpenAI(event.StopReason))
+			case "metadata":
+				if event.Usage == nil {
+					continue
+				}
+				usage := event.Usage.toOpenAI()
+				out = chunk(openai.ChatCompletionStreamChoiceDelta{}, "")
+				out.Choices = nil
+				out.Usage = &usage
+			default:
+				continue
+			}
+			c <- ChatCompletionStreamResponse{ChatCompletionStreamResponse: out}
+		}
+	}()
+	return c, nil
+}
+
+// Embeddings is not supported by the Bedrock provider.
+func (p *bedrockProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	return openai.EmbeddingResponse{}, errEmbeddingsNotSupported
+}
+
+type bedrockImageBlock struct {
+	Format string `json:"format"`
+	Source struct {
+		Bytes string `json:"bytes"`
+	} `json:"source"`
+}
+
+type bedrockToolUseBlock struct {
+	ToolUseID string          `json:"toolUseId"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+}
+
+type bedrockToolResultBlock struct {
+	ToolUseID string                `json:"toolUseId"`
+	Content   []bedrockContentBlock `json:"content"`
+}
+
+type bedrockReasoningBlock struct {
+	ReasoningText *struct {
+		Text      string `json:"text"`
+		Signature string `json:"signature,omitempty"`
+	} `json:"reasoningText,omitempty"`
+}
+
+type bedrockContentBlock struct {
+	Text             string                  `json:"text,omitempty"`
+	Image            *bedrockImageBlock      `json:"image,omitempty"`
+	ToolUse          *bedrockToolUseBlock    `json:"toolUse,omitempty"`
+	ToolResult       *bedrockToolResultBlock `json:"toolResult,omitempty"`
+	ReasoningContent *bedrockReasoningBlock  `json:"reasoningContent,omitempty"`
+}
+
+type bedrockMessage struct {
+	Role    string                `json:"role"`
+	Content []bedrockContentBlock `json:"content"`
+}
+
+type bedrockInferenceConfig struct {
+	MaxTokens     int      `json:"maxTokens,omitempty"`
+	Temperature   *float32 `json:"temperature,omitempty"`
+	TopP          *float32 `json:"topP,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+}
+
+type bedrockToolSpec struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema struct {
+		JSON any `json:"json"`
+	} `json:"inputSchema"`
+}
+
+type bedrockTool struct {
+	ToolSpec bedrockToolSpec `json:"toolSpec"`
+}
+
+type bedrockToolConfig struct {
+	Tools      []bedrockTool  `json:"tools"`
+	ToolChoice map[string]any `json:"toolChoice,omitempty"`
+}
+
+type bedrockConverseRequest struct {
+	Messages        []bedrockMessage       `json:"messages"`
+	System          []bedrockContentBlock  `json:"system,omitempty"`
+	InferenceConfig bedrockInferenceConfig `json:"inferenceConfig"`
+	ToolConfig      *bedrockToolConfig     `json:"toolConfig,omitempty"`
+}
+
+type bedrockUsage struct {
+	InputTokens          int `json:"inputTokens"`
+	OutputTokens         int `json:"outputTokens"`
+	TotalTokens          int `json:"totalTokens"`
+	CacheReadInputTokens int `json:"cacheReadInputTokens"`
+}
+
+func (u bedrockUsage) toOpenAI() openai.Usage {
+	return openai.Usage{
+		PromptTokens:        u.InputTokens,
+		CompletionTokens:    u.OutputTokens,
+		TotalTokens:         u.TotalTokens,
+		PromptTokensDetails: &openai.PromptTokensDetails{CachedTokens: u.CacheReadInputTokens},
+	}
+}
+
+type bedrockConverseResponse struct {
+	Output struct {
+		Message bedrockMessage `json:"message"`
+	} `json:"output"`
+	StopReason string       `json:"stopReason"`
+	Usage      bedrockUsage `json:"usage"`
+}
+
+// bedrockStreamEvent is the union of the payloads of ConverseStream events.
+type bedrockStreamEvent struct {
+	ContentBlockIndex int `json:"contentBlockIndex"`
+	Start             *struct {
+		ToolUse *struct {
+			ToolUseID string `json:"toolUseId"`
+			Name      string `json:"name"`
+		} `json:"toolUse"`
+	} `json:"start"`
+	Delta *struct {
+		Text    string `json:"text"`
+		ToolUse *struct {
+			Input string `json:"input"`
+		} `json:"toolUse"`
+		ReasoningContent *struct {
+			Text string `json:"text"`
+		} `json:"reasoningContent"`
+	} `json:"delta"`
+	StopReason string        `json:"stopReason"`
+	Usage      *bedrockUsage `json:"usage"`
+}
+
+// openAIRequestToBedrock translates an OpenAI chat completion request into a
+// Bedrock Converse request. System messages are extracted into the system
+// prompt, tool results are sent as user messages, and consecutive messages with
+// the same role are merged since Converse requires alternating roles.
+func openAIRequestToBedrock(r openai.ChatCompletionRequest) (bedrockConverseRequest, error) {
+	var req bedrockConverseRequest
+	appendBlocks := func(role string, blocks []bedrockContentBlock) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == role {
+			req.Messages[n-1].Content = append(req.Messages[n-1].Content, blocks...)
+			return
+		}
+		req.Messages = append(req.Messages, bedrockMessage{Role: role, Content: blocks})
+	}
+
+	for _, m := range r.Messages {
+		switch m.Role {
+		case openai.ChatMessageRoleSystem, openai.ChatMessageRoleDeveloper:
+			blocks, err := openAIContentToBedrock(m)
+			if err != nil {
+				return bedrockConverseRequest{}, err
+			}
+			req.System = append(req.System, blocks...)
+		case openai.ChatMessageRoleUser:
+			blocks, err := openAIContentToBedrock(m)
+			if err != nil {
+				return bedrockConverseRequest{}, err
+			}
+			appendBlocks("user", blocks)
+		case openai.ChatMessageRoleAssistant:
+			blocks, err := openAIContentToBedrock(m)
+			if err != nil {
+				return bedrockConverseRequest{}, err
+			}
+			for _, tc := range m.ToolCalls {
+				input := json.RawMessage(tc.Function.Arguments)
+				if len(strings.TrimSpace(tc.Function.Arguments)) == 0 {
+					input = json.RawMessage("{}")
+				}
+				if !json.Valid(input) {
+					return bedrockConverseRequest{}, fmt.Errorf("%w: invalid tool call arguments for %s", errBadRequest, tc.Function.Name)
+				}
+				blocks = append(blocks, bedrockContentBlock{ToolUse: &bedrockToolUseBlock{
+					ToolUseID: tc.ID,
+					Name:      tc.Function.Name,
+					Input:     input,
+				}})
+			}
+			appendBlocks("assistant", blocks)
+		case openai.ChatMessageRoleTool:
+			appendBlocks("user", []bedrockContentBlock{{ToolResult: &bedrockToolResultBlock{
+				ToolUseID: m.ToolCallID,
+				Content:   []bedrockContentBlock{{Text: m.Content}},
+			}}})
+		default:
+			return bedrockConverseRequest{}, fmt.Errorf("%w: unsupported message role: %s", errBadRequest, m.Role)
+		}
+	}
+
+	// Converse has no tool choice forbidding tool use, so the tools are left
+	// out instead. It requires them to be defined if the conversation already
+	// has tool calls though, so such requests can't be served.
+	if r.ToolChoice == "none" {
+		for _, m := range r.Messages {
+			if len(m.ToolCalls) > 0 || m.Role == openai.ChatMessageRoleTool {
+				return bedrockConverseRequest{}, fmt.Errorf("%w: tool choice none is not supported for conversations with tool calls", errBadRequest)
+			}
+		}
+	}
+	if len(r.Tools) > 0 && r.ToolChoice != "none" {
+		cfg := bedrockToolConfig{}
+		for _, t := range r.Tools {
+			if t.Type != openai.ToolTypeFunction || t.Function == nil {
+				return bedrockConverseRequest{}, fmt.Errorf("%w: unsupported tool type: %s", errBadRequest, t.Type)
+			}
+			spec := bedrockToolSpec{Name: t.Function.Name, Description: t.Function.Description}
+			spec.InputSchema.JSON = t.Function.Parameters
+			if spec.InputSchema.JSON == nil {
+				spec.InputSchema.JSON = map[string]any{"type": "object"}
+			}
+			cfg.Tools = append(cfg.Tools, bedrockTool{ToolSpec: spec})
+		}
+		if r.ToolChoice != nil {
+			choice, err := openAIToolChoiceToBedrock(r.ToolChoice)
+			if err != nil {
+				return bedrockConverseRequest{}, err
+			}
+			cfg.ToolChoice = choice
+		}
+		req.ToolConfig = &cfg
+	}
+
+	req.InferenceConfig = bedrockInferenceConfig{
+		MaxTokens:     r.MaxCompletionTokens,
+		StopSequences: r.Stop,
+	}
+	if req.InferenceConfig.MaxTokens == 0 {
+		req.InferenceConfig.MaxTokens = r.MaxTokens
+	}
+	if r.Temperature != 0 {
+		req.InferenceConfig.Temperature = &r.Temperature
+	}
+	if r.TopP != 0 {
+		req.InferenceConfig.TopP = &r.TopP
+	}
+	return req, nil
+}
+
+// openAIContentToBedrock converts the text and image content of an OpenAI
+// message into Bedrock content blocks.
+func openAIContentToBedrock(m openai.ChatCompletionMessage) ([]bedrockContentBlock, error) {
+	var blocks []bedrockContentBlock
+	if m.Content != "" {
+		blocks = append(blocks, bedrockContentBlock{Text: m.Content})
+	}
+	for _, part := range m.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			if part.Text != "" {
+				blocks = append(blocks, bedrockContentBlock{Text: part.Text})
+			}
+		case openai.ChatMessagePartTypeImageURL:
+			if part.ImageURL == nil {
+				continue
+			}
+			// Converse only accepts inline image bytes.
+			mediaType, data, err := parseImageDataURL(part.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+				return nil, fmt.Errorf("%w: invalid image data: %s", errBadRequest, err)
+			}
+			image := &bedrockImageBlock{Format: strings.TrimPrefix(mediaType, "image/")}
+			image.Source.Bytes = data
+			blocks = append(blocks, bedrockContentBlock{Image: image})
+		}
+	}
+	return blocks, nil
+}
+
+// openAIToolChoiceToBedrock converts an OpenAI tool choice, which is either a
+// string or a tool choice object, to a Bedrock tool choice. Converse has no
+// equivalent of "none", which callers must handle by leaving out the tools.
+func openAIToolChoiceToBedrock(choice any) (map[string]any, error) {
+	switch c := choice.(type) {
+	case string:
+		switch c {
+		case "auto":
+			return map[string]any{"auto": map[string]any{}}, nil
+		case "required":
+			return map[string]any{"any": map[string]any{}}, nil
+		}
+		return nil, fmt.Errorf("%w: unsupported tool choice: %s", errBadRequest, c)
+	default:
+		b, err := json.Marshal(choice)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid tool choice: %s", errBadRequest, err)
+		}
+		var tc openai.ToolChoice
+		if err := json.Unmarshal(b, &tc); err != nil || tc.Function.Name == "" {
+			return nil, fmt.Errorf("%w: invalid tool choice: %s", errBadRequest, string(b))
+		}
+		return map[string]any{"tool": map[string]any{"name": tc.Function.Name}}, nil
+	}
+}
+
+// bedrockResponseToOpenAI converts a Converse response to an OpenAI chat completion response.
+func bedrockResponseToOpenAI(resp bedrockConverseResponse, model string) openai.ChatCompletionResponse {
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	var content, reasoning strings.Builder
+	for _, block := range resp.Output.Message.Content {
+		switch {
+		case block.ToolUse != nil:
+			args := string(block.ToolUse.Input)
+			if args == "" {
+				args = "{}"
+			}
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:       block.ToolUse.ToolUseID,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: block.ToolUse.Name, Arguments: args},
+			})
+		case block.ReasoningContent != nil && block.ReasoningContent.ReasoningText != nil:
+			reasoning.WriteString(block.ReasoningContent.ReasoningText.Text)
+		default:
+			content.WriteString(block.Text)
+		}
+	}
+	message.Content = content.String()
+	message.ReasoningContent = reasoning.String()
+	return openai.ChatCompletionResponse{
+		ID:      fmt.Sprintf("chatcmpl-bedrock-%d", time.Now().UnixNano()),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      message,
+			FinishReason: bedrockStopReasonToOpenAI(resp.StopReason),
+		}},
+		Usage: resp.Usage.toOpenAI(),
+	}
+}
+
+func bedrockStopReasonToOpenAI(reason string) openai.FinishReason {
+	switch reason {
+	case "end_turn", "stop_sequence":
+		return openai.FinishReasonStop
+	case "max_tokens":
+		return openai.FinishReasonLength
+	case "tool_use":
+		return openai.FinishReasonToolCalls
+	case "guardrail_intervened", "content_filtered":
+		return openai.FinishReasonContentFilter
+	}
+	return openai.FinishReasonStop
+}
+
+// bedrockError converts a non-2xx Bedrock response into an OpenAI API error so
+// it is reported to clients in the same way as other providers' errors.
+func bedrockError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	body := struct {
+		Message string `json:"message"`
+	}{}
+	message := string(b)
+	if json.Unmarshal(b, &body) == nil && body.Message != "" {
+		message = body.Message
+	}
+	// The error type may be suffixed with extra information after a colon.
+	errorType, _, _ := strings.Cut(resp.Header.Get("X-Amzn-ErrorType"), ":")
+	return &openai.APIError{
+		Code:           errorType,
+		Message:        message,
+		Type:           errorType,
+		HTTPStatusCode: resp.StatusCode,
+	}
+}
+
+// bedrockStreamException converts an exception received in the middle of a
+// ConverseStream response into an OpenAI API error.
+func bedrockStreamException(msg eventStreamMessage) error {
+	errorType := msg.Headers[":exception-type"]
+	if errorType == "" {
+		errorType = msg.Headers[":error-code"]
+	}
+	body := struct {
+		Message string `json:"message"`
+	}{}
+	message := string(msg.Payload)
+	if json.Unmarshal(msg.Payload, &body) == nil && body.Message != "" {
+		message = body.Message
+	}
+	if m := msg.Headers[":error-message"]; m != "" {
+		message = m
+	}
+	status := http.StatusInternalServerError
+	switch errorType {
+	case "throttlingException":
+		status = http.StatusTooManyRequests
+	case "validationException":
+		status = http.StatusBadRequest
+	case "serviceUnavailableException":
+		status = http.StatusServiceUnavailable
+	case "modelStreamErrorException":
+		status = http.StatusFailedDependency
+	}
+	return &openai.APIError{
+		Code:           errorType,
+		Message:        message,
+		Type:           errorType,
+		HTTPStatusCode: status,
+	}
+}
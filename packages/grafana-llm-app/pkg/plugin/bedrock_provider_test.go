@@ -0,0 +1,353 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeEventStreamMessage encodes a message with string headers using the AWS
+// event stream encoding.
+func encodeEventStreamMessage(headers map[string]string, payload string) []byte {
+	var h bytes.Buffer
+	for name, value := range headers {
+		h.WriteByte(byte(len(name)))
+		h.WriteString(name)
+		h.WriteByte(7)
+		_ = binary.Write(&h, binary.BigEndian, uint16(len(value)))
+		h.WriteString(value)
+	}
+	totalLen := uint32(eventStreamPreludeLen + h.Len() + len(payload) + eventStreamCRCLen)
+
+	var msg bytes.Buffer
+	_ = binary.Write(&msg, binary.BigEndian, totalLen)
+	_ = binary.Write(&msg, binary.BigEndian, uint32(h.Len()))
+	_ = binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()))
+	msg.Write(h.Bytes())
+	msg.WriteString(payload)
+	_ = binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()))
+	return msg.Bytes()
+}
+
+func bedrockEvent(eventType, payload string) []byte {
+	return encodeEventStreamMessage(map[string]string{
+		":message-type": "event",
+		":event-type":   eventType,
+		":content-type": "application/json",
+	}, payload)
+}
+
+// newMockBedrockServer returns a local stand-in for the Bedrock runtime API which
+// checks requests are signed, captures the request body and responds with the
+// given body.
+func newMockBedrockServer(t *testing.T, path string, status int, contentType string, body []byte, captured *map[string]any) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, path, r.URL.EscapedPath())
+		auth := r.Header.Get("Authorization")
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDTEST/"), auth)
+		assert.Contains(t, auth, "/us-west-2/bedrock/aws4_request")
+		assert.NotEmpty(t, r.Header.Get("X-Amz-Date"))
+		assert.Equal(t, "session-token", r.Header.Get("X-Amz-Security-Token"))
+		if captured != nil {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(captured))
+		}
+		w.Header().Set("Content-Type", contentType)
+		if status != http.StatusOK {
+			w.Header().Set("X-Amzn-ErrorType", "ThrottlingException:http://internal.amazon.com/coral/com.amazon.bedrock/")
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	}))
+}
+
+func newTestBedrockProvider(t *testing.T, url string) LLMProvider {
+	t.Helper()
+	provider, err := createProvider(&Settings{
+		Provider: ProviderTypeBedrock,
+		Bedrock: BedrockSettings{
+			Region:          "us-west-2",
+			URL:             url,
+			accessKeyID:     "AKIDTEST",
+			secretAccessKey: "secret",
+			sessionToken:    "session-token",
+		},
+	})
+	require.NoError(t, err)
+	require.IsType(t, &bedrockProvider{}, provider)
+	return provider
+}
+
+func TestBedrockProvider_ChatCompletion(t *testing.T) {
+	var captured map[string]any
+	server := newMockBedrockServer(t, "/model/us.anthropic.claude-sonnet-4-20250514-v1%3A0/converse", http.StatusOK, "application/json", []byte(`{
+		"output": {
+			"message": {
+				"role": "assistant",
+				"content": [
+					{"reasoningContent": {"reasoningText": {"text": "Let me check.", "signature": "sig"}}},
+					{"text": "Checking the weather."},
+					{"toolUse": {"toolUseId": "tooluse_1", "name": "get_weather", "input": {"city": "London"}}}
+				]
+			}
+		},
+		"stopReason": "tool_use",
+		"usage": {"inputTokens": 10, "outputTokens": 7, "totalTokens": 17}
+	}`), &captured)
+	defer server.Close()
+
+	provider := newTestBedrockProvider(t, server.URL)
+
+	resp, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model: ModelLarge,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: "You are helpful."},
+				{Role: openai.ChatMessageRoleUser, Content: "What's the weather in Paris?"},
+				{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{
+					ID:       "tooluse_0",
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+				}}},
+				{Role: openai.ChatMessageRoleTool, ToolCallID: "tooluse_0", Content: "sunny"},
+				{Role: openai.ChatMessageRoleUser, Content: "And London?"},
+			},
+			Tools: []openai.Tool{{
+				Type: openai.ToolTypeFunction,
+				Function: &openai.FunctionDefinition{
+					Name:        "get_weather",
+					Description: "Get the weather",
+					Parameters: map[string]any{
+						"type":       "object",
+						"properties": map[string]any{"city": map[string]any{"type": "string"}},
+					},
+				},
+			}},
+			ToolChoice: openai.ToolChoice{Type: openai.ToolTypeFunction, Function: openai.ToolFunction{Name: "get_weather"}},
+			MaxTokens:  100,
+		},
+	})
+	require.NoError(t, err)
+
+	// Check the request was translated correctly.
+	assert.Equal(t, []any{map[string]any{"text": "You are helpful."}}, captured["system"])
+	messages := captured["messages"].([]any)
+	require.Len(t, messages, 3)
+	assert.Equal(t, map[string]any{
+		"role": "assistant",
+		"content": []any{map[string]any{"toolUse": map[string]any{
+			"toolUseId": "tooluse_0",
+			"name":      "get_weather",
+			"input":     map[string]any{"city": "Paris"},
+		}}},
+	}, messages[1])
+	assert.Equal(t, map[string]any{
+		"role": "user",
+		"content": []any{
+			map[string]any{"toolResult": map[string]any{
+				"toolUseId": "tooluse_0",
+				"content":   []any{map[string]any{"text": "sunny"}},
+			}},
+			map[string]any{"text": "And London?"},
+		},
+	}, messages[2])
+	toolConfig := captured["toolConfig"].(map[string]any)
+	assert.Equal(t, map[string]any{"tool": map[string]any{"name": "get_weather"}}, toolConfig["toolChoice"])
+	assert.Len(t, toolConfig["tools"], 1)
+	assert.Equal(t, map[string]any{"maxTokens": float64(100)}, captured["inferenceConfig"])
+
+	// Check the response was translated correctly.
+	require.Len(t, resp.Choices, 1)
+	choice := resp.Choices[0]
+	assert.Equal(t, openai.FinishReasonToolCalls, choice.FinishReason)
+	assert.Equal(t, "Checking the weather.", choice.Message.Content)
+	assert.Equal(t, "Let me check.", choice.Message.ReasoningContent)
+	require.Len(t, choice.Message.ToolCalls, 1)
+	assert.Equal(t, "tooluse_1", choice.Message.ToolCalls[0].ID)
+	assert.JSONEq(t, `{"city":"London"}`, choice.Message.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, 17, resp.Usage.TotalTokens)
+}
+
+func TestOpenAIRequestToBedrock_ToolChoiceNone(t *testing.T) {
+	tools := []openai.Tool{{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{Name: "get_weather"}}}
+	req, err := openAIRequestToBedrock(openai.ChatCompletionRequest{
+		Messages:   []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "What's the weather in Paris?"}},
+		Tools:      tools,
+		ToolChoice: "none",
+	})
+	require.NoError(t, err)
+	assert.Nil(t, req.ToolConfig, "tools should be left out so that the model can't call them")
+
+	// Converse requires tools to be defined for conversations with tool calls.
+	_, err = openAIRequestToBedrock(openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: "What's the weather in Paris?"},
+			{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{
+				ID:       "tooluse_0",
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: "get_weather", Arguments: `{}`},
+			}}},
+			{Role: openai.ChatMessageRoleTool, ToolCallID: "tooluse_0", Content: "sunny"},
+		},
+		Tools:      tools,
+		ToolChoice: "none",
+	})
+	require.ErrorIs(t, err, errBadRequest)
+}
+
+func TestBedrockProvider_ChatCompletionStream(t *testing.T) {
+	var body bytes.Buffer
+	body.Write(bedrockEvent("messageStart", `{"role": "assistant"}`))
+	body.Write(bedrockEvent("contentBlockDelta", `{"contentBlockIndex": 0, "delta": {"text": "Hello"}}`))
+	body.Write(bedrockEvent("contentBlockStop", `{"contentBlockIndex": 0}`))
+	body.Write(bedrockEvent("contentBlockStart", `{"contentBlockIndex": 1, "start": {"toolUse": {"toolUseId": "tooluse_1", "name": "get_weather"}}}`))
+	body.Write(bedrockEvent("contentBlockDelta", `{"contentBlockIndex": 1, "delta": {"toolUse": {"input": "{\"city\":"}}}`))
+	body.Write(bedrockEvent("contentBlockDelta", `{"contentBlockIndex": 1, "delta": {"toolUse": {"input": "\"London\"}"}}}`))
+	body.Write(bedrockEvent("contentBlockStop", `{"contentBlockIndex": 1}`))
+	body.Write(bedrockEvent("messageStop", `{"stopReason": "tool_use"}`))
+	body.Write(bedrockEvent("metadata", `{"usage": {"inputTokens": 5, "outputTokens": 2, "totalTokens": 7}, "metrics": {"latencyMs": 100}}`))
+
+	server := newMockBedrockServer(t, "/model/us.anthropic.claude-3-5-haiku-20241022-v1%3A0/converse-stream", http.StatusOK, "application/vnd.amazon.eventstream", body.Bytes(), nil)
+	defer server.Close()
+
+	provider := newTestBedrockProvider(t, server.URL)
+
+	stream, err := provider.ChatCompletionStream(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		},
+	})
+	require.NoError(t, err)
+
+	var chunks []openai.ChatCompletionStreamResponse
+	for resp := range stream {
+		require.NoError(t, resp.Error)
+		chunks = append(chunks, resp.ChatCompletionStreamResponse)
+	}
+	require.Len(t, chunks, 7)
+
+	assert.Equal(t, openai.ChatMessageRoleAssistant, chunks[0].Choices[0].Delta.Role)
+	assert.Equal(t, "Hello", chunks[1].Choices[0].Delta.Content)
+
+	toolCall := chunks[2].Choices[0].Delta.ToolCalls[0]
+	require.NotNil(t, toolCall.Index)
+	assert.Equal(t, 0, *toolCall.Index)
+	assert.Equal(t, "tooluse_1", toolCall.ID)
+	assert.Equal(t, "get_weather", toolCall.Function.Name)
+	args := chunks[3].Choices[0].Delta.ToolCalls[0].Function.Arguments + chunks[4].Choices[0].Delta.ToolCalls[0].Function.Arguments
+	assert.JSONEq(t, `{"city":"London"}`, args)
+	assert.Equal(t, 0, *chunks[4].Choices[0].Delta.ToolCalls[0].Index)
+
+	assert.Equal(t, openai.FinishReasonToolCalls, chunks[5].Choices[0].FinishReason)
+	require.NotNil(t, chunks[6].Usage)
+	assert.Equal(t, 7, chunks[6].Usage.TotalTokens)
+}
+
+func TestBedrockProvider_StreamException(t *testing.T) {
+	var body bytes.Buffer
+	body.Write(bedrockEvent("messageStart", `{"role": "assistant"}`))
+	body.Write(encodeEventStreamMessage(map[string]string{
+		":message-type":   "exception",
+		":exception-type": "throttlingException",
+	}, `{"message": "Too many requests"}`))
+
+	server := newMockBedrockServer(t, "/model/us.anthropic.claude-3-5-haiku-20241022-v1%3A0/converse-stream", http.StatusOK, "application/vnd.amazon.eventstream", body.Bytes(), nil)
+	defer server.Close()
+
+	provider := newTestBedrockProvider(t, server.URL)
+
+	stream, err := provider.ChatCompletionStream(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		},
+	})
+	require.NoError(t, err)
+
+	var lastErr error
+	for resp := range stream {
+		if resp.Error != nil {
+			lastErr = resp.Error
+		}
+	}
+	var apiErr *openai.APIError
+	require.ErrorAs(t, lastErr, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.HTTPStatusCode)
+	assert.Equal(t, "Too many requests", apiErr.Message)
+}
+
+func TestBedrockProvider_ErrorHandling(t *testing.T) {
+	server := newMockBedrockServer(t, "/model/us.anthropic.claude-3-5-haiku-20241022-v1%3A0/converse", http.StatusTooManyRequests, "application/json",
+		[]byte(`{"message": "Too many requests, please wait before trying again."}`), nil)
+	defer server.Close()
+
+	provider := newTestBedrockProvider(t, server.URL)
+
+	_, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		},
+	})
+	var apiErr *openai.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.HTTPStatusCode)
+	assert.Equal(t, "ThrottlingException", apiErr.Type)
+	assert.Equal(t, "Too many requests, please wait before trying again.", apiErr.Message)
+}
+
+func TestEventStreamDecoder(t *testing.T) {
+	t.Run("decodes messages", func(t *testing.T) {
+		msg := bedrockEvent("messageStart", `{"role": "assistant"}`)
+		d := eventStreamDecoder{r: bytes.NewReader(msg)}
+		got, err := d.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, "messageStart", got.Headers[":event-type"])
+		assert.Equal(t, `{"role": "assistant"}`, string(got.Payload))
+	})
+
+	t.Run("rejects corrupt messages", func(t *testing.T) {
+		msg := bedrockEvent("messageStart", `{"role": "assistant"}`)
+		msg[len(msg)-5] ^= 0xff
+		d := eventStreamDecoder{r: bytes.NewReader(msg)}
+		_, err := d.Decode()
+		require.ErrorContains(t, err, "checksum")
+	})
+
+	t.Run("rejects truncated messages", func(t *testing.T) {
+		msg := bedrockEvent("messageStart", `{"role": "assistant"}`)
+		d := eventStreamDecoder{r: bytes.NewReader(msg[:len(msg)-3])}
+		_, err := d.Decode()
+		require.Error(t, err)
+	})
+}
+
+func TestBedrockSettings_Configured(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		settings BedrockSettings
+		expected bool
+	}{
+		{"empty", BedrockSettings{}, false},
+		{"no region", BedrockSettings{accessKeyID: "id", secretAccessKey: "secret"}, false},
+		{"no secret", BedrockSettings{Region: "us-east-1", accessKeyID: "id"}, false},
+		{"configured", BedrockSettings{Region: "us-east-1", accessKeyID: "id", secretAccessKey: "secret"}, true},
+	} {
+		t.Run(fmt.Sprint(tc.name), func(t *testing.T) {
+			s := Settings{Provider: ProviderTypeBedrock, Bedrock: tc.settings}
+			assert.Equal(t, tc.expected, s.Configured())
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// ResponseCache is a backend for storing cached chat completions responses.
+// Implementations must be safe for concurrent use.
+type ResponseCache interface {
+	// Get returns the value stored for key, and whether one was found.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value for key until ttl has elapsed.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// newResponseCache creates the cache backend configured in settings.
+func newResponseCache(settings CacheSettings) ResponseCache {
+	// loadSettings only allows supported backends, of which there is currently
+	// just the in-memory one.
+	return newMemoryCache(settings.MaxEntries)
+}
+
+// memoryCache is an in-memory ResponseCache holding up to maxEntries values,
+// evicting the least recently used when full.
+type memoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	// entries holds *memoryCacheEntry values, most recently used first.
+	entries *list.List
+	keys    map[string]*list.Element
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryCache(maxEntries int) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		entries:    list.New(),
+		keys:       map[string]*list.Element{},
+		now:        time.Now,
+	}
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.keys[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := el.Value.(*memoryCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(el)
+		return nil, false, nil
+	}
+	c.entries.MoveToFront(el)
+	return entry.value, true, nil
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(ttl)
+	if el, ok := c.keys[key]; ok {
+		entry := el.Value.(*memoryCacheEntry)
+		entry.value, entry.expires = value, expires
+		c.entries.MoveToFront(el)
+		return nil
+	}
+	c.keys[key] = c.entries.PushFront(&memoryCacheEntry{key: key, value: value, expires: expires})
+	for c.entries.Len() > c.maxEntries {
+		c.remove(c.entries.Back())
+	}
+	return nil
+}
+
+func (c *memoryCache) remove(el *list.Element) {
+	c.entries.Remove(el)
+	delete(c.keys, el.Value.(*memoryCacheEntry).key)
+}
+
+// cachedResponse is the value stored in the cache for a chat completions request.
+type cachedResponse struct {
+	Provider ProviderType                  `json:"provider"`
+	Response openai.ChatCompletionResponse `json:"response"`
+}
+
+// cachingProvider wraps an LLMProvider, serving chat completions requests from
+// a ResponseCache where possible, falling back to the semantic cache if one is
+// configured. Models and Embeddings are passed through to the wrapped provider.
+type cachingProvider struct {
+	LLMProvider
+	cache    ResponseCache
+	semantic *semanticCache
+	settings *Settings
+	// metrics counts cache hits and misses, if set.
+	metrics *metrics
+}
+
+func newCachingProvider(provider LLMProvider, cache ResponseCache, semantic *semanticCache, settings *Settings) *cachingProvider {
+	return &cachingProvider{LLMProvider: provider, cache: cache, semantic: semantic, settings: settings}
+}
+
+// cacheKey returns the key identifying a request in the cache, and whether the
+// request can be cached at all. Only deterministic requests, those with a
+// temperature of 0, are cached unless the caller opts in.
+//
+// The key is a hash of the request along with the provider and model it will
+// be sent to, excluding fields which don't affect the response such as whether
+// it is streamed. Stream and non-stream requests therefore share cached
+// responses.
+func (p *cachingProvider) cacheKey(req ChatCompletionRequest) (string, bool) {
+	if !cacheable(req) {
+		return "", false
+	}
+	provider, model := p.settings.resolvedModel(req.Model)
+	sum, err := requestHash(provider, model, normalizedRequest(req))
+	if err != nil {
+		return "", false
+	}
+	return "chat:" + sum, true
+}
+
+// cacheable reports whether the response to a request may be cached.
+func cacheable(req ChatCompletionRequest) bool {
+	return req.Temperature == math.SmallestNonzeroFloat32 || req.GrafanaCache
+}
+
+// normalizedRequest returns the parts of a request which affect the response.
+func normalizedRequest(req ChatCompletionRequest) openai.ChatCompletionRequest {
+	r := req.ChatCompletionRequest
+	r.Model = ""
+	r.Stream = false
+	r.StreamOptions = nil
+	r.User = ""
+	r.Store = false
+	r.Metadata = nil
+	return r
+}
+
+// requestHash returns a hex encoded hash of a request along with the provider
+// and model it will be sent to.
+func requestHash(provider ProviderType, model string, r openai.ChatCompletionRequest) (string, error) {
+	b, err := json.Marshal(struct {
+		Provider ProviderType                 `json:"provider"`
+		Model    string                       `json:"model"`
+		Request  openai.ChatCompletionRequest `json:"request"`
+	}{provider, model, r})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (p *cachingProvider) get(ctx context.Context, key string) (cachedResponse, bool) {
+	b, ok, err := p.cache.Get(ctx, key)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to read from response cache", "err", err)
+		return cachedResponse{}, false
+	}
+	if !ok {
+		return cachedResponse{}, false
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal(b, &cached); err != nil {
+		log.DefaultLogger.Warn("Ignoring invalid response cache entry", "err", err)
+		return cachedResponse{}, false
+	}
+	return cached, true
+}
+
+func (p *cachingProvider) set(ctx context.Context, key string, cached cachedResponse) {
+	b, err := json.Marshal(cached)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to encode response for cache", "err", err)
+		return
+	}
+	ttl := time.Duration(p.settings.Cache.TTLSeconds) * time.Second
+	if err := p.cache.Set(ctx, key, b, ttl); err != nil {
+		log.DefaultLogger.Warn("Failed to write to response cache", "err", err)
+	}
+}
+
+func (p *cachingProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	key, ok := p.cacheKey(req)
+	if !ok {
+		return p.LLMProvider.ChatCompletion(ctx, req)
+	}
+	md := responseMetadataFromContext(ctx)
+	sq, cached, ok := p.lookup(ctx, key, req)
+	if ok {
+		return cached.Response, nil
+	}
+	resp, err := p.LLMProvider.ChatCompletion(ctx, req)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	p.save(ctx, key, sq, cachedResponse{Provider: md.Provider(), Response: resp})
+	return resp, nil
+}
+
+// lookup looks a request up in the response cache and then the semantic
+// cache, recording the outcome in the response metadata. If the request
+// missed, the returned query can be passed to save so that the semantic cache
+// doesn't need to embed the request again.
+func (p *cachingProvider) lookup(ctx context.Context, key string, req ChatCompletionRequest) (*semanticQuery, cachedResponse, bool) {
+	md := responseMetadataFromContext(ctx)
+	if cached, ok := p.get(ctx, key); ok {
+		md.setProvider(cached.Provider)
+		md.setCache(cacheHit)
+		p.metrics.observeCache(cacheHit)
+		return nil, cached, true
+	}
+	var sq *semanticQuery
+	if p.semantic != nil {
+		provider, model := p.settings.resolvedModel(req.Model)
+		sq = p.semantic.query(ctx, p.settings.Tenant, provider, model, req)
+		if cached, ok := p.semantic.get(ctx, sq); ok {
+			md.setProvider(cached.Provider)
+			md.setCache(cacheSemanticHit)
+			p.metrics.observeCache(cacheSemanticHit)
+			return nil, cached, true
+		}
+	}
+	md.setCache(cacheMiss)
+	p.metrics.observeCache(cacheMiss)
+	return sq, cachedResponse{}, false
+}
+
+// save stores a response in the response cache and, if sq is non-nil, the
+// semantic cache.
+func (p *cachingProvider) save(ctx context.Context, key string, sq *semanticQuery, cached cachedResponse) {
+	p.set(ctx, key, cached)
+	if sq != nil {
+		p.semantic.set(ctx, sq, cached)
+	}
+}
+
+// ChatCompletionStream replays cached responses as a single chunk. Otherwise
+// the stream is passed through, and cached once it has completed successfully.
+func (p *cachingProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	key, ok := p.cacheKey(req)
+	if !ok {
+		return p.LLMProvider.ChatCompletionStream(ctx, req)
+	}
+	md := responseMetadataFromContext(ctx)
+	sq, cached, ok := p.lookup(ctx, key, req)
+	if ok {
+		c := make(chan ChatCompletionStreamResponse, 1)
+		c <- streamResponseFromChatCompletion(cached.Response)
+		close(c)
+		return c, nil
+	}
+	c, err := p.LLMProvider.ChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		var acc streamAccumulator
+		failed := false
+		for resp := range c {
+			if resp.Error != nil {
+				failed = true
+			} else {
+				acc.add(resp.ChatCompletionStreamResponse)
+			}
+			if !forwardStreamResponse(ctx, out, resp, c) {
+				failed = true
+				break
+			}
+		}
+		if !failed && acc.complete() {
+			// Use a context which outlives the request, which may already
+			// have finished once the last chunk has been sent.
+			p.save(context.WithoutCancel(ctx), key, sq, cachedResponse{Provider: md.Provider(), Response: acc.resp})
+		}
+	}()
+	return out, nil
+}
+
+// streamAccumulator builds a complete chat completions response from the
+// chunks of a stream.
+type streamAccumulator struct {
+	resp openai.ChatCompletionResponse
+}
+
+func (a *streamAccumulator) add(chunk openai.ChatCompletionStreamResponse) {
+	if a.resp.ID == "" {
+		a.resp.ID = chunk.ID
+		a.resp.Object = "chat.completion"
+		a.resp.Created = chunk.Created
+		a.resp.Model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		a.resp.Usage = *chunk.Usage
+	}
+	for _, c := range chunk.Choices {
+		for len(a.resp.Choices) <= c.Index {
+			a.resp.Choices = append(a.resp.Choices, openai.ChatCompletionChoice{Index: len(a.resp.Choices)})
+		}
+		choice := &a.resp.Choices[c.Index]
+		if c.Delta.Role != "" {
+			choice.Message.Role = c.Delta.Role
+		}
+		choice.Message.Content += c.Delta.Content
+		choice.Message.ReasoningContent += c.Delta.ReasoningContent
+		for _, tc := range c.Delta.ToolCalls {
+			i := len(choice.Message.ToolCalls)
+			if tc.Index != nil {
+				i = *tc.Index
+			}
+			for len(choice.Message.ToolCalls) <= i {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, openai.ToolCall{})
+			}
+			call := &choice.Message.ToolCalls[i]
+			if tc.ID != "" {
+				call.ID = tc.ID
+			}
+			if tc.Type != "" {
+				call.Type = tc.Type
+			}
+			if tc.Function.Name != "" {
+				call.Function.Name = tc.Function.Name
+			}
+			call.Function.Arguments += tc.Function.Arguments
+		}
+		if c.FinishReason != "" {
+			choice.FinishReason = c.FinishReason
+		}
+	}
+}
+
+// complete reports whether every choice in the stream has finished.
+func (a *streamAccumulator) complete() bool {
+	if len(a.resp.Choices) == 0 {
+		return false
+	}
+	for _, c := range a.resp.Choices {
+		if c.FinishReason == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,278 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newMemoryCache(2)
+	c.now = func() time.Time { return now }
+
+	require.NoError(t, c.Set(ctx, "a", []byte("1"), time.Minute))
+	require.NoError(t, c.Set(ctx, "b", []byte("2"), time.Hour))
+	v, ok, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), v)
+
+	// "b" is now the least recently used, so it is evicted.
+	require.NoError(t, c.Set(ctx, "c", []byte("3"), time.Hour))
+	_, ok, _ = c.Get(ctx, "b")
+	assert.False(t, ok, "least recently used entry should be evicted")
+	_, ok, _ = c.Get(ctx, "c")
+	assert.True(t, ok)
+
+	now = now.Add(2 * time.Minute)
+	_, ok, _ = c.Get(ctx, "a")
+	assert.False(t, ok, "expired entry should not be returned")
+	_, ok, _ = c.Get(ctx, "c")
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.entries.Len())
+}
+
+func cacheTestRequest(content string, temperature float32) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages:    []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: content}},
+			Temperature: temperature,
+		},
+	}
+}
+
+func newCacheTestSettings() *Settings {
+	return &Settings{
+		Provider: ProviderTypeOpenAI,
+		Models:   defaultModelSettings(ProviderTypeOpenAI),
+		Cache:    CacheSettings{Enabled: true, TTLSeconds: 60, MaxEntries: 10},
+	}
+}
+
+func TestCachingProvider_CacheKey(t *testing.T) {
+	p := newCachingProvider(&fakeBackend{}, newMemoryCache(10), nil, newCacheTestSettings())
+
+	key, ok := p.cacheKey(cacheTestRequest("hi", math.SmallestNonzeroFloat32))
+	require.True(t, ok)
+
+	streamed := cacheTestRequest("hi", math.SmallestNonzeroFloat32)
+	streamed.Stream = true
+	streamed.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	streamKey, _ := p.cacheKey(streamed)
+	assert.Equal(t, key, streamKey, "streaming should not affect the key")
+
+	otherMessage, _ := p.cacheKey(cacheTestRequest("hello", math.SmallestNonzeroFloat32))
+	assert.NotEqual(t, key, otherMessage)
+
+	withTools := cacheTestRequest("hi", math.SmallestNonzeroFloat32)
+	withTools.Tools = []openai.Tool{{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{Name: "f"}}}
+	toolsKey, _ := p.cacheKey(withTools)
+	assert.NotEqual(t, key, toolsKey)
+
+	large := cacheTestRequest("hi", math.SmallestNonzeroFloat32)
+	large.Model = ModelLarge
+	largeKey, _ := p.cacheKey(large)
+	assert.NotEqual(t, key, largeKey)
+
+	_, ok = p.cacheKey(cacheTestRequest("hi", 0.7))
+	assert.False(t, ok, "non-zero temperature should not be cached")
+	_, ok = p.cacheKey(cacheTestRequest("hi", 0))
+	assert.False(t, ok, "default temperature should not be cached")
+
+	optIn := cacheTestRequest("hi", 0.7)
+	optIn.GrafanaCache = true
+	_, ok = p.cacheKey(optIn)
+	assert.True(t, ok)
+}
+
+func TestCachingProvider_ChatCompletion(t *testing.T) {
+	inner := &fakeBackend{}
+	p := newCachingProvider(inner, newMemoryCache(10), nil, newCacheTestSettings())
+
+	for i, expCache := range []string{cacheMiss, cacheHit} {
+		ctx, md := withResponseMetadata(context.Background())
+		md.setProvider(ProviderTypeOpenAI)
+		resp, err := p.ChatCompletion(ctx, cacheTestRequest("hi", math.SmallestNonzeroFloat32))
+		require.NoError(t, err)
+		assert.Equal(t, "ok", resp.ID)
+		assert.Equal(t, expCache, md.Cache(), "request %d", i)
+		assert.Equal(t, ProviderTypeOpenAI, md.Provider())
+	}
+	assert.Equal(t, 1, inner.calls)
+
+	ctx, md := withResponseMetadata(context.Background())
+	_, err := p.ChatCompletion(ctx, cacheTestRequest("hi", 1))
+	require.NoError(t, err)
+	assert.Equal(t, "", md.Cache())
+	assert.Equal(t, 2, inner.calls)
+}
+
+func TestCachingProvider_DoesNotCacheErrors(t *testing.T) {
+	inner := &fakeBackend{err: &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}}
+	p := newCachingProvider(inner, newMemoryCache(10), nil, newCacheTestSettings())
+	for range 2 {
+		_, err := p.ChatCompletion(context.Background(), cacheTestRequest("hi", math.SmallestNonzeroFloat32))
+		require.Error(t, err)
+	}
+	assert.Equal(t, 2, inner.calls)
+}
+
+func TestCachingProvider_ChatCompletionStream(t *testing.T) {
+	finish := streamChunk("")
+	finish.Choices[0].FinishReason = openai.FinishReasonStop
+	inner := &fakeBackend{chunks: []ChatCompletionStreamResponse{streamChunk("Hello "), streamChunk("there"), finish}}
+	p := newCachingProvider(inner, newMemoryCache(10), nil, newCacheTestSettings())
+	req := cacheTestRequest("hi", math.SmallestNonzeroFloat32)
+	req.Stream = true
+
+	ctx, md := withResponseMetadata(context.Background())
+	c, err := p.ChatCompletionStream(ctx, req)
+	require.NoError(t, err)
+	var chunks []ChatCompletionStreamResponse
+	for chunk := range c {
+		chunks = append(chunks, chunk)
+	}
+	assert.Len(t, chunks, 3)
+	assert.Equal(t, cacheMiss, md.Cache())
+
+	ctx, md = withResponseMetadata(context.Background())
+	c, err = p.ChatCompletionStream(ctx, req)
+	require.NoError(t, err)
+	chunks = nil
+	for chunk := range c {
+		chunks = append(chunks, chunk)
+	}
+	assert.Equal(t, cacheHit, md.Cache())
+	require.Len(t, chunks, 1)
+	assert.Equal(t, "Hello there", chunks[0].Choices[0].Delta.Content)
+	assert.Equal(t, openai.FinishReasonStop, chunks[0].Choices[0].FinishReason)
+
+	// Non-streaming requests share the cached response.
+	req.Stream = false
+	resp, err := p.ChatCompletion(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello there", resp.Choices[0].Message.Content)
+	assert.Equal(t, 1, inner.calls)
+}
+
+func TestCachingProvider_DoesNotCacheIncompleteStreams(t *testing.T) {
+	unavailable := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}
+	for _, tc := range []struct {
+		name   string
+		chunks []ChatCompletionStreamResponse
+	}{
+		{name: "error", chunks: []ChatCompletionStreamResponse{streamChunk("Hello"), {Error: unavailable}}},
+		{name: "no finish reason", chunks: []ChatCompletionStreamResponse{streamChunk("Hello")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := &fakeBackend{chunks: tc.chunks}
+			p := newCachingProvider(inner, newMemoryCache(10), nil, newCacheTestSettings())
+			for range 2 {
+				c, err := p.ChatCompletionStream(context.Background(), cacheTestRequest("hi", math.SmallestNonzeroFloat32))
+				require.NoError(t, err)
+				for range c {
+				}
+			}
+			assert.Equal(t, 2, inner.calls)
+		})
+	}
+}
+
+func TestStreamAccumulator(t *testing.T) {
+	index := func(i int) *int { return &i }
+	var acc streamAccumulator
+	for _, chunk := range []openai.ChatCompletionStreamResponse{
+		{ID: "1", Model: "gpt", Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{
+			Role:      openai.ChatMessageRoleAssistant,
+			ToolCalls: []openai.ToolCall{{Index: index(0), ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "f", Arguments: `{"a":`}}},
+		}}}},
+		{Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{
+			ToolCalls: []openai.ToolCall{{Index: index(0), Function: openai.FunctionCall{Arguments: `1}`}}},
+		}}}},
+		{Choices: []openai.ChatCompletionStreamChoice{{FinishReason: openai.FinishReasonToolCalls}}, Usage: &openai.Usage{TotalTokens: 3}},
+	} {
+		acc.add(chunk)
+	}
+	require.True(t, acc.complete())
+	assert.Equal(t, openai.ChatCompletionResponse{
+		ID:     "1",
+		Object: "chat.completion",
+		Model:  "gpt",
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:       "call_1",
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: "f", Arguments: `{"a":1}`},
+				}},
+			},
+			FinishReason: openai.FinishReasonToolCalls,
+		}},
+		Usage: openai.Usage{TotalTokens: 3},
+	}, acc.resp)
+}
+
+func TestLoadSettingsCache(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{JSONData: json.RawMessage(`{"cache": {"enabled": true, "backend": "redis"}}`)})
+	require.NoError(t, err)
+	assert.Equal(t, CacheSettings{
+		Enabled:    true,
+		Backend:    cacheBackendMemory,
+		TTLSeconds: defaultCacheTTLSeconds,
+		MaxEntries: defaultCacheMaxEntries,
+		Semantic: SemanticCacheSettings{
+			Collection: defaultSemanticCacheCollection,
+			Threshold:  defaultSemanticCacheThreshold,
+		},
+	}, settings.Cache)
+}
+
+func TestChatCompletionsCacheHeaders(t *testing.T) {
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test", "cache": {"enabled": true}}`)}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app, ok := inst.(*App)
+	require.True(t, ok)
+
+	call := func(body string) *backend.CallResourceResponse {
+		var r mockCallResourceResponseSender
+		err := app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+			Method:        http.MethodPost,
+			Path:          "/llm/v1/chat/completions",
+			Body:          []byte(body),
+		}, &r)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, r.response.Status, string(r.response.Body))
+		return r.response
+	}
+	body := `{"model": "base", "temperature": 0, "stream": %t, "messages": [{"role": "user", "content": "Explain this panel"}]}`
+
+	first := call(fmt.Sprintf(body, false))
+	assert.Equal(t, cacheMiss, http.Header(first.Headers).Get(cacheHeader))
+	second := call(fmt.Sprintf(body, false))
+	assert.Equal(t, cacheHit, http.Header(second.Headers).Get(cacheHeader))
+	assert.Equal(t, first.Body, second.Body)
+
+	streamed := call(fmt.Sprintf(body, true))
+	assert.Equal(t, cacheHit, http.Header(streamed.Headers).Get(cacheHeader))
+	assert.True(t, strings.HasSuffix(string(streamed.Body), "data: [DONE]\n\n"), string(streamed.Body))
+
+	uncached := call(`{"model": "base", "messages": [{"role": "user", "content": "Explain this panel"}]}`)
+	assert.Empty(t, http.Header(uncached.Headers).Get(cacheHeader))
+}
@@ -1,6 +1,9 @@
 package plugin
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/sashabaranov/go-openai"
 )
 
@@ -23,3 +26,14 @@ func ForceUserMessage(req *openai.ChatCompletionRequest) {
 		req.Messages[len(req.Messages)-1].Role = "user"
 	}
 }
+
+// parseImageDataURL splits a base64 encoded image data URL, which has the form
+// data:<media type>;base64,<data>, into its media type and data.
+func parseImageDataURL(u string) (string, string, error) {
+	meta, data, ok := strings.Cut(strings.TrimPrefix(u, "data:"), ",")
+	mediaType, encoding, _ := strings.Cut(meta, ";")
+	if !strings.HasPrefix(u, "data:") || !ok || encoding != "base64" {
+		return "", "", fmt.Errorf("%w: unsupported image data URL", errBadRequest)
+	}
+	return mediaType, data, nil
+}
@@ -0,0 +1,389 @@
+package plugin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// circuitState is the state of a provider's circuit breaker.
+type circuitState string
+
+const (
+	// circuitClosed lets requests through, counting their failures.
+	circuitClosed circuitState = "closed"
+	// circuitOpen rejects requests without sending them.
+	circuitOpen circuitState = "open"
+	// circuitHalfOpen lets a limited number of probe requests through to
+	// find out whether the provider has recovered.
+	circuitHalfOpen circuitState = "half_open"
+)
+
+// circuitOpenError is returned instead of sending a request to a provider
+// whose circuit is open.
+type circuitOpenError struct {
+	Provider ProviderType
+	// RetryAfter is how long until the circuit half-opens.
+	RetryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("LLM provider %s is temporarily unavailable after repeated failures, retry after %ds", e.Provider, e.retryAfterSeconds())
+}
+
+// retryAfterSeconds returns RetryAfter rounded up to whole seconds, and at
+// least 1, as used in the Retry-After header.
+func (e *circuitOpenError) retryAfterSeconds() int {
+	return max(int(math.Ceil(e.RetryAfter.Seconds())), 1)
+}
+
+// handleCircuitOpenError writes an OpenAI-shaped 503 response for a request
+// rejected by a circuit breaker.
+func handleCircuitOpenError(w http.ResponseWriter, err *circuitOpenError) {
+	body, merr := json.Marshal(openai.ErrorResponse{Error: &openai.APIError{
+		Code:    "provider_unavailable",
+		Message: err.Error(),
+		Type:    "circuit_open",
+	}})
+	if merr != nil {
+		handleError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(err.retryAfterSeconds()))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	//nolint:errcheck
+	w.Write(body)
+}
+
+// circuitBuckets is the number of buckets the window of a circuit breaker is
+// divided into. Buckets expire as a whole, so the window slides in steps of a
+// tenth of its length.
+const circuitBuckets = 10
+
+// circuitBucket counts the requests of one period of the window.
+type circuitBucket struct {
+	// period is the number of bucket periods since the Unix epoch.
+	period   int64
+	requests int
+	failures int
+}
+
+// circuitBreaker tracks the failure rate of a single provider. It is safe for
+// concurrent use.
+type circuitBreaker struct {
+	provider ProviderType
+	settings CircuitBreakerSettings
+	metrics  *metrics
+	now      func() time.Time
+
+	mu      sync.Mutex
+	state   circuitState
+	buckets [circuitBuckets]circuitBucket
+	// opened is when the circuit last opened.
+	opened time.Time
+	// probes is the number of probe requests sent since the circuit
+	// half-opened, and succeeded the number which succeeded.
+	probes    int
+	succeeded int
+}
+
+func (b *circuitBreaker) bucketPeriod() time.Duration {
+	return time.Duration(b.settings.WindowSeconds) * time.Second / circuitBuckets
+}
+
+func (b *circuitBreaker) openPeriod() time.Duration {
+	return time.Duration(b.settings.OpenSeconds) * time.Second
+}
+
+// allow returns a *circuitOpenError if a request shouldn't be sent, and
+// otherwise a function which must be called with the result of the request.
+func (b *circuitBreaker) allow() (func(error), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen {
+		if wait := b.openPeriod() - b.now().Sub(b.opened); wait > 0 {
+			return nil, &circuitOpenError{Provider: b.provider, RetryAfter: wait}
+		}
+		b.transition(circuitHalfOpen)
+	}
+	if b.state == circuitHalfOpen {
+		if b.probes >= b.settings.HalfOpenRequests {
+			// Wait for the probes already sent to decide.
+			return nil, &circuitOpenError{Provider: b.provider}
+		}
+		b.probes++
+		return func(err error) { b.recordProbe(err) }, nil
+	}
+	return func(err error) { b.record(err) }, nil
+}
+
+// errEmptyStream is the result recorded for streams which end without any
+// chunks, which say nothing about the provider.
+var errEmptyStream = errors.New("stream ended without a response")
+
+// circuitFailure reports whether err counts as a failure of the provider, and
+// whether it counts at all: requests canceled by the caller, and streams
+// without a response, say nothing about the provider.
+func circuitFailure(err error) (failed, counted bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errEmptyStream) {
+		return false, false
+	}
+	return isRetryableError(err), true
+}
+
+// record counts the result of a request sent while the circuit was closed,
+// opening it if the failure rate is exceeded.
+func (b *circuitBreaker) record(err error) {
+	failed, counted := circuitFailure(err)
+	if !counted {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitClosed {
+		// The circuit opened while the request was in flight.
+		return
+	}
+	now := b.now()
+	period := now.UnixNano() / int64(b.bucketPeriod())
+	bucket := &b.buckets[period%circuitBuckets]
+	if bucket.period != period {
+		*bucket = circuitBucket{period: period}
+	}
+	bucket.requests++
+	if !failed {
+		return
+	}
+	bucket.failures++
+	requests, failures := b.counts(period)
+	if requests >= b.settings.MinimumRequests && float64(failures) >= b.settings.FailureRate*float64(requests) {
+		b.opened = now
+		b.transition(circuitOpen)
+	}
+}
+
+// recordProbe handles the result of a request sent while the circuit was
+// half-open, closing it once enough probes have succeeded and reopening it if
+// any fails.
+func (b *circuitBreaker) recordProbe(err error) {
+	failed, counted := circuitFailure(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitHalfOpen {
+		return
+	}
+	switch {
+	case !counted:
+		// Let another request probe instead.
+		b.probes--
+	case failed:
+		b.opened = b.now()
+		b.transition(circuitOpen)
+	default:
+		b.succeeded++
+		if b.succeeded >= b.settings.HalfOpenRequests {
+			b.buckets = [circuitBuckets]circuitBucket{}
+			b.transition(circuitClosed)
+		}
+	}
+}
+
+// counts returns the requests and failures in the window ending in the given
+// bucket period. The caller must hold b.mu.
+func (b *circuitBreaker) counts(period int64) (requests, failures int) {
+	for _, bucket := range b.buckets {
+		if period-bucket.period < circuitBuckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+// transition changes the state of the circuit. The caller must hold b.mu.
+func (b *circuitBreaker) transition(state circuitState) {
+	b.state = state
+	b.probes, b.succeeded = 0, 0
+	b.metrics.observeCircuitState(b.provider, state, true)
+	switch state {
+	case circuitOpen:
+		log.DefaultLogger.Warn("LLM provider circuit breaker opened", "provider", b.provider, "openSeconds", b.settings.OpenSeconds)
+	case circuitHalfOpen:
+		log.DefaultLogger.Info("LLM provider circuit breaker half-open, probing provider", "provider", b.provider)
+	case circuitClosed:
+		log.DefaultLogger.Info("LLM provider circuit breaker closed", "provider", b.provider)
+	}
+}
+
+// circuitBreakerHealth is the state of a provider's circuit breaker, as
+// reported by health checks.
+type circuitBreakerHealth struct {
+	Provider ProviderType `json:"provider"`
+	State    circuitState `json:"state"`
+	// Requests and Failures are counted over the window while the circuit
+	// is closed.
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+	// RetryAfterSeconds is how long until an open circuit half-opens.
+	RetryAfterSeconds int `json:"retryAfterSeconds,omitempty"`
+}
+
+func (b *circuitBreaker) health() circuitBreakerHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	h := circuitBreakerHealth{Provider: b.provider, State: b.state}
+	switch b.state {
+	case circuitClosed:
+		h.Requests, h.Failures = b.counts(now.UnixNano() / int64(b.bucketPeriod()))
+	case circuitOpen:
+		if wait := b.openPeriod() - now.Sub(b.opened); wait > 0 {
+			h.RetryAfterSeconds = (&circuitOpenError{RetryAfter: wait}).retryAfterSeconds()
+		} else {
+			// The next request will probe the provider.
+			h.State = circuitHalfOpen
+		}
+	}
+	return h
+}
+
+// circuitBreakers holds the circuit breaker of each provider, created when a
+// provider is first used. It is safe for concurrent use.
+type circuitBreakers struct {
+	settings CircuitBreakerSettings
+	metrics  *metrics
+
+	mu       sync.Mutex
+	breakers map[ProviderType]*circuitBreaker
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+func newCircuitBreakers(settings CircuitBreakerSettings, metrics *metrics) *circuitBreakers {
+	return &circuitBreakers{
+		settings: settings,
+		metrics:  metrics,
+		breakers: map[ProviderType]*circuitBreaker{},
+		now:      time.Now,
+	}
+}
+
+func (c *circuitBreakers) get(provider ProviderType) *circuitBreaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[provider]
+	if !ok {
+		b = &circuitBreaker{
+			provider: provider,
+			settings: c.settings,
+			metrics:  c.metrics,
+			now:      c.now,
+			state:    circuitClosed,
+		}
+		c.breakers[provider] = b
+		c.metrics.observeCircuitState(provider, circuitClosed, false)
+	}
+	return b
+}
+
+// wrap returns p guarded by the circuit breaker of provider. It returns p
+// unchanged if c is nil, i.e. circuit breakers are disabled.
+func (c *circuitBreakers) wrap(provider ProviderType, p LLMProvider) LLMProvider {
+	if c == nil || p == nil {
+		return p
+	}
+	return &circuitBreakerProvider{LLMProvider: p, breaker: c.get(provider)}
+}
+
+// health returns the state of each circuit breaker, ordered by provider.
+func (c *circuitBreakers) health() []circuitBreakerHealth {
+	c.mu.Lock()
+	breakers := make([]*circuitBreaker, 0, len(c.breakers))
+	for _, b := range c.breakers {
+		breakers = append(breakers, b)
+	}
+	c.mu.Unlock()
+	slices.SortFunc(breakers, func(a, b *circuitBreaker) int {
+		return cmp.Compare(a.provider, b.provider)
+	})
+	health := make([]circuitBreakerHealth, 0, len(breakers))
+	for _, b := range breakers {
+		health = append(health, b.health())
+	}
+	return health
+}
+
+// circuitBreakerProvider is an LLMProvider which fails fast while the circuit
+// breaker of the provider it wraps is open. Listing models isn't guarded,
+// since it doesn't usually call the provider.
+type circuitBreakerProvider struct {
+	LLMProvider
+	breaker *circuitBreaker
+}
+
+func (p *circuitBreakerProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	done, err := p.breaker.allow()
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	resp, err := p.LLMProvider.ChatCompletion(ctx, req)
+	done(err)
+	return resp, err
+}
+
+// ChatCompletionStream records the result of a stream when its first chunk
+// arrives: like the fallback provider, it judges the provider by whether it
+// started to respond. Streams which end before then, usually because the
+// request was canceled, aren't counted.
+func (p *circuitBreakerProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	done, err := p.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.LLMProvider.ChatCompletionStream(ctx, req)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	out := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		first := true
+		for resp := range c {
+			if first {
+				done(resp.Error)
+				first = false
+			}
+			if !forwardStreamResponse(ctx, out, resp, c) {
+				break
+			}
+		}
+		if first {
+			done(cmp.Or(ctx.Err(), errEmptyStream))
+		}
+	}()
+	return out, nil
+}
+
+func (p *circuitBreakerProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	done, err := p.breaker.allow()
+	if err != nil {
+		return openai.EmbeddingResponse{}, err
+	}
+	resp, err := p.LLMProvider.Embeddings(ctx, req)
+	done(err)
+	return resp, err
+}
@@ -0,0 +1,260 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCircuitBreakers returns circuit breakers which open after half of
+// four requests fail, and a pointer to the time they see.
+func newTestCircuitBreakers() (*circuitBreakers, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newCircuitBreakers(CircuitBreakerSettings{
+		FailureRate:      0.5,
+		MinimumRequests:  4,
+		WindowSeconds:    60,
+		OpenSeconds:      30,
+		HalfOpenRequests: 1,
+	}, nil)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCircuitBreaker_Opens(t *testing.T) {
+	unavailable := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+	breakers, _ := newTestCircuitBreakers()
+	inner := &fakeBackend{}
+	p := breakers.wrap(ProviderTypeOpenAI, inner)
+	ctx := context.Background()
+
+	for range 2 {
+		_, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+		require.NoError(t, err)
+	}
+	inner.err = unavailable
+	_, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+	assert.ErrorIs(t, err, unavailable)
+	assert.Equal(t, circuitClosed, breakers.health()[0].State, "the circuit should not open before the minimum requests")
+	_, err = p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+	assert.ErrorIs(t, err, unavailable)
+
+	_, err = p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+	var openErr *circuitOpenError
+	require.ErrorAs(t, err, &openErr)
+	assert.Equal(t, ProviderTypeOpenAI, openErr.Provider)
+	assert.Equal(t, 30*time.Second, openErr.RetryAfter)
+	assert.Equal(t, 4, inner.calls, "requests should fail fast while the circuit is open")
+	assert.Equal(t, []circuitBreakerHealth{{Provider: ProviderTypeOpenAI, State: circuitOpen, RetryAfterSeconds: 30}}, breakers.health())
+
+	_, err = p.Embeddings(ctx, EmbeddingRequest{})
+	assert.ErrorAs(t, err, &openErr)
+	_, err = p.ChatCompletionStream(ctx, ChatCompletionRequest{Model: ModelBase})
+	assert.ErrorAs(t, err, &openErr)
+	assert.Equal(t, 4, inner.calls)
+}
+
+func TestCircuitBreaker_IgnoresClientErrors(t *testing.T) {
+	breakers, _ := newTestCircuitBreakers()
+	inner := &fakeBackend{err: errBadRequest}
+	p := breakers.wrap(ProviderTypeOpenAI, inner)
+	for range 10 {
+		_, err := p.ChatCompletion(context.Background(), ChatCompletionRequest{Model: ModelBase})
+		assert.ErrorIs(t, err, errBadRequest)
+	}
+	inner.err = context.Canceled
+	for range 10 {
+		_, err := p.ChatCompletion(context.Background(), ChatCompletionRequest{Model: ModelBase})
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+	assert.Equal(t, []circuitBreakerHealth{{Provider: ProviderTypeOpenAI, State: circuitClosed, Requests: 10}}, breakers.health())
+}
+
+func TestCircuitBreaker_Window(t *testing.T) {
+	breakers, now := newTestCircuitBreakers()
+	inner := &fakeBackend{err: &openai.APIError{HTTPStatusCode: http.StatusBadGateway}}
+	p := breakers.wrap(ProviderTypeOpenAI, inner)
+	for range 3 {
+		//nolint:errcheck
+		p.ChatCompletion(context.Background(), ChatCompletionRequest{Model: ModelBase})
+	}
+	*now = now.Add(time.Minute)
+	//nolint:errcheck
+	p.ChatCompletion(context.Background(), ChatCompletionRequest{Model: ModelBase})
+	assert.Equal(t, []circuitBreakerHealth{{Provider: ProviderTypeOpenAI, State: circuitClosed, Requests: 1, Failures: 1}}, breakers.health(),
+		"failures which have left the window should not be counted")
+}
+
+func TestCircuitBreaker_HalfOpen(t *testing.T) {
+	unavailable := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+	breakers, now := newTestCircuitBreakers()
+	inner := &fakeBackend{err: unavailable}
+	p := breakers.wrap(ProviderTypeOpenAI, inner)
+	ctx := context.Background()
+	for range 4 {
+		//nolint:errcheck
+		p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+	}
+	require.Equal(t, circuitOpen, breakers.health()[0].State)
+
+	// A failed probe reopens the circuit.
+	*now = now.Add(30 * time.Second)
+	assert.Equal(t, circuitHalfOpen, breakers.health()[0].State)
+	_, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+	assert.ErrorIs(t, err, unavailable)
+	assert.Equal(t, 5, inner.calls)
+	assert.Equal(t, circuitOpen, breakers.health()[0].State)
+
+	// A successful probe closes it.
+	*now = now.Add(30 * time.Second)
+	inner.err = nil
+	_, err = p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+	require.NoError(t, err)
+	assert.Equal(t, []circuitBreakerHealth{{Provider: ProviderTypeOpenAI, State: circuitClosed}}, breakers.health())
+}
+
+func TestCircuitBreaker_HalfOpenLimitsProbes(t *testing.T) {
+	breakers, now := newTestCircuitBreakers()
+	b := breakers.get(ProviderTypeOpenAI)
+	for range 4 {
+		done, err := b.allow()
+		require.NoError(t, err)
+		done(fmt.Errorf("dial: %w", syscall.ECONNREFUSED))
+	}
+	*now = now.Add(time.Minute)
+
+	done, err := b.allow()
+	require.NoError(t, err)
+	_, err = b.allow()
+	assert.ErrorAs(t, err, new(*circuitOpenError), "only one probe should be sent at a time")
+
+	// A canceled probe lets another request probe.
+	done(context.Canceled)
+	done, err = b.allow()
+	require.NoError(t, err)
+	done(nil)
+	assert.Equal(t, circuitClosed, b.health().State)
+}
+
+func TestCircuitBreaker_HalfOpenEmptyStream(t *testing.T) {
+	breakers, now := newTestCircuitBreakers()
+	b := breakers.get(ProviderTypeOpenAI)
+	for range 4 {
+		done, err := b.allow()
+		require.NoError(t, err)
+		done(fmt.Errorf("dial: %w", syscall.ECONNREFUSED))
+	}
+	*now = now.Add(time.Minute)
+	p := breakers.wrap(ProviderTypeOpenAI, &fakeBackend{})
+
+	// Probes whose streams end before their first chunk, whether canceled
+	// or not, don't show that the provider has recovered.
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, ctx := range []context.Context{canceled, context.Background()} {
+		c, err := p.ChatCompletionStream(ctx, ChatCompletionRequest{Model: ModelBase})
+		require.NoError(t, err)
+		for range c {
+		}
+		assert.Equal(t, circuitHalfOpen, b.health().State)
+	}
+
+	// They let another request probe.
+	done, err := b.allow()
+	require.NoError(t, err)
+	done(nil)
+	assert.Equal(t, circuitClosed, b.health().State)
+}
+
+func TestCircuitBreaker_Stream(t *testing.T) {
+	unavailable := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+	breakers, _ := newTestCircuitBreakers()
+	inner := &fakeBackend{chunks: []ChatCompletionStreamResponse{{Error: unavailable}}}
+	p := breakers.wrap(ProviderTypeOpenAI, inner)
+	for range 4 {
+		c, err := p.ChatCompletionStream(context.Background(), ChatCompletionRequest{Model: ModelBase})
+		require.NoError(t, err)
+		for range c {
+		}
+	}
+	assert.Equal(t, circuitOpen, breakers.health()[0].State, "streams failing before their first chunk should count as failures")
+}
+
+func TestCircuitBreaker_FailsOver(t *testing.T) {
+	breakers, _ := newTestCircuitBreakers()
+	primary := &fakeBackend{err: &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}}
+	secondary := &fakeBackend{}
+	p := newFallbackProvider([]namedProvider{
+		{name: ProviderTypeOpenAI, provider: breakers.wrap(ProviderTypeOpenAI, primary)},
+		{name: ProviderTypeAnthropic, provider: breakers.wrap(ProviderTypeAnthropic, secondary)},
+	})
+	for range 6 {
+		ctx, md := withResponseMetadata(context.Background())
+		_, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+		require.NoError(t, err)
+		assert.Equal(t, ProviderTypeAnthropic, md.Provider())
+	}
+	assert.Equal(t, 4, primary.calls, "the primary provider should be skipped once its circuit opens")
+	assert.Equal(t, 6, secondary.calls)
+}
+
+func TestChatCompletionsCircuitOpen(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprint(w, `{"error": {"message": "overloaded"}}`)
+	}))
+	defer failing.Close()
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{
+		JSONData: []byte(fmt.Sprintf(`{
+			"provider": "openai",
+			"openAI": {"url": %q},
+			"retries": {"maxAttempts": 1},
+			"circuitBreaker": {"minimumRequests": 2, "openSeconds": 60}
+		}`, failing.URL)),
+		DecryptedSecureJSONData: map[string]string{openAIKey: "abcd1234"},
+	}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	statuses := make([]int, 0, 3)
+	var r mockCallResourceResponseSender
+	for range 3 {
+		r = mockCallResourceResponseSender{}
+		err = app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{OrgID: 1, AppInstanceSettings: &settings},
+			Method:        http.MethodPost,
+			Path:          "/llm/v1/chat/completions",
+			Body:          []byte(`{"model": "base", "messages": [{"role": "user", "content": "hi"}]}`),
+		}, &r)
+		require.NoError(t, err)
+		statuses = append(statuses, r.response.Status)
+	}
+	assert.Equal(t, []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusServiceUnavailable}, statuses)
+	assert.Equal(t, "60", http.Header(r.response.Headers).Get("Retry-After"))
+	var body openai.ErrorResponse
+	require.NoError(t, json.Unmarshal(r.response.Body, &body))
+	assert.Equal(t, "provider_unavailable", body.Error.Code)
+
+	resp, err := app.CheckHealth(ctx, &backend.CheckHealthRequest{
+		PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+	})
+	require.NoError(t, err)
+	var details healthCheckDetails
+	require.NoError(t, json.Unmarshal(resp.JSONDetails, &details))
+	require.Len(t, details.LLMProvider.CircuitBreakers, 1)
+	assert.Equal(t, ProviderTypeOpenAI, details.LLMProvider.CircuitBreakers[0].Provider)
+	assert.Equal(t, circuitOpen, details.LLMProvider.CircuitBreakers[0].State)
+	assert.False(t, details.LLMProvider.Models[ModelBase].OK)
+}
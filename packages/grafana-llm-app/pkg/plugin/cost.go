@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// requestCost returns the cost in US dollars of a request with the given usage
+// to a model with the given price.
+func requestCost(price ModelPrice, usage openai.Usage) float64 {
+	cached := 0
+	if usage.PromptTokensDetails != nil {
+		cached = min(usage.PromptTokensDetails.CachedTokens, usage.PromptTokens)
+	}
+	cachedPrice := price.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = price.Input
+	}
+	cost := float64(usage.PromptTokens-cached)*price.Input +
+		float64(cached)*cachedPrice +
+		float64(usage.CompletionTokens)*price.Output
+	return cost / 1_000_000
+}
+
+// monthStart returns the start of the UTC month containing t.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// budgetTracker tracks the cost of requests in the current month against the
+// monthly budget. It is safe for concurrent use.
+type budgetTracker struct {
+	mu       sync.Mutex
+	settings BudgetSettings
+	// thresholds are the alert thresholds in increasing order.
+	thresholds []float64
+	// month is the start of the month spent is for.
+	month time.Time
+	spent float64
+	// alerted is the number of thresholds reached this month.
+	alerted int
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+// newBudgetTracker creates a budget tracker for an org, since app instances
+// and so their settings are per org. The cost of the org's requests made
+// earlier in the month is taken from the usage store, if usage metering is
+// enabled.
+func newBudgetTracker(settings BudgetSettings, usage *usageStore, orgID int64) *budgetTracker {
+	b := &budgetTracker{
+		settings:   settings,
+		thresholds: slices.Sorted(slices.Values(settings.AlertThresholds)),
+		now:        time.Now,
+	}
+	b.month = monthStart(b.now())
+	if usage != nil {
+		b.spent = usage.cost(orgID, b.month, b.month.AddDate(0, 1, 0))
+	}
+	// Don't alert again for thresholds reached before a restart.
+	for b.alerted < len(b.thresholds) && b.spent >= b.thresholds[b.alerted]*b.settings.Monthly {
+		b.alerted++
+	}
+	if b.exceeded() {
+		log.DefaultLogger.Warn("Monthly LLM budget exceeded, serving requests with the base model", "budget", b.settings.Monthly, "spent", b.spent)
+	}
+	return b
+}
+
+// roll starts a new month if t is in a later month. It must be called with
+// b.mu held.
+func (b *budgetTracker) roll(t time.Time) {
+	if month := monthStart(t); month.After(b.month) {
+		b.month, b.spent, b.alerted = month, 0, 0
+	}
+}
+
+// exceeded reports whether the budget has been spent. It must be called with
+// b.mu held or before b is shared.
+func (b *budgetTracker) exceeded() bool {
+	return b.spent >= b.settings.Monthly
+}
+
+// record adds the cost of a request, logging a warning when it takes the
+// spend past an alert threshold or the budget.
+func (b *budgetTracker) record(r usageRecord) error {
+	if r.Cost == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(r.Time)
+	if monthStart(r.Time).Before(b.month) {
+		return nil
+	}
+	wasExceeded := b.exceeded()
+	b.spent += *r.Cost
+	for b.alerted < len(b.thresholds) && b.spent >= b.thresholds[b.alerted]*b.settings.Monthly {
+		log.DefaultLogger.Warn("Monthly LLM budget alert threshold reached", "threshold", b.thresholds[b.alerted], "budget", b.settings.Monthly, "spent", b.spent)
+		b.alerted++
+	}
+	if !wasExceeded && b.exceeded() {
+		log.DefaultLogger.Warn("Monthly LLM budget exceeded, serving requests with the base model", "budget", b.settings.Monthly, "spent", b.spent)
+	}
+	return nil
+}
+
+// degraded reports whether requests should be served by the base model
+// because the budget has been exceeded.
+func (b *budgetTracker) degraded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(b.now())
+	return b.exceeded()
+}
+
+type budgetHealthDetails struct {
+	// Month is the current month, in YYYY-MM format.
+	Month   string  `json:"month"`
+	Monthly float64 `json:"monthly"`
+	Spent   float64 `json:"spent"`
+	// AlertsReached are the alert thresholds reached this month.
+	AlertsReached []float64 `json:"alertsReached"`
+	// Degraded is true if requests are being served by the base model.
+	Degraded bool `json:"degraded"`
+}
+
+// health reports the spend against the budget this month.
+func (b *budgetTracker) health() *budgetHealthDetails {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(b.now())
+	return &budgetHealthDetails{
+		Month:         b.month.Format("2006-01"),
+		Monthly:       b.settings.Monthly,
+		Spent:         b.spent,
+		AlertsReached: slices.Clone(b.thresholds[:b.alerted]),
+		Degraded:      b.exceeded(),
+	}
+}
+
+// budgetProvider wraps an LLMProvider, serving chat completions requests with
+// the base model while the monthly budget is exceeded.
+type budgetProvider struct {
+	LLMProvider
+	budget *budgetTracker
+}
+
+// degrade switches a request to the base model if the budget is exceeded.
+func (p *budgetProvider) degrade(ctx context.Context, req ChatCompletionRequest) ChatCompletionRequest {
+	if req.Model == ModelBase || !p.budget.degraded() {
+		return req
+	}
+	log.DefaultLogger.Debug("Monthly budget exceeded, using base model", "model", req.Model)
+	req.Model = ModelBase
+	responseMetadataFromContext(ctx).setDegraded(degradedBudget)
+	return req
+}
+
+func (p *budgetProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return p.LLMProvider.ChatCompletion(ctx, p.degrade(ctx, req))
+}
+
+func (p *budgetProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	return p.LLMProvider.ChatCompletionStream(ctx, p.degrade(ctx, req))
+}
@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestCost(t *testing.T) {
+	price := ModelPrice{Input: 2, Output: 8, CachedInput: 0.5}
+	assert.InDelta(t, 0.002+0.008, requestCost(price, tokens(1000, 1000)), 1e-12)
+
+	usage := tokens(1000, 0)
+	usage.PromptTokensDetails = &openai.PromptTokensDetails{CachedTokens: 400}
+	assert.InDelta(t, 600*2/1e6+400*0.5/1e6, requestCost(price, usage), 1e-12)
+
+	// Cached tokens are charged at the input price if there's no cached price.
+	assert.InDelta(t, 1000*2/1e6, requestCost(ModelPrice{Input: 2}, usage), 1e-12)
+}
+
+func TestPricingSettings_Price(t *testing.T) {
+	for _, provider := range []ProviderType{ProviderTypeOpenAI, ProviderTypeAnthropic, ProviderTypeGemini, ProviderTypeBedrock} {
+		for model, name := range defaultModelSettings(provider).Mapping {
+			_, ok := PricingSettings{}.price(name)
+			assert.True(t, ok, "default %s model %s should have a price", provider, model)
+		}
+	}
+
+	s := PricingSettings{Models: map[string]ModelPrice{
+		"gpt-4.1":  {Input: 1, Output: 1},
+		"my-model": {Input: 0.1, Output: 0.2},
+	}}
+	p, ok := s.price("gpt-4.1")
+	require.True(t, ok)
+	assert.Equal(t, ModelPrice{Input: 1, Output: 1}, p, "configured prices should replace the defaults")
+	_, ok = s.price("my-model")
+	assert.True(t, ok)
+	_, ok = s.price("gpt-4.1-mini")
+	assert.True(t, ok)
+	_, ok = s.price("llama3")
+	assert.False(t, ok)
+}
+
+func newBudgetTestTracker(settings BudgetSettings, usage *usageStore) (*budgetTracker, *time.Time) {
+	now := usageTestTime
+	b := newBudgetTracker(settings, usage, 0)
+	b.now = func() time.Time { return now }
+	b.month = monthStart(now)
+	return b, &now
+}
+
+func costRecord(t time.Time, cost float64) usageRecord {
+	return usageRecord{Time: t, Usage: tokens(1, 1), Cost: &cost}
+}
+
+func TestBudgetTracker(t *testing.T) {
+	b, now := newBudgetTestTracker(BudgetSettings{Monthly: 10, AlertThresholds: []float64{0.9, 0.5}}, nil)
+
+	require.NoError(t, b.record(costRecord(*now, 4)))
+	require.NoError(t, b.record(usageRecord{Time: *now, Usage: tokens(1000, 1000)}), "unpriced requests should be ignored")
+	assert.False(t, b.degraded())
+	assert.Empty(t, b.health().AlertsReached)
+
+	require.NoError(t, b.record(costRecord(*now, 2)))
+	assert.Equal(t, []float64{0.5}, b.health().AlertsReached)
+
+	require.NoError(t, b.record(costRecord(*now, 4)))
+	assert.True(t, b.degraded())
+	assert.Equal(t, &budgetHealthDetails{
+		Month:         "2024-01",
+		Monthly:       10,
+		Spent:         10,
+		AlertsReached: []float64{0.5, 0.9},
+		Degraded:      true,
+	}, b.health())
+
+	// Late records for the previous month don't count against the new one.
+	*now = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	assert.False(t, b.degraded(), "the budget should reset each month")
+	require.NoError(t, b.record(costRecord(usageTestTime, 4)))
+	assert.Equal(t, 0.0, b.health().Spent)
+	assert.Equal(t, "2024-02", b.health().Month)
+}
+
+func TestBudgetTracker_LoadsSpendFromUsage(t *testing.T) {
+	now := time.Now()
+	s, err := newUsageStore(UsageSettings{RetentionDays: defaultUsageRetentionDays})
+	require.NoError(t, err)
+	require.NoError(t, s.record(costRecord(now, 6)))
+	require.NoError(t, s.record(costRecord(monthStart(now).Add(-time.Hour), 100)))
+	other := costRecord(now, 50)
+	other.Key.OrgID = 2
+	require.NoError(t, s.record(other))
+
+	b := newBudgetTracker(BudgetSettings{Monthly: 10, AlertThresholds: []float64{0.5}}, s, 0)
+	d := b.health()
+	assert.Equal(t, 6.0, d.Spent, "only this org's spend this month should count")
+	assert.Equal(t, []float64{0.5}, d.AlertsReached)
+	assert.False(t, d.Degraded)
+}
+
+func TestBudgetProvider(t *testing.T) {
+	b, now := newBudgetTestTracker(BudgetSettings{Monthly: 1}, nil)
+	inner := &scriptedProvider{responses: []openai.ChatCompletionResponse{answerResponse("a"), answerResponse("b")}}
+	p := &budgetProvider{LLMProvider: inner, budget: b}
+
+	ctx, md := withResponseMetadata(context.Background())
+	_, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelLarge})
+	require.NoError(t, err)
+	assert.Equal(t, Model(ModelLarge), inner.requests[0].Model)
+	assert.Empty(t, md.Degraded())
+
+	require.NoError(t, b.record(costRecord(*now, 1)))
+	ctx, md = withResponseMetadata(context.Background())
+	_, err = p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelLarge})
+	require.NoError(t, err)
+	assert.Equal(t, Model(ModelBase), inner.requests[1].Model, "requests should use the base model once the budget is exceeded")
+	assert.Equal(t, degradedBudget, md.Degraded())
+}
+
+func TestLoadSettingsPricing(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{JSONData: []byte(`{"pricing": {"models": {"llama3": {"input": 0.1, "output": 0.2}}, "budget": {"monthly": 500}}}`)})
+	require.NoError(t, err)
+	assert.Equal(t, ModelPrice{Input: 0.1, Output: 0.2}, settings.Pricing.Models["llama3"])
+	assert.Equal(t, BudgetSettings{Monthly: 500, AlertThresholds: defaultBudgetAlertThresholds}, settings.Pricing.Budget)
+
+	settings, err = loadSettings(backend.AppInstanceSettings{JSONData: []byte(`{"pricing": {"budget": {"monthly": 500, "alertThresholds": []}}}`)})
+	require.NoError(t, err)
+	assert.Empty(t, settings.Pricing.Budget.AlertThresholds)
+}
+
+func TestChatCompletionsCostAndBudget(t *testing.T) {
+	ctx := context.Background()
+	// The test provider uses 5 prompt and 5 completion tokens per request,
+	// which costs $0.00005 with the default OpenAI large model, so the first
+	// request spends the budget.
+	settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test", "pricing": {"budget": {"monthly": 0.00001}}}`)}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	call := func() *backend.CallResourceResponse {
+		var r mockCallResourceResponseSender
+		err := app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{OrgID: 1, AppInstanceSettings: &settings},
+			Method:        http.MethodPost,
+			Path:          "/llm/v1/chat/completions",
+			Body:          []byte(`{"model": "large", "messages": [{"role": "user", "content": "hi"}]}`),
+		}, &r)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, r.response.Status, string(r.response.Body))
+		return r.response
+	}
+
+	resp := call()
+	headers := http.Header(resp.Headers)
+	cost, err := strconv.ParseFloat(headers.Get(costHeader), 64)
+	require.NoError(t, err)
+	assert.InDelta(t, (5*2.00+5*8.00)/1e6, cost, 1e-12, "the first request should use the large model")
+	assert.Empty(t, headers.Get(degradedHeader))
+
+	resp = call()
+	headers = http.Header(resp.Headers)
+	assert.Equal(t, degradedBudget, headers.Get(degradedHeader))
+	cost, err = strconv.ParseFloat(headers.Get(costHeader), 64)
+	require.NoError(t, err)
+	assert.InDelta(t, (5*0.40+5*1.60)/1e6, cost, 1e-12, "the second request should use the base model")
+
+	health, err := app.CheckHealth(ctx, &backend.CheckHealthRequest{})
+	require.NoError(t, err)
+	var details healthCheckDetails
+	require.NoError(t, json.Unmarshal(health.JSONDetails, &details))
+	require.NotNil(t, details.Budget)
+	assert.True(t, details.Budget.Degraded)
+	assert.InDelta(t, (5*2.00+5*8.00+5*0.40+5*1.60)/1e6, details.Budget.Spent, 1e-12)
+}
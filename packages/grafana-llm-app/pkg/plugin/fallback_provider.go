@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// fallbackProvider implements the LLMProvider interface by trying each of its
+// backends in priority order, failing over to the next one when a request fails
+// with a retryable error.
+type fallbackProvider struct {
+	backends []namedProvider
+}
+
+func newFallbackProvider(backends []namedProvider) *fallbackProvider {
+	return &fallbackProvider{backends: backends}
+}
+
+func (p *fallbackProvider) Models(ctx context.Context) (ModelResponse, error) {
+	var err error
+	for _, b := range p.backends {
+		var resp ModelResponse
+		resp, err = b.provider.Models(ctx)
+		if err == nil {
+			return resp, nil
+		}
+		if !p.shouldFailOver(ctx, b, err) {
+			return ModelResponse{}, err
+		}
+	}
+	return ModelResponse{}, err
+}
+
+func (p *fallbackProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	var err error
+	for _, b := range p.backends {
+		var resp openai.ChatCompletionResponse
+		resp, err = b.provider.ChatCompletion(ctx, req)
+		if err == nil {
+			responseMetadataFromContext(ctx).setProvider(b.name)
+			return resp, nil
+		}
+		if !p.shouldFailOver(ctx, b, err) {
+			return openai.ChatCompletionResponse{}, err
+		}
+	}
+	return openai.ChatCompletionResponse{}, err
+}
+
+// ChatCompletionStream fails over until a backend has produced its first chunk.
+// After that, errors are passed on to the caller since part of the response has
+// already been sent.
+func (p *fallbackProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	var err error
+	for _, b := range p.backends {
+		var c <-chan ChatCompletionStreamResponse
+		c, err = b.provider.ChatCompletionStream(ctx, req)
+		if err == nil {
+			first, ok := <-c
+			if !ok {
+				// The stream ended without any chunks; nothing to fail over from.
+				responseMetadataFromContext(ctx).setProvider(b.name)
+				return c, nil
+			}
+			if first.Error == nil {
+				responseMetadataFromContext(ctx).setProvider(b.name)
+				return prependStreamResponse(ctx, first, c), nil
+			}
+			err = first.Error
+			// Drain the channel so the backend's goroutine can exit.
+			go func() {
+				for range c {
+				}
+			}()
+		}
+		if !p.shouldFailOver(ctx, b, err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (p *fallbackProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	var err error
+	for _, b := range p.backends {
+		var resp openai.EmbeddingResponse
+		resp, err = b.provider.Embeddings(ctx, req)
+		if err == nil {
+			responseMetadataFromContext(ctx).setProvider(b.name)
+			return resp, nil
+		}
+		if !p.shouldFailOver(ctx, b, err) {
+			return openai.EmbeddingResponse{}, err
+		}
+	}
+	return openai.EmbeddingResponse{}, err
+}
+
+// shouldFailOver logs the failure of a backend and reports whether the next
+// backend should be tried.
+func (p *fallbackProvider) shouldFailOver(ctx context.Context, b namedProvider, err error) bool {
+	if ctx.Err() != nil || !isRetryableError(err) {
+		return false
+	}
+	log.DefaultLogger.Warn("LLM provider failed, trying next provider", "provider", b.name, "err", err)
+	return true
+}
+
+// prependStreamResponse returns a channel which yields first followed by the
+// remaining responses from c.
+func prependStreamResponse(ctx context.Context, first ChatCompletionStreamResponse, c <-chan ChatCompletionStreamResponse) <-chan ChatCompletionStreamResponse {
+	out := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		if !forwardStreamResponse(ctx, out, first, c) {
+			return
+		}
+		for resp := range c {
+			if !forwardStreamResponse(ctx, out, resp, c) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// isRetryableError reports whether an error returned by a provider is likely to
+// be transient or specific to that provider, i.e. server errors, rate limits,
+// timeouts, connection errors and open circuit breakers.
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var openErr *circuitOpenError
+	if errors.As(err, &openErr) {
+		return true
+	}
+	if status := errorStatusCode(err); status != 0 {
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// errorStatusCode returns the HTTP status code of a provider error, or 0 if it
+// does not have one.
+func errorStatusCode(err error) int {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode
+	}
+	return 0
+}
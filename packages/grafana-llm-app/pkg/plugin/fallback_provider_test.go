@@ -0,0 +1,299 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBackend is an LLMProvider which fails with err, or streams chunks.
+type fakeBackend struct {
+	err    error
+	chunks []ChatCompletionStreamResponse
+	calls  int
+}
+
+func (p *fakeBackend) Models(context.Context) (ModelResponse, error) {
+	p.calls++
+	if p.err != nil {
+		return ModelResponse{}, p.err
+	}
+	return ModelResponse{Data: []ModelInfo{{ID: ModelBase}}}, nil
+}
+
+func (p *fakeBackend) ChatCompletion(context.Context, ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	p.calls++
+	if p.err != nil {
+		return openai.ChatCompletionResponse{}, p.err
+	}
+	return openai.ChatCompletionResponse{ID: "ok"}, nil
+}
+
+func (p *fakeBackend) ChatCompletionStream(context.Context, ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	p.calls++
+	if p.err != nil {
+		return nil, p.err
+	}
+	c := make(chan ChatCompletionStreamResponse, len(p.chunks))
+	for _, chunk := range p.chunks {
+		c <- chunk
+	}
+	close(c)
+	return c, nil
+}
+
+func (p *fakeBackend) Embeddings(context.Context, EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	p.calls++
+	if p.err != nil {
+		return openai.EmbeddingResponse{}, p.err
+	}
+	return openai.EmbeddingResponse{Model: "ok"}, nil
+}
+
+func streamChunk(content string) ChatCompletionStreamResponse {
+	return ChatCompletionStreamResponse{
+		ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+			Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: content}}},
+		},
+	}
+}
+
+func TestFallbackProvider_ChatCompletion(t *testing.T) {
+	unavailable := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+	badRequest := &openai.APIError{HTTPStatusCode: http.StatusBadRequest, Message: "invalid"}
+
+	for _, tc := range []struct {
+		name        string
+		backends    []*fakeBackend
+		expProvider ProviderType
+		expErr      error
+		expCalls    []int
+	}{
+		{
+			name:        "primary succeeds",
+			backends:    []*fakeBackend{{}, {}},
+			expProvider: ProviderTypeOpenAI,
+			expCalls:    []int{1, 0},
+		},
+		{
+			name:        "fails over on server error",
+			backends:    []*fakeBackend{{err: unavailable}, {}},
+			expProvider: ProviderTypeAnthropic,
+			expCalls:    []int{1, 1},
+		},
+		{
+			name:     "does not fail over on client error",
+			backends: []*fakeBackend{{err: badRequest}, {}},
+			expErr:   badRequest,
+			expCalls: []int{1, 0},
+		},
+		{
+			name:     "returns last error when all fail",
+			backends: []*fakeBackend{{err: unavailable}, {err: syscall.ECONNREFUSED}},
+			expErr:   syscall.ECONNREFUSED,
+			expCalls: []int{1, 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newFallbackProvider([]namedProvider{
+				{name: ProviderTypeOpenAI, provider: tc.backends[0]},
+				{name: ProviderTypeAnthropic, provider: tc.backends[1]},
+			})
+			ctx, md := withResponseMetadata(context.Background())
+			resp, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+			if tc.expErr != nil {
+				assert.ErrorIs(t, err, tc.expErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, "ok", resp.ID)
+			}
+			assert.Equal(t, tc.expProvider, md.Provider())
+			for i, b := range tc.backends {
+				assert.Equal(t, tc.expCalls[i], b.calls, "calls to backend %d", i)
+			}
+		})
+	}
+}
+
+func TestFallbackProvider_ChatCompletionStream(t *testing.T) {
+	unavailable := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+
+	for _, tc := range []struct {
+		name        string
+		backends    []*fakeBackend
+		expProvider ProviderType
+		expChunks   []ChatCompletionStreamResponse
+		expErr      error
+	}{
+		{
+			name:        "fails over when stream cannot be established",
+			backends:    []*fakeBackend{{err: unavailable}, {chunks: []ChatCompletionStreamResponse{streamChunk("a"), streamChunk("b")}}},
+			expProvider: ProviderTypeAnthropic,
+			expChunks:   []ChatCompletionStreamResponse{streamChunk("a"), streamChunk("b")},
+		},
+		{
+			name: "fails over when first chunk is an error",
+			backends: []*fakeBackend{
+				{chunks: []ChatCompletionStreamResponse{{Error: unavailable}}},
+				{chunks: []ChatCompletionStreamResponse{streamChunk("a")}},
+			},
+			expProvider: ProviderTypeAnthropic,
+			expChunks:   []ChatCompletionStreamResponse{streamChunk("a")},
+		},
+		{
+			name: "does not fail over after first chunk",
+			backends: []*fakeBackend{
+				{chunks: []ChatCompletionStreamResponse{streamChunk("a"), {Error: unavailable}}},
+				{chunks: []ChatCompletionStreamResponse{streamChunk("b")}},
+			},
+			expProvider: ProviderTypeOpenAI,
+			expChunks:   []ChatCompletionStreamResponse{streamChunk("a"), {Error: unavailable}},
+		},
+		{
+			name:     "does not fail over on client error",
+			backends: []*fakeBackend{{err: errBadRequest}, {chunks: []ChatCompletionStreamResponse{streamChunk("a")}}},
+			expErr:   errBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newFallbackProvider([]namedProvider{
+				{name: ProviderTypeOpenAI, provider: tc.backends[0]},
+				{name: ProviderTypeAnthropic, provider: tc.backends[1]},
+			})
+			ctx, md := withResponseMetadata(context.Background())
+			c, err := p.ChatCompletionStream(ctx, ChatCompletionRequest{Model: ModelBase})
+			if tc.expErr != nil {
+				assert.ErrorIs(t, err, tc.expErr)
+				return
+			}
+			require.NoError(t, err)
+			var chunks []ChatCompletionStreamResponse
+			for chunk := range c {
+				chunks = append(chunks, chunk)
+			}
+			assert.Equal(t, tc.expChunks, chunks)
+			assert.Equal(t, tc.expProvider, md.Provider())
+		})
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{name: "nil", err: nil, exp: false},
+		{name: "rate limited", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, exp: true},
+		{name: "server error", err: &openai.APIError{HTTPStatusCode: http.StatusBadGateway}, exp: true},
+		{name: "request error", err: &openai.RequestError{HTTPStatusCode: http.StatusServiceUnavailable}, exp: true},
+		{name: "client error", err: &openai.APIError{HTTPStatusCode: http.StatusUnauthorized}, exp: false},
+		{name: "bad request", err: errBadRequest, exp: false},
+		{name: "deadline exceeded", err: fmt.Errorf("wrapped: %w", context.DeadlineExceeded), exp: true},
+		{name: "connection refused", err: fmt.Errorf("dial: %w", syscall.ECONNREFUSED), exp: true},
+		{name: "unexpected eof", err: io.ErrUnexpectedEOF, exp: true},
+		{name: "canceled", err: context.Canceled, exp: false},
+		{name: "other", err: errors.New("boom"), exp: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.exp, isRetryableError(tc.err))
+		})
+	}
+}
+
+func TestCreateProviderWithFallbacks(t *testing.T) {
+	provider, err := createProvider(&Settings{
+		Provider:  ProviderTypeAnthropic,
+		Models:    defaultModelSettings(ProviderTypeAnthropic),
+		Fallbacks: []FallbackProvider{{Provider: ProviderTypeGemini}, {Provider: ProviderTypeLocal}},
+	})
+	require.NoError(t, err)
+	fp, ok := provider.(*fallbackProvider)
+	require.True(t, ok)
+	names := make([]ProviderType, 0, len(fp.backends))
+	for _, b := range fp.backends {
+		names = append(names, b.name)
+	}
+	assert.Equal(t, []ProviderType{ProviderTypeAnthropic, ProviderTypeGemini, ProviderTypeLocal}, names)
+}
+
+// newFallbackTestSettings returns settings using an OpenAI provider which
+// always fails with a 503, falling back to a local provider.
+func newFallbackTestSettings(t *testing.T) backend.AppInstanceSettings {
+	t.Helper()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprint(w, `{"error": {"message": "overloaded"}}`)
+	}))
+	t.Cleanup(failing.Close)
+	var requested string
+	local := newMockLocalServer(t, true, &requested)
+	t.Cleanup(local.Close)
+
+	return backend.AppInstanceSettings{
+		JSONData: []byte(fmt.Sprintf(`{
+			"provider": "openai",
+			"openAI": {"url": %q},
+			"local": {"url": %q},
+			"fallbacks": [{"provider": "local"}],
+			"retries": {"initialBackoffMilliseconds": 1}
+		}`, failing.URL, local.URL)),
+		DecryptedSecureJSONData: map[string]string{openAIKey: "abcd1234"},
+	}
+}
+
+func TestChatCompletionsFallbackProviderHeader(t *testing.T) {
+	ctx := context.Background()
+	settings := newFallbackTestSettings(t)
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app, ok := inst.(*App)
+	require.True(t, ok)
+
+	var r mockCallResourceResponseSender
+	err = app.CallResource(ctx, &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+		Method:        http.MethodPost,
+		Path:          "/llm/v1/chat/completions",
+		Body:          []byte(`{"model": "base", "messages": [{"role": "user", "content": "Hi"}]}`),
+	}, &r)
+	require.NoError(t, err)
+	require.NotNil(t, r.response)
+	require.Equal(t, http.StatusOK, r.response.Status, string(r.response.Body))
+	assert.Equal(t, string(ProviderTypeLocal), http.Header(r.response.Headers).Get(providerHeader))
+}
+
+func TestCheckHealthFallbackBackends(t *testing.T) {
+	ctx := context.Background()
+	settings := newFallbackTestSettings(t)
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app, ok := inst.(*App)
+	require.True(t, ok)
+
+	resp, err := app.CheckHealth(ctx, &backend.CheckHealthRequest{
+		PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+	})
+	require.NoError(t, err)
+	var details healthCheckDetails
+	require.NoError(t, json.Unmarshal(resp.JSONDetails, &details))
+
+	assert.True(t, details.LLMProvider.OK)
+	assert.True(t, details.LLMProvider.Models[ModelBase].OK)
+	require.Len(t, details.LLMProvider.Backends, 2)
+	assert.Equal(t, ProviderTypeOpenAI, details.LLMProvider.Backends[0].Provider)
+	assert.False(t, details.LLMProvider.Backends[0].OK)
+	assert.Equal(t, ProviderTypeLocal, details.LLMProvider.Backends[1].Provider)
+	assert.True(t, details.LLMProvider.Backends[1].OK)
+}
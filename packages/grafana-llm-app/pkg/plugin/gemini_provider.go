@@ -0,0 +1,725 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	defaultGeminiURL = "https://generativelanguage.googleapis.com"
+	vertexAIScope    = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// geminiProvider implements the LLMProvider interface using the Gemini
+// generateContent API, either directly via the Gemini API or via Vertex AI.
+// See: https://ai.google.dev/api/generate-content
+type geminiProvider struct {
+	settings GeminiSettings
+	models   *ModelSettings
+	client   *http.Client
+}
+
+func NewGeminiProvider(settings GeminiSettings, models *ModelSettings) (LLMProvider, error) {
+	client := &http.Client{
+		Transport: providerTransport(settings.retries, settings.httpTransport),
+	}
+	if settings.VertexAI {
+		ts, err := vertexAITokenSource(settings.serviceAccountJSON, outboundTransport(settings.httpTransport))
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = providerTransport(settings.retries, &oauth2.Transport{Source: ts, Base: outboundTransport(settings.httpTransport)})
+	}
+	return &geminiProvider{
+		settings: settings,
+		models:   models,
+		client:   client,
+	}, nil
+}
+
+// vertexAITokenSource creates an OAuth2 token source from a Google service
+// account key file, which fetches tokens using transport.
+func vertexAITokenSource(serviceAccountJSON string, transport http.RoundTripper) (oauth2.TokenSource, error) {
+	var key struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		PrivateKeyID string `json:"private_key_id"`
+		TokenURI     string `json:"token_uri"`
+	}
+	if err := json.Unmarshal([]byte(serviceAccountJSON), &key); err != nil {
+		return nil, fmt.Errorf("parse service account key: %w", err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, errors.New("service account key must contain client_email and private_key")
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	cfg := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		TokenURL:     key.TokenURI,
+		Scopes:       []string{vertexAIScope},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+	return cfg.TokenSource(ctx), nil
+}
+
+func (p *geminiProvider) Models(ctx context.Context) (ModelResponse, error) {
+	return ModelResponse{Data: modelInfos(p.models)}, nil
+}
+
+// endpoint returns the URL of the given method for the given model.
+func (p *geminiProvider) endpoint(model, method string) (string, error) {
+	var (
+		u   string
+		err error
+	)
+	if p.settings.VertexAI {
+		base := p.settings.URL
+		if base == "" || base == defaultGeminiURL {
+			base = fmt.Sprintf("https://%s-aiplatform.googleapis.com", p.settings.Location)
+		}
+		u, err = url.JoinPath(base, "v1", "projects", p.settings.Project, "locations", p.settings.Location, "publishers", "google", "models", model+":"+method)
+	} else {
+		u, err = url.JoinPath(p.settings.URL, "v1beta", "models", model+":"+method)
+	}
+	if err != nil {
+		return "", fmt.Errorf("join url: %w", err)
+	}
+	return u, nil
+}
+
+func (p *geminiProvider) doRequest(ctx context.Context, req ChatCompletionRequest, method string) (*http.Response, string, error) {
+	r := req.ChatCompletionRequest
+	ForceUserMessage(&r)
+	model := req.Model.toGemini(p.models)
+	log.DefaultLogger.Debug("model", "model", model)
+
+	body, err := openAIRequestToGemini(r)
+	if err != nil {
+		return nil, "", err
+	}
+	u, err := p.endpoint(model, method)
+	if err != nil {
+		return nil, "", err
+	}
+	if method == "streamGenerateContent" {
+		u += "?alt=sse"
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("marshal request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return nil, "", fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if !p.settings.VertexAI {
+		httpReq.Header.Set("x-goog-api-key", p.settings.apiKey)
+	}
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close() //nolint:errcheck
+		return nil, "", geminiError(resp)
+	}
+	return resp, model, nil
+}
+
+func (p *geminiProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, model, err := p.doRequest(ctx, req, "generateContent")
+	if err != nil {
+		log.DefaultLogger.Error("error creating gemini chat completion", "err", err)
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var gResp geminiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&gResp); err != nil {
+		return openai.ChatCompletionResponse{}, fmt.Errorf("decode response: %w", err)
+	}
+	return geminiResponseToOpenAI(gResp, model, 0), nil
+}
+
+func (p *geminiProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	resp, model, err := p.doRequest(ctx, req, "streamGenerateContent")
+	if err != nil {
+		log.DefaultLogger.Error("error establishing gemini stream", "err", err)
+		return nil, err
+	}
+
+	c := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer resp.Body.Close() //nolint:errcheck
+		defer close(c)
+
+		// Gemini does not index tool calls across chunks, so keep a running
+		// count to assign OpenAI tool call indexes.
+		toolCalls := 0
+		first := true
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			data, ok := strings.CutPrefix(line, "data:")
+			if !ok {
+				continue
+			}
+			var gResp geminiResponse
+			if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &gResp); err != nil {
+				c <- ChatCompletionStreamResponse{Error: fmt.Errorf("decode stream chunk: %w", err)}
+				return
+			}
+			full := geminiResponseToOpenAI(gResp, model, toolCalls)
+			chunk := openai.ChatCompletionStreamResponse{
+				ID:      full.ID,
+				Object:  "chat.completion.chunk",
+				Created: full.Created,
+				Model:   full.Model,
+			}
+			for _, choice := range full.Choices {
+				delta := openai.ChatCompletionStreamChoiceDelta{
+					Content:          choice.Message.Content,
+					ReasoningContent: choice.Message.ReasoningContent,
+				}
+				if first {
+					delta.Role = openai.ChatMessageRoleAssistant
+					first = false
+				}
+				for _, tc := range choice.Message.ToolCalls {
+					idx := toolCalls
+					toolCalls++
+					tc.Index = &idx
+					delta.ToolCalls = append(delta.ToolCalls, tc)
+				}
+				chunk.Choices = append(chunk.Choices, openai.ChatCompletionStreamChoice{
+					Index:        choice.Index,
+					Delta:        delta,
+					FinishReason: choice.FinishReason,
+				})
+			}
+			if gResp.UsageMetadata != nil {
+				usage := full.Usage
+				chunk.Usage = &usage
+			}
+			c <- ChatCompletionStreamResponse{ChatCompletionStreamResponse: chunk}
+		}
+		if err := scanner.Err(); err != nil {
+			log.DefaultLogger.Error("gemini stream error", "err", err)
+			c <- ChatCompletionStreamResponse{Error: err}
+		}
+	}()
+	return c, nil
+}
+
+// Embeddings is not supported by the Gemini provider.
+func (p *geminiProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	return openai.EmbeddingResponse{}, errEmbeddingsNotSupported
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+	FileData         *geminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type geminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	ID       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiFunctionCallingConfig struct {
+	Mode                 string   `json:"mode"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type geminiToolConfig struct {
+	FunctionCallingConfig geminiFunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature     *float32 `json:"temperature,omitempty"`
+	TopP            *float32 `json:"topP,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	CandidateCount  int      `json:"candidateCount,omitempty"`
+	Seed            *int     `json:"seed,omitempty"`
+}
+
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []geminiTool            `json:"tools,omitempty"`
+	ToolConfig        *geminiToolConfig       `json:"toolConfig,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiCandidate struct {
+	Content      geminiContent `json:"content"`
+	FinishReason string        `json:"finishReason"`
+	Index        int           `json:"index"`
+}
+
+type geminiUsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+}
+
+type geminiResponse struct {
+	Candidates    []geminiCandidate    `json:"candidates"`
+	UsageMetadata *geminiUsageMetadata `json:"usageMetadata,omitempty"`
+	ModelVersion  string               `json:"modelVersion"`
+	ResponseID    string               `json:"responseId"`
+}
+
+// openAIRequestToGemini translates an OpenAI chat completion request into a
+// Gemini generateContent request.
+func openAIRequestToGemini(r openai.ChatCompletionRequest) (geminiRequest, error) {
+	var req geminiRequest
+
+	// Tool results only reference the ID of the call, but Gemini requires the
+	// function name, so keep track of the names of previous calls.
+	toolNames := map[string]string{}
+	appendParts := func(role string, parts []geminiPart) {
+		if len(parts) == 0 {
+			return
+		}
+		if n := len(req.Contents); n > 0 && req.Contents[n-1].Role == role {
+			req.Contents[n-1].Parts = append(req.Contents[n-1].Parts, parts...)
+			return
+		}
+		req.Contents = append(req.Contents, geminiContent{Role: role, Parts: parts})
+	}
+
+	for _, m := range r.Messages {
+		switch m.Role {
+		case openai.ChatMessageRoleSystem, openai.ChatMessageRoleDeveloper:
+			parts, err := openAIContentToGemini(m)
+			if err != nil {
+				return geminiRequest{}, err
+			}
+			if req.SystemInstruction == nil {
+				req.SystemInstruction = &geminiContent{}
+			}
+			req.SystemInstruction.Parts = append(req.SystemInstruction.Parts, parts...)
+		case openai.ChatMessageRoleUser:
+			parts, err := openAIContentToGemini(m)
+			if err != nil {
+				return geminiRequest{}, err
+			}
+			appendParts("user", parts)
+		case openai.ChatMessageRoleAssistant:
+			parts, err := openAIContentToGemini(m)
+			if err != nil {
+				return geminiRequest{}, err
+			}
+			for _, tc := range m.ToolCalls {
+				toolNames[tc.ID] = tc.Function.Name
+				args := json.RawMessage(tc.Function.Arguments)
+				if len(strings.TrimSpace(tc.Function.Arguments)) == 0 {
+					args = json.RawMessage("{}")
+				}
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					ID:   tc.ID,
+					Name: tc.Function.Name,
+					Args: args,
+				}})
+			}
+			appendParts("model", parts)
+		case openai.ChatMessageRoleTool:
+			name := toolNames[m.ToolCallID]
+			if name == "" {
+				name = m.Name
+			}
+			if name == "" {
+				return geminiRequest{}, fmt.Errorf("%w: no tool call found for tool result: %s", errBadRequest, m.ToolCallID)
+			}
+			// The response must be a JSON object, so wrap anything else.
+			response := map[string]any{}
+			if err := json.Unmarshal([]byte(m.Content), &response); err != nil {
+				response = map[string]any{"content": m.Content}
+			}
+			appendParts("user", []geminiPart{{FunctionResponse: &geminiFunctionResponse{
+				ID:       m.ToolCallID,
+				Name:     name,
+				Response: response,
+			}}})
+		default:
+			return geminiRequest{}, fmt.Errorf("%w: unsupported message role: %s", errBadRequest, m.Role)
+		}
+	}
+
+	if len(r.Tools) > 0 {
+		tool := geminiTool{}
+		for _, t := range r.Tools {
+			if t.Type != openai.ToolTypeFunction || t.Function == nil {
+				return geminiRequest{}, fmt.Errorf("%w: unsupported tool type: %s", errBadRequest, t.Type)
+			}
+			params, err := openAISchemaToGemini(t.Function.Parameters)
+			if err != nil {
+				return geminiRequest{}, fmt.Errorf("%w: invalid parameters for tool %s: %s", errBadRequest, t.Function.Name, err)
+			}
+			tool.FunctionDeclarations = append(tool.FunctionDeclarations, geminiFunctionDeclaration{
+				Name:        t.Function.Name,
+				Description: t.Function.Description,
+				Parameters:  params,
+			})
+		}
+		req.Tools = []geminiTool{tool}
+	}
+	if r.ToolChoice != nil {
+		cfg, err := openAIToolChoiceToGemini(r.ToolChoice)
+		if err != nil {
+			return geminiRequest{}, err
+		}
+		req.ToolConfig = &geminiToolConfig{FunctionCallingConfig: cfg}
+	}
+
+	cfg := geminiGenerationConfig{
+		MaxOutputTokens: r.MaxCompletionTokens,
+		StopSequences:   r.Stop,
+		CandidateCount:  r.N,
+		Seed:            r.Seed,
+	}
+	if cfg.MaxOutputTokens == 0 {
+		cfg.MaxOutputTokens = r.MaxTokens
+	}
+	if r.Temperature != 0 {
+		cfg.Temperature = &r.Temperature
+	}
+	if r.TopP != 0 {
+		cfg.TopP = &r.TopP
+	}
+	req.GenerationConfig = &cfg
+	return req, nil
+}
+
+// geminiSchemaKeywords are the JSON schema keywords Gemini accepts in function
+// parameters. Requests using any others, such as additionalProperties, $schema
+// or $defs, are rejected.
+var geminiSchemaKeywords = map[string]bool{
+	"type": true, "format": true, "title": true, "description": true, "nullable": true, "enum": true,
+	"default": true, "example": true, "items": true, "minItems": true, "maxItems": true,
+	"properties": true, "required": true, "minProperties": true, "maxProperties": true, "propertyOrdering": true,
+	"minLength": true, "maxLength": true, "pattern": true, "minimum": true, "maximum": true, "anyOf": true,
+}
+
+// maxGeminiSchemaDepth limits how deeply references are inlined, since
+// schemas may be recursive.
+const maxGeminiSchemaDepth = 16
+
+// openAISchemaToGemini converts the JSON schema of an OpenAI tool's parameters
+// into the subset Gemini accepts. Local references are inlined, nullable types
+// are converted to nullable, and unsupported keywords are dropped.
+func openAISchemaToGemini(params any) (map[string]any, error) {
+	if params == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return nil, err
+	}
+	if schema == nil {
+		return nil, nil
+	}
+	defs := map[string]any{}
+	for _, key := range []string{"$defs", "definitions"} {
+		if d, ok := schema[key].(map[string]any); ok {
+			for name, def := range d {
+				defs["#/"+key+"/"+name] = def
+			}
+		}
+	}
+	return geminiSchema(schema, defs, 0), nil
+}
+
+func geminiSchema(schema map[string]any, defs map[string]any, depth int) map[string]any {
+	if ref, ok := schema["$ref"].(string); ok {
+		def, ok := defs[ref].(map[string]any)
+		if !ok || depth >= maxGeminiSchemaDepth {
+			return map[string]any{"type": "object"}
+		}
+		return geminiSchema(def, defs, depth+1)
+	}
+	out := make(map[string]any, len(schema))
+	for key, v := range schema {
+		if !geminiSchemaKeywords[key] {
+			continue
+		}
+		switch key {
+		case "type":
+			// JSON schema allows a list of types, but Gemini only allows one,
+			// so ["string", "null"] becomes a nullable string.
+			types, ok := v.([]any)
+			if !ok {
+				out[key] = v
+				continue
+			}
+			for _, t := range types {
+				if t == "null" {
+					out["nullable"] = true
+				} else if _, ok := out[key]; !ok {
+					out[key] = t
+				}
+			}
+		case "properties":
+			props, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			converted := make(map[string]any, len(props))
+			for name, prop := range props {
+				if p, ok := prop.(map[string]any); ok {
+					converted[name] = geminiSchema(p, defs, depth+1)
+				}
+			}
+			out[key] = converted
+		case "items":
+			if items, ok := v.(map[string]any); ok {
+				out[key] = geminiSchema(items, defs, depth+1)
+			}
+		case "anyOf":
+			schemas, ok := v.([]any)
+			if !ok {
+				continue
+			}
+			converted := make([]any, 0, len(schemas))
+			for _, s := range schemas {
+				if m, ok := s.(map[string]any); ok {
+					converted = append(converted, geminiSchema(m, defs, depth+1))
+				}
+			}
+			out[key] = converted
+		default:
+			out[key] = v
+		}
+	}
+	return out
+}
+
+// openAIContentToGemini converts the text and image content of an OpenAI
+// message into Gemini parts.
+func openAIContentToGemini(m openai.ChatCompletionMessage) ([]geminiPart, error) {
+	var parts []geminiPart
+	if m.Content != "" {
+		parts = append(parts, geminiPart{Text: m.Content})
+	}
+	for _, part := range m.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			if part.Text != "" {
+				parts = append(parts, geminiPart{Text: part.Text})
+			}
+		case openai.ChatMessagePartTypeImageURL:
+			if part.ImageURL == nil {
+				continue
+			}
+			u := part.ImageURL.URL
+			if !strings.HasPrefix(u, "data:") {
+				parts = append(parts, geminiPart{FileData: &geminiFileData{FileURI: u}})
+				continue
+			}
+			mediaType, data, err := parseImageDataURL(u)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, geminiPart{InlineData: &geminiBlob{MimeType: mediaType, Data: data}})
+		}
+	}
+	return parts, nil
+}
+
+// openAIToolChoiceToGemini converts an OpenAI tool choice, which is either a
+// string or a tool choice object, to a Gemini function calling config.
+func openAIToolChoiceToGemini(choice any) (geminiFunctionCallingConfig, error) {
+	switch c := choice.(type) {
+	case string:
+		switch c {
+		case "none":
+			return geminiFunctionCallingConfig{Mode: "NONE"}, nil
+		case "auto":
+			return geminiFunctionCallingConfig{Mode: "AUTO"}, nil
+		case "required":
+			return geminiFunctionCallingConfig{Mode: "ANY"}, nil
+		}
+		return geminiFunctionCallingConfig{}, fmt.Errorf("%w: unsupported tool choice: %s", errBadRequest, c)
+	default:
+		b, err := json.Marshal(choice)
+		if err != nil {
+			return geminiFunctionCallingConfig{}, fmt.Errorf("%w: invalid tool choice: %s", errBadRequest, err)
+		}
+		var tc openai.ToolChoice
+		if err := json.Unmarshal(b, &tc); err != nil || tc.Function.Name == "" {
+			return geminiFunctionCallingConfig{}, fmt.Errorf("%w: invalid tool choice: %s", errBadRequest, string(b))
+		}
+		return geminiFunctionCallingConfig{Mode: "ANY", AllowedFunctionNames: []string{tc.Function.Name}}, nil
+	}
+}
+
+// geminiResponseToOpenAI converts a Gemini generateContent response, or a
+// single chunk of a streamed response, to an OpenAI chat completion response.
+// Tool calls without an ID are numbered starting at toolCallOffset.
+func geminiResponseToOpenAI(resp geminiResponse, model string, toolCallOffset int) openai.ChatCompletionResponse {
+	out := openai.ChatCompletionResponse{
+		ID:      resp.ResponseID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   resp.ModelVersion,
+	}
+	if out.Model == "" {
+		out.Model = model
+	}
+	for i, candidate := range resp.Candidates {
+		message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+		var content, reasoning strings.Builder
+		for _, part := range candidate.Content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				id := part.FunctionCall.ID
+				if id == "" {
+					id = fmt.Sprintf("call_%d_%d", i, toolCallOffset+len(message.ToolCalls))
+				}
+				args := string(part.FunctionCall.Args)
+				if args == "" {
+					args = "{}"
+				}
+				message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+					ID:       id,
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: part.FunctionCall.Name, Arguments: args},
+				})
+			case part.Thought:
+				reasoning.WriteString(part.Text)
+			default:
+				content.WriteString(part.Text)
+			}
+		}
+		message.Content = content.String()
+		message.ReasoningContent = reasoning.String()
+		finishReason := geminiFinishReasonToOpenAI(candidate.FinishReason)
+		if finishReason == openai.FinishReasonStop && len(message.ToolCalls) > 0 {
+			finishReason = openai.FinishReasonToolCalls
+		}
+		out.Choices = append(out.Choices, openai.ChatCompletionChoice{
+			Index:        candidate.Index,
+			Message:      message,
+			FinishReason: finishReason,
+		})
+	}
+	if u := resp.UsageMetadata; u != nil {
+		out.Usage = openai.Usage{
+			PromptTokens:            u.PromptTokenCount,
+			CompletionTokens:        u.CandidatesTokenCount + u.ThoughtsTokenCount,
+			TotalTokens:             u.TotalTokenCount,
+			PromptTokensDetails:     &openai.PromptTokensDetails{CachedTokens: u.CachedContentTokenCount},
+			CompletionTokensDetails: &openai.CompletionTokensDetails{ReasoningTokens: u.ThoughtsTokenCount},
+		}
+	}
+	return out
+}
+
+func geminiFinishReasonToOpenAI(reason string) openai.FinishReason {
+	switch reason {
+	case "":
+		return ""
+	case "STOP":
+		return openai.FinishReasonStop
+	case "MAX_TOKENS":
+		return openai.FinishReasonLength
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return openai.FinishReasonContentFilter
+	}
+	return openai.FinishReasonStop
+}
+
+// geminiError converts a non-2xx Gemini response into an OpenAI API error so it
+// is reported to clients in the same way as other providers' errors.
+func geminiError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	// Gemini sometimes returns errors as a single element array.
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		var errs []json.RawMessage
+		if json.Unmarshal(b, &errs) == nil && len(errs) > 0 {
+			b = errs[0]
+		}
+	}
+	body := struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}{}
+	message := string(b)
+	if json.Unmarshal(b, &body) == nil && body.Error.Message != "" {
+		message = body.Error.Message
+	}
+	return &openai.APIError{
+		Code:           body.Error.Status,
+		Message:        message,
+		Type:           body.Error.Status,
+		HTTPStatusCode: resp.StatusCode,
+	}
+}
@@ -0,0 +1,352 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMockGeminiServer returns a server which captures the request body sent to
+// the given path and responds with the given body.
+func newMockGeminiServer(t *testing.T, path string, status int, body string, captured *map[string]any) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, path, r.URL.Path)
+		assert.Equal(t, "test-key", r.Header.Get("x-goog-api-key"))
+		if captured != nil {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(captured))
+		}
+		if r.URL.Query().Get("alt") == "sse" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(status)
+		_, _ = fmt.Fprint(w, body)
+	}))
+}
+
+func newTestGeminiProvider(t *testing.T, settings GeminiSettings) LLMProvider {
+	t.Helper()
+	provider, err := createProvider(&Settings{Provider: ProviderTypeGemini, Gemini: settings})
+	require.NoError(t, err)
+	require.IsType(t, &geminiProvider{}, provider)
+	return provider
+}
+
+func TestGeminiProvider_ChatCompletion(t *testing.T) {
+	var captured map[string]any
+	server := newMockGeminiServer(t, "/v1beta/models/gemini-2.5-pro:generateContent", http.StatusOK, `{
+		"candidates": [{
+			"content": {
+				"role": "model",
+				"parts": [
+					{"text": "Let me check.", "thought": true},
+					{"text": "Checking the weather."},
+					{"functionCall": {"name": "get_weather", "args": {"city": "London"}}}
+				]
+			},
+			"finishReason": "STOP",
+			"index": 0
+		}],
+		"usageMetadata": {"promptTokenCount": 10, "candidatesTokenCount": 7, "thoughtsTokenCount": 3, "totalTokenCount": 20},
+		"modelVersion": "gemini-2.5-pro",
+		"responseId": "resp_123"
+	}`, &captured)
+	defer server.Close()
+
+	provider := newTestGeminiProvider(t, GeminiSettings{URL: server.URL, apiKey: "test-key"})
+
+	resp, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model: ModelLarge,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: "You are helpful."},
+				{Role: openai.ChatMessageRoleUser, Content: "What's the weather in Paris?"},
+				{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{
+					ID:       "call_0",
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+				}}},
+				{Role: openai.ChatMessageRoleTool, ToolCallID: "call_0", Content: "sunny"},
+				{Role: openai.ChatMessageRoleUser, Content: "And London?"},
+			},
+			Tools: []openai.Tool{{
+				Type: openai.ToolTypeFunction,
+				Function: &openai.FunctionDefinition{
+					Name:        "get_weather",
+					Description: "Get the weather",
+					Parameters: map[string]any{
+						"type":                 "object",
+						"properties":           map[string]any{"city": map[string]any{"type": "string"}},
+						"additionalProperties": false,
+					},
+				},
+			}},
+			ToolChoice:  "required",
+			Temperature: 0.5,
+			MaxTokens:   100,
+		},
+	})
+	require.NoError(t, err)
+
+	// Check the request was translated correctly.
+	assert.Equal(t, map[string]any{"parts": []any{map[string]any{"text": "You are helpful."}}}, captured["systemInstruction"])
+	contents := captured["contents"].([]any)
+	// Consecutive user turns, including tool results, are merged.
+	require.Len(t, contents, 3)
+	assert.Equal(t, "user", contents[0].(map[string]any)["role"])
+	assert.Equal(t, map[string]any{
+		"role": "model",
+		"parts": []any{map[string]any{"functionCall": map[string]any{
+			"id":   "call_0",
+			"name": "get_weather",
+			"args": map[string]any{"city": "Paris"},
+		}}},
+	}, contents[1])
+	assert.Equal(t, map[string]any{
+		"role": "user",
+		"parts": []any{
+			map[string]any{"functionResponse": map[string]any{
+				"id":       "call_0",
+				"name":     "get_weather",
+				"response": map[string]any{"content": "sunny"},
+			}},
+			map[string]any{"text": "And London?"},
+		},
+	}, contents[2])
+	assert.Equal(t, map[string]any{"functionCallingConfig": map[string]any{"mode": "ANY"}}, captured["toolConfig"])
+	assert.Equal(t, map[string]any{"temperature": 0.5, "maxOutputTokens": float64(100)}, captured["generationConfig"])
+	tools := captured["tools"].([]any)
+	require.Len(t, tools, 1)
+	declaration := tools[0].(map[string]any)["functionDeclarations"].([]any)[0].(map[string]any)
+	assert.Equal(t, "get_weather", declaration["name"])
+	assert.Equal(t, map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"city": map[string]any{"type": "string"}},
+	}, declaration["parameters"], "keywords Gemini doesn't support should be removed")
+
+	// Check the response was translated correctly.
+	assert.Equal(t, "resp_123", resp.ID)
+	assert.Equal(t, "gemini-2.5-pro", resp.Model)
+	require.Len(t, resp.Choices, 1)
+	choice := resp.Choices[0]
+	assert.Equal(t, openai.FinishReasonToolCalls, choice.FinishReason)
+	assert.Equal(t, "Checking the weather.", choice.Message.Content)
+	assert.Equal(t, "Let me check.", choice.Message.ReasoningContent)
+	require.Len(t, choice.Message.ToolCalls, 1)
+	assert.Equal(t, "get_weather", choice.Message.ToolCalls[0].Function.Name)
+	assert.JSONEq(t, `{"city":"London"}`, choice.Message.ToolCalls[0].Function.Arguments)
+	assert.NotEmpty(t, choice.Message.ToolCalls[0].ID)
+	assert.Equal(t, 10, resp.Usage.PromptTokens)
+	assert.Equal(t, 10, resp.Usage.CompletionTokens)
+	assert.Equal(t, 20, resp.Usage.TotalTokens)
+}
+
+func TestOpenAISchemaToGemini(t *testing.T) {
+	params := json.RawMessage(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"additionalProperties": false,
+		"properties": {
+			"query": {"type": "string", "description": "The query"},
+			"limit": {"type": ["integer", "null"], "minimum": 1},
+			"labels": {"type": "array", "items": {"$ref": "#/$defs/label"}}
+		},
+		"required": ["query"],
+		"$defs": {
+			"label": {"type": "object", "additionalProperties": {"type": "string"}, "properties": {"name": {"type": "string"}}}
+		}
+	}`)
+	schema, err := openAISchemaToGemini(params)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"query":  map[string]any{"type": "string", "description": "The query"},
+			"limit":  map[string]any{"type": "integer", "nullable": true, "minimum": float64(1)},
+			"labels": map[string]any{"type": "array", "items": map[string]any{"type": "object", "properties": map[string]any{"name": map[string]any{"type": "string"}}}},
+		},
+		"required": []any{"query"},
+	}, schema)
+
+	// Recursive references are only inlined up to a limit.
+	schema, err = openAISchemaToGemini(map[string]any{"$ref": "#/$defs/node", "$defs": map[string]any{
+		"node": map[string]any{"type": "object", "properties": map[string]any{"child": map[string]any{"$ref": "#/$defs/node"}}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "object", schema["type"])
+
+	schema, err = openAISchemaToGemini(nil)
+	require.NoError(t, err)
+	assert.Nil(t, schema)
+}
+
+func TestGeminiProvider_ChatCompletionStream(t *testing.T) {
+	server := newMockGeminiServer(t, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", http.StatusOK,
+		`data: {"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello"}]}, "index": 0}], "modelVersion": "gemini-2.5-flash"}
+
+data: {"candidates": [{"content": {"role": "model", "parts": [{"text": " world"}, {"functionCall": {"name": "get_weather", "args": {}}}]}, "finishReason": "STOP", "index": 0}], "usageMetadata": {"promptTokenCount": 5, "candidatesTokenCount": 2, "totalTokenCount": 7}, "modelVersion": "gemini-2.5-flash"}
+
+`, nil)
+	defer server.Close()
+
+	provider := newTestGeminiProvider(t, GeminiSettings{URL: server.URL, apiKey: "test-key"})
+
+	stream, err := provider.ChatCompletionStream(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		},
+	})
+	require.NoError(t, err)
+
+	var chunks []openai.ChatCompletionStreamResponse
+	for resp := range stream {
+		require.NoError(t, resp.Error)
+		chunks = append(chunks, resp.ChatCompletionStreamResponse)
+	}
+	require.Len(t, chunks, 2)
+
+	assert.Equal(t, openai.ChatMessageRoleAssistant, chunks[0].Choices[0].Delta.Role)
+	assert.Equal(t, "Hello", chunks[0].Choices[0].Delta.Content)
+	assert.Empty(t, chunks[0].Choices[0].FinishReason)
+
+	assert.Empty(t, chunks[1].Choices[0].Delta.Role)
+	assert.Equal(t, " world", chunks[1].Choices[0].Delta.Content)
+	require.Len(t, chunks[1].Choices[0].Delta.ToolCalls, 1)
+	require.NotNil(t, chunks[1].Choices[0].Delta.ToolCalls[0].Index)
+	assert.Equal(t, 0, *chunks[1].Choices[0].Delta.ToolCalls[0].Index)
+	assert.Equal(t, "{}", chunks[1].Choices[0].Delta.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, openai.FinishReasonToolCalls, chunks[1].Choices[0].FinishReason)
+	require.NotNil(t, chunks[1].Usage)
+	assert.Equal(t, 7, chunks[1].Usage.TotalTokens)
+}
+
+func TestGeminiProvider_ErrorHandling(t *testing.T) {
+	server := newMockGeminiServer(t, "/v1beta/models/gemini-2.5-flash:generateContent", http.StatusTooManyRequests,
+		`{"error": {"code": 429, "message": "Resource has been exhausted", "status": "RESOURCE_EXHAUSTED"}}`, nil)
+	defer server.Close()
+
+	provider := newTestGeminiProvider(t, GeminiSettings{URL: server.URL, apiKey: "test-key"})
+
+	_, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		},
+	})
+	var apiErr *openai.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.HTTPStatusCode)
+	assert.Equal(t, "Resource has been exhausted", apiErr.Message)
+}
+
+func TestGeminiProvider_InvalidRequest(t *testing.T) {
+	provider := newTestGeminiProvider(t, GeminiSettings{URL: "http://localhost:0", apiKey: "test-key"})
+
+	_, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "Hi"},
+				{Role: openai.ChatMessageRoleTool, ToolCallID: "unknown", Content: "result"},
+			},
+		},
+	})
+	require.ErrorIs(t, err, errBadRequest)
+}
+
+func TestGeminiProvider_VertexAI(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprint(w, `{"access_token": "vertex-token", "token_type": "Bearer", "expires_in": 3600}`)
+		case "/v1/projects/my-project/locations/europe-west4/publishers/google/models/gemini-2.5-flash:generateContent":
+			assert.Equal(t, "Bearer vertex-token", r.Header.Get("Authorization"))
+			assert.Empty(t, r.Header.Get("x-goog-api-key"))
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprint(w, `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hi"}]}, "finishReason": "STOP"}]}`)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	serviceAccount, err := json.Marshal(map[string]string{
+		"client_email": "test@my-project.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    server.URL + "/token",
+	})
+	require.NoError(t, err)
+
+	// Tokens are fetched with the outbound transport, so that they can be
+	// fetched through a proxy.
+	var paths []string
+	provider := newTestGeminiProvider(t, GeminiSettings{
+		URL:                server.URL,
+		VertexAI:           true,
+		Project:            "my-project",
+		Location:           "europe-west4",
+		serviceAccountJSON: string(serviceAccount),
+		httpTransport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			paths = append(paths, r.URL.Path)
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	})
+
+	resp, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, "Hi", resp.Choices[0].Message.Content)
+	assert.Equal(t, openai.FinishReasonStop, resp.Choices[0].FinishReason)
+	assert.Equal(t, []string{"/token", "/v1/projects/my-project/locations/europe-west4/publishers/google/models/gemini-2.5-flash:generateContent"}, paths)
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestGeminiSettings_Configured(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		settings GeminiSettings
+		expected bool
+	}{
+		{"no key", GeminiSettings{}, false},
+		{"api key", GeminiSettings{apiKey: "key"}, true},
+		{"vertex without service account", GeminiSettings{VertexAI: true, Project: "p", apiKey: "key"}, false},
+		{"vertex without project", GeminiSettings{VertexAI: true, serviceAccountJSON: "{}"}, false},
+		{"vertex", GeminiSettings{VertexAI: true, Project: "p", serviceAccountJSON: "{}"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := Settings{Provider: ProviderTypeGemini, Gemini: tc.settings}
+			assert.Equal(t, tc.expected, s.Configured())
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/sashabaranov/go-openai"
@@ -15,6 +14,7 @@ type grafanaProvider struct {
 	settings LLMGatewaySettings
 	tenant   string
 	gcomKey  string
+	models   *ModelSettings
 	oc       *openai.Client
 }
 
@@ -30,8 +30,7 @@ func (t *TenantRoundTripper) RoundTrip(r *http.Request) (*http.Response, error)
 
 func NewGrafanaProvider(settings Settings) (LLMProvider, error) {
 	client := &http.Client{
-		Timeout:   2 * time.Minute,
-		Transport: &TenantRoundTripper{next: http.DefaultTransport, tenant: settings.Tenant},
+		Transport: providerTransport(settings.Retries, &TenantRoundTripper{next: outboundTransport(settings.httpTransport), tenant: settings.Tenant}),
 	}
 	cfg := openai.DefaultConfig(fmt.Sprintf("%s:%s", settings.Tenant, settings.GrafanaComAPIKey))
 	base, err := url.JoinPath(settings.LLMGateway.URL, "/openai/v1")
@@ -44,6 +43,7 @@ func NewGrafanaProvider(settings Settings) (LLMProvider, error) {
 		settings: settings.LLMGateway,
 		tenant:   settings.Tenant,
 		gcomKey:  settings.GrafanaComAPIKey,
+		models:   settings.Models,
 		oc:       openai.NewClientWithConfig(cfg),
 	}, nil
 }
@@ -79,3 +79,15 @@ func (p *grafanaProvider) ChatCompletionStream(ctx context.Context, req ChatComp
 
 	return streamOpenAIRequest(ctx, r, p.oc)
 }
+
+func (p *grafanaProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	r := req.EmbeddingRequest
+	r.Model = openai.EmbeddingModel(req.Model.toEmbedding(ProviderTypeGrafana, p.models))
+
+	resp, err := p.oc.CreateEmbeddings(ctx, r)
+	if err != nil {
+		log.DefaultLogger.Error("error creating grafana embeddings", "err", err)
+		return openai.EmbeddingResponse{}, err
+	}
+	return resp, nil
+}
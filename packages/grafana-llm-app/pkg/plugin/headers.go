@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// HeaderSettings is an extra header sent with every request to a provider,
+// for example to identify the team or cost center to a gateway.
+type HeaderSettings struct {
+	// Name is the name of the header.
+	Name string `json:"name"`
+	// Value is the value of the header. It may refer to the user making the
+	// request with the placeholders ${user.login}, ${user.email},
+	// ${user.name}, ${user.role} and ${org.id}.
+	Value string `json:"value"`
+	// SecureKey is the key of the secure JSON data holding the value, for
+	// headers which carry credentials. If set, Value is ignored and
+	// placeholders aren't expanded.
+	SecureKey string `json:"secureKey"`
+
+	// secret is the value read from SecureKey.
+	secret string
+}
+
+// headerPlaceholder matches the placeholders in header values.
+var headerPlaceholder = regexp.MustCompile(`\$\{([a-z.]+)\}`)
+
+// headerPlaceholderValue returns the value of a placeholder for the user and
+// org of a request, and whether the placeholder is known.
+func headerPlaceholderValue(name string, pCtx backend.PluginContext) (string, bool) {
+	user := pCtx.User
+	if user == nil {
+		user = &backend.User{}
+	}
+	switch name {
+	case "user.login":
+		return user.Login, true
+	case "user.email":
+		return user.Email, true
+	case "user.name":
+		return user.Name, true
+	case "user.role":
+		return user.Role, true
+	case "org.id":
+		if pCtx.OrgID == 0 {
+			return "", true
+		}
+		return strconv.FormatInt(pCtx.OrgID, 10), true
+	}
+	return "", false
+}
+
+// validate returns an error if the header can't be sent.
+func (h HeaderSettings) validate() error {
+	if h.Name == "" || strings.ContainsFunc(h.Name, func(r rune) bool { return !isHeaderTokenChar(r) }) {
+		return fmt.Errorf("invalid header name %q", h.Name)
+	}
+	if h.SecureKey != "" {
+		if h.secret == "" {
+			return fmt.Errorf("header %s: secure JSON data %s is empty", h.Name, h.SecureKey)
+		}
+		return nil
+	}
+	for _, m := range headerPlaceholder.FindAllStringSubmatch(h.Value, -1) {
+		if _, ok := headerPlaceholderValue(m[1], backend.PluginContext{}); !ok {
+			return fmt.Errorf("header %s: unknown placeholder %s", h.Name, m[0])
+		}
+	}
+	return nil
+}
+
+// isHeaderTokenChar reports whether r may appear in a header name.
+func isHeaderTokenChar(r rune) bool {
+	if r > unicode.MaxASCII || r <= ' ' || r == 0x7f {
+		return false
+	}
+	return !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+}
+
+// value returns the value of the header for the user and org of a request.
+func (h HeaderSettings) value(pCtx backend.PluginContext) string {
+	if h.SecureKey != "" {
+		return h.secret
+	}
+	return headerPlaceholder.ReplaceAllStringFunc(h.Value, func(placeholder string) string {
+		v, _ := headerPlaceholderValue(headerPlaceholder.FindStringSubmatch(placeholder)[1], pCtx)
+		// Users choose their own names, so make sure they can't add headers.
+		return strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, v)
+	})
+}
+
+// loadHeaders reads the secret values of headers from the secure JSON data,
+// dropping any headers which can't be sent.
+func loadHeaders(headers []HeaderSettings, secrets map[string]string) []HeaderSettings {
+	loaded := make([]HeaderSettings, 0, len(headers))
+	for _, h := range headers {
+		h.secret = secrets[h.SecureKey]
+		if err := h.validate(); err != nil {
+			log.DefaultLogger.Warn("Ignoring custom provider header", "err", err)
+			continue
+		}
+		loaded = append(loaded, h)
+	}
+	return loaded
+}
+
+// headerTransport adds custom headers to each request, expanding their
+// placeholders for the user and org in the request's context.
+type headerTransport struct {
+	next    http.RoundTripper
+	headers []HeaderSettings
+}
+
+// withHeaders returns next, adding the given headers to each request. Headers
+// are set before retries so that every attempt carries them.
+func withHeaders(headers []HeaderSettings, next http.RoundTripper) http.RoundTripper {
+	if len(headers) == 0 {
+		return next
+	}
+	return &headerTransport{next: next, headers: headers}
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pCtx := backend.PluginConfigFromContext(req.Context())
+	req = req.Clone(req.Context())
+	for _, h := range t.headers {
+		// Headers whose value is empty, e.g. because the request isn't
+		// made on behalf of a user, aren't sent.
+		if v := h.value(pCtx); v != "" {
+			req.Header.Set(h.Name, v)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
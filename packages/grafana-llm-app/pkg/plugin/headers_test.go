@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHeaders(t *testing.T) {
+	headers := loadHeaders([]HeaderSettings{
+		{Name: "X-Team", Value: "observability"},
+		{Name: "X-Gateway-Token", SecureKey: "gatewayToken"},
+		{Name: "X-User", Value: "${user.login}@${org.id}"},
+		{Name: "X-Missing-Secret", SecureKey: "missing"},
+		{Name: "X-Unknown", Value: "${user.password}"},
+		{Name: "Not A Header", Value: "x"},
+		{Value: "no name"},
+	}, map[string]string{"gatewayToken": "s3cret"})
+	require.Len(t, headers, 3)
+	assert.Equal(t, "X-Team", headers[0].Name)
+	assert.Equal(t, "X-Gateway-Token", headers[1].Name)
+	assert.Equal(t, "s3cret", headers[1].secret)
+	assert.Equal(t, "X-User", headers[2].Name)
+}
+
+func TestHeaderTransport(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer server.Close()
+	rt := withHeaders(loadHeaders([]HeaderSettings{
+		{Name: "X-Team", Value: "observability"},
+		{Name: "X-Gateway-Token", SecureKey: "gatewayToken", Value: "${user.login}"},
+		{Name: "X-User", Value: "${user.login};${user.role};${org.id}"},
+		{Name: "X-Email", Value: "${user.email}"},
+	}, map[string]string{"gatewayToken": "${org.id}"}), http.DefaultTransport)
+
+	get := func(ctx context.Context) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Empty(t, req.Header, "the caller's request should not be modified")
+	}
+
+	get(backend.WithPluginContext(context.Background(), backend.PluginContext{
+		OrgID: 2,
+		User:  &backend.User{Login: "alice\r\nX-Injected: true", Role: "Editor"},
+	}))
+	assert.Equal(t, "observability", got.Get("X-Team"))
+	assert.Equal(t, "${org.id}", got.Get("X-Gateway-Token"), "placeholders should not be expanded in secrets")
+	assert.Equal(t, "aliceX-Injected: true;Editor;2", got.Get("X-User"))
+	assert.Empty(t, got.Get("X-Injected"))
+	_, ok := got["X-Email"]
+	assert.False(t, ok, "headers with empty values should not be sent")
+
+	get(context.Background())
+	assert.Equal(t, "observability", got.Get("X-Team"))
+	assert.Equal(t, ";;", got.Get("X-User"))
+}
+
+func TestChatCompletionsHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(answerResponse("hi"))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{
+		JSONData: []byte(fmt.Sprintf(`{
+			"provider": "openai",
+			"openAI": {
+				"url": %q,
+				"headers": [
+					{"name": "X-Cost-Center", "value": "1234"},
+					{"name": "X-Gateway-Token", "secureKey": "gatewayToken"},
+					{"name": "X-Grafana-User", "value": "${user.login}"}
+				]
+			}
+		}`, server.URL)),
+		DecryptedSecureJSONData: map[string]string{openAIKey: "abcd1234", "gatewayToken": "s3cret"},
+	}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	var r mockCallResourceResponseSender
+	err = app.CallResource(ctx, &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{OrgID: 1, User: &backend.User{Login: "alice"}, AppInstanceSettings: &settings},
+		Method:        http.MethodPost,
+		Path:          "/llm/v1/chat/completions",
+		Body:          []byte(`{"model": "base", "messages": [{"role": "user", "content": "hi"}]}`),
+	}, &r)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, r.response.Status, string(r.response.Body))
+	assert.Equal(t, "1234", got.Get("X-Cost-Center"))
+	assert.Equal(t, "s3cret", got.Get("X-Gateway-Token"))
+	assert.Equal(t, "alice", got.Get("X-Grafana-User"))
+	assert.Equal(t, "Bearer abcd1234", got.Get("Authorization"))
+}
@@ -11,8 +11,6 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
-var supportedModels = []Model{ModelBase, ModelLarge}
-
 type modelHealth struct {
 	OK       bool   `json:"ok"`
 	Error    string `json:"error,omitempty"`
@@ -25,6 +23,20 @@ type llmProviderHealthDetails struct {
 	Error      string                `json:"error,omitempty"`
 	Response   any                   `json:"response,omitempty"`
 	Models     map[Model]modelHealth `json:"models"`
+	// Backends contains the health of each provider in the fallback chain,
+	// if fallback providers are configured.
+	Backends []backendHealthDetails `json:"backends,omitempty"`
+	// CircuitBreakers contains the state of the circuit breaker of each
+	// provider which has been used, if circuit breakers are enabled. An open
+	// circuit means the provider is temporarily unavailable.
+	CircuitBreakers []circuitBreakerHealth `json:"circuitBreakers,omitempty"`
+}
+
+type backendHealthDetails struct {
+	Provider   ProviderType          `json:"provider"`
+	Configured bool                  `json:"configured"`
+	OK         bool                  `json:"ok"`
+	Models     map[Model]modelHealth `json:"models"`
 }
 
 type vectorHealthDetails struct {
@@ -39,6 +51,10 @@ type healthCheckDetails struct {
 	OpenAI  llmProviderHealthDetails `json:"openAI"`
 	Vector  vectorHealthDetails      `json:"vector"`
 	Version string                   `json:"version"`
+	// Quotas reports quota usage, if quotas are configured.
+	Quotas *quotaHealthDetails `json:"quotas,omitempty"`
+	// Budget reports spend against the monthly budget, if one is configured.
+	Budget *budgetHealthDetails `json:"budget,omitempty"`
 }
 
 func getVersion() string {
@@ -82,15 +98,20 @@ func extractErrorResponse(err error) any {
 	return nil
 }
 
-// getUnconfiguredError returns a specific error message based on the provider type
-func (a *App) getUnconfiguredError() string {
-	provider := a.settings.getEffectiveProvider()
-
+// unconfiguredError returns a specific error message based on the provider type
+func (a *App) unconfiguredError(provider ProviderType) string {
 	switch provider {
 	case ProviderTypeAnthropic:
 		return "Anthropic API key is not configured"
 	case ProviderTypeOpenAI:
 		return "OpenAI API key is not configured"
+	case ProviderTypeBedrock:
+		return "AWS Bedrock region or credentials are not configured"
+	case ProviderTypeGemini:
+		if a.settings.Gemini.VertexAI {
+			return "Vertex AI service account key or project is not configured"
+		}
+		return "Gemini API key is not configured"
 	case ProviderTypeAzure:
 		hasAPIKey := a.settings.OpenAI.apiKey != ""
 		hasMappings := len(a.settings.OpenAI.AzureMapping) > 0
@@ -115,7 +136,10 @@ func (a *App) testProviderModel(ctx context.Context, model Model) error {
 	if err != nil {
 		return err
 	}
+	return testModel(ctx, llmProvider, model)
+}
 
+func testModel(ctx context.Context, llmProvider LLMProvider, model Model) error {
 	req := ChatCompletionRequest{
 		Model: model,
 		ChatCompletionRequest: openai.ChatCompletionRequest{
@@ -124,13 +148,69 @@ func (a *App) testProviderModel(ctx context.Context, model Model) error {
 			},
 		},
 	}
-	_, err = llmProvider.ChatCompletion(ctx, req)
+	_, err := llmProvider.ChatCompletion(ctx, req)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// backendHealth checks the health of a single provider in the fallback chain.
+func (a *App) backendHealth(ctx context.Context, provider ProviderType, models *ModelSettings) backendHealthDetails {
+	d := backendHealthDetails{
+		Provider:   provider,
+		Configured: a.settings.providerConfigured(provider),
+		Models:     map[Model]modelHealth{},
+	}
+	llmProvider, createErr := createProviderOfType(a.settings, provider, models)
+	for _, model := range a.settings.supportedModels() {
+		health := modelHealth{OK: false, Error: a.unconfiguredError(provider)}
+		if d.Configured {
+			err := createErr
+			if err == nil {
+				err = testModel(ctx, llmProvider, model)
+			}
+			health = modelHealth{OK: err == nil}
+			if err != nil {
+				health.Error = err.Error()
+				health.Response = extractErrorResponse(err)
+			}
+		}
+		d.OK = d.OK || health.OK
+		d.Models[model] = health
+	}
+	return d
+}
+
+// fallbackModelHealth checks the health of each provider in the fallback chain.
+// A model is healthy if any provider serves it; otherwise the primary provider's
+// error is reported.
+func (a *App) fallbackModelHealth(ctx context.Context, d *llmProviderHealthDetails) {
+	d.Backends = []backendHealthDetails{a.backendHealth(ctx, a.settings.getEffectiveProvider(), a.settings.Models)}
+	for _, f := range a.settings.Fallbacks {
+		models := f.Models
+		if models == nil {
+			models = defaultModelSettings(f.Provider)
+		}
+		d.Backends = append(d.Backends, a.backendHealth(ctx, f.Provider, models))
+	}
+	for _, b := range d.Backends {
+		d.Configured = d.Configured || b.Configured
+	}
+	for _, model := range a.settings.supportedModels() {
+		if _, routed := a.settings.Routes[model]; routed {
+			continue
+		}
+		d.Models[model] = d.Backends[0].Models[model]
+		for _, b := range d.Backends {
+			if b.Models[model].OK {
+				d.Models[model] = b.Models[model]
+				break
+			}
+		}
+	}
+}
+
 // llmProviderHealth checks the health of the LLM provider configuration and caches the
 // result if successful. The caller must lock a.healthCheckMutex.
 func (a *App) llmProviderHealth(ctx context.Context) (llmProviderHealthDetails, error) {
@@ -153,9 +233,19 @@ func (a *App) llmProviderHealth(ctx context.Context) (llmProviderHealthDetails,
 		Models:     map[Model]modelHealth{},
 	}
 
-	for _, model := range supportedModels {
-		health := modelHealth{OK: false, Error: a.getUnconfiguredError()}
-		if d.Configured {
+	if len(a.settings.Fallbacks) > 0 {
+		a.fallbackModelHealth(ctx, &d)
+	}
+	for _, model := range a.settings.supportedModels() {
+		if _, ok := d.Models[model]; ok {
+			// Already checked as part of the fallback chain.
+			continue
+		}
+		provider := a.settings.modelProvider(model)
+		configured := a.settings.providerConfigured(provider)
+		d.Configured = d.Configured || configured
+		health := modelHealth{OK: false, Error: a.unconfiguredError(provider)}
+		if configured {
 			health.OK = true
 			health.Error = ""
 			err := a.testProviderModel(ctx, model)
@@ -247,10 +337,19 @@ func (a *App) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest)
 		provider.Response = extractErrorResponse(err)
 	}
 
+	// Circuit breakers are reported even when the provider's health is
+	// cached, since their state changes with each request.
+	if a.settings.breakers != nil {
+		provider.CircuitBreakers = a.settings.breakers.health()
+	}
+
 	vector := a.vectorHealth(ctx)
 	if vector.Error == "" {
 		a.healthVector = &vector
 	}
+	a.metrics.observeHealth(healthCheckLLMProvider, provider.OK)
+	a.metrics.observeModelHealth(provider.Models)
+	a.metrics.observeHealth(healthCheckVector, vector.OK)
 
 	details := healthCheckDetails{
 		LLMProvider: provider,
@@ -258,6 +357,12 @@ func (a *App) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest)
 		Vector:      vector,
 		Version:     getVersion(),
 	}
+	if a.quotas != nil {
+		details.Quotas = a.quotas.health()
+	}
+	if a.budget != nil {
+		details.Budget = a.budget.health()
+	}
 	body, err := json.Marshal(details)
 	if err != nil {
 		return &backend.CheckHealthResult{
@@ -205,6 +205,37 @@ func TestCheckHealth(t *testing.T) {
 				Version: "unknown",
 			},
 		},
+		{
+			name: "routed model uses its own provider",
+			settings: backend.AppInstanceSettings{
+				DecryptedSecureJSONData: map[string]string{openAIKey: "abcd1234"},
+				JSONData: json.RawMessage(`{
+					"provider": "anthropic",
+					"openAI": {
+						"url": "%s"
+					},
+					"routes": {
+						"large": {"provider": "openai", "model": "gpt-4.1"}
+					}
+				}`),
+			},
+			responses: []mockProviderHealthResponse{
+				{code: http.StatusOK, body: "{}"},
+			},
+			expDetails: healthCheckDetails{
+				LLMProvider: llmProviderHealthDetails{
+					Configured: true,
+					OK:         true,
+					Error:      "",
+					Models: map[Model]modelHealth{
+						ModelBase:  {OK: false, Error: "Anthropic API key is not configured"},
+						ModelLarge: {OK: true, Error: ""},
+					},
+				},
+				Vector:  vectorHealthDetails{},
+				Version: "unknown",
+			},
+		},
 		{
 			name: "azure unconfigured - no API key and no model mappings",
 			settings: backend.AppInstanceSettings{
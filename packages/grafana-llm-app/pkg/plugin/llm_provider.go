@@ -9,33 +9,47 @@ import (
 	"math/rand"
 	"strings"
 
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
 	"github.com/sashabaranov/go-openai"
 )
 
 var errBadRequest = errors.New("bad request")
 
+// errEmbeddingsNotSupported is returned by providers which cannot create embeddings.
+var errEmbeddingsNotSupported = fmt.Errorf("%w: embeddings are not supported by this provider", errBadRequest)
+
 type Model string
 
 const (
 	ModelBase  = "base"
 	ModelLarge = "large"
+
+	// Well-known tiers which are available once declared in ModelSettings.Tiers.
+	ModelSmall       = "small"
+	ModelReasoning   = "reasoning"
+	ModelVision      = "vision"
+	ModelLongContext = "long-context"
 )
 
-// UnmarshalJSON accepts either OpenAI named models for backwards
-// compatability, or the new abstract model names.
+// ModelFromString accepts either OpenAI named models for backwards
+// compatability, or abstract model names. Names other than base and large are
+// returned as is, to be resolved against the declared tiers.
 func ModelFromString(m string) (Model, error) {
 	switch {
 	case m == ModelLarge || (strings.HasPrefix(m, "gpt-4") && !strings.Contains(m, "-mini")):
 		return ModelLarge, nil
 	case m == ModelBase || strings.HasPrefix(m, "gpt-3.5") || strings.Contains(m, "-mini"):
 		return ModelBase, nil
+	case m == "":
+		return "", errors.New("model name is required")
 	}
-	// TODO: Give users the ability to specify a default model abstraction in settings, and use that here.
-	return "", fmt.Errorf("unrecognized model: %s", m)
+	return Model(m), nil
 }
 
 // UnmarshalJSON accepts either OpenAI named models for backwards
-// compatability, or the new abstract model names.
+// compatability, or abstract model names. Names other than base and large are
+// kept as is; tiers which have not been declared are resolved to the default
+// model by ModelSettings.resolve.
 func (m *Model) UnmarshalJSON(data []byte) error {
 	dataString := string(data)
 	switch {
@@ -46,8 +60,12 @@ func (m *Model) UnmarshalJSON(data []byte) error {
 		*m = ModelBase
 		return nil
 	}
-	// TODO: Give users the ability to specify a default model abstraction in settings, and use that here.
-	return fmt.Errorf("unrecognized model: %s", dataString)
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("unrecognized model: %s", dataString)
+	}
+	*m = Model(name)
+	return nil
 }
 
 func (m Model) toOpenAI(modelSettings *ModelSettings) string {
@@ -58,6 +76,14 @@ func (m Model) toAnthropic(modelSettings *ModelSettings) string {
 	return m.toProvider(ProviderTypeAnthropic, modelSettings)
 }
 
+func (m Model) toGemini(modelSettings *ModelSettings) string {
+	return m.toProvider(ProviderTypeGemini, modelSettings)
+}
+
+func (m Model) toBedrock(modelSettings *ModelSettings) string {
+	return m.toProvider(ProviderTypeBedrock, modelSettings)
+}
+
 func (m Model) toProvider(provider ProviderType, modelSettings *ModelSettings) string {
 	defaults := defaultModelSettings(provider)
 	// First check for nil settings, in which case we should use the defaults.
@@ -77,9 +103,25 @@ func (m Model) toProvider(provider ProviderType, modelSettings *ModelSettings) s
 	return modelSettings.getModel(m)
 }
 
+// toEmbedding returns the name of the provider's embedding model for the
+// abstract embedding model, using the provider's defaults if it is not mapped.
+func (m Model) toEmbedding(provider ProviderType, modelSettings *ModelSettings) string {
+	if name := modelSettings.getEmbeddingModel(m); name != "" {
+		return name
+	}
+	return defaultModelSettings(provider).getEmbeddingModel(m)
+}
+
 type ChatCompletionRequest struct {
 	openai.ChatCompletionRequest
 	Model Model `json:"model"`
+	// GrafanaTools are the MCP toolsets whose tools are made available to the
+	// model. Tool calls for them are executed by the plugin, which only returns
+	// the final answer.
+	GrafanaTools []mcp.Toolset `json:"grafana_tools,omitempty"`
+	// GrafanaCache opts in to the response cache for requests which do not
+	// set a temperature of 0.
+	GrafanaCache bool `json:"grafana_cache,omitempty"`
 }
 
 // UnmarshalJSON implements json.Unmarshaler.
@@ -108,11 +150,31 @@ func (c *ChatCompletionRequest) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// EmbeddingRequest is a request for embeddings using an abstract embedding model.
+type EmbeddingRequest struct {
+	openai.EmbeddingRequest
+	Model Model `json:"model"`
+}
+
 type ChatCompletionStreamResponse struct {
 	openai.ChatCompletionStreamResponse
 	// Random padding used to mitigate side channel attacks.
 	// See https://blog.cloudflare.com/ai-side-channel-attack-mitigated.
 	Padding string `json:"p,omitempty"`
+	// GrafanaToolStep describes a Grafana tool call made on behalf of the
+	// model, for requests using GrafanaTools.
+	GrafanaToolStep *GrafanaToolStep `json:"grafana_tool_step,omitempty"`
+	// Cost is the estimated cost of the request in US dollars. It is set on
+	// the chunk carrying usage, if the model has a known price.
+	Cost *float64 `json:"cost,omitempty"`
+	// StopSequence is the stop sequence which ended the response, if any. It
+	// is set on the chunk carrying the finish reason, by providers which
+	// report it.
+	StopSequence string `json:"stop_sequence,omitempty"`
+	// Citations are the sources cited for content streamed so far, by
+	// providers which report them. Their offsets are into the content of the
+	// whole response.
+	Citations []Citation `json:"citations,omitempty"`
 	// Error indicates that an error occurred mid-stream.
 	Error error `json:"-"`
 
@@ -131,12 +193,119 @@ func (r ChatCompletionStreamResponse) MarshalJSON() ([]byte, error) {
 	return json.Marshal(a)
 }
 
+// forwardStreamResponse sends resp on out, which the goroutines of providers
+// wrapping streams use instead of sending directly, since nothing may be
+// receiving once the request is canceled. In that case the remaining responses
+// from c are drained so that the goroutine sending them can exit too, and
+// false is returned.
+func forwardStreamResponse(ctx context.Context, out chan<- ChatCompletionStreamResponse, resp ChatCompletionStreamResponse, c <-chan ChatCompletionStreamResponse) bool {
+	select {
+	case out <- resp:
+		return true
+	case <-ctx.Done():
+		go func() {
+			for range c {
+			}
+		}()
+		return false
+	}
+}
+
+// streamResponseFromChatCompletion returns a single stream chunk containing
+// the whole of a chat completions response, for sending complete responses to
+// clients which requested a stream.
+func streamResponseFromChatCompletion(resp openai.ChatCompletionResponse) ChatCompletionStreamResponse {
+	choices := make([]openai.ChatCompletionStreamChoice, 0, len(resp.Choices))
+	for _, c := range resp.Choices {
+		choices = append(choices, openai.ChatCompletionStreamChoice{
+			Index: c.Index,
+			Delta: openai.ChatCompletionStreamChoiceDelta{
+				Role:             c.Message.Role,
+				Content:          c.Message.Content,
+				ReasoningContent: c.Message.ReasoningContent,
+				ToolCalls:        c.Message.ToolCalls,
+			},
+			FinishReason: c.FinishReason,
+		})
+	}
+	usage := resp.Usage
+	return ChatCompletionStreamResponse{
+		ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+			ID:      resp.ID,
+			Object:  "chat.completion.chunk",
+			Created: resp.Created,
+			Model:   resp.Model,
+			Choices: choices,
+			Usage:   &usage,
+		},
+	}
+}
+
+// Citation is a source the model cited for part of its response.
+type Citation struct {
+	// Start and End are the byte offsets of the cited part of the message
+	// content.
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// Source describes what was cited, in the provider's format.
+	Source json.RawMessage `json:"source"`
+}
+
+// chatCompletionResponse is the response to a non-streaming chat completions
+// request, with the details some providers report in addition to those in
+// OpenAI responses.
+type chatCompletionResponse struct {
+	openai.ChatCompletionResponse
+	// StopSequence is the stop sequence which ended the response, if any.
+	StopSequence string `json:"stop_sequence,omitempty"`
+	// Citations are the sources cited in the response.
+	Citations []Citation `json:"citations,omitempty"`
+}
+
+// newChatCompletionResponse returns the response to a non-streaming request,
+// with the details providers recorded in md.
+func newChatCompletionResponse(resp openai.ChatCompletionResponse, md *responseMetadata) chatCompletionResponse {
+	stopSequence, citations := md.CompletionDetails()
+	return chatCompletionResponse{ChatCompletionResponse: resp, StopSequence: stopSequence, Citations: citations}
+}
+
 type ModelResponse struct {
 	Data []ModelInfo `json:"data"`
+	// ProviderModels lists the models available from the provider, for
+	// providers which support discovering them.
+	ProviderModels []ProviderModelInfo `json:"providerModels,omitempty"`
 }
 
 type ModelInfo struct {
 	ID Model `json:"id"`
+	// Name is the provider's name for the model, if known.
+	Name string `json:"name,omitempty"`
+	// Provider is the provider serving the model, if models are routed to
+	// different providers.
+	Provider ProviderType `json:"provider,omitempty"`
+
+	// Description, Capabilities and ContextWindow describe declared tiers.
+	Description   string            `json:"description,omitempty"`
+	Capabilities  []ModelCapability `json:"capabilities,omitempty"`
+	ContextWindow int               `json:"contextWindow,omitempty"`
+}
+
+// modelInfos returns a ModelInfo for each abstract model which can be requested.
+func modelInfos(models *ModelSettings) []ModelInfo {
+	infos := []ModelInfo{}
+	for _, m := range models.models() {
+		infos = append(infos, ModelInfo{ID: m})
+	}
+	return infos
+}
+
+// ProviderModelInfo describes a model discovered on the provider's server.
+type ProviderModelInfo struct {
+	ID                string `json:"id"`
+	OwnedBy           string `json:"ownedBy,omitempty"`
+	Family            string `json:"family,omitempty"`
+	ParameterSize     string `json:"parameterSize,omitempty"`
+	QuantizationLevel string `json:"quantizationLevel,omitempty"`
 }
 
 type LLMProvider interface {
@@ -147,4 +316,6 @@ type LLMProvider interface {
 	// ChatCompletionStream provides text completion in a chat-like interface with
 	// tokens being sent as they are ready.
 	ChatCompletionStream(context.Context, ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error)
+	// Embeddings creates embedding vectors representing the input.
+	Embeddings(context.Context, EmbeddingRequest) (openai.EmbeddingResponse, error)
 }
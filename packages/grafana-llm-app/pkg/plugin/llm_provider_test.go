@@ -1,13 +1,16 @@
 package plugin
 
 import (
+	"context"
 	"encoding/json"
 	"math"
 	"testing"
+	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/sashabaranov/go-openai"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestModelFromString(t *testing.T) {
@@ -27,11 +30,16 @@ func TestModelFromString(t *testing.T) {
 			wantErr:  false,
 		},
 
-		// unknown models
+		// tiers and unknown models are resolved later
+		{
+			input:    "reasoning",
+			expected: ModelReasoning,
+			wantErr:  false,
+		},
 		{
 			input:    "invalid_model",
-			expected: "",
-			wantErr:  true,
+			expected: "invalid_model",
+			wantErr:  false,
 		},
 		{
 			input:    "",
@@ -118,20 +126,30 @@ func TestModelUnmarshalJSON(t *testing.T) {
 			wantErr:  false,
 		},
 
-		// unknown models
+		// tiers and unknown models are resolved later
+		{
+			input:    []byte(`"long-context"`),
+			expected: ModelLongContext,
+			wantErr:  false,
+		},
 		{
 			input:    []byte(`"invalid_model"`),
-			expected: "",
-			wantErr:  true,
+			expected: "invalid_model",
+			wantErr:  false,
 		},
 		{
 			input:    []byte(`""`),
 			expected: "",
-			wantErr:  true,
+			wantErr:  false,
 		},
 		{
 			input:    []byte(`null`),
 			expected: "",
+			wantErr:  false,
+		},
+		{
+			input:    []byte(`42`),
+			expected: "",
 			wantErr:  true,
 		},
 
@@ -370,3 +388,75 @@ func TestModelToOpenAI(t *testing.T) {
 		})
 	}
 }
+
+// blockingStreamProvider streams chunks without checking whether the request
+// was canceled, like the providers using the OpenAI client do. done is closed
+// once all chunks have been sent.
+type blockingStreamProvider struct {
+	fakeBackend
+	chunks int
+	done   chan struct{}
+}
+
+func (p *blockingStreamProvider) ChatCompletionStream(context.Context, ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	c := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(p.done)
+		defer close(c)
+		for range p.chunks {
+			c <- streamChunk("Hello alice@example.com ")
+		}
+	}()
+	return c, nil
+}
+
+func TestStreamWrappersStopWhenCanceled(t *testing.T) {
+	settings := newCacheTestSettings()
+	m, _ := newTestMetrics()
+	for _, tc := range []struct {
+		name string
+		wrap func(LLMProvider) LLMProvider
+	}{
+		{"fallback", func(p LLMProvider) LLMProvider {
+			return newFallbackProvider([]namedProvider{{name: ProviderTypeOpenAI, provider: p}})
+		}},
+		{"circuit breaker", func(p LLMProvider) LLMProvider {
+			breakers, _ := newTestCircuitBreakers()
+			return breakers.wrap(ProviderTypeOpenAI, p)
+		}},
+		{"tracing", func(p LLMProvider) LLMProvider { return &tracingProvider{LLMProvider: p, settings: settings} }},
+		{"metrics", func(p LLMProvider) LLMProvider {
+			return &instrumentedProvider{LLMProvider: p, metrics: m, settings: settings}
+		}},
+		{"usage", func(p LLMProvider) LLMProvider { return newMeteringProvider(p, settings) }},
+		{"cache", func(p LLMProvider) LLMProvider { return newCachingProvider(p, newMemoryCache(10), nil, settings) }},
+		{"audit", func(p LLMProvider) LLMProvider {
+			return &auditingProvider{LLMProvider: p, audit: newAuditLog(AuditSettings{})}
+		}},
+		{"redaction", func(p LLMProvider) LLMProvider {
+			return &redactingProvider{LLMProvider: p, redactor: newRedactor(RedactionSettings{})}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := &blockingStreamProvider{chunks: 10, done: make(chan struct{})}
+			ctx, cancel := context.WithCancel(context.Background())
+			c, err := tc.wrap(inner).ChatCompletionStream(ctx, ChatCompletionRequest{
+				Model:        ModelBase,
+				GrafanaCache: true,
+				ChatCompletionRequest: openai.ChatCompletionRequest{
+					Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Say hello to alice@example.com"}},
+				},
+			})
+			require.NoError(t, err)
+			<-c
+			// Stop reading, as a client disconnecting would.
+			cancel()
+
+			select {
+			case <-inner.done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the provider's goroutine is still blocked sending chunks")
+			}
+		})
+	}
+}
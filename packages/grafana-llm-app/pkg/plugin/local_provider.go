@@ -0,0 +1,263 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// localProvider implements the LLMProvider interface for self-hosted,
+// OpenAI-compatible servers such as Ollama and vLLM. Unlike the custom
+// provider, it discovers the models available on the server.
+type localProvider struct {
+	settings LocalSettings
+	models   *ModelSettings
+	client   *http.Client
+	oc       *openai.Client
+}
+
+func NewLocalProvider(settings LocalSettings, models *ModelSettings) (LLMProvider, error) {
+	client := &http.Client{
+		Transport: providerTransport(settings.retries, settings.httpTransport),
+	}
+	cfg := openai.DefaultConfig(settings.apiKey)
+	base, err := url.JoinPath(settings.URL, "/v1")
+	if err != nil {
+		return nil, fmt.Errorf("join url: %w", err)
+	}
+	cfg.BaseURL = base
+	cfg.HTTPClient = client
+	return &localProvider{
+		settings: settings,
+		models:   models,
+		client:   client,
+		oc:       openai.NewClientWithConfig(cfg),
+	}, nil
+}
+
+// Models returns the abstract models along with the models they resolve to,
+// and the models discovered on the server.
+func (p *localProvider) Models(ctx context.Context) (ModelResponse, error) {
+	available, err := p.discoverModels(ctx)
+	if err != nil {
+		return ModelResponse{}, err
+	}
+	resp := ModelResponse{ProviderModels: available}
+	for _, m := range p.models.models() {
+		resp.Data = append(resp.Data, ModelInfo{ID: m, Name: p.mappedModel(m, available)})
+	}
+	return resp, nil
+}
+
+func (p *localProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	r := req.ChatCompletionRequest
+	model, err := p.resolveModel(ctx, req.Model)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	r.Model = model
+
+	ForceUserMessage(&r)
+
+	resp, err := p.oc.CreateChatCompletion(ctx, r)
+	if err != nil {
+		log.DefaultLogger.Error("error creating local chat completion", "err", err)
+		return openai.ChatCompletionResponse{}, err
+	}
+	return resp, nil
+}
+
+func (p *localProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	r := req.ChatCompletionRequest
+	model, err := p.resolveModel(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	r.Model = model
+
+	return streamOpenAIRequest(ctx, r, p.oc)
+}
+
+// Embeddings creates embeddings using the mapped embedding model. Unlike chat
+// models, embedding models are not discovered since they cannot be told apart
+// from other models on the server.
+func (p *localProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	model := p.models.getEmbeddingModel(req.Model)
+	if model == "" {
+		return openai.EmbeddingResponse{}, fmt.Errorf("%w: no embedding model is mapped for model: %s", errBadRequest, req.Model)
+	}
+	r := req.EmbeddingRequest
+	r.Model = openai.EmbeddingModel(model)
+
+	resp, err := p.oc.CreateEmbeddings(ctx, r)
+	if err != nil {
+		log.DefaultLogger.Error("error creating local embeddings", "err", err)
+		return openai.EmbeddingResponse{}, err
+	}
+	return resp, nil
+}
+
+// mappedModel returns the name of the model mapped to the given abstract model,
+// falling back to the default model's mapping and then the first available model.
+// An empty string is returned if no model could be found.
+func (p *localProvider) mappedModel(model Model, available []ProviderModelInfo) string {
+	if p.models != nil {
+		if name := p.models.Mapping[model]; name != "" {
+			return name
+		}
+		if name := p.models.Mapping[p.models.Default]; name != "" {
+			return name
+		}
+	}
+	if len(available) > 0 {
+		return available[0].ID
+	}
+	return ""
+}
+
+// resolveModel returns the name of the model to use for the given abstract model.
+// The server is only queried if no mapping has been configured, and the models
+// it has are remembered for a while.
+func (p *localProvider) resolveModel(ctx context.Context, model Model) (string, error) {
+	if name := p.mappedModel(model, nil); name != "" {
+		return name, nil
+	}
+	available, err := p.settings.discovered.get(ctx, p.discoverModels)
+	if err != nil {
+		return "", err
+	}
+	name := p.mappedModel(model, available)
+	if name == "" {
+		return "", errors.New("no models are available on the server")
+	}
+	p.settings.discovered.warnUnmapped(name)
+	return name, nil
+}
+
+// discoveredModelsTTL is how long the models discovered on a local server are
+// used to resolve unmapped models before discovering them again.
+const discoveredModelsTTL = time.Minute
+
+// discoveredModels remembers the models discovered on a local server, so that
+// resolving unmapped models doesn't add a request to the server to every chat
+// completions request. All methods are safe to call on a nil
+// *discoveredModels, which doesn't remember anything.
+type discoveredModels struct {
+	mu      sync.Mutex
+	models  []ProviderModelInfo
+	expires time.Time
+	// warned is whether the use of the first model for unmapped models has
+	// been logged.
+	warned bool
+}
+
+func newDiscoveredModels() *discoveredModels {
+	return &discoveredModels{}
+}
+
+// get returns the remembered models, calling discover to discover them again
+// if they have expired.
+func (d *discoveredModels) get(ctx context.Context, discover func(context.Context) ([]ProviderModelInfo, error)) ([]ProviderModelInfo, error) {
+	if d == nil {
+		return discover(ctx)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.models != nil && time.Now().Before(d.expires) {
+		return d.models, nil
+	}
+	models, err := discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.models, d.expires = models, time.Now().Add(discoveredModelsTTL)
+	return models, nil
+}
+
+// warnUnmapped logs a warning the first time unmapped models are served by the
+// first model on the server, since every tier then uses the same model.
+func (d *discoveredModels) warnUnmapped(name string) {
+	if d != nil {
+		d.mu.Lock()
+		warned := d.warned
+		d.warned = true
+		d.mu.Unlock()
+		if warned {
+			return
+		}
+	}
+	log.DefaultLogger.Warn("No model mapping configured for the local provider, using the first model available on the server for all models", "name", name)
+}
+
+// discoverModels lists the models available on the server, using Ollama's
+// native API if available and the OpenAI-compatible API otherwise.
+func (p *localProvider) discoverModels(ctx context.Context) ([]ProviderModelInfo, error) {
+	var tags struct {
+		Models []struct {
+			Name    string `json:"name"`
+			Details struct {
+				Family            string `json:"family"`
+				ParameterSize     string `json:"parameter_size"`
+				QuantizationLevel string `json:"quantization_level"`
+			} `json:"details"`
+		} `json:"models"`
+	}
+	err := p.getJSON(ctx, "/api/tags", &tags)
+	if err == nil {
+		models := make([]ProviderModelInfo, 0, len(tags.Models))
+		for _, m := range tags.Models {
+			models = append(models, ProviderModelInfo{
+				ID:                m.Name,
+				OwnedBy:           "ollama",
+				Family:            m.Details.Family,
+				ParameterSize:     m.Details.ParameterSize,
+				QuantizationLevel: m.Details.QuantizationLevel,
+			})
+		}
+		return models, nil
+	}
+	log.DefaultLogger.Debug("Unable to list models using Ollama API, falling back to OpenAI API", "err", err)
+
+	list, err := p.oc.ListModels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list models: %w", err)
+	}
+	models := make([]ProviderModelInfo, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, ProviderModelInfo{ID: m.ID, OwnedBy: m.OwnedBy})
+	}
+	return models, nil
+}
+
+func (p *localProvider) getJSON(ctx context.Context, path string, v any) error {
+	u, err := url.JoinPath(p.settings.URL, path)
+	if err != nil {
+		return fmt.Errorf("join url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	if p.settings.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.settings.apiKey)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(b))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
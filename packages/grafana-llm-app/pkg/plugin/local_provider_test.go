@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMockLocalServer returns a server which behaves like Ollama if ollama is
+// true, or like vLLM otherwise. Chat completion requests record the requested
+// model.
+func newMockLocalServer(t *testing.T, ollama bool, requestedModel *string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	if ollama {
+		mux.HandleFunc("/api/tags", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, `{"models": [
+				{"name": "llama3.2:latest", "details": {"family": "llama", "parameter_size": "3.2B", "quantization_level": "Q4_K_M"}},
+				{"name": "qwen2.5:32b", "details": {"family": "qwen2", "parameter_size": "32.8B", "quantization_level": "Q4_K_M"}}
+			]}`)
+		})
+	}
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"object": "list", "data": [{"id": "meta-llama/Llama-3.1-8B-Instruct", "object": "model", "owned_by": "vllm"}]}`)
+	})
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		*requestedModel = req.Model
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "model": %q, "choices": [{"index": 0, "message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`, req.Model)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestLocalProvider_Models(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ollama   bool
+		models   *ModelSettings
+		expected ModelResponse
+	}{
+		{
+			name:   "ollama with mapping",
+			ollama: true,
+			models: &ModelSettings{Default: ModelBase, Mapping: map[Model]string{ModelBase: "llama3.2:latest", ModelLarge: "qwen2.5:32b"}},
+			expected: ModelResponse{
+				Data: []ModelInfo{{ID: ModelBase, Name: "llama3.2:latest"}, {ID: ModelLarge, Name: "qwen2.5:32b"}},
+				ProviderModels: []ProviderModelInfo{
+					{ID: "llama3.2:latest", OwnedBy: "ollama", Family: "llama", ParameterSize: "3.2B", QuantizationLevel: "Q4_K_M"},
+					{ID: "qwen2.5:32b", OwnedBy: "ollama", Family: "qwen2", ParameterSize: "32.8B", QuantizationLevel: "Q4_K_M"},
+				},
+			},
+		},
+		{
+			name:   "openai-compatible without mapping",
+			ollama: false,
+			models: defaultModelSettings(ProviderTypeLocal),
+			expected: ModelResponse{
+				Data: []ModelInfo{
+					{ID: ModelBase, Name: "meta-llama/Llama-3.1-8B-Instruct"},
+					{ID: ModelLarge, Name: "meta-llama/Llama-3.1-8B-Instruct"},
+				},
+				ProviderModels: []ProviderModelInfo{{ID: "meta-llama/Llama-3.1-8B-Instruct", OwnedBy: "vllm"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requested string
+			server := newMockLocalServer(t, tc.ollama, &requested)
+			defer server.Close()
+
+			provider, err := createProvider(&Settings{Provider: ProviderTypeLocal, Local: LocalSettings{URL: server.URL}, Models: tc.models})
+			require.NoError(t, err)
+
+			resp, err := provider.Models(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, resp)
+		})
+	}
+}
+
+func TestLocalProvider_ChatCompletion(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		models   *ModelSettings
+		model    Model
+		expected string
+	}{
+		{
+			name:     "mapped model",
+			models:   &ModelSettings{Default: ModelBase, Mapping: map[Model]string{ModelBase: "llama3.2:latest", ModelLarge: "qwen2.5:32b"}},
+			model:    ModelLarge,
+			expected: "qwen2.5:32b",
+		},
+		{
+			name:     "falls back to default mapping",
+			models:   &ModelSettings{Default: ModelBase, Mapping: map[Model]string{ModelBase: "llama3.2:latest"}},
+			model:    ModelLarge,
+			expected: "llama3.2:latest",
+		},
+		{
+			name:     "falls back to first discovered model",
+			models:   defaultModelSettings(ProviderTypeLocal),
+			model:    ModelLarge,
+			expected: "llama3.2:latest",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requested string
+			server := newMockLocalServer(t, true, &requested)
+			defer server.Close()
+
+			provider, err := createProvider(&Settings{Provider: ProviderTypeLocal, Local: LocalSettings{URL: server.URL}, Models: tc.models})
+			require.NoError(t, err)
+
+			resp, err := provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+				Model: tc.model,
+				ChatCompletionRequest: openai.ChatCompletionRequest{
+					Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+				},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, requested)
+			assert.Equal(t, "Hi", resp.Choices[0].Message.Content)
+		})
+	}
+}
+
+func TestLocalProvider_DiscoveredModelsAreRemembered(t *testing.T) {
+	var discoveries atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tags", func(w http.ResponseWriter, r *http.Request) {
+		discoveries.Add(1)
+		_, _ = fmt.Fprint(w, `{"models": [{"name": "llama3.2:latest"}]}`)
+	})
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"id": "1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Providers are created for each request, so the discovered models are
+	// remembered in the settings.
+	settings := &Settings{Provider: ProviderTypeLocal, Local: LocalSettings{URL: server.URL, discovered: newDiscoveredModels()}, Models: defaultModelSettings(ProviderTypeLocal)}
+	for _, model := range []Model{ModelBase, ModelLarge, ModelBase} {
+		provider, err := createProvider(settings)
+		require.NoError(t, err)
+		_, err = provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+			Model: model,
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+			},
+		})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), discoveries.Load())
+}
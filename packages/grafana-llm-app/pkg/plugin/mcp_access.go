@@ -0,0 +1,228 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// mcpRoles are the organization roles MCP access can be granted to, from the
+// least to the most privileged.
+var mcpRoles = []string{"Viewer", "Editor", "Admin"}
+
+// defaultMCPRolePolicies are used if no role policies are configured, so that
+// viewers can't use tools which modify Grafana, and only admins can use the
+// admin toolset.
+var defaultMCPRolePolicies = map[string]MCPAccessPolicy{
+	"Viewer": {Toolsets: []mcp.Toolset{mcpAllToolsets}, ExcludeToolsets: []mcp.Toolset{mcp.ToolsetAdmin}},
+	"Editor": {Toolsets: []mcp.Toolset{mcpAllToolsets}, ExcludeToolsets: []mcp.Toolset{mcp.ToolsetAdmin}, Write: true},
+	"Admin":  {Toolsets: []mcp.Toolset{mcpAllToolsets}, Write: true},
+}
+
+// allows returns whether the policy grants access to a tool.
+func (p MCPAccessPolicy) allows(toolset mcp.Toolset, tool string, write bool) bool {
+	if slices.Contains(p.Tools, tool) {
+		return true
+	}
+	if write && !p.Write || slices.Contains(p.ExcludeToolsets, toolset) {
+		return false
+	}
+	return slices.Contains(p.Toolsets, toolset) || slices.Contains(p.Toolsets, mcpAllToolsets)
+}
+
+// mcpAccess determines which MCP tools users may use.
+type mcpAccess struct {
+	settings MCPAccessSettings
+	// teams looks up users' team memberships. It is nil if no team policies
+	// are configured.
+	teams *teamLookup
+}
+
+// newMCPAccess returns the MCP access control for settings, which looks up
+// teams in the Grafana instance at grafanaURL using transport.
+func newMCPAccess(settings MCPAccessSettings, grafanaURL, saToken string, transport http.RoundTripper) *mcpAccess {
+	if len(settings.Roles) == 0 {
+		settings.Roles = defaultMCPRolePolicies
+	}
+	a := &mcpAccess{settings: settings}
+	if len(settings.Teams) > 0 {
+		a.teams = newTeamLookup(grafanaURL, saToken, transport, time.Duration(settings.TeamCacheSeconds)*time.Second)
+	}
+	return a
+}
+
+// authorize returns which tools the user in the plugin context in ctx may
+// use. Requests without a user may not use any tools.
+func (a *mcpAccess) authorize(ctx context.Context) mcp.ToolAuthorizer {
+	pCtx := backend.PluginConfigFromContext(ctx)
+	policies := a.policies(ctx, pCtx.OrgID, pCtx.User)
+	return func(toolset mcp.Toolset, tool string, write bool) bool {
+		for _, p := range policies {
+			if p.allows(toolset, tool, write) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// policies returns the policies granted to a user by their role and teams.
+func (a *mcpAccess) policies(ctx context.Context, orgID int64, user *backend.User) []MCPAccessPolicy {
+	if user == nil {
+		return nil
+	}
+	var policies []MCPAccessPolicy
+	if i := slices.Index(mcpRoles, user.Role); i >= 0 {
+		for _, role := range mcpRoles[:i+1] {
+			if p, ok := a.settings.Roles[role]; ok {
+				policies = append(policies, p)
+			}
+		}
+	}
+	if a.teams == nil || user.Login == "" {
+		return policies
+	}
+	teams, err := a.teams.teams(ctx, orgID, user.Login)
+	if err != nil {
+		// Teams only grant additional access, so the user can still use the
+		// tools their role grants.
+		log.DefaultLogger.Warn("Unable to look up teams for MCP access control", "user", user.Login, "err", err)
+	}
+	for _, team := range teams {
+		if p, ok := a.settings.Teams[team]; ok {
+			policies = append(policies, p)
+		}
+	}
+	return policies
+}
+
+// teamLookupFailureTTL is how long a failed team lookup is remembered, so that
+// the Grafana API isn't asked again for every tool list and call while it is
+// failing.
+const teamLookupFailureTTL = 10 * time.Second
+
+// teamLookup looks up the teams users belong to using the Grafana API,
+// caching them for a while.
+type teamLookup struct {
+	grafanaURL string
+	saToken    string
+	client     *http.Client
+	ttl        time.Duration
+
+	mu    sync.Mutex
+	cache map[teamCacheKey]cachedTeams
+}
+
+type teamCacheKey struct {
+	orgID int64
+	login string
+}
+
+type cachedTeams struct {
+	names   []string
+	expires time.Time
+}
+
+func newTeamLookup(grafanaURL, saToken string, transport http.RoundTripper, ttl time.Duration) *teamLookup {
+	return &teamLookup{
+		grafanaURL: grafanaURL,
+		saToken:    saToken,
+		client:     &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		ttl:        ttl,
+		cache:      map[teamCacheKey]cachedTeams{},
+	}
+}
+
+// teams returns the names of the teams a user belongs to in an organization.
+// If they can't be looked up, an error is returned, and the user is treated as
+// a member of no teams until the failure expires.
+func (l *teamLookup) teams(ctx context.Context, orgID int64, login string) ([]string, error) {
+	key := teamCacheKey{orgID: orgID, login: login}
+	now := time.Now()
+	l.mu.Lock()
+	cached, ok := l.cache[key]
+	l.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.names, nil
+	}
+
+	names, err := l.lookup(ctx, orgID, login)
+	if err != nil {
+		// Failures are remembered as membership of no teams, unless the
+		// request was canceled.
+		if ctx.Err() == nil {
+			l.store(key, cachedTeams{expires: now.Add(teamLookupFailureTTL)}, now)
+		}
+		return nil, err
+	}
+	l.store(key, cachedTeams{names: names, expires: now.Add(l.ttl)}, now)
+	return names, nil
+}
+
+// lookup looks up the teams a user belongs to using the Grafana API.
+func (l *teamLookup) lookup(ctx context.Context, orgID int64, login string) ([]string, error) {
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err := l.get(ctx, orgID, "/api/users/lookup?loginOrEmail="+url.QueryEscape(login), &user); err != nil {
+		return nil, fmt.Errorf("look up user: %w", err)
+	}
+	var teams []struct {
+		Name string `json:"name"`
+	}
+	if err := l.get(ctx, orgID, fmt.Sprintf("/api/users/%d/teams", user.ID), &teams); err != nil {
+		return nil, fmt.Errorf("list teams: %w", err)
+	}
+	names := make([]string, 0, len(teams))
+	for _, team := range teams {
+		names = append(names, team.Name)
+	}
+	return names, nil
+}
+
+// store caches the teams of a user, removing expired entries.
+func (l *teamLookup) store(key teamCacheKey, teams cachedTeams, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, c := range l.cache {
+		if now.After(c.expires) {
+			delete(l.cache, k)
+		}
+	}
+	l.cache[key] = teams
+}
+
+// get makes a request to the Grafana API as the plugin's service account,
+// decoding the JSON response into v.
+func (l *teamLookup) get(ctx context.Context, orgID int64, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.grafanaURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("create http request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+l.saToken)
+	req.Header.Set("X-Grafana-Org-Id", strconv.FormatInt(orgID, 10))
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("make request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
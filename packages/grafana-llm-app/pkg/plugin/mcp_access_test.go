@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func userContext(role, login string) context.Context {
+	return backend.WithPluginContext(context.Background(), backend.PluginContext{
+		OrgID: 2,
+		User:  &backend.User{Login: login, Role: role},
+	})
+}
+
+func TestMCPAccessDefaultRoles(t *testing.T) {
+	a := newMCPAccess(MCPAccessSettings{Enabled: true}, "", "", nil)
+	for _, tc := range []struct {
+		role               string
+		read, write, admin bool
+	}{
+		{role: "None"},
+		{role: "Viewer", read: true},
+		{role: "Editor", read: true, write: true},
+		{role: "Admin", read: true, write: true, admin: true},
+	} {
+		t.Run(tc.role, func(t *testing.T) {
+			authorize := a.authorize(userContext(tc.role, "alice"))
+			assert.Equal(t, tc.read, authorize(mcp.ToolsetLoki, "query_loki_logs", false))
+			assert.Equal(t, tc.write, authorize(mcp.ToolsetDashboard, "update_dashboard", true))
+			assert.Equal(t, tc.admin, authorize(mcp.ToolsetAdmin, "list_users", false))
+		})
+	}
+
+	authorize := a.authorize(context.Background())
+	assert.False(t, authorize(mcp.ToolsetLoki, "query_loki_logs", false), "requests without a user should not be able to use any tools")
+}
+
+func TestMCPAccessTeams(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		assert.Equal(t, "Bearer sa-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "2", r.Header.Get("X-Grafana-Org-Id"))
+		switch r.URL.Path {
+		case "/api/users/lookup":
+			if r.URL.Query().Get("loginOrEmail") != "alice" {
+				http.Error(w, "user not found", http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"id": 7, "login": "alice"})
+		case "/api/users/7/teams":
+			_ = json.NewEncoder(w).Encode([]map[string]any{{"id": 1, "name": "sre"}, {"id": 2, "name": "frontend"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// Teams are looked up with the outbound transport.
+	var sent atomic.Int32
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent.Add(1)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	a := newMCPAccess(MCPAccessSettings{
+		Enabled: true,
+		Roles: map[string]MCPAccessPolicy{
+			"Viewer": {Toolsets: []mcp.Toolset{mcp.ToolsetLoki, mcp.ToolsetDashboard}},
+		},
+		Teams: map[string]MCPAccessPolicy{
+			"sre":   {Toolsets: []mcp.Toolset{mcp.ToolsetDashboard}, Write: true},
+			"admin": {Toolsets: []mcp.Toolset{mcpAllToolsets}, Write: true},
+		},
+		TeamCacheSeconds: 60,
+	}, srv.URL, "sa-token", transport)
+
+	alice := a.authorize(userContext("Viewer", "alice"))
+	assert.True(t, alice(mcp.ToolsetLoki, "query_loki_logs", false))
+	assert.True(t, alice(mcp.ToolsetDashboard, "update_dashboard", true), "the sre team should grant write tools of its toolsets")
+	assert.False(t, alice(mcp.ToolsetAlerting, "create_alert_rule", true), "teams should only grant their toolsets")
+	assert.False(t, alice(mcp.ToolsetAdmin, "list_users", false), "alice is not in the admin team")
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, int32(2), sent.Load())
+
+	// Team memberships are cached.
+	a.authorize(userContext("Viewer", "alice"))
+	assert.Equal(t, int32(2), requests.Load())
+
+	// If teams can't be looked up, users keep the access their role grants.
+	bob := a.authorize(userContext("Viewer", "bob"))
+	assert.True(t, bob(mcp.ToolsetLoki, "query_loki_logs", false))
+	assert.False(t, bob(mcp.ToolsetDashboard, "update_dashboard", true))
+	assert.Equal(t, int32(3), requests.Load())
+
+	// Failed lookups are cached for a while too.
+	a.authorize(userContext("Viewer", "bob"))
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestMCPAccessPolicy(t *testing.T) {
+	p := MCPAccessPolicy{
+		Toolsets:        []mcp.Toolset{mcpAllToolsets},
+		ExcludeToolsets: []mcp.Toolset{mcp.ToolsetAdmin},
+		Tools:           []string{"update_annotation"},
+	}
+	assert.True(t, p.allows(mcp.ToolsetPrometheus, "query_prometheus", false))
+	assert.False(t, p.allows(mcp.ToolsetAdmin, "list_teams", false))
+	assert.False(t, p.allows(mcp.ToolsetDashboard, "update_dashboard", true))
+	assert.True(t, p.allows(mcp.ToolsetAnnotations, "update_annotation", true), "tools should be granted individually even if they modify Grafana")
+}
@@ -0,0 +1,386 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-llm-app/pkg/plugin/vector"
+	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sashabaranov/go-openai"
+)
+
+const metricsNamespace = "grafana_llm"
+
+// Operations, used as the operation label of request metrics.
+const (
+	operationChat       = "chat"
+	operationChatStream = "chat_stream"
+	operationEmbeddings = "embeddings"
+)
+
+// Statuses of requests, used as the status label of request metrics.
+const (
+	statusSuccess    = "success"
+	statusError      = "error"
+	statusBadRequest = "bad_request"
+	statusCanceled   = "canceled"
+	// statusCircuitOpen is a request rejected by a provider's circuit breaker
+	// without being sent.
+	statusCircuitOpen = "circuit_open"
+)
+
+// requestStatus returns the status label of a request which returned err.
+func requestStatus(err error) string {
+	switch {
+	case err == nil:
+		return statusSuccess
+	case errors.Is(err, errBadRequest):
+		return statusBadRequest
+	case errors.Is(err, context.Canceled):
+		return statusCanceled
+	case errors.As(err, new(*circuitOpenError)):
+		return statusCircuitOpen
+	default:
+		return statusError
+	}
+}
+
+// Health checks, used as the check label of the health metric.
+const (
+	healthCheckLLMProvider = "llm_provider"
+	healthCheckVector      = "vector"
+)
+
+// metrics are the Prometheus metrics of the plugin. All methods are safe to
+// call on a nil *metrics, in which case they do nothing.
+type metrics struct {
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	timeToFirstToken *prometheus.HistogramVec
+	tokensPerSecond  *prometheus.HistogramVec
+	tokens           *prometheus.CounterVec
+	cacheRequests    *prometheus.CounterVec
+	toolCalls        *prometheus.CounterVec
+	toolCallDuration *prometheus.HistogramVec
+	vectorSearch     *prometheus.HistogramVec
+	health           *prometheus.GaugeVec
+	modelHealth      *prometheus.GaugeVec
+	circuitState     *prometheus.GaugeVec
+	circuitChanges   *prometheus.CounterVec
+	redactions       *prometheus.CounterVec
+	injections       *prometheus.CounterVec
+}
+
+// newMetrics creates the plugin's metrics and registers them with reg.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests sent to LLM providers.",
+		}, []string{"operation", "provider", "model", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of requests sent to LLM providers, until the end of the stream for streaming requests.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80, 160},
+		}, []string{"operation", "provider", "model", "status"}),
+		timeToFirstToken: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_time_to_first_token_seconds",
+			Help:      "Time from sending a streaming request to an LLM provider to receiving the first chunk.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32},
+		}, []string{"provider", "model"}),
+		tokensPerSecond: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_tokens_per_second",
+			Help:      "Rate at which LLM providers stream completion tokens after the first chunk.",
+			Buckets:   []float64{5, 10, 20, 40, 60, 80, 100, 150, 200, 400},
+		}, []string{"provider", "model"}),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tokens_total",
+			Help:      "Tokens used by chat completions requests, by type (prompt or completion).",
+		}, []string{"provider", "model", "type"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_requests_total",
+			Help:      "Cacheable chat completions requests, by result (hit, semantic_hit or miss).",
+		}, []string{"result"}),
+		toolCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mcp_tool_calls_total",
+			Help:      "Calls to MCP tools.",
+		}, []string{"toolset", "status"}),
+		toolCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "mcp_tool_call_duration_seconds",
+			Help:      "Duration of calls to MCP tools.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"toolset"}),
+		vectorSearch: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "vector_search_duration_seconds",
+			Help:      "Duration of vector searches, including embedding the query.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"status"}),
+		health: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "health_check_ok",
+			Help:      "Whether each feature was healthy at the last health check (1) or not (0).",
+		}, []string{"check"}),
+		modelHealth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "model_health_check_ok",
+			Help:      "Whether each model was healthy at the last health check (1) or not (0).",
+		}, []string{"model"}),
+		circuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_state",
+			Help:      "State of each provider's circuit breaker: 0 closed, 1 half-open, 2 open.",
+		}, []string{"provider"}),
+		circuitChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_transitions_total",
+			Help:      "Changes of state of each provider's circuit breaker, by the state entered.",
+		}, []string{"provider", "state"}),
+		redactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "redactions_total",
+			Help:      "Values redacted from chat completions requests before they were sent to LLM providers, by detector.",
+		}, []string{"detector"}),
+		injections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mcp_tool_result_injections_total",
+			Help:      "MCP tool results which look like prompt injections, by the pattern found.",
+		}, []string{"toolset", "pattern"}),
+	}
+	reg.MustRegister(
+		m.requests, m.requestDuration, m.timeToFirstToken, m.tokensPerSecond, m.tokens,
+		m.cacheRequests, m.toolCalls, m.toolCallDuration, m.vectorSearch, m.health, m.modelHealth,
+		m.circuitState, m.circuitChanges, m.redactions, m.injections,
+	)
+	return m
+}
+
+// defaultMetrics returns the metrics registered with the default registry,
+// which is served by the plugin's metrics handler. They are shared by all app
+// instances, since metrics can only be registered once.
+var defaultMetrics = sync.OnceValue(func() *metrics {
+	return newMetrics(prometheus.DefaultRegisterer)
+})
+
+func (m *metrics) observeRequest(operation string, provider ProviderType, model Model, status string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(operation, string(provider), string(model), status).Inc()
+	m.requestDuration.WithLabelValues(operation, string(provider), string(model), status).Observe(duration.Seconds())
+}
+
+// observeStream records the time to the first chunk of a stream, and the rate
+// at which completion tokens were streamed after it.
+func (m *metrics) observeStream(provider ProviderType, model Model, timeToFirstToken, generation time.Duration, completionTokens int) {
+	if m == nil {
+		return
+	}
+	m.timeToFirstToken.WithLabelValues(string(provider), string(model)).Observe(timeToFirstToken.Seconds())
+	if generation > 0 && completionTokens > 0 {
+		m.tokensPerSecond.WithLabelValues(string(provider), string(model)).Observe(float64(completionTokens) / generation.Seconds())
+	}
+}
+
+// record counts the tokens used by a request. It makes metrics a
+// usageRecorder.
+func (m *metrics) record(r usageRecord) error {
+	if m == nil {
+		return nil
+	}
+	m.tokens.WithLabelValues(string(r.Key.Provider), string(r.Key.Model), "prompt").Add(float64(r.Usage.PromptTokens))
+	m.tokens.WithLabelValues(string(r.Key.Provider), string(r.Key.Model), "completion").Add(float64(r.Usage.CompletionTokens))
+	return nil
+}
+
+// observeCache counts a cacheable request, given the value of the cache
+// header.
+func (m *metrics) observeCache(status string) {
+	if m == nil {
+		return
+	}
+	m.cacheRequests.WithLabelValues(strings.ToLower(status)).Inc()
+}
+
+// observeToolCall counts a call to an MCP tool. It has the signature of
+// mcp.Settings.ObserveToolCall.
+func (m *metrics) observeToolCall(toolset mcp.Toolset, tool string, duration time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	status := statusSuccess
+	if failed {
+		status = statusError
+	}
+	m.toolCalls.WithLabelValues(string(toolset), status).Inc()
+	m.toolCallDuration.WithLabelValues(string(toolset)).Observe(duration.Seconds())
+}
+
+func (m *metrics) observeHealth(check string, ok bool) {
+	if m == nil {
+		return
+	}
+	m.health.WithLabelValues(check).Set(boolToFloat(ok))
+}
+
+func (m *metrics) observeModelHealth(models map[Model]modelHealth) {
+	if m == nil {
+		return
+	}
+	for model, h := range models {
+		m.modelHealth.WithLabelValues(string(model)).Set(boolToFloat(h.OK))
+	}
+}
+
+// circuitStateValues are the values of the circuit breaker state metric.
+var circuitStateValues = map[circuitState]float64{
+	circuitClosed:   0,
+	circuitHalfOpen: 1,
+	circuitOpen:     2,
+}
+
+// observeCircuitState records the state of a provider's circuit breaker, and
+// counts the transition if it changed.
+func (m *metrics) observeCircuitState(provider ProviderType, state circuitState, transitioned bool) {
+	if m == nil {
+		return
+	}
+	m.circuitState.WithLabelValues(string(provider)).Set(circuitStateValues[state])
+	if transitioned {
+		m.circuitChanges.WithLabelValues(string(provider), string(state)).Inc()
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// instrumentedProvider wraps an LLMProvider, recording metrics about each
+// request.
+type instrumentedProvider struct {
+	LLMProvider
+	metrics  *metrics
+	settings *Settings
+}
+
+// provider returns the provider which served a request for model.
+func (p *instrumentedProvider) provider(ctx context.Context, model Model) ProviderType {
+	return servingProvider(ctx, p.settings, model)
+}
+
+func (p *instrumentedProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	start := time.Now()
+	resp, err := p.LLMProvider.ChatCompletion(ctx, req)
+	p.metrics.observeRequest(operationChat, p.provider(ctx, req.Model), req.Model, requestStatus(err), time.Since(start))
+	return resp, err
+}
+
+func (p *instrumentedProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	start := time.Now()
+	c, err := p.LLMProvider.ChatCompletionStream(ctx, req)
+	if err != nil {
+		p.metrics.observeRequest(operationChatStream, p.provider(ctx, req.Model), req.Model, requestStatus(err), time.Since(start))
+		return nil, err
+	}
+	out := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		var (
+			first      time.Time
+			streamErr  error
+			chars      int
+			usedTokens int
+		)
+		for resp := range c {
+			if resp.Error != nil {
+				streamErr = resp.Error
+			} else {
+				if first.IsZero() && len(resp.Choices) > 0 {
+					first = time.Now()
+				}
+				for _, choice := range resp.Choices {
+					chars += len(choice.Delta.Content) + len(choice.Delta.ReasoningContent)
+				}
+				if resp.Usage != nil {
+					usedTokens = resp.Usage.CompletionTokens
+				}
+			}
+			if !forwardStreamResponse(ctx, out, resp, c) {
+				streamErr = ctx.Err()
+				break
+			}
+		}
+		end := time.Now()
+		provider := p.provider(ctx, req.Model)
+		p.metrics.observeRequest(operationChatStream, provider, req.Model, requestStatus(streamErr), end.Sub(start))
+		if first.IsZero() {
+			return
+		}
+		if usedTokens == 0 {
+			usedTokens = estimateTokens(chars)
+		}
+		p.metrics.observeStream(provider, req.Model, first.Sub(start), end.Sub(first), usedTokens)
+	}()
+	return out, nil
+}
+
+func (p *instrumentedProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	start := time.Now()
+	resp, err := p.LLMProvider.Embeddings(ctx, req)
+	model := p.settings.embeddingModel(req.Model)
+	p.metrics.observeRequest(operationEmbeddings, servingEmbeddingsProvider(ctx, p.settings), model, requestStatus(err), time.Since(start))
+	return resp, err
+}
+
+// instrumentedVectorService wraps a vector.Service, recording the duration of
+// searches.
+type instrumentedVectorService struct {
+	vector.Service
+	metrics *metrics
+}
+
+func (s *instrumentedVectorService) Search(ctx context.Context, collection string, query string, topK uint64, filter map[string]any) ([]store.SearchResult, error) {
+	start := time.Now()
+	results, err := s.Service.Search(ctx, collection, query, topK, filter)
+	if s.metrics != nil {
+		s.metrics.vectorSearch.WithLabelValues(requestStatus(err)).Observe(time.Since(start).Seconds())
+	}
+	return results, err
+}
+
+// observeRedactions counts the values redacted from a request by each
+// detector.
+func (m *metrics) observeRedactions(counts map[string]int) {
+	if m == nil {
+		return
+	}
+	for detector, n := range counts {
+		m.redactions.WithLabelValues(detector).Add(float64(n))
+	}
+}
+
+// observeInjection counts a tool result which looks like a prompt injection.
+func (m *metrics) observeInjection(toolset mcp.Toolset, patterns []string) {
+	if m == nil {
+		return
+	}
+	for _, pattern := range patterns {
+		m.injections.WithLabelValues(string(toolset), pattern).Inc()
+	}
+}
@@ -0,0 +1,325 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/store"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	mcpgo "github.com/mark3labs/mcp-go/mcp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMetrics() (*metrics, *prometheus.Registry) {
+	reg := prometheus.NewRegistry()
+	return newMetrics(reg), reg
+}
+
+// histogramSamples scrapes reg and returns the number of observations and
+// their sum for the histogram series with the given labels.
+func histogramSamples(t *testing.T, reg prometheus.Gatherer, name string, labels map[string]string) (uint64, float64) {
+	t.Helper()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+		}
+	}
+	return 0, 0
+}
+
+func TestInstrumentedProvider_ChatCompletion(t *testing.T) {
+	m, reg := newTestMetrics()
+	inner := &fakeBackend{}
+	p := &instrumentedProvider{LLMProvider: inner, metrics: m, settings: newCacheTestSettings()}
+
+	_, err := p.ChatCompletion(context.Background(), ChatCompletionRequest{Model: ModelBase})
+	require.NoError(t, err)
+	inner.err = fmt.Errorf("%w: no messages", errBadRequest)
+	_, err = p.ChatCompletion(context.Background(), ChatCompletionRequest{Model: ModelLarge})
+	require.Error(t, err)
+	inner.err = errors.New("boom")
+	_, err = p.Embeddings(context.Background(), EmbeddingRequest{Model: ModelBase})
+	require.Error(t, err)
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP grafana_llm_requests_total Requests sent to LLM providers.
+# TYPE grafana_llm_requests_total counter
+grafana_llm_requests_total{model="base",operation="chat",provider="openai",status="success"} 1
+grafana_llm_requests_total{model="base",operation="embeddings",provider="openai",status="error"} 1
+grafana_llm_requests_total{model="large",operation="chat",provider="openai",status="bad_request"} 1
+`), "grafana_llm_requests_total"))
+	count, _ := histogramSamples(t, reg, "grafana_llm_request_duration_seconds", map[string]string{"operation": "chat", "status": "success"})
+	assert.Equal(t, uint64(1), count)
+}
+
+func TestInstrumentedProvider_EmbeddingsModel(t *testing.T) {
+	m, reg := newTestMetrics()
+	p := &instrumentedProvider{LLMProvider: &fakeBackend{}, metrics: m, settings: newCacheTestSettings()}
+
+	// Clients can request any model, but only configured ones are used as
+	// labels, since the others are served by the base model.
+	for _, model := range []Model{ModelBase, ModelLarge, "text-embedding-ada-002", "made-up"} {
+		_, err := p.Embeddings(context.Background(), EmbeddingRequest{Model: model})
+		require.NoError(t, err)
+	}
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP grafana_llm_requests_total Requests sent to LLM providers.
+# TYPE grafana_llm_requests_total counter
+grafana_llm_requests_total{model="base",operation="embeddings",provider="openai",status="success"} 3
+grafana_llm_requests_total{model="large",operation="embeddings",provider="openai",status="success"} 1
+`), "grafana_llm_requests_total"))
+}
+
+func TestInstrumentedProvider_EmbeddingsIgnoreRoutes(t *testing.T) {
+	m, reg := newTestMetrics()
+	settings := newCacheTestSettings()
+	settings.Routes = map[Model]ModelRoute{ModelBase: {Provider: ProviderTypeAnthropic}}
+	p := &instrumentedProvider{LLMProvider: &fakeBackend{}, metrics: m, settings: settings}
+
+	// Routes only apply to chat models, so embeddings are recorded as served
+	// by the primary provider.
+	_, err := p.Embeddings(context.Background(), EmbeddingRequest{Model: ModelBase})
+	require.NoError(t, err)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP grafana_llm_requests_total Requests sent to LLM providers.
+# TYPE grafana_llm_requests_total counter
+grafana_llm_requests_total{model="base",operation="embeddings",provider="openai",status="success"} 1
+`), "grafana_llm_requests_total"))
+}
+
+// slowStreamProvider streams its chunks with a delay before each one.
+type slowStreamProvider struct {
+	fakeBackend
+	delay time.Duration
+}
+
+func (p *slowStreamProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	c := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(c)
+		for _, chunk := range p.chunks {
+			time.Sleep(p.delay)
+			c <- chunk
+		}
+	}()
+	return c, nil
+}
+
+func TestInstrumentedProvider_ChatCompletionStream(t *testing.T) {
+	m, reg := newTestMetrics()
+	usageChunk := ChatCompletionStreamResponse{ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{Usage: &openai.Usage{CompletionTokens: 4}}}
+	inner := &slowStreamProvider{fakeBackend: fakeBackend{chunks: []ChatCompletionStreamResponse{streamChunk("Hello"), streamChunk(" there"), usageChunk}}, delay: 20 * time.Millisecond}
+	p := &instrumentedProvider{LLMProvider: inner, metrics: m, settings: newCacheTestSettings()}
+
+	c, err := p.ChatCompletionStream(context.Background(), ChatCompletionRequest{Model: ModelBase})
+	require.NoError(t, err)
+	for range c {
+	}
+
+	// Metrics are recorded after the stream is closed.
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(m.requests) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP grafana_llm_requests_total Requests sent to LLM providers.
+# TYPE grafana_llm_requests_total counter
+grafana_llm_requests_total{model="base",operation="chat_stream",provider="openai",status="success"} 1
+`), "grafana_llm_requests_total"))
+
+	labels := map[string]string{"provider": "openai", "model": "base"}
+	count, ttft := histogramSamples(t, reg, "grafana_llm_stream_time_to_first_token_seconds", labels)
+	assert.Equal(t, uint64(1), count)
+	assert.GreaterOrEqual(t, ttft, 0.02)
+	assert.Less(t, ttft, 0.04, "time to first token should not include the rest of the stream")
+
+	// 4 tokens were streamed over the 40ms after the first chunk.
+	count, tps := histogramSamples(t, reg, "grafana_llm_stream_tokens_per_second", labels)
+	assert.Equal(t, uint64(1), count)
+	assert.Greater(t, tps, 0.0)
+	assert.LessOrEqual(t, tps, 100.0)
+}
+
+func TestInstrumentedProvider_StreamError(t *testing.T) {
+	m, reg := newTestMetrics()
+	failed := ChatCompletionStreamResponse{Error: errors.New("connection reset")}
+	inner := &fakeBackend{chunks: []ChatCompletionStreamResponse{streamChunk("Hi"), failed}}
+	p := &instrumentedProvider{LLMProvider: inner, metrics: m, settings: newCacheTestSettings()}
+
+	c, err := p.ChatCompletionStream(context.Background(), ChatCompletionRequest{Model: ModelBase})
+	require.NoError(t, err)
+	for range c {
+	}
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(m.requests) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP grafana_llm_requests_total Requests sent to LLM providers.
+# TYPE grafana_llm_requests_total counter
+grafana_llm_requests_total{model="base",operation="chat_stream",provider="openai",status="error"} 1
+`), "grafana_llm_requests_total"))
+}
+
+func TestMetrics_TokensAndCache(t *testing.T) {
+	m, reg := newTestMetrics()
+	settings := newCacheTestSettings()
+	inner := &scriptedProvider{responses: []openai.ChatCompletionResponse{answerResponse("4")}}
+	metered := newMeteringProvider(&instrumentedProvider{LLMProvider: inner, metrics: m, settings: settings}, settings, m)
+	cached := newCachingProvider(metered, newMemoryCache(10), nil, settings)
+	cached.metrics = m
+
+	req := cacheTestRequest("what is 2+2?", math.SmallestNonzeroFloat32)
+	for range 2 {
+		_, err := cached.ChatCompletion(usageTestContext(), req)
+		require.NoError(t, err)
+	}
+
+	resp := answerResponse("4")
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+# HELP grafana_llm_cache_requests_total Cacheable chat completions requests, by result (hit, semantic_hit or miss).
+# TYPE grafana_llm_cache_requests_total counter
+grafana_llm_cache_requests_total{result="hit"} 1
+grafana_llm_cache_requests_total{result="miss"} 1
+# HELP grafana_llm_tokens_total Tokens used by chat completions requests, by type (prompt or completion).
+# TYPE grafana_llm_tokens_total counter
+grafana_llm_tokens_total{model="base",provider="openai",type="completion"} %d
+grafana_llm_tokens_total{model="base",provider="openai",type="prompt"} %d
+`, resp.Usage.CompletionTokens, resp.Usage.PromptTokens)), "grafana_llm_cache_requests_total", "grafana_llm_tokens_total"))
+}
+
+func TestMetrics_ToolCalls(t *testing.T) {
+	m, reg := newTestMetrics()
+	server, err := mcp.New(mcp.Settings{
+		IsToolsetEnabled: func(mcp.Toolset) bool { return false },
+		ObserveToolCall:  m.observeToolCall,
+	}, "test")
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	server.AddTool(mcp.ToolsetPrometheus, mcpgo.NewTool("query_prometheus"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return mcpgo.NewToolResultText("up"), nil
+	})
+	server.AddTool(mcp.ToolsetLoki, mcpgo.NewTool("query_loki"), func(ctx context.Context, req mcpgo.CallToolRequest) (*mcpgo.CallToolResult, error) {
+		return nil, errors.New("loki is down")
+	})
+
+	for _, tool := range []string{"query_prometheus", "query_prometheus", "query_loki"} {
+		_, _ = server.CallTool(context.Background(), &backend.PluginContext{}, "", tool, "")
+	}
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP grafana_llm_mcp_tool_calls_total Calls to MCP tools.
+# TYPE grafana_llm_mcp_tool_calls_total counter
+grafana_llm_mcp_tool_calls_total{status="error",toolset="loki"} 1
+grafana_llm_mcp_tool_calls_total{status="success",toolset="prometheus"} 2
+`), "grafana_llm_mcp_tool_calls_total"))
+	count, _ := histogramSamples(t, reg, "grafana_llm_mcp_tool_call_duration_seconds", map[string]string{"toolset": "prometheus"})
+	assert.Equal(t, uint64(2), count)
+}
+
+// fakeVectorService returns err from searches.
+type fakeVectorService struct {
+	err error
+}
+
+func (s *fakeVectorService) Search(context.Context, string, string, uint64, map[string]any) ([]store.SearchResult, error) {
+	return nil, s.err
+}
+
+func (s *fakeVectorService) Health(context.Context) error { return nil }
+
+func (s *fakeVectorService) Cancel() {}
+
+func TestMetrics_VectorSearch(t *testing.T) {
+	m, reg := newTestMetrics()
+	inner := &fakeVectorService{}
+	s := &instrumentedVectorService{Service: inner, metrics: m}
+
+	_, err := s.Search(context.Background(), "dashboards", "cpu", 5, nil)
+	require.NoError(t, err)
+	inner.err = errors.New("qdrant unavailable")
+	_, err = s.Search(context.Background(), "dashboards", "cpu", 5, nil)
+	require.Error(t, err)
+
+	for _, status := range []string{statusSuccess, statusError} {
+		count, _ := histogramSamples(t, reg, "grafana_llm_vector_search_duration_seconds", map[string]string{"status": status})
+		assert.Equal(t, uint64(1), count, status)
+	}
+}
+
+func TestMetrics_App(t *testing.T) {
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test"}`)}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+	require.Same(t, defaultMetrics(), app.metrics, "app instances should share the metrics served by the plugin")
+
+	requests := app.metrics.requests.WithLabelValues(operationChat, string(ProviderTypeTest), ModelBase, statusSuccess)
+	before := testutil.ToFloat64(requests)
+	var r mockCallResourceResponseSender
+	err = app.CallResource(ctx, &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{OrgID: 1, AppInstanceSettings: &settings},
+		Method:        http.MethodPost,
+		Path:          "/llm/v1/chat/completions",
+		Body:          []byte(`{"messages": [{"role": "user", "content": "hi"}]}`),
+	}, &r)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, r.response.Status)
+	assert.Equal(t, before+1, testutil.ToFloat64(requests))
+
+	_, err = app.CheckHealth(ctx, &backend.CheckHealthRequest{})
+	require.NoError(t, err)
+	require.NoError(t, testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(`
+# HELP grafana_llm_health_check_ok Whether each feature was healthy at the last health check (1) or not (0).
+# TYPE grafana_llm_health_check_ok gauge
+grafana_llm_health_check_ok{check="llm_provider"} 1
+grafana_llm_health_check_ok{check="vector"} 0
+`), "grafana_llm_health_check_ok"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(app.metrics.modelHealth.WithLabelValues(ModelBase)))
+}
+
+func TestMetrics_CircuitBreaker(t *testing.T) {
+	m, reg := newTestMetrics()
+	breakers, _ := newTestCircuitBreakers()
+	breakers.metrics = m
+	p := breakers.wrap(ProviderTypeOpenAI, &fakeBackend{err: &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}})
+	p = &instrumentedProvider{LLMProvider: p, metrics: m, settings: newCacheTestSettings()}
+	for range 5 {
+		//nolint:errcheck
+		p.ChatCompletion(context.Background(), ChatCompletionRequest{Model: ModelBase})
+	}
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP grafana_llm_circuit_breaker_state State of each provider's circuit breaker: 0 closed, 1 half-open, 2 open.
+# TYPE grafana_llm_circuit_breaker_state gauge
+grafana_llm_circuit_breaker_state{provider="openai"} 2
+# HELP grafana_llm_circuit_breaker_transitions_total Changes of state of each provider's circuit breaker, by the state entered.
+# TYPE grafana_llm_circuit_breaker_transitions_total counter
+grafana_llm_circuit_breaker_transitions_total{provider="openai",state="open"} 1
+# HELP grafana_llm_requests_total Requests sent to LLM providers.
+# TYPE grafana_llm_requests_total counter
+grafana_llm_requests_total{model="base",operation="chat",provider="openai",status="circuit_open"} 1
+grafana_llm_requests_total{model="base",operation="chat",provider="openai",status="error"} 4
+`), "grafana_llm_circuit_breaker_state", "grafana_llm_circuit_breaker_transitions_total", "grafana_llm_requests_total"))
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/sashabaranov/go-openai"
@@ -21,7 +20,7 @@ type openAI struct {
 
 func NewOpenAIProvider(settings OpenAISettings, models *ModelSettings) (LLMProvider, error) {
 	client := &http.Client{
-		Timeout: 2 * time.Minute,
+		Transport: withHeaders(settings.Headers, providerTransport(settings.retries, settings.httpTransport)),
 	}
 	cfg := openai.DefaultConfig(settings.apiKey)
 
@@ -46,12 +45,7 @@ func NewOpenAIProvider(settings OpenAISettings, models *ModelSettings) (LLMProvi
 }
 
 func (p *openAI) Models(ctx context.Context) (ModelResponse, error) {
-	return ModelResponse{
-		Data: []ModelInfo{
-			{ID: ModelBase},
-			{ID: ModelLarge},
-		},
-	}, nil
+	return ModelResponse{Data: modelInfos(p.models)}, nil
 }
 
 func (p *openAI) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
@@ -77,6 +71,18 @@ func (p *openAI) ChatCompletionStream(ctx context.Context, req ChatCompletionReq
 	return streamOpenAIRequest(ctx, r, p.oc)
 }
 
+func (p *openAI) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	r := req.EmbeddingRequest
+	r.Model = openai.EmbeddingModel(req.Model.toEmbedding(ProviderTypeOpenAI, p.models))
+
+	resp, err := p.oc.CreateEmbeddings(ctx, r)
+	if err != nil {
+		log.DefaultLogger.Error("error creating openai embeddings", "err", err)
+		return openai.EmbeddingResponse{}, err
+	}
+	return resp, nil
+}
+
 func streamOpenAIRequest(ctx context.Context, r openai.ChatCompletionRequest, oc *openai.Client) (<-chan ChatCompletionStreamResponse, error) {
 	r.Stream = true
 
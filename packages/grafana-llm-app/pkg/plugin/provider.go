@@ -1,24 +1,208 @@
 package plugin
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// namedProvider is an LLMProvider along with the type of provider it is.
+type namedProvider struct {
+	name     ProviderType
+	provider LLMProvider
+}
 
 func createProvider(settings *Settings) (LLMProvider, error) {
-	provider := settings.getEffectiveProvider()
+	primary, err := createFallbackChain(settings)
+	if err != nil || len(settings.Routes) == 0 {
+		return primary, err
+	}
+
+	routes := make(map[Model]namedProvider, len(settings.Routes))
+	for model, route := range settings.Routes {
+		p, err := createProviderOfType(settings, route.Provider, route.modelSettings(model))
+		if err != nil {
+			return nil, fmt.Errorf("create provider %s for model %s: %w", route.Provider, model, err)
+		}
+		routes[model] = namedProvider{name: route.Provider, provider: p}
+	}
+	return newRouterProvider(namedProvider{name: settings.getEffectiveProvider(), provider: primary}, routes, settings.supportedModels()), nil
+}
+
+// providerTransport returns the transport for the HTTP client of a provider,
+// sending requests using next. Failed requests are retried according to
+// retries, and each attempt is traced.
+func providerTransport(retries transport.RetrySettings, next http.RoundTripper) http.RoundTripper {
+	return transport.NewRetrying(retries, tracedTransport(outboundTransport(next)))
+}
 
+// outboundTransport returns t, the transport built from the outbound HTTP
+// settings, or http.DefaultTransport if the settings weren't loaded with
+// loadSettings.
+func outboundTransport(t http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return http.DefaultTransport
+	}
+	return t
+}
+
+// withCache wraps provider so that it serves chat completions requests from the
+// response cache and semantic cache, if caching is enabled.
+func (a *App) withCache(provider LLMProvider) LLMProvider {
+	if a.responseCache == nil || provider == nil {
+		return provider
+	}
+	c := newCachingProvider(provider, a.responseCache, a.semanticCache, a.settings)
+	c.metrics = a.metrics
+	return c
+}
+
+// withMetrics wraps provider so that metrics are recorded about each request.
+func (a *App) withMetrics(provider LLMProvider) LLMProvider {
+	if a.metrics == nil || provider == nil {
+		return provider
+	}
+	return &instrumentedProvider{LLMProvider: provider, metrics: a.metrics, settings: a.settings}
+}
+
+// withTracing wraps provider so that a span is created for each request.
+func (a *App) withTracing(provider LLMProvider) LLMProvider {
+	if provider == nil {
+		return provider
+	}
+	return &tracingProvider{LLMProvider: provider, settings: a.settings}
+}
+
+// servingProvider returns the provider which served a request for model: the
+// one recorded in the response metadata of ctx if a router or fallback chain
+// chose it, and otherwise the one configured for the model.
+func servingProvider(ctx context.Context, settings *Settings, model Model) ProviderType {
+	if served := responseMetadataFromContext(ctx).Provider(); served != "" {
+		return served
+	}
+	provider, _ := settings.resolvedModel(model)
+	return provider
+}
+
+// servingEmbeddingsProvider returns the provider which served an embeddings
+// request, as servingProvider does for chat completions requests.
+func servingEmbeddingsProvider(ctx context.Context, settings *Settings) ProviderType {
+	if served := responseMetadataFromContext(ctx).Provider(); served != "" {
+		return served
+	}
+	return settings.getEffectiveProvider()
+}
+
+// withUsage wraps provider so that the token usage and cost of chat
+// completions requests is recorded in metrics and counted against quotas and
+// the budget, if usage metering, quotas or a budget are enabled.
+func (a *App) withUsage(provider LLMProvider) LLMProvider {
+	var recorders []usageRecorder
+	if a.metrics != nil {
+		recorders = append(recorders, a.metrics)
+	}
+	if a.usageStore != nil {
+		recorders = append(recorders, a.usageStore)
+	}
+	if a.quotas != nil {
+		recorders = append(recorders, a.quotas)
+	}
+	if a.budget != nil {
+		recorders = append(recorders, a.budget)
+	}
+	if len(recorders) == 0 || provider == nil {
+		return provider
+	}
+	return newMeteringProvider(provider, a.settings, recorders...)
+}
+
+// withBudget wraps provider so that chat completions requests are served by
+// the base model while the monthly budget is exceeded, if one is configured.
+func (a *App) withBudget(provider LLMProvider) LLMProvider {
+	if a.budget == nil || provider == nil {
+		return provider
+	}
+	return &budgetProvider{LLMProvider: provider, budget: a.budget}
+}
+
+// checkQuota returns a *quotaExceededError if the request in ctx would exceed
+// a quota, and otherwise counts it against the requests per minute quotas.
+func (a *App) checkQuota(ctx context.Context) error {
+	if a.quotas == nil {
+		return nil
+	}
+	pCtx := backend.PluginConfigFromContext(ctx)
+	user := ""
+	if pCtx.User != nil {
+		user = pCtx.User.Login
+	}
+	return a.quotas.allow(pCtx.OrgID, user, pluginIDFromContext(ctx))
+}
+
+// createFallbackChain creates the configured provider, wrapped in a
+// fallbackProvider if any fallback providers are configured.
+func createFallbackChain(settings *Settings) (LLMProvider, error) {
+	primary, err := createProviderOfType(settings, settings.getEffectiveProvider(), settings.Models)
+	if err != nil || len(settings.Fallbacks) == 0 {
+		return primary, err
+	}
+
+	backends := []namedProvider{{name: settings.getEffectiveProvider(), provider: primary}}
+	for _, f := range settings.Fallbacks {
+		models := f.Models
+		if models == nil {
+			models = defaultModelSettings(f.Provider)
+		}
+		p, err := createProviderOfType(settings, f.Provider, models)
+		if err != nil {
+			return nil, fmt.Errorf("create fallback provider %s: %w", f.Provider, err)
+		}
+		backends = append(backends, namedProvider{name: f.Provider, provider: p})
+	}
+	return newFallbackProvider(backends), nil
+}
+
+// createProviderOfType creates a single provider of the given type, using the
+// given model settings rather than the top level ones. It is guarded by the
+// provider's circuit breaker, if circuit breakers are enabled.
+func createProviderOfType(settings *Settings, provider ProviderType, models *ModelSettings) (LLMProvider, error) {
+	p, err := newProviderOfType(settings, provider, models)
+	if err != nil {
+		return nil, err
+	}
+	return settings.breakers.wrap(provider, p), nil
+}
+
+func newProviderOfType(settings *Settings, provider ProviderType, models *ModelSettings) (LLMProvider, error) {
 	switch provider {
 	case ProviderTypeOpenAI, ProviderTypeCustom:
 		// Handle the case when the OpenAI provider is set to Azure
 		// for backwards compatibility.
 		if settings.OpenAI.Provider == ProviderTypeAzure {
-			return NewAzureProvider(settings.OpenAI, settings.Models.Default)
+			return NewAzureProvider(settings.OpenAI, models.Default)
 		}
-		return NewOpenAIProvider(settings.OpenAI, settings.Models)
+		return NewOpenAIProvider(settings.OpenAI, models)
 	case ProviderTypeAzure:
-		return NewAzureProvider(settings.OpenAI, settings.Models.Default)
+		return NewAzureProvider(settings.OpenAI, models.Default)
 	case ProviderTypeGrafana:
-		return NewGrafanaProvider(*settings)
+		s := *settings
+		s.Models = models
+		return NewGrafanaProvider(s)
 	case ProviderTypeAnthropic:
-		return NewAnthropicProvider(settings.Anthropic, settings.Models)
+		if settings.Anthropic.UseMessagesAPI {
+			return NewAnthropicMessagesProvider(settings.Anthropic, models)
+		}
+		return NewAnthropicProvider(settings.Anthropic, models)
+	case ProviderTypeGemini:
+		return NewGeminiProvider(settings.Gemini, models)
+	case ProviderTypeBedrock:
+		return NewBedrockProvider(settings.Bedrock, models)
+	case ProviderTypeLocal:
+		return NewLocalProvider(settings.Local, models)
 	case ProviderTypeTest:
 		return &settings.OpenAI.TestProvider, nil
 	default:
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSettingsRetries(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{})
+	require.NoError(t, err)
+	defaults := transport.RetrySettings{
+		MaxAttempts:                transport.DefaultMaxAttempts,
+		InitialBackoffMilliseconds: transport.DefaultInitialBackoffMilliseconds,
+		MaxBackoffSeconds:          transport.DefaultMaxBackoffSeconds,
+	}
+	assert.Equal(t, defaults, settings.Retries)
+
+	settings, err = loadSettings(backend.AppInstanceSettings{JSONData: []byte(`{"retries": {"maxAttempts": 5}, "vector": {"embed": {"type": "openai"}}}`)})
+	require.NoError(t, err)
+	assert.Equal(t, 5, settings.Retries.MaxAttempts)
+	assert.Equal(t, transport.DefaultMaxBackoffSeconds, settings.Retries.MaxBackoffSeconds)
+	for name, retries := range map[string]transport.RetrySettings{
+		"openai":    settings.OpenAI.retries,
+		"anthropic": settings.Anthropic.retries,
+		"gemini":    settings.Gemini.retries,
+		"bedrock":   settings.Bedrock.retries,
+		"local":     settings.Local.retries,
+		"embedder":  settings.Vector.Embed.Retries,
+	} {
+		assert.Equal(t, settings.Retries, retries, "%s should use the retry settings", name)
+	}
+}
+
+func TestLoadSettingsHTTP(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{
+		JSONData:                []byte(`{"http": {"connectTimeoutSeconds": 5, "proxyUrl": "http://proxy:3128"}, "vector": {"embed": {"type": "openai"}}}`),
+		DecryptedSecureJSONData: map[string]string{transport.CACertKey: "ca"},
+	})
+	// The CA certificate isn't valid PEM.
+	assert.ErrorContains(t, err, "outbound HTTP settings")
+	assert.Nil(t, settings)
+
+	settings, err = loadSettings(backend.AppInstanceSettings{
+		JSONData: []byte(`{"http": {"connectTimeoutSeconds": 5, "proxyUrl": "http://proxy:3128"}, "vector": {"embed": {"type": "openai"}}}`),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, transport.HTTPSettings{
+		ConnectTimeoutSeconds:    5,
+		ResponseTimeoutSeconds:   transport.DefaultResponseTimeoutSeconds,
+		StreamIdleTimeoutSeconds: transport.DefaultStreamIdleTimeoutSeconds,
+		ProxyURL:                 "http://proxy:3128",
+	}, settings.HTTP)
+	require.NotNil(t, settings.httpTransport)
+	for name, rt := range map[string]http.RoundTripper{
+		"openai":    settings.OpenAI.httpTransport,
+		"anthropic": settings.Anthropic.httpTransport,
+		"gemini":    settings.Gemini.httpTransport,
+		"bedrock":   settings.Bedrock.httpTransport,
+		"local":     settings.Local.httpTransport,
+	} {
+		assert.Same(t, settings.httpTransport, rt, "%s should use the outbound transport", name)
+	}
+	assert.Equal(t, settings.HTTP, settings.Vector.Embed.HTTP)
+	assert.Equal(t, settings.HTTP, settings.Vector.Store.HTTP)
+}
+
+func TestChatCompletionsRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After-Ms", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = fmt.Fprint(w, `{"error": {"message": "rate limited"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(answerResponse("hi"))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{
+		JSONData:                []byte(fmt.Sprintf(`{"provider": "openai", "openAI": {"url": %q}}`, server.URL)),
+		DecryptedSecureJSONData: map[string]string{openAIKey: "abcd1234"},
+	}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	var r mockCallResourceResponseSender
+	err = app.CallResource(ctx, &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{OrgID: 1, AppInstanceSettings: &settings},
+		Method:        http.MethodPost,
+		Path:          "/llm/v1/chat/completions",
+		Body:          []byte(`{"model": "base", "messages": [{"role": "user", "content": "hi"}]}`),
+	}, &r)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r.response.Status, string(r.response.Body))
+	assert.Equal(t, int32(2), calls.Load(), "the rate limited request should be retried")
+}
@@ -0,0 +1,260 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// quotaScope is what a quota applies to.
+type quotaScope string
+
+const (
+	quotaScopeOrg    quotaScope = "org"
+	quotaScopeUser   quotaScope = "user"
+	quotaScopeCaller quotaScope = "caller"
+)
+
+// Limits a quota can be exceeded for, used as the error type of 429 responses
+// in the same way as OpenAI.
+const (
+	quotaLimitRequests = "requests"
+	quotaLimitTokens   = "tokens"
+)
+
+// quotaExceededError is returned when a request would exceed a quota.
+type quotaExceededError struct {
+	Scope quotaScope
+	Key   string
+	// Limit is quotaLimitRequests or quotaLimitTokens.
+	Limit string
+	// RetryAfter is how long until the request would be allowed.
+	RetryAfter time.Duration
+}
+
+func (e *quotaExceededError) Error() string {
+	period := "minute"
+	if e.Limit == quotaLimitTokens {
+		period = "day"
+	}
+	return fmt.Sprintf("%s per %s quota exceeded for %s %s, retry after %ds", e.Limit, period, e.Scope, e.Key, e.retryAfterSeconds())
+}
+
+// retryAfterSeconds returns RetryAfter rounded up to whole seconds, as used in
+// the Retry-After header.
+func (e *quotaExceededError) retryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// handleQuotaError writes an OpenAI-shaped 429 response for a quota error.
+func handleQuotaError(w http.ResponseWriter, err *quotaExceededError) {
+	log.DefaultLogger.Warn("Quota exceeded", "scope", err.Scope, "key", err.Key, "limit", err.Limit)
+	body, merr := json.Marshal(openai.ErrorResponse{Error: &openai.APIError{
+		Code:    "rate_limit_exceeded",
+		Message: err.Error(),
+		Type:    err.Limit,
+	}})
+	if merr != nil {
+		handleError(w, err, http.StatusTooManyRequests)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(err.retryAfterSeconds()))
+	w.WriteHeader(http.StatusTooManyRequests)
+	//nolint:errcheck
+	w.Write(body)
+}
+
+type quotaKey struct {
+	scope quotaScope
+	key   string
+}
+
+// quotaState tracks the usage of a single org, user or caller.
+type quotaState struct {
+	// requests is the number of requests which can currently be made. It is
+	// refilled continuously at the rate of the requests per minute limit, up
+	// to that limit.
+	requests float64
+	refilled time.Time
+	// tokens is the number of tokens used since the start of day, which is a
+	// UTC day.
+	tokens int64
+	day    time.Time
+}
+
+// quotaLimiter enforces the request and token quotas of orgs, users and
+// callers. It is safe for concurrent use.
+type quotaLimiter struct {
+	mu       sync.Mutex
+	settings QuotaSettings
+	states   map[quotaKey]*quotaState
+	// pruned is the day on which idle states were last removed.
+	pruned time.Time
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+func newQuotaLimiter(settings QuotaSettings) *quotaLimiter {
+	return &quotaLimiter{
+		settings: settings,
+		states:   map[quotaKey]*quotaState{},
+		now:      time.Now,
+	}
+}
+
+// quotaSubjects returns the org, user and caller a request counts against.
+// Users and callers are only counted if known.
+func quotaSubjects(orgID int64, user, caller string) []quotaKey {
+	subjects := []quotaKey{{scope: quotaScopeOrg, key: strconv.FormatInt(orgID, 10)}}
+	if user != "" {
+		subjects = append(subjects, quotaKey{scope: quotaScopeUser, key: user})
+	}
+	if caller != "" {
+		subjects = append(subjects, quotaKey{scope: quotaScopeCaller, key: caller})
+	}
+	return subjects
+}
+
+// state returns the up to date state of a subject. It must be called with q.mu
+// held.
+func (q *quotaLimiter) state(k quotaKey, limits QuotaLimits, now time.Time) *quotaState {
+	day := now.UTC().Truncate(24 * time.Hour)
+	s, ok := q.states[k]
+	if !ok {
+		s = &quotaState{requests: float64(limits.RequestsPerMinute), refilled: now, day: day}
+		q.states[k] = s
+		return s
+	}
+	if limits.RequestsPerMinute > 0 {
+		rpm := float64(limits.RequestsPerMinute)
+		s.requests = min(rpm, s.requests+now.Sub(s.refilled).Minutes()*rpm)
+	}
+	s.refilled = now
+	if day.After(s.day) {
+		s.tokens, s.day = 0, day
+	}
+	return s
+}
+
+// allow reports whether a request may be made, counting it against the
+// requests per minute quotas if so. Otherwise the error reports the quota
+// which would be exceeded for longest.
+func (q *quotaLimiter) allow(orgID int64, user, caller string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	q.prune(now)
+	subjects := quotaSubjects(orgID, user, caller)
+	states := make([]*quotaState, len(subjects))
+	var exceeded *quotaExceededError
+	for i, k := range subjects {
+		limits := q.settings.limits(k.scope, k.key)
+		s := q.state(k, limits, now)
+		states[i] = s
+		var err *quotaExceededError
+		if limits.TokensPerDay > 0 && s.tokens >= limits.TokensPerDay {
+			err = &quotaExceededError{Scope: k.scope, Key: k.key, Limit: quotaLimitTokens, RetryAfter: s.day.Add(24 * time.Hour).Sub(now)}
+		} else if limits.RequestsPerMinute > 0 && s.requests < 1 {
+			wait := (1 - s.requests) / float64(limits.RequestsPerMinute) * float64(time.Minute)
+			err = &quotaExceededError{Scope: k.scope, Key: k.key, Limit: quotaLimitRequests, RetryAfter: time.Duration(wait)}
+		}
+		if err != nil && (exceeded == nil || err.RetryAfter > exceeded.RetryAfter) {
+			exceeded = err
+		}
+	}
+	if exceeded != nil {
+		return exceeded
+	}
+	for i, k := range subjects {
+		if q.settings.limits(k.scope, k.key).RequestsPerMinute > 0 {
+			states[i].requests--
+		}
+	}
+	return nil
+}
+
+// record counts the tokens used by a request against the tokens per day
+// quotas. Requests which are already running when a quota is reached are
+// allowed to finish, so usage may exceed the quota slightly.
+func (q *quotaLimiter) record(r usageRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, k := range quotaSubjects(r.Key.OrgID, r.Key.User, r.PluginID) {
+		s := q.state(k, q.settings.limits(k.scope, k.key), r.Time)
+		s.tokens += int64(r.Usage.TotalTokens)
+	}
+	return nil
+}
+
+// prune removes the state of subjects which haven't made a request for a day,
+// at most once a day. It must be called with q.mu held.
+func (q *quotaLimiter) prune(now time.Time) {
+	day := now.UTC().Truncate(24 * time.Hour)
+	if !day.After(q.pruned) {
+		return
+	}
+	for k, s := range q.states {
+		if now.Sub(s.refilled) > 24*time.Hour {
+			delete(q.states, k)
+		}
+	}
+	q.pruned = day
+}
+
+// quotaExceededDetails describes a quota which is currently exceeded.
+type quotaExceededDetails struct {
+	Scope             quotaScope `json:"scope"`
+	Key               string     `json:"key"`
+	Limit             string     `json:"limit"`
+	RetryAfterSeconds int        `json:"retryAfterSeconds"`
+}
+
+type quotaHealthDetails struct {
+	// Limits are the configured quotas.
+	Limits QuotaSettings `json:"limits"`
+	// Exceeded lists the orgs, users and callers which are currently
+	// prevented from making requests.
+	Exceeded []quotaExceededDetails `json:"exceeded"`
+}
+
+// health reports the configured quotas and those currently exceeded.
+func (q *quotaLimiter) health() *quotaHealthDetails {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	d := &quotaHealthDetails{Limits: q.settings, Exceeded: []quotaExceededDetails{}}
+	for k := range q.states {
+		limits := q.settings.limits(k.scope, k.key)
+		s := q.state(k, limits, now)
+		e := quotaExceededDetails{Scope: k.scope, Key: k.key}
+		switch {
+		case limits.TokensPerDay > 0 && s.tokens >= limits.TokensPerDay:
+			e.Limit = quotaLimitTokens
+			e.RetryAfterSeconds = int(math.Ceil(s.day.Add(24 * time.Hour).Sub(now).Seconds()))
+		case limits.RequestsPerMinute > 0 && s.requests < 1:
+			e.Limit = quotaLimitRequests
+			e.RetryAfterSeconds = int(math.Ceil((1 - s.requests) / float64(limits.RequestsPerMinute) * 60))
+		default:
+			continue
+		}
+		d.Exceeded = append(d.Exceeded, e)
+	}
+	slices.SortFunc(d.Exceeded, func(a, b quotaExceededDetails) int {
+		if c := strings.Compare(string(a.Scope), string(b.Scope)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return d
+}
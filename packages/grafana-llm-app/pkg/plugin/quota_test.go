@@ -0,0 +1,226 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newQuotaTestLimiter(settings QuotaSettings) (*quotaLimiter, *time.Time) {
+	now := time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)
+	q := newQuotaLimiter(settings)
+	q.now = func() time.Time { return now }
+	return q, &now
+}
+
+func requireQuotaExceeded(t *testing.T, err error, scope quotaScope, limit string, retryAfter time.Duration) {
+	t.Helper()
+	var quotaErr *quotaExceededError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, scope, quotaErr.Scope)
+	assert.Equal(t, limit, quotaErr.Limit)
+	assert.Equal(t, retryAfter, quotaErr.RetryAfter)
+}
+
+func TestQuotaLimiter_RequestsPerMinute(t *testing.T) {
+	q, now := newQuotaTestLimiter(QuotaSettings{Org: QuotaScopeSettings{QuotaLimits: QuotaLimits{RequestsPerMinute: 2}}})
+
+	require.NoError(t, q.allow(1, "alice", ""))
+	require.NoError(t, q.allow(1, "bob", ""))
+	requireQuotaExceeded(t, q.allow(1, "alice", ""), quotaScopeOrg, quotaLimitRequests, 30*time.Second)
+	require.NoError(t, q.allow(2, "alice", ""), "other orgs should have their own quota")
+
+	*now = now.Add(30 * time.Second)
+	require.NoError(t, q.allow(1, "alice", ""))
+	require.Error(t, q.allow(1, "alice", ""))
+
+	// Requests accumulate up to the limit.
+	*now = now.Add(time.Hour)
+	require.NoError(t, q.allow(1, "alice", ""))
+	require.NoError(t, q.allow(1, "alice", ""))
+	require.Error(t, q.allow(1, "alice", ""))
+}
+
+func TestQuotaLimiter_TokensPerDay(t *testing.T) {
+	q, now := newQuotaTestLimiter(QuotaSettings{User: QuotaScopeSettings{QuotaLimits: QuotaLimits{TokensPerDay: 100}}})
+
+	require.NoError(t, q.allow(1, "alice", ""))
+	require.NoError(t, q.record(usageRecord{Time: *now, Key: usageKey{OrgID: 1, User: "alice"}, Usage: tokens(60, 40)}))
+	requireQuotaExceeded(t, q.allow(1, "alice", ""), quotaScopeUser, quotaLimitTokens, time.Hour)
+	require.NoError(t, q.allow(1, "bob", ""))
+
+	*now = now.Add(time.Hour)
+	require.NoError(t, q.allow(1, "alice", ""), "token quotas should reset each day")
+}
+
+func TestQuotaLimiter_Overrides(t *testing.T) {
+	q, _ := newQuotaTestLimiter(QuotaSettings{Caller: QuotaScopeSettings{
+		QuotaLimits: QuotaLimits{RequestsPerMinute: 1},
+		Overrides: map[string]QuotaLimits{
+			"grafana-assistant-app": {},
+			"noisy-panel":           {TokensPerDay: 10},
+		},
+	}})
+
+	for range 3 {
+		require.NoError(t, q.allow(1, "alice", "grafana-assistant-app"), "callers can be exempted")
+		require.NoError(t, q.allow(1, "alice", ""), "caller quotas only apply to known callers")
+	}
+	require.NoError(t, q.allow(1, "alice", "dashboard"))
+	require.Error(t, q.allow(1, "alice", "dashboard"))
+
+	require.NoError(t, q.record(usageRecord{Time: q.now(), Key: usageKey{OrgID: 1, Caller: "noisy-panel"}, PluginID: "noisy-panel", Usage: tokens(5, 0)}))
+	require.NoError(t, q.record(usageRecord{Time: q.now(), Key: usageKey{OrgID: 1, Caller: "other-feature"}, PluginID: "noisy-panel", Usage: tokens(5, 0)}))
+	requireQuotaExceeded(t, q.allow(1, "alice", "noisy-panel"), quotaScopeCaller, quotaLimitTokens, time.Hour)
+}
+
+func TestQuotaLimiter_DeniedRequestsAreNotCounted(t *testing.T) {
+	q, _ := newQuotaTestLimiter(QuotaSettings{
+		Org:  QuotaScopeSettings{QuotaLimits: QuotaLimits{RequestsPerMinute: 2}},
+		User: QuotaScopeSettings{QuotaLimits: QuotaLimits{RequestsPerMinute: 1}},
+	})
+	require.NoError(t, q.allow(1, "alice", ""))
+	require.Error(t, q.allow(1, "alice", ""))
+	require.NoError(t, q.allow(1, "bob", ""), "alice's denied request should not count against the org")
+}
+
+func TestQuotaLimiter_Health(t *testing.T) {
+	settings := QuotaSettings{
+		Org:  QuotaScopeSettings{QuotaLimits: QuotaLimits{RequestsPerMinute: 1}},
+		User: QuotaScopeSettings{QuotaLimits: QuotaLimits{TokensPerDay: 10}},
+	}
+	q, _ := newQuotaTestLimiter(settings)
+	require.NoError(t, q.allow(1, "alice", ""))
+	require.NoError(t, q.record(usageRecord{Time: q.now(), Key: usageKey{OrgID: 1, User: "alice"}, Usage: tokens(10, 5)}))
+
+	d := q.health()
+	assert.Equal(t, settings, d.Limits)
+	assert.Equal(t, []quotaExceededDetails{
+		{Scope: quotaScopeOrg, Key: "1", Limit: quotaLimitRequests, RetryAfterSeconds: 60},
+		{Scope: quotaScopeUser, Key: "alice", Limit: quotaLimitTokens, RetryAfterSeconds: 3600},
+	}, d.Exceeded)
+}
+
+func TestLoadSettingsQuotas(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{JSONData: []byte(`{"quotas": {"caller": {"requestsPerMinute": 5, "overrides": {"grafana-assistant-app": {"tokensPerDay": 1000}}}}}`)})
+	require.NoError(t, err)
+	assert.True(t, settings.Quotas.enabled())
+	assert.Equal(t, QuotaLimits{RequestsPerMinute: 5}, settings.Quotas.limits(quotaScopeCaller, "other"))
+	assert.Equal(t, QuotaLimits{TokensPerDay: 1000}, settings.Quotas.limits(quotaScopeCaller, "grafana-assistant-app"))
+	assert.Equal(t, QuotaLimits{}, settings.Quotas.limits(quotaScopeOrg, "1"))
+
+	settings, err = loadSettings(backend.AppInstanceSettings{})
+	require.NoError(t, err)
+	assert.False(t, settings.Quotas.enabled())
+}
+
+func TestChatCompletionsQuota(t *testing.T) {
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test", "quotas": {"user": {"tokensPerDay": 15}}}`)}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	call := func() *backend.CallResourceResponse {
+		var r mockCallResourceResponseSender
+		err := app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{OrgID: 1, User: &backend.User{Login: "alice"}, AppInstanceSettings: &settings},
+			Method:        http.MethodPost,
+			Path:          "/llm/v1/chat/completions",
+			Body:          []byte(`{"messages": [{"role": "user", "content": "hi"}]}`),
+		}, &r)
+		require.NoError(t, err)
+		return r.response
+	}
+
+	// The test provider uses 10 tokens per request, so the second request
+	// reaches the quota.
+	for range 2 {
+		resp := call()
+		require.Equal(t, http.StatusOK, resp.Status, string(resp.Body))
+	}
+	resp := call()
+	require.Equal(t, http.StatusTooManyRequests, resp.Status)
+	assert.NotEmpty(t, http.Header(resp.Headers).Get("Retry-After"))
+	var body openai.ErrorResponse
+	require.NoError(t, json.Unmarshal(resp.Body, &body))
+	require.NotNil(t, body.Error)
+	assert.Equal(t, "rate_limit_exceeded", body.Error.Code)
+	assert.Equal(t, quotaLimitTokens, body.Error.Type)
+
+	health, err := app.CheckHealth(ctx, &backend.CheckHealthRequest{})
+	require.NoError(t, err)
+	var details healthCheckDetails
+	require.NoError(t, json.Unmarshal(health.JSONDetails, &details))
+	require.NotNil(t, details.Quotas)
+	require.Len(t, details.Quotas.Exceeded, 1)
+	assert.Equal(t, "alice", details.Quotas.Exceeded[0].Key)
+}
+
+func TestChatCompletionsCallerQuota(t *testing.T) {
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test", "quotas": {"caller": {"requestsPerMinute": 1}}}`)}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	call := func(headers map[string][]string) *backend.CallResourceResponse {
+		var r mockCallResourceResponseSender
+		err := app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{OrgID: 1, User: &backend.User{Login: "alice"}, AppInstanceSettings: &settings},
+			Method:        http.MethodPost,
+			Path:          "/llm/v1/chat/completions",
+			Headers:       headers,
+			Body:          []byte(`{"messages": [{"role": "user", "content": "hi"}]}`),
+		}, &r)
+		require.NoError(t, err)
+		return r.response
+	}
+
+	resp := call(map[string][]string{pluginIDHeader: {"noisy-panel"}, http.CanonicalHeaderKey(callerHeader): {"feature-a"}})
+	require.Equal(t, http.StatusOK, resp.Status, string(resp.Body))
+	// Plugins can't avoid their quota by claiming to be another caller.
+	resp = call(map[string][]string{pluginIDHeader: {"noisy-panel"}, http.CanonicalHeaderKey(callerHeader): {"feature-b"}})
+	require.Equal(t, http.StatusTooManyRequests, resp.Status, string(resp.Body))
+	// The caller header alone isn't trusted, so it doesn't count against a
+	// caller quota.
+	for range 2 {
+		resp = call(map[string][]string{http.CanonicalHeaderKey(callerHeader): {"noisy-panel"}})
+		require.Equal(t, http.StatusOK, resp.Status, string(resp.Body))
+	}
+}
+
+func TestRunStreamQuota(t *testing.T) {
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test", "quotas": {"org": {"requestsPerMinute": 1}}}`)}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	run := func() []json.RawMessage {
+		r := mockStreamPacketSender{messages: []json.RawMessage{}}
+		err := app.RunStream(ctx, &backend.RunStreamRequest{
+			PluginContext: backend.PluginContext{OrgID: 1, AppInstanceSettings: &settings},
+			Path:          testLLMChatCompletionsPath + "/abcd1234",
+			Data:          []byte(`{"messages": [{"role": "user", "content": "hi"}]}`),
+		}, backend.NewStreamSender(&r))
+		require.NoError(t, err)
+		return r.messages
+	}
+
+	require.Greater(t, len(run()), 1)
+	messages := run()
+	require.Len(t, messages, 1)
+	var event EventError
+	require.NoError(t, json.Unmarshal(messages[0], &event))
+	assert.Equal(t, "rate_limit_exceeded", event.Code)
+	assert.Equal(t, quotaLimitRequests, event.Type)
+	assert.Equal(t, 60, event.RetryAfter)
+}
@@ -0,0 +1,451 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Built-in redaction detectors.
+const (
+	redactionEmail       = "email"
+	redactionIPv4        = "ipv4"
+	redactionIPv6        = "ipv6"
+	redactionJWT         = "jwt"
+	redactionAWSKey      = "aws_key"
+	redactionBearerToken = "bearer_token"
+	redactionCardNumber  = "card_number"
+)
+
+// redactionDetector finds values to redact.
+type redactionDetector struct {
+	name string
+	re   *regexp.Regexp
+	// valid, if set, reports whether the value at s[start:end] should be
+	// redacted, to filter out false positives.
+	valid func(s string, start, end int) bool
+}
+
+// builtinRedactionDetectors are the built-in detectors, in the order they are
+// applied. Detectors for tokens come first so that their parts aren't
+// redacted separately.
+var builtinRedactionDetectors = []redactionDetector{
+	{name: redactionJWT, re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)},
+	{name: redactionBearerToken, re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{8,}=*)`)},
+	{name: redactionAWSKey, re: regexp.MustCompile(`\b((?:AKIA|ASIA|AIDA|AROA)[0-9A-Z]{16})\b`)},
+	{name: redactionAWSKey, re: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+]{40})\b`)},
+	{name: redactionEmail, re: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)},
+	{name: redactionCardNumber, re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: validCardNumber},
+	{name: redactionIPv4, re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`)},
+	{name: redactionIPv6, re: regexp.MustCompile(`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}(?:%[0-9A-Za-z]+)?`), valid: validIPv6},
+}
+
+// validCardNumber reports whether a sequence of digits passes the Luhn check
+// used by payment card numbers.
+func validCardNumber(s string, start, end int) bool {
+	sum, n := 0, 0
+	for i := end - 1; i >= start; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// validIPv6 reports whether a candidate is an IPv6 address which isn't part
+// of a longer word, so that e.g. std::cerr isn't redacted.
+func validIPv6(s string, start, end int) bool {
+	if start > 0 && isWordByte(s[start-1]) || end < len(s) && isWordByte(s[end]) {
+		return false
+	}
+	candidate := s[start:end]
+	if strings.Trim(candidate, ":") == "" {
+		return false
+	}
+	addr, err := netip.ParseAddr(candidate)
+	return err == nil && addr.Is6()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// redactionPlaceholderRegex matches the placeholders values are replaced with.
+var redactionPlaceholderRegex = regexp.MustCompile(`\[REDACTED_[A-Z0-9_]+_\d+\]`)
+
+const (
+	redactionPlaceholderPrefix = "[REDACTED_"
+	// maxRedactionPlaceholderLength is the length of the longest placeholder
+	// held back while rehydrating a stream.
+	maxRedactionPlaceholderLength = 64
+)
+
+// redactor replaces personal data and secrets in chat completions requests
+// with placeholders.
+type redactor struct {
+	detectors []redactionDetector
+}
+
+// newRedactor returns a redactor using the configured detectors and patterns.
+// Unknown detectors and invalid patterns are ignored.
+func newRedactor(settings RedactionSettings) *redactor {
+	r := &redactor{}
+	for _, name := range settings.Detectors {
+		if !slices.ContainsFunc(builtinRedactionDetectors, func(d redactionDetector) bool { return d.name == name }) {
+			log.DefaultLogger.Warn("Ignoring unknown redaction detector", "detector", name)
+		}
+	}
+	for _, d := range builtinRedactionDetectors {
+		if len(settings.Detectors) == 0 || slices.Contains(settings.Detectors, d.name) {
+			r.detectors = append(r.detectors, d)
+		}
+	}
+	for _, p := range settings.Patterns {
+		if p.Name == "" {
+			log.DefaultLogger.Warn("Ignoring redaction pattern without a name", "regex", p.Regex)
+			continue
+		}
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			log.DefaultLogger.Warn("Ignoring invalid redaction pattern", "name", p.Name, "err", err)
+			continue
+		}
+		r.detectors = append(r.detectors, redactionDetector{name: p.Name, re: re})
+	}
+	return r
+}
+
+// redaction holds the values replaced in a request, so that they can be
+// restored in its response.
+type redaction struct {
+	detectors []redactionDetector
+	// placeholders maps values to their placeholders, and values maps them
+	// back.
+	placeholders map[string]string
+	values       map[string]string
+	// counts is the number of values redacted by each detector.
+	counts map[string]int
+	// next is the number of the next placeholder for each detector.
+	next map[string]int
+}
+
+// redact returns a copy of req with the values found in its messages replaced
+// with placeholders. The same value is always replaced with the same
+// placeholder.
+func (r *redactor) redact(req ChatCompletionRequest) (ChatCompletionRequest, *redaction) {
+	rd := &redaction{
+		detectors:    r.detectors,
+		placeholders: map[string]string{},
+		values:       map[string]string{},
+		counts:       map[string]int{},
+		next:         map[string]int{},
+	}
+	messages := make([]openai.ChatCompletionMessage, len(req.Messages))
+	for i, m := range req.Messages {
+		m.Content = rd.text(m.Content)
+		if len(m.MultiContent) > 0 {
+			m.MultiContent = slices.Clone(m.MultiContent)
+			for j := range m.MultiContent {
+				m.MultiContent[j].Text = rd.text(m.MultiContent[j].Text)
+			}
+		}
+		if len(m.ToolCalls) > 0 {
+			m.ToolCalls = slices.Clone(m.ToolCalls)
+			for j := range m.ToolCalls {
+				m.ToolCalls[j].Function.Arguments = rd.text(m.ToolCalls[j].Function.Arguments)
+			}
+		}
+		messages[i] = m
+	}
+	req.Messages = messages
+	return req, rd
+}
+
+// text replaces the values found in s with placeholders.
+func (rd *redaction) text(s string) string {
+	if s == "" {
+		return s
+	}
+	for _, d := range rd.detectors {
+		s = rd.replace(d, s)
+	}
+	return s
+}
+
+// replace replaces the values d finds in s.
+func (rd *redaction) replace(d redactionDetector, s string) string {
+	matches := d.re.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		// Only redact the first capturing group, if there is one.
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		if start == end || d.valid != nil && !d.valid(s, start, end) {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(rd.placeholder(d.name, s[start:end]))
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// placeholder returns the placeholder for a value found by a detector.
+func (rd *redaction) placeholder(detector, value string) string {
+	rd.counts[detector]++
+	if p, ok := rd.placeholders[value]; ok {
+		return p
+	}
+	rd.next[detector]++
+	p := fmt.Sprintf("%s%s_%d]", redactionPlaceholderPrefix, placeholderName(detector), rd.next[detector])
+	rd.placeholders[value] = p
+	rd.values[p] = value
+	return p
+}
+
+// placeholderName returns a detector's name as used in placeholders, e.g.
+// CARD_NUMBER for card_number.
+func placeholderName(detector string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, detector)
+}
+
+// rehydrate replaces the placeholders in s with the values they replaced.
+func (rd *redaction) rehydrate(s string) string {
+	if len(rd.values) == 0 || !strings.Contains(s, redactionPlaceholderPrefix) {
+		return s
+	}
+	return redactionPlaceholderRegex.ReplaceAllStringFunc(s, func(p string) string {
+		if v, ok := rd.values[p]; ok {
+			return v
+		}
+		return p
+	})
+}
+
+// rehydrateResponse replaces the placeholders in the messages of resp.
+func (rd *redaction) rehydrateResponse(resp openai.ChatCompletionResponse) openai.ChatCompletionResponse {
+	if len(rd.values) == 0 {
+		return resp
+	}
+	resp.Choices = slices.Clone(resp.Choices)
+	for i := range resp.Choices {
+		m := &resp.Choices[i].Message
+		m.Content = rd.rehydrate(m.Content)
+		if len(m.ToolCalls) > 0 {
+			m.ToolCalls = slices.Clone(m.ToolCalls)
+			for j := range m.ToolCalls {
+				m.ToolCalls[j].Function.Arguments = rd.rehydrate(m.ToolCalls[j].Function.Arguments)
+			}
+		}
+	}
+	return resp
+}
+
+// streamKey identifies the content (tool -1) or the arguments of a tool call
+// of a choice in a stream.
+type streamKey struct {
+	choice, tool int
+}
+
+// streamRehydrator replaces placeholders in streamed deltas. Placeholders may
+// be split across chunks, so text which could be the start of one is held
+// back until the rest arrives.
+type streamRehydrator struct {
+	rd      *redaction
+	pending map[streamKey]string
+}
+
+// write returns the text of a delta which can be sent, rehydrated.
+func (h *streamRehydrator) write(key streamKey, s string) string {
+	s = h.pending[key] + s
+	delete(h.pending, key)
+	if i := strings.LastIndexByte(s, '['); i >= 0 && isPlaceholderPrefix(s[i:]) {
+		h.pending[key] = s[i:]
+		s = s[:i]
+	}
+	return h.rd.rehydrate(s)
+}
+
+// flush returns the text held back for key.
+func (h *streamRehydrator) flush(key streamKey) string {
+	s := h.pending[key]
+	delete(h.pending, key)
+	return h.rd.rehydrate(s)
+}
+
+// isPlaceholderPrefix reports whether s could be the start of an unfinished
+// placeholder.
+func isPlaceholderPrefix(s string) bool {
+	if len(s) > maxRedactionPlaceholderLength || strings.Contains(s, "]") {
+		return false
+	}
+	if len(s) <= len(redactionPlaceholderPrefix) {
+		return strings.HasPrefix(redactionPlaceholderPrefix, s)
+	}
+	if !strings.HasPrefix(s, redactionPlaceholderPrefix) {
+		return false
+	}
+	return strings.Trim(s[len(redactionPlaceholderPrefix):], "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") == ""
+}
+
+// rehydrate replaces the placeholders in a chunk of a stream, holding back
+// partial placeholders. Those of a choice are flushed when it finishes.
+func (h *streamRehydrator) rehydrate(resp *ChatCompletionStreamResponse) {
+	resp.Choices = slices.Clone(resp.Choices)
+	for i := range resp.Choices {
+		c := &resp.Choices[i]
+		c.Delta.Content = h.write(streamKey{c.Index, -1}, c.Delta.Content)
+		c.Delta.ToolCalls = slices.Clone(c.Delta.ToolCalls)
+		for j := range c.Delta.ToolCalls {
+			tc := &c.Delta.ToolCalls[j]
+			tc.Function.Arguments = h.write(streamKey{c.Index, toolCallIndex(tc, j)}, tc.Function.Arguments)
+		}
+		if c.FinishReason != "" {
+			h.flushChoice(c)
+		}
+	}
+}
+
+// flushChoice adds the text held back for a choice to its delta.
+func (h *streamRehydrator) flushChoice(c *openai.ChatCompletionStreamChoice) {
+	for _, key := range slices.SortedFunc(maps.Keys(h.pending), func(a, b streamKey) int { return a.tool - b.tool }) {
+		if key.choice != c.Index {
+			continue
+		}
+		if key.tool < 0 {
+			c.Delta.Content += h.flush(key)
+			continue
+		}
+		index := key.tool
+		c.Delta.ToolCalls = append(c.Delta.ToolCalls, openai.ToolCall{Index: &index, Function: openai.FunctionCall{Arguments: h.flush(key)}})
+	}
+}
+
+// remaining returns a chunk with any text still held back when a stream ends
+// without its choices finishing, or false if there is none.
+func (h *streamRehydrator) remaining() (ChatCompletionStreamResponse, bool) {
+	var resp ChatCompletionStreamResponse
+	for _, key := range slices.SortedFunc(maps.Keys(h.pending), func(a, b streamKey) int { return a.choice - b.choice }) {
+		if !slices.ContainsFunc(resp.Choices, func(c openai.ChatCompletionStreamChoice) bool { return c.Index == key.choice }) {
+			resp.Choices = append(resp.Choices, openai.ChatCompletionStreamChoice{Index: key.choice})
+		}
+	}
+	for i := range resp.Choices {
+		h.flushChoice(&resp.Choices[i])
+	}
+	return resp, len(resp.Choices) > 0
+}
+
+func toolCallIndex(tc *openai.ToolCall, i int) int {
+	if tc.Index != nil {
+		return *tc.Index
+	}
+	return i
+}
+
+type redactionCountsKey struct{}
+
+// withRedactionCounts returns a context carrying the number of values
+// redacted from a request by each detector, for the audit log.
+func withRedactionCounts(ctx context.Context, counts map[string]int) context.Context {
+	return context.WithValue(ctx, redactionCountsKey{}, counts)
+}
+
+func redactionCountsFromContext(ctx context.Context) map[string]int {
+	counts, _ := ctx.Value(redactionCountsKey{}).(map[string]int)
+	return counts
+}
+
+// redactingProvider is an LLMProvider which redacts personal data and secrets
+// from the messages of chat completions requests, and restores them in the
+// responses.
+type redactingProvider struct {
+	LLMProvider
+	redactor *redactor
+	metrics  *metrics
+}
+
+func (p *redactingProvider) redact(ctx context.Context, req ChatCompletionRequest) (context.Context, ChatCompletionRequest, *redaction) {
+	req, rd := p.redactor.redact(req)
+	if len(rd.counts) > 0 {
+		p.metrics.observeRedactions(rd.counts)
+		ctx = withRedactionCounts(ctx, rd.counts)
+	}
+	return ctx, req, rd
+}
+
+func (p *redactingProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	ctx, req, rd := p.redact(ctx, req)
+	resp, err := p.LLMProvider.ChatCompletion(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	return rd.rehydrateResponse(resp), nil
+}
+
+func (p *redactingProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	ctx, req, rd := p.redact(ctx, req)
+	c, err := p.LLMProvider.ChatCompletionStream(ctx, req)
+	if err != nil || len(rd.values) == 0 {
+		return c, err
+	}
+	out := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		h := &streamRehydrator{rd: rd, pending: map[streamKey]string{}}
+		for resp := range c {
+			if resp.Error == nil {
+				h.rehydrate(&resp)
+			}
+			if !forwardStreamResponse(ctx, out, resp, c) {
+				return
+			}
+		}
+		if resp, ok := h.remaining(); ok {
+			forwardStreamResponse(ctx, out, resp, c)
+		}
+	}()
+	return out, nil
+}
+
+// withRedaction wraps provider so that personal data and secrets are redacted
+// from requests, if redaction is enabled.
+func (a *App) withRedaction(provider LLMProvider) LLMProvider {
+	if a.redactor == nil || provider == nil {
+		return provider
+	}
+	return &redactingProvider{LLMProvider: provider, redactor: a.redactor, metrics: a.metrics}
+}
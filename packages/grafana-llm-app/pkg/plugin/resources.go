@@ -10,12 +10,15 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/store"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/sashabaranov/go-openai"
 )
 
@@ -104,7 +107,7 @@ func getLLMOptInState(ctx context.Context, settings *Settings) (llmGatewayRespon
 	proxyReq.Header.Add("X-Scope-OrgID", settings.Tenant)
 	proxyReq.Header.Set("Content-Type", "application/json")
 
-	httpClient := &http.Client{}
+	httpClient := &http.Client{Transport: outboundTransport(settings.httpTransport)}
 	resp, err := httpClient.Do(proxyReq)
 	if err != nil {
 		return llmGatewayResponse{}, fmt.Errorf("failed to send request to llm-gateway %w", err)
@@ -236,7 +239,7 @@ func (app *App) handleSaveLLMOptInState(w http.ResponseWriter, req *http.Request
 	proxyReq.Header.Add("X-Scope-OrgID", app.settings.Tenant)
 	proxyReq.Header.Set("Content-Type", "application/json")
 
-	httpClient := &http.Client{}
+	httpClient := &http.Client{Transport: outboundTransport(app.settings.httpTransport)}
 	resp, err := httpClient.Do(proxyReq)
 	if err != nil {
 		handleError(w, fmt.Errorf("failed to send request to llm-gateway %w", err), http.StatusBadRequest)
@@ -454,6 +457,7 @@ func (a *App) handleModels() http.HandlerFunc {
 			handleError(w, err, http.StatusInternalServerError)
 			return
 		}
+		a.settings.Models.describe(models.Data)
 
 		resp, err := json.Marshal(models)
 		if err != nil {
@@ -475,10 +479,15 @@ func (a *App) handleChatCompletionsStream(
 ) {
 	log.DefaultLogger.Info("handling stream request")
 	c, err := llmProvider.ChatCompletionStream(ctx, req)
-	if err != nil {
+	var openErr *circuitOpenError
+	if errors.As(err, &openErr) {
+		handleCircuitOpenError(w, openErr)
+		return
+	} else if err != nil {
 		handleError(w, err, http.StatusInternalServerError)
 		return
 	}
+	responseMetadataFromContext(ctx).setHeaders(w.Header())
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.WriteHeader(http.StatusOK)
 	var writeErr error
@@ -541,12 +550,106 @@ func handleStreamError(w http.ResponseWriter, err error, code int) error {
 	return nil
 }
 
+// handleChatCompletionsWithTools handles a chat completions request using
+// Grafana tools. Streaming requests receive a chunk for each tool call followed
+// by the final answer; other requests receive the final answer along with all
+// tool calls.
+func (a *App) handleChatCompletionsWithTools(
+	ctx context.Context,
+	llmProvider LLMProvider,
+	req ChatCompletionRequest,
+	pCtx *backend.PluginContext,
+	grafanaIdToken string,
+	w http.ResponseWriter,
+) {
+	agent, err := a.newToolAgent(llmProvider, pCtx, grafanaIdToken)
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	md := responseMetadataFromContext(ctx)
+
+	var steps []GrafanaToolStep
+	streaming := false
+	writeChunk := func(chunk ChatCompletionStreamResponse) error {
+		if !streaming {
+			md.setHeaders(w.Header())
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			streaming = true
+		}
+		chunk.ignorePadding = a.ignoreResponsePadding
+		b, err := json.Marshal(chunk)
+		if err != nil {
+			return fmt.Errorf("marshal streaming response: %w", err)
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+		return err
+	}
+	onStep := func(step GrafanaToolStep) error {
+		if !req.Stream {
+			steps = append(steps, step)
+			return nil
+		}
+		return writeChunk(toolStepStreamResponse(step))
+	}
+
+	resp, err := agent.run(ctx, req, onStep)
+	if err != nil {
+		if streaming {
+			if err := handleStreamError(w, err, http.StatusInternalServerError); err != nil {
+				log.DefaultLogger.Warn("failed to write stream", "err", err)
+			}
+			return
+		}
+		var openErr *circuitOpenError
+		switch {
+		case errors.As(err, &openErr):
+			handleCircuitOpenError(w, openErr)
+		case errors.Is(err, errBadRequest):
+			handleError(w, err, http.StatusBadRequest)
+		case errors.Is(err, errAgentBudgetExceeded):
+			handleError(w, err, http.StatusUnprocessableEntity)
+		default:
+			handleError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if req.Stream {
+		chunk := streamResponseFromChatCompletion(resp)
+		chunk.StopSequence, chunk.Citations = md.CompletionDetails()
+		if err := writeChunk(chunk); err != nil {
+			log.DefaultLogger.Warn("failed to write stream", "err", err)
+			return
+		}
+		//nolint:errcheck
+		w.Write([]byte("data: [DONE]\n\n"))
+		return
+	}
+
+	respBody, err := json.Marshal(grafanaToolsResponse{chatCompletionResponse: newChatCompletionResponse(resp, md), GrafanaToolSteps: steps})
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	md.setHeaders(w.Header())
+	w.WriteHeader(http.StatusOK)
+	//nolint:errcheck
+	w.Write(respBody)
+}
+
 func (a *App) handleChatCompletions() http.HandlerFunc {
 	llmProvider, err := createProvider(a.settings)
+	// Meter usage beneath the cache, so that only requests actually sent to
+	// the provider are recorded, and apply the budget above it, so that
+	// degraded requests are cached under the base model.
+	llmProvider = a.withRedaction(a.withAudit(a.withBudget(a.withCache(a.withUsage(a.withMetrics(a.withTracing(llmProvider)))))))
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			handleError(w, errors.New("LLM provider has invalid configuration"), http.StatusUnprocessableEntity)
+			return
 		}
 		if llmProvider == nil {
 			handleError(w, errors.New("must configure an LLM provider"), http.StatusUnprocessableEntity)
@@ -567,15 +670,102 @@ func (a *App) handleChatCompletions() http.HandlerFunc {
 			handleError(w, fmt.Errorf("could not decode request: %w", err), http.StatusBadRequest)
 			return
 		}
-
+		req.Model = a.settings.Models.resolve(req.Model)
+
+		ctx, md := withResponseMetadata(r.Context())
+		ctx = withAuditRequestID(withRequestCaller(ctx, r.Header.Get))
+		ctx, span := startRequestSpan(ctx, "handleChatCompletions", req)
+		defer span.End()
+		setTraceparentHeader(ctx, w.Header())
+		if err := a.checkQuota(ctx); err != nil {
+			//nolint:errcheck
+			tracing.Error(span, err)
+			a.audit.recordRejected(ctx, req, err)
+			var quotaErr *quotaExceededError
+			if errors.As(err, &quotaErr) {
+				handleQuotaError(w, quotaErr)
+				return
+			}
+			handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if len(req.GrafanaTools) > 0 {
+			pCtx := backend.PluginConfigFromContext(ctx)
+			a.handleChatCompletionsWithTools(ctx, llmProvider, req, &pCtx, r.Header.Get(backend.GrafanaUserSignInTokenHeaderName), w)
+			return
+		}
 		if req.Stream {
-			a.handleChatCompletionsStream(r.Context(), llmProvider, req, w)
+			a.handleChatCompletionsStream(ctx, llmProvider, req, w)
 			return
 		}
 
-		resp, err := llmProvider.ChatCompletion(r.Context(), req)
-		if errors.Is(err, errBadRequest) {
+		resp, err := llmProvider.ChatCompletion(ctx, req)
+		if err != nil {
+			//nolint:errcheck
+			tracing.Error(span, err)
+		}
+		var openErr *circuitOpenError
+		if errors.As(err, &openErr) {
+			handleCircuitOpenError(w, openErr)
+			return
+		} else if errors.Is(err, errBadRequest) {
 			handleError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		respBody, err := json.Marshal(newChatCompletionResponse(resp, md))
+		if err != nil {
+			handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		md.setHeaders(w.Header())
+		w.WriteHeader(http.StatusOK)
+		//nolint:errcheck
+		w.Write(respBody)
+	}
+}
+
+func (a *App) handleEmbeddings() http.HandlerFunc {
+	llmProvider, err := createProvider(a.settings)
+	llmProvider = a.withMetrics(a.withTracing(llmProvider))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			handleError(w, errors.New("LLM provider has invalid configuration"), http.StatusUnprocessableEntity)
+			return
+		}
+		if llmProvider == nil {
+			handleError(w, errors.New("must configure an LLM provider"), http.StatusUnprocessableEntity)
+			return
+		}
+		if r.Method != http.MethodPost {
+			handleError(w, errors.New("only POST method allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		reqBody, err := io.ReadAll(r.Body)
+		if err != nil {
+			handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		req := EmbeddingRequest{}
+		err = json.Unmarshal(reqBody, &req)
+		if err != nil {
+			handleError(w, fmt.Errorf("could not decode request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		ctx, md := withResponseMetadata(r.Context())
+		resp, err := llmProvider.Embeddings(ctx, req)
+		var openErr *circuitOpenError
+		if errors.As(err, &openErr) {
+			handleCircuitOpenError(w, openErr)
+			return
+		} else if errors.Is(err, errBadRequest) {
+			handleError(w, err, http.StatusBadRequest)
+			return
 		} else if err != nil {
 			handleError(w, err, http.StatusInternalServerError)
 			return
@@ -586,18 +776,115 @@ func (a *App) handleChatCompletions() http.HandlerFunc {
 			handleError(w, err, http.StatusInternalServerError)
 			return
 		}
+		md.setHeaders(w.Header())
 		w.WriteHeader(http.StatusOK)
 		//nolint:errcheck
 		w.Write(respBody)
 	}
 }
 
+// usageResponse is the response to a usage request.
+type usageResponse struct {
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	GroupBy []string     `json:"groupBy"`
+	Usage   []usageGroup `json:"usage"`
+}
+
+// parseUsageTime parses a time given either in RFC 3339 format or as
+// milliseconds since the epoch, as Grafana uses for time ranges.
+func parseUsageTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: must be RFC 3339 or milliseconds since the epoch", s)
+	}
+	return t.UTC(), nil
+}
+
+// parseUsageQuery parses the from, to and groupBy parameters of a usage
+// request. The time range defaults to the last 24 hours.
+func parseUsageQuery(params url.Values, now time.Time) (usageQuery, error) {
+	q := usageQuery{To: now.UTC()}
+	if to := params.Get("to"); to != "" {
+		t, err := parseUsageTime(to)
+		if err != nil {
+			return usageQuery{}, err
+		}
+		q.To = t
+	}
+	q.From = q.To.Add(-24 * time.Hour)
+	if from := params.Get("from"); from != "" {
+		t, err := parseUsageTime(from)
+		if err != nil {
+			return usageQuery{}, err
+		}
+		q.From = t
+	}
+	if !q.From.Before(q.To) {
+		return usageQuery{}, errors.New("from must be before to")
+	}
+	q.GroupBy = []string{}
+	for _, d := range strings.Split(params.Get("groupBy"), ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		if !slices.Contains(usageGroupByDimensions, d) {
+			return usageQuery{}, fmt.Errorf("invalid groupBy %q: must be one of %s", d, strings.Join(usageGroupByDimensions, ", "))
+		}
+		q.GroupBy = append(q.GroupBy, d)
+	}
+	return q, nil
+}
+
+// handleUsage returns the token usage of the requesting admin's org.
+func (a *App) handleUsage(w http.ResponseWriter, req *http.Request) {
+	if a.usageStore == nil {
+		handleError(w, errors.New("usage metering is disabled"), http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodGet {
+		handleError(w, errors.New("only GET method allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	user := backend.UserFromContext(req.Context())
+	if user == nil || user.Role != "Admin" {
+		handleError(w, errors.New("only admins can view usage"), http.StatusForbidden)
+		return
+	}
+	q, err := parseUsageQuery(req.URL.Query(), a.usageStore.now())
+	if err != nil {
+		handleError(w, err, http.StatusBadRequest)
+		return
+	}
+	q.OrgID = backend.PluginConfigFromContext(req.Context()).OrgID
+	respBody, err := json.Marshal(usageResponse{
+		From:    q.From,
+		To:      q.To,
+		GroupBy: q.GroupBy,
+		Usage:   a.usageStore.query(q),
+	})
+	if err != nil {
+		handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	//nolint:errcheck
+	w.Write(respBody)
+}
+
 // registerRoutes takes a *http.ServeMux and registers some HTTP handlers.
 func (a *App) registerRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/openai/v1/models", a.handleModels())                    // Deprecated
 	mux.HandleFunc("/openai/v1/chat/completions", a.handleChatCompletions()) // Deprecated
 	mux.HandleFunc("/llm/v1/chat/completions", a.handleChatCompletions())
+	mux.HandleFunc("/llm/v1/embeddings", a.handleEmbeddings())
 	mux.HandleFunc("/llm/v1/models", a.handleModels())
+	mux.HandleFunc("/llm/v1/usage", a.handleUsage)
 	mux.HandleFunc("/vector/search", a.handleVectorSearch)
 	mux.HandleFunc("/grafana-llm-state", a.handleLLMState)
 	mux.HandleFunc("/save-plugin-settings", a.handleSavePluginSettings)
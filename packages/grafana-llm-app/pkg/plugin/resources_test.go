@@ -3,6 +3,7 @@ package plugin
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -838,3 +839,265 @@ func withProviderURL(t *testing.T, s backend.AppInstanceSettings, url string) ba
 	}
 	return s
 }
+
+func TestModelTiers(t *testing.T) {
+	ctx := context.Background()
+	server := newMockOpenAIServer()
+	defer server.server.Close()
+
+	settings := backend.AppInstanceSettings{
+		JSONData: []byte(fmt.Sprintf(`{
+			"provider": "openai",
+			"openAI": {"url": %q},
+			"models": {
+				"default": "large",
+				"mapping": {"base": "gpt-4.1-mini", "large": "gpt-4.1", "reasoning": "o3"},
+				"tiers": [
+					{"id": "reasoning", "description": "Multi-step reasoning", "capabilities": ["reasoning", "tools"], "contextWindow": 200000}
+				]
+			}
+		}`, server.server.URL)),
+		DecryptedSecureJSONData: map[string]string{openAIKey: "abcd1234"},
+	}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app, ok := inst.(*App)
+	require.True(t, ok)
+
+	t.Run("models include tiers", func(t *testing.T) {
+		var r mockCallResourceResponseSender
+		err := app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+			Method:        http.MethodGet,
+			Path:          "/llm/v1/models",
+		}, &r)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, r.response.Status)
+		var resp ModelResponse
+		require.NoError(t, json.Unmarshal(r.response.Body, &resp))
+		require.Equal(t, []ModelInfo{
+			{ID: ModelBase},
+			{ID: ModelLarge},
+			{
+				ID:            ModelReasoning,
+				Description:   "Multi-step reasoning",
+				Capabilities:  []ModelCapability{ModelCapabilityReasoning, ModelCapabilityTools},
+				ContextWindow: 200000,
+			},
+		}, resp.Data)
+	})
+
+	for _, tc := range []struct {
+		model         string
+		expectedModel string
+	}{
+		{model: "reasoning", expectedModel: "o3"},
+		{model: "small", expectedModel: "gpt-4.1"},
+		{model: "", expectedModel: "gpt-4.1"},
+	} {
+		t.Run("chat completion with model "+tc.model, func(t *testing.T) {
+			var r mockCallResourceResponseSender
+			err := app.CallResource(ctx, &backend.CallResourceRequest{
+				PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+				Method:        http.MethodPost,
+				Path:          "/llm/v1/chat/completions",
+				Body:          []byte(fmt.Sprintf(`{"model": %q, "messages": [{"role": "user", "content": "Hi"}]}`, tc.model)),
+			}, &r)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, r.response.Status, string(r.response.Body))
+			oReq := &openai.ChatCompletionRequest{}
+			require.NoError(t, json.Unmarshal(server.requestBody, oReq))
+			require.Equal(t, tc.expectedModel, oReq.Model)
+		})
+	}
+
+	t.Run("health checks tiers", func(t *testing.T) {
+		details, err := app.llmProviderHealth(ctx)
+		require.NoError(t, err)
+		require.Contains(t, details.Models, Model(ModelReasoning))
+		require.True(t, details.Models[ModelReasoning].OK)
+	})
+}
+
+func TestChatCompletionsErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name     string
+		jsonData string
+		body     string
+
+		expStatus int
+		expError  string
+	}{
+		{
+			name:      "invalid provider",
+			jsonData:  `{"provider": "unknown"}`,
+			body:      `{"model": "base", "messages": [{"role": "user", "content": "Hi"}]}`,
+			expStatus: http.StatusUnprocessableEntity,
+			expError:  "LLM provider has invalid configuration",
+		},
+		{
+			name:      "bad request",
+			jsonData:  `{"provider": "gemini", "gemini": {"url": "http://127.0.0.1:1"}}`,
+			body:      `{"model": "base", "messages": [{"role": "user", "content": "Hi"}], "tools": [{"type": "code_interpreter"}]}`,
+			expStatus: http.StatusBadRequest,
+			expError:  "bad request: unsupported tool type: code_interpreter",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := backend.AppInstanceSettings{
+				JSONData:                []byte(tc.jsonData),
+				DecryptedSecureJSONData: map[string]string{geminiKey: "abcd1234"},
+			}
+			inst, err := NewApp(ctx, settings)
+			require.NoError(t, err)
+			app, ok := inst.(*App)
+			require.True(t, ok)
+
+			var r mockCallResourceResponseSender
+			err = app.CallResource(ctx, &backend.CallResourceRequest{
+				PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+				Method:        http.MethodPost,
+				Path:          "/llm/v1/chat/completions",
+				Body:          []byte(tc.body),
+			}, &r)
+			require.NoError(t, err)
+			require.Equal(t, tc.expStatus, r.response.Status, string(r.response.Body))
+			// Only the error should be written, not a response as well.
+			require.JSONEq(t, fmt.Sprintf(`{"error": %q}`, tc.expError), string(r.response.Body))
+		})
+	}
+}
+
+func TestEmbeddings(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		jsonData string
+		body     string
+
+		expStatus int
+		expError  string
+		expModel  string
+		expPath   string
+	}{
+		{
+			name:      "openai default base model",
+			jsonData:  `{"provider": "openai", "openAI": {"url": %q}}`,
+			body:      `{"model": "base", "input": "hello"}`,
+			expStatus: http.StatusOK,
+			expModel:  string(openai.SmallEmbedding3),
+			expPath:   "/v1/embeddings",
+		},
+		{
+			name:      "openai unknown model uses base",
+			jsonData:  `{"provider": "openai", "openAI": {"url": %q}}`,
+			body:      `{"model": "text-embedding-ada-002", "input": ["hello", "world"]}`,
+			expStatus: http.StatusOK,
+			expModel:  string(openai.SmallEmbedding3),
+			expPath:   "/v1/embeddings",
+		},
+		{
+			name:      "openai mapped large model",
+			jsonData:  `{"provider": "openai", "openAI": {"url": %q}, "models": {"default": "base", "embeddingMapping": {"large": "my-embedding"}}}`,
+			body:      `{"model": "large", "input": "hello"}`,
+			expStatus: http.StatusOK,
+			expModel:  "my-embedding",
+			expPath:   "/v1/embeddings",
+		},
+		{
+			name:      "grafana mapped large model",
+			jsonData:  `{"provider": "grafana", "llmGateway": {"url": %q}, "models": {"default": "base", "embeddingMapping": {"large": "my-embedding"}}}`,
+			body:      `{"model": "large", "input": "hello"}`,
+			expStatus: http.StatusOK,
+			expModel:  "my-embedding",
+			expPath:   "/openai/v1/embeddings",
+		},
+		{
+			name:      "azure deployment",
+			jsonData:  `{"provider": "azure", "openAI": {"url": %q, "azureModelMapping": [["base", "gpt-4o-mini"]], "azureEmbeddingMapping": [["base", "embedding-deployment"]]}}`,
+			body:      `{"model": "large", "input": "hello"}`,
+			expStatus: http.StatusOK,
+			expModel:  "embedding-deployment",
+			expPath:   "/openai/deployments/embedding-deployment/embeddings",
+		},
+		{
+			name:      "azure without embedding deployment",
+			jsonData:  `{"provider": "azure", "openAI": {"url": %q, "azureModelMapping": [["base", "gpt-4o-mini"]]}}`,
+			body:      `{"model": "base", "input": "hello"}`,
+			expStatus: http.StatusBadRequest,
+		},
+		{
+			name:      "invalid provider",
+			jsonData:  `{"provider": "unknown", "openAI": {"url": %q}}`,
+			body:      `{"model": "base", "input": "hello"}`,
+			expStatus: http.StatusUnprocessableEntity,
+			expError:  "LLM provider has invalid configuration",
+		},
+		{
+			name:      "unsupported provider",
+			jsonData:  `{"provider": "anthropic", "anthropic": {"url": %q}}`,
+			body:      `{"model": "base", "input": "hello"}`,
+			expStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newMockOpenAIServer()
+			defer server.server.Close()
+			settings := backend.AppInstanceSettings{
+				JSONData: []byte(fmt.Sprintf(tc.jsonData, server.server.URL)),
+				DecryptedSecureJSONData: map[string]string{
+					openAIKey:                "abcd1234",
+					"anthropicKey":           "abcd1234",
+					encodedTenantAndTokenKey: base64.StdEncoding.EncodeToString([]byte("123:abcd1234")),
+				},
+			}
+			inst, err := NewApp(ctx, settings)
+			require.NoError(t, err)
+			app, ok := inst.(*App)
+			require.True(t, ok)
+
+			var r mockCallResourceResponseSender
+			err = app.CallResource(ctx, &backend.CallResourceRequest{
+				PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+				Method:        http.MethodPost,
+				Path:          "/llm/v1/embeddings",
+				Body:          []byte(tc.body),
+			}, &r)
+			require.NoError(t, err)
+			require.Equal(t, tc.expStatus, r.response.Status, string(r.response.Body))
+			if tc.expError != "" {
+				require.JSONEq(t, fmt.Sprintf(`{"error": %q}`, tc.expError), string(r.response.Body))
+			}
+			if tc.expStatus != http.StatusOK {
+				return
+			}
+			require.Equal(t, tc.expPath, server.request.URL.Path)
+			oReq := &openai.EmbeddingRequest{}
+			require.NoError(t, json.Unmarshal(server.requestBody, oReq))
+			require.Equal(t, openai.EmbeddingModel(tc.expModel), oReq.Model)
+		})
+	}
+
+	t.Run("test provider", func(t *testing.T) {
+		settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test"}`)}
+		inst, err := NewApp(ctx, settings)
+		require.NoError(t, err)
+		app, ok := inst.(*App)
+		require.True(t, ok)
+
+		var r mockCallResourceResponseSender
+		err = app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{AppInstanceSettings: &settings},
+			Method:        http.MethodPost,
+			Path:          "/llm/v1/embeddings",
+			Body:          []byte(`{"model": "base", "input": "hello"}`),
+		}, &r)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, r.response.Status, string(r.response.Body))
+		var resp openai.EmbeddingResponse
+		require.NoError(t, json.Unmarshal(r.response.Body, &resp))
+		require.Equal(t, []float32{0.1, 0.2, 0.3}, resp.Data[0].Embedding)
+	})
+}
@@ -0,0 +1,189 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// providerHeader is the response header naming the provider which served a request.
+	providerHeader = "X-Grafana-LLM-Provider"
+	// cacheHeader is the response header reporting whether a cacheable request
+	// was served from the response cache.
+	cacheHeader = "X-Grafana-LLM-Cache"
+	// costHeader is the response header reporting the estimated cost of a
+	// request in US dollars, if the model has a known price.
+	costHeader = "X-Grafana-LLM-Cost"
+	// degradedHeader is the response header reporting why a request was
+	// served by the base model instead of the model requested.
+	degradedHeader = "X-Grafana-LLM-Degraded"
+)
+
+// degradedBudget is reported in the degraded header when a request was served
+// by the base model because the monthly budget was exceeded.
+const degradedBudget = "budget"
+
+// Values of the cache header.
+const (
+	cacheHit  = "HIT"
+	cacheMiss = "MISS"
+	// cacheSemanticHit is reported when a request was served from the
+	// semantic cache, with the response to a similar request.
+	cacheSemanticHit = "SEMANTIC_HIT"
+)
+
+// responseMetadata records how a request was served so that handlers can report
+// it to clients, e.g. in response headers. Providers find it in the request
+// context. All methods are safe to call on a nil *responseMetadata.
+type responseMetadata struct {
+	mu       sync.Mutex
+	provider ProviderType
+	// cache is cacheHit, cacheSemanticHit or cacheMiss if the request could
+	// be cached.
+	cache string
+	// cost is the estimated cost of the request in US dollars, if known.
+	cost *float64
+	// degraded is why the request was served by the base model, if it was.
+	degraded string
+	// stopSequence and citations are details of the response which OpenAI
+	// responses have no fields for, reported by some providers.
+	stopSequence string
+	citations    []Citation
+}
+
+type responseMetadataKey struct{}
+
+// withResponseMetadata returns a context carrying a new responseMetadata.
+func withResponseMetadata(ctx context.Context) (context.Context, *responseMetadata) {
+	md := &responseMetadata{}
+	return context.WithValue(ctx, responseMetadataKey{}, md), md
+}
+
+// responseMetadataFromContext returns the responseMetadata in the context, or nil.
+func responseMetadataFromContext(ctx context.Context) *responseMetadata {
+	md, _ := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	return md
+}
+
+func (m *responseMetadata) setProvider(provider ProviderType) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.provider = provider
+}
+
+// Provider returns the provider which served the request, if known.
+func (m *responseMetadata) Provider() ProviderType {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.provider
+}
+
+func (m *responseMetadata) setCache(status string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache = status
+}
+
+// Cache returns whether the request was served from the response cache, if it
+// could be cached.
+func (m *responseMetadata) Cache() string {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cache
+}
+
+func (m *responseMetadata) setCost(cost float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cost = &cost
+}
+
+// Cost returns the estimated cost of the request in US dollars, if known.
+func (m *responseMetadata) Cost() (float64, bool) {
+	if m == nil {
+		return 0, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cost == nil {
+		return 0, false
+	}
+	return *m.cost, true
+}
+
+func (m *responseMetadata) setDegraded(reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.degraded = reason
+}
+
+// Degraded returns why the request was served by the base model instead of
+// the model requested, if it was.
+func (m *responseMetadata) Degraded() string {
+	if m == nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.degraded
+}
+
+// setCompletionDetails records the stop sequence which ended a non-streaming
+// response and the sources it cited, replacing those of earlier responses to
+// the same request.
+func (m *responseMetadata) setCompletionDetails(stopSequence string, citations []Citation) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopSequence = stopSequence
+	m.citations = citations
+}
+
+// CompletionDetails returns the stop sequence which ended the response and the
+// sources it cited, if the provider reported them.
+func (m *responseMetadata) CompletionDetails() (string, []Citation) {
+	if m == nil {
+		return "", nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopSequence, m.citations
+}
+
+// setHeaders sets response headers describing how the request was served.
+func (m *responseMetadata) setHeaders(h http.Header) {
+	if provider := m.Provider(); provider != "" {
+		h.Set(providerHeader, string(provider))
+	}
+	if cache := m.Cache(); cache != "" {
+		h.Set(cacheHeader, cache)
+	}
+	if cost, ok := m.Cost(); ok {
+		h.Set(costHeader, strconv.FormatFloat(cost, 'f', -1, 64))
+	}
+	if degraded := m.Degraded(); degraded != "" {
+		h.Set(degradedHeader, degraded)
+	}
+}
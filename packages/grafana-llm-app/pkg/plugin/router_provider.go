@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// routerProvider implements the LLMProvider interface by sending requests for
+// each routed abstract model to the provider it is routed to, and requests for
+// any other model to the primary provider.
+type routerProvider struct {
+	primary namedProvider
+	routes  map[Model]namedProvider
+	// models are the abstract models which can be requested.
+	models []Model
+}
+
+func newRouterProvider(primary namedProvider, routes map[Model]namedProvider, models []Model) *routerProvider {
+	return &routerProvider{primary: primary, routes: routes, models: models}
+}
+
+func (p *routerProvider) backend(model Model) namedProvider {
+	if b, ok := p.routes[model]; ok {
+		return b
+	}
+	return p.primary
+}
+
+// Models returns each supported model from the provider it is routed to, along
+// with the models discovered on all of those providers.
+func (p *routerProvider) Models(ctx context.Context) (ModelResponse, error) {
+	var resp ModelResponse
+	responses := map[LLMProvider]ModelResponse{}
+	for _, model := range p.models {
+		b := p.backend(model)
+		r, ok := responses[b.provider]
+		if !ok {
+			var err error
+			r, err = b.provider.Models(ctx)
+			if err != nil {
+				return ModelResponse{}, fmt.Errorf("list %s models: %w", b.name, err)
+			}
+			responses[b.provider] = r
+			resp.ProviderModels = append(resp.ProviderModels, r.ProviderModels...)
+		}
+		for _, info := range r.Data {
+			if info.ID == model {
+				info.Provider = b.name
+				resp.Data = append(resp.Data, info)
+			}
+		}
+	}
+	return resp, nil
+}
+
+func (p *routerProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	b := p.backend(req.Model)
+	resp, err := b.provider.ChatCompletion(ctx, req)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	p.setProvider(ctx, b)
+	return resp, nil
+}
+
+func (p *routerProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	b := p.backend(req.Model)
+	c, err := b.provider.ChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	p.setProvider(ctx, b)
+	return c, nil
+}
+
+// Embeddings are always created by the primary provider, since routes only
+// apply to chat models.
+func (p *routerProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	resp, err := p.primary.provider.Embeddings(ctx, req)
+	if err != nil {
+		return openai.EmbeddingResponse{}, err
+	}
+	p.setProvider(ctx, p.primary)
+	return resp, nil
+}
+
+// setProvider records the provider which served a request, unless the backend
+// has already done so, e.g. because it failed over to another provider.
+func (p *routerProvider) setProvider(ctx context.Context, b namedProvider) {
+	md := responseMetadataFromContext(ctx)
+	if md.Provider() == "" {
+		md.setProvider(b.name)
+	}
+}
@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterProvider_ChatCompletion(t *testing.T) {
+	primary := &fakeBackend{}
+	routed := &fakeBackend{}
+	p := newRouterProvider(
+		namedProvider{name: ProviderTypeAnthropic, provider: primary},
+		map[Model]namedProvider{ModelBase: {name: ProviderTypeLocal, provider: routed}},
+		[]Model{ModelBase, ModelLarge},
+	)
+
+	for _, tc := range []struct {
+		model       Model
+		expBackend  *fakeBackend
+		expProvider ProviderType
+	}{
+		{model: ModelBase, expBackend: routed, expProvider: ProviderTypeLocal},
+		{model: ModelLarge, expBackend: primary, expProvider: ProviderTypeAnthropic},
+	} {
+		t.Run(string(tc.model), func(t *testing.T) {
+			primary.calls, routed.calls = 0, 0
+			ctx, md := withResponseMetadata(context.Background())
+			_, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: tc.model})
+			require.NoError(t, err)
+			assert.Equal(t, 1, tc.expBackend.calls)
+			assert.Equal(t, 1, primary.calls+routed.calls)
+			assert.Equal(t, tc.expProvider, md.Provider())
+
+			ctx, md = withResponseMetadata(context.Background())
+			_, err = p.ChatCompletionStream(ctx, ChatCompletionRequest{Model: tc.model})
+			require.NoError(t, err)
+			assert.Equal(t, 2, tc.expBackend.calls)
+			assert.Equal(t, tc.expProvider, md.Provider())
+		})
+	}
+}
+
+func TestRouterProvider_KeepsFallbackProvider(t *testing.T) {
+	unavailable := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}
+	chain := newFallbackProvider([]namedProvider{
+		{name: ProviderTypeOpenAI, provider: &fakeBackend{err: unavailable}},
+		{name: ProviderTypeGemini, provider: &fakeBackend{}},
+	})
+	p := newRouterProvider(namedProvider{name: ProviderTypeOpenAI, provider: chain}, map[Model]namedProvider{}, []Model{ModelBase, ModelLarge})
+
+	ctx, md := withResponseMetadata(context.Background())
+	_, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelLarge})
+	require.NoError(t, err)
+	assert.Equal(t, ProviderTypeGemini, md.Provider())
+}
+
+func TestRouterProvider_Models(t *testing.T) {
+	var requested string
+	server := newMockLocalServer(t, true, &requested)
+	defer server.Close()
+
+	provider, err := createProvider(&Settings{
+		Provider: ProviderTypeTest,
+		OpenAI:   OpenAISettings{TestProvider: defaultTestProvider()},
+		Local:    LocalSettings{URL: server.URL},
+		Routes: map[Model]ModelRoute{
+			ModelBase: {Provider: ProviderTypeLocal, Model: "qwen2.5:32b"},
+		},
+	})
+	require.NoError(t, err)
+
+	resp, err := provider.Models(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ModelInfo{
+		{ID: ModelBase, Name: "qwen2.5:32b", Provider: ProviderTypeLocal},
+		{ID: ModelLarge, Provider: ProviderTypeTest},
+	}, resp.Data)
+	assert.Len(t, resp.ProviderModels, 2)
+
+	_, err = provider.ChatCompletion(context.Background(), ChatCompletionRequest{
+		Model: ModelBase,
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "qwen2.5:32b", requested)
+}
+
+func TestLoadSettingsRoutes(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{
+		JSONData: json.RawMessage(`{
+			"provider": "anthropic",
+			"routes": {
+				"base": {"provider": "local", "model": "llama3.2:latest"},
+				"large": {"provider": "unknown"},
+				"huge": {"provider": "openai"}
+			}
+		}`),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[Model]ModelRoute{
+		ModelBase: {Provider: ProviderTypeLocal, Model: "llama3.2:latest"},
+	}, settings.Routes)
+	assert.Equal(t, ProviderTypeLocal, settings.modelProvider(ModelBase))
+	assert.Equal(t, ProviderTypeAnthropic, settings.modelProvider(ModelLarge))
+}
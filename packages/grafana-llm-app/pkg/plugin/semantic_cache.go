@@ -0,0 +1,287 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/embed"
+	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/store"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// semanticCacheTopK is the number of neighbours fetched when looking a request
+// up in the semantic cache. More than one is needed since the nearest may have
+// expired.
+const semanticCacheTopK = 5
+
+// semanticCache stores chat completions responses in a vector store, keyed by
+// the embedding of the request's final user message, so that a request can be
+// served with the response to a similar one.
+//
+// Entries are scoped so that a response is only ever returned for requests
+// from the same tenant and org, sent to the same provider and model, and
+// identical to the cached request apart from the final user message.
+type semanticCache struct {
+	embedder   embed.Embedder
+	model      string
+	store      store.VectorStore
+	cancel     context.CancelFunc
+	collection string
+	threshold  float64
+	ttl        time.Duration
+
+	mu sync.Mutex
+	// collectionReady is set once the collection is known to exist.
+	collectionReady bool
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+// newSemanticCache creates a semantic cache using the embedder and vector store
+// configured in the vector settings.
+func newSemanticCache(settings *Settings, secrets map[string]string) (*semanticCache, error) {
+	if !settings.Vector.Enabled {
+		return nil, errors.New("the semantic cache requires vector services to be enabled")
+	}
+	embedder, err := embed.NewEmbedder(settings.Vector.Embed, secrets)
+	if err != nil {
+		return nil, fmt.Errorf("new embedder: %w", err)
+	}
+	if embedder == nil {
+		return nil, errors.New("no embedder configured")
+	}
+	st, cancel, err := store.NewVectorStore(settings.Vector.Store, secrets)
+	if err != nil {
+		return nil, fmt.Errorf("new vector store: %w", err)
+	}
+	if st == nil {
+		return nil, errors.New("no vector store configured")
+	}
+	return &semanticCache{
+		embedder:   embedder,
+		model:      settings.Vector.Model,
+		store:      st,
+		cancel:     cancel,
+		collection: settings.Cache.Semantic.Collection,
+		threshold:  settings.Cache.Semantic.Threshold,
+		ttl:        time.Duration(settings.Cache.TTLSeconds) * time.Second,
+		now:        time.Now,
+	}, nil
+}
+
+// Cancel closes the connection to the vector store.
+func (c *semanticCache) Cancel() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// semanticQuery identifies a request in the semantic cache.
+type semanticQuery struct {
+	// scope holds the payload fields which must match exactly for a cached
+	// response to be returned.
+	scope     map[string]string
+	prompt    string
+	embedding []float32
+}
+
+// semanticCacheEntry is the payload stored with each point in the collection.
+type semanticCacheEntry struct {
+	OrgID    string `json:"org_id"`
+	Tenant   string `json:"tenant"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	// Context is a hash of the request without its final user message.
+	Context string `json:"context"`
+	Prompt  string `json:"prompt"`
+	// Response is the JSON encoded cachedResponse.
+	Response  string `json:"response"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// query returns the semantic cache query for a request, or nil if the request
+// can't be served from the semantic cache. Requests can only be served if
+// they're made by a user in an org and end with a text user message.
+func (c *semanticCache) query(ctx context.Context, tenant string, provider ProviderType, model string, req ChatCompletionRequest) *semanticQuery {
+	orgID := backend.PluginConfigFromContext(ctx).OrgID
+	if orgID == 0 || len(req.Messages) == 0 {
+		return nil
+	}
+	last := req.Messages[len(req.Messages)-1]
+	if last.Role != openai.ChatMessageRoleUser || last.Content == "" {
+		return nil
+	}
+	r := normalizedRequest(req)
+	r.Messages = r.Messages[:len(r.Messages)-1]
+	reqContext, err := requestHash(provider, model, r)
+	if err != nil {
+		return nil
+	}
+	embedding, err := c.embedder.Embed(ctx, c.model, last.Content)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to embed request for semantic cache", "err", err)
+		return nil
+	}
+	if tenant == "" {
+		// Vector stores may not match empty strings, so use a placeholder
+		// for instances outside Grafana Cloud.
+		tenant = "none"
+	}
+	return &semanticQuery{
+		scope: map[string]string{
+			"org_id":   strconv.FormatInt(orgID, 10),
+			"tenant":   tenant,
+			"provider": string(provider),
+			"model":    model,
+			"context":  reqContext,
+		},
+		prompt:    last.Content,
+		embedding: embedding,
+	}
+}
+
+// ensureCollection reports whether the collection exists, creating it with
+// vectors of the given size if it doesn't and size is non-zero.
+func (c *semanticCache) ensureCollection(ctx context.Context, size int) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.collectionReady {
+		return true, nil
+	}
+	exists, err := c.store.CollectionExists(ctx, c.collection)
+	if err != nil {
+		return false, fmt.Errorf("check collection: %w", err)
+	}
+	if !exists {
+		if size == 0 {
+			return false, nil
+		}
+		log.DefaultLogger.Info("Creating semantic cache collection", "collection", c.collection)
+		if err := c.store.CreateCollection(ctx, c.collection, uint64(size)); err != nil {
+			return false, fmt.Errorf("create collection: %w", err)
+		}
+	}
+	c.collectionReady = true
+	return true, nil
+}
+
+// get returns the cached response to the most similar request within scope,
+// if it is similar enough and hasn't expired.
+func (c *semanticCache) get(ctx context.Context, q *semanticQuery) (cachedResponse, bool) {
+	if q == nil {
+		return cachedResponse{}, false
+	}
+	ready, err := c.ensureCollection(ctx, 0)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to read from semantic cache", "err", err)
+		return cachedResponse{}, false
+	}
+	if !ready {
+		return cachedResponse{}, false
+	}
+	filter := make(map[string]any, len(q.scope))
+	for k, v := range q.scope {
+		filter[k] = map[string]any{"$eq": v}
+	}
+	results, err := c.store.Search(ctx, c.collection, q.embedding, semanticCacheTopK, filter)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to read from semantic cache", "err", err)
+		return cachedResponse{}, false
+	}
+	now := c.now().Unix()
+	for _, r := range results {
+		if r.Score < c.threshold {
+			// Results are sorted by score, so none of the rest are similar
+			// enough either.
+			break
+		}
+		if !matchesScope(r.Payload, q.scope) || payloadInt(r.Payload["expires_at"]) <= now {
+			continue
+		}
+		response, _ := r.Payload["response"].(string)
+		var cached cachedResponse
+		if err := json.Unmarshal([]byte(response), &cached); err != nil {
+			log.DefaultLogger.Warn("Ignoring invalid semantic cache entry", "err", err)
+			continue
+		}
+		return cached, true
+	}
+	return cachedResponse{}, false
+}
+
+// set stores a response in the semantic cache, replacing any entry for the same
+// prompt within the query's scope.
+func (c *semanticCache) set(ctx context.Context, q *semanticQuery, cached cachedResponse) {
+	response, err := json.Marshal(cached)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to encode response for semantic cache", "err", err)
+		return
+	}
+	payload, err := json.Marshal(semanticCacheEntry{
+		OrgID:     q.scope["org_id"],
+		Tenant:    q.scope["tenant"],
+		Provider:  q.scope["provider"],
+		Model:     q.scope["model"],
+		Context:   q.scope["context"],
+		Prompt:    q.prompt,
+		Response:  string(response),
+		ExpiresAt: c.now().Add(c.ttl).Unix(),
+	})
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to encode response for semantic cache", "err", err)
+		return
+	}
+	if _, err := c.ensureCollection(ctx, len(q.embedding)); err != nil {
+		log.DefaultLogger.Warn("Failed to write to semantic cache", "err", err)
+		return
+	}
+	err = c.store.UpsertColumnar(ctx, c.collection, []uint64{semanticPointID(q)}, [][]float32{q.embedding}, []string{string(payload)})
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to write to semantic cache", "err", err)
+	}
+}
+
+// semanticPointID returns the ID of the point storing the response to a query,
+// derived from its scope and prompt.
+func semanticPointID(q *semanticQuery) uint64 {
+	b, _ := json.Marshal(struct {
+		Scope  map[string]string `json:"scope"`
+		Prompt string            `json:"prompt"`
+	}{q.scope, q.prompt})
+	sum := sha256.Sum256(b)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// matchesScope reports whether a search result's payload has the given scope.
+// The vector store is asked to filter on the scope already, but it is checked
+// again so that a store ignoring the filter can't leak responses.
+func matchesScope(payload map[string]any, scope map[string]string) bool {
+	for k, v := range scope {
+		if s, _ := payload[k].(string); s != v {
+			return false
+		}
+	}
+	return true
+}
+
+// payloadInt returns the value of an integer payload field, which vector stores
+// may return as either an integer or a float.
+func payloadInt(v any) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
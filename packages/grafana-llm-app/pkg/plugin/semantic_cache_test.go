@@ -0,0 +1,324 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/store"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEmbedder embeds texts using a fixed table of vectors.
+type fakeEmbedder struct {
+	vectors map[string][]float32
+	calls   int
+}
+
+func (e *fakeEmbedder) Embed(ctx context.Context, model string, text string) ([]float32, error) {
+	e.calls++
+	v, ok := e.vectors[text]
+	if !ok {
+		return nil, fmt.Errorf("no embedding for %q", text)
+	}
+	return v, nil
+}
+
+func (e *fakeEmbedder) Health(ctx context.Context, model string) error {
+	return nil
+}
+
+type fakeVectorPoint struct {
+	vector  []float32
+	payload map[string]any
+}
+
+// fakeVectorStore is an in-memory vector store supporting $eq filters, which
+// scores points by cosine similarity.
+type fakeVectorStore struct {
+	mu          sync.Mutex
+	collections map[string]uint64
+	points      map[uint64]fakeVectorPoint
+	// ignoreFilter makes Search return points regardless of the filter.
+	ignoreFilter bool
+}
+
+func newFakeVectorStore() *fakeVectorStore {
+	return &fakeVectorStore{collections: map[string]uint64{}, points: map[uint64]fakeVectorPoint{}}
+}
+
+func (s *fakeVectorStore) CollectionExists(ctx context.Context, collection string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.collections[collection]
+	return ok, nil
+}
+
+func (s *fakeVectorStore) Search(ctx context.Context, collection string, vector []float32, topK uint64, filter map[string]interface{}) ([]store.SearchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var results []store.SearchResult
+	for _, p := range s.points {
+		if !s.ignoreFilter && !fakeFilterMatches(p.payload, filter) {
+			continue
+		}
+		results = append(results, store.SearchResult{Payload: p.payload, Score: cosineSimilarity(vector, p.vector)})
+	}
+	slices.SortFunc(results, func(a, b store.SearchResult) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return 0
+	})
+	if uint64(len(results)) > topK {
+		results = results[:topK]
+	}
+	return results, nil
+}
+
+func fakeFilterMatches(payload map[string]any, filter map[string]interface{}) bool {
+	for k, cond := range filter {
+		if payload[k] != cond.(map[string]any)["$eq"] {
+			return false
+		}
+	}
+	return true
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i] * b[i])
+		na += float64(a[i] * a[i])
+		nb += float64(b[i] * b[i])
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+func (s *fakeVectorStore) Health(ctx context.Context) error {
+	return nil
+}
+
+func (s *fakeVectorStore) Collections(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var collections []string
+	for c := range s.collections {
+		collections = append(collections, c)
+	}
+	return collections, nil
+}
+
+func (s *fakeVectorStore) CreateCollection(ctx context.Context, collection string, size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collections[collection] = size
+	return nil
+}
+
+func (s *fakeVectorStore) PointExists(ctx context.Context, collection string, id uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.points[id]
+	return ok, nil
+}
+
+func (s *fakeVectorStore) UpsertColumnar(ctx context.Context, collection string, ids []uint64, embeddings [][]float32, payloadJSONs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, id := range ids {
+		var payload map[string]any
+		if err := json.Unmarshal([]byte(payloadJSONs[i]), &payload); err != nil {
+			return err
+		}
+		s.points[id] = fakeVectorPoint{vector: embeddings[i], payload: payload}
+	}
+	return nil
+}
+
+var semanticTestVectors = map[string][]float32{
+	"explain this alert":        {1, 0, 0},
+	"what does this alert mean": {0.99, 0.1, 0},
+	"write a haiku":             {0, 0, 1},
+}
+
+func newSemanticTestCache(st *fakeVectorStore) (*semanticCache, *fakeEmbedder) {
+	embedder := &fakeEmbedder{vectors: semanticTestVectors}
+	return &semanticCache{
+		embedder:   embedder,
+		store:      st,
+		collection: defaultSemanticCacheCollection,
+		threshold:  0.95,
+		ttl:        time.Minute,
+		now:        time.Now,
+	}, embedder
+}
+
+func withOrg(orgID int64) context.Context {
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{OrgID: orgID})
+	ctx, _ = withResponseMetadata(ctx)
+	return ctx
+}
+
+func TestSemanticCache(t *testing.T) {
+	st := newFakeVectorStore()
+	sc, embedder := newSemanticTestCache(st)
+	inner := &fakeBackend{}
+	p := newCachingProvider(inner, newMemoryCache(10), sc, newCacheTestSettings())
+
+	ctx := withOrg(1)
+	_, err := p.ChatCompletion(ctx, cacheTestRequest("explain this alert", math.SmallestNonzeroFloat32))
+	require.NoError(t, err)
+	assert.Equal(t, cacheMiss, responseMetadataFromContext(ctx).Cache())
+	assert.Equal(t, uint64(3), st.collections[defaultSemanticCacheCollection], "collection should be created with the embedding size")
+
+	ctx = withOrg(1)
+	resp, err := p.ChatCompletion(ctx, cacheTestRequest("what does this alert mean", math.SmallestNonzeroFloat32))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp.ID)
+	assert.Equal(t, cacheSemanticHit, responseMetadataFromContext(ctx).Cache())
+	assert.Equal(t, 1, inner.calls)
+
+	ctx = withOrg(1)
+	_, err = p.ChatCompletion(ctx, cacheTestRequest("write a haiku", math.SmallestNonzeroFloat32))
+	require.NoError(t, err)
+	assert.Equal(t, cacheMiss, responseMetadataFromContext(ctx).Cache(), "dissimilar prompts should miss")
+	assert.Equal(t, 2, inner.calls)
+
+	// Identical requests are served by the response cache without embedding.
+	calls := embedder.calls
+	ctx = withOrg(1)
+	_, err = p.ChatCompletion(ctx, cacheTestRequest("explain this alert", math.SmallestNonzeroFloat32))
+	require.NoError(t, err)
+	assert.Equal(t, cacheHit, responseMetadataFromContext(ctx).Cache())
+	assert.Equal(t, calls, embedder.calls)
+}
+
+func TestSemanticCache_Scope(t *testing.T) {
+	st := newFakeVectorStore()
+	sc, _ := newSemanticTestCache(st)
+	settings := newCacheTestSettings()
+	ctx := withOrg(1)
+	req := cacheTestRequest("explain this alert", math.SmallestNonzeroFloat32)
+	provider, model := settings.resolvedModel(req.Model)
+	sc.set(ctx, sc.query(ctx, settings.Tenant, provider, model, req), cachedResponse{Provider: provider})
+
+	paraphrase := func() ChatCompletionRequest {
+		return cacheTestRequest("what does this alert mean", math.SmallestNonzeroFloat32)
+	}
+	otherModel := paraphrase()
+	otherModel.Model = ModelLarge
+	withSystemPrompt := paraphrase()
+	withSystemPrompt.Messages = append([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: "be brief"}}, withSystemPrompt.Messages...)
+
+	for _, tc := range []struct {
+		name   string
+		ctx    context.Context
+		tenant string
+		req    ChatCompletionRequest
+		hit    bool
+	}{
+		{name: "same scope", ctx: withOrg(1), req: paraphrase(), hit: true},
+		{name: "other org", ctx: withOrg(2), req: paraphrase()},
+		{name: "other tenant", ctx: withOrg(1), tenant: "1234", req: paraphrase()},
+		{name: "other model", ctx: withOrg(1), req: otherModel},
+		{name: "other context", ctx: withOrg(1), req: withSystemPrompt},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, model := settings.resolvedModel(tc.req.Model)
+			q := sc.query(tc.ctx, tc.tenant, provider, model, tc.req)
+			require.NotNil(t, q)
+			_, ok := sc.get(tc.ctx, q)
+			assert.Equal(t, tc.hit, ok)
+		})
+	}
+
+	// Responses must stay scoped even if the store ignores the filter.
+	st.ignoreFilter = true
+	provider, model = settings.resolvedModel(ModelBase)
+	_, ok := sc.get(withOrg(2), sc.query(withOrg(2), "", provider, model, paraphrase()))
+	assert.False(t, ok)
+}
+
+func TestSemanticCache_Expiry(t *testing.T) {
+	sc, _ := newSemanticTestCache(newFakeVectorStore())
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sc.now = func() time.Time { return now }
+	ctx := withOrg(1)
+	q := sc.query(ctx, "", ProviderTypeOpenAI, "gpt-4.1-mini", cacheTestRequest("explain this alert", math.SmallestNonzeroFloat32))
+	require.NotNil(t, q)
+	sc.set(ctx, q, cachedResponse{Provider: ProviderTypeOpenAI})
+
+	_, ok := sc.get(ctx, q)
+	assert.True(t, ok)
+	now = now.Add(2 * time.Minute)
+	_, ok = sc.get(ctx, q)
+	assert.False(t, ok, "expired entries should not be returned")
+}
+
+func TestSemanticCache_Query(t *testing.T) {
+	sc, embedder := newSemanticTestCache(newFakeVectorStore())
+	req := cacheTestRequest("explain this alert", math.SmallestNonzeroFloat32)
+
+	assert.Nil(t, sc.query(context.Background(), "", ProviderTypeOpenAI, "m", req), "requests without an org should not be cached")
+
+	assistantLast := req
+	assistantLast.Messages = append(slices.Clone(req.Messages), openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "ok"})
+	assert.Nil(t, sc.query(withOrg(1), "", ProviderTypeOpenAI, "m", assistantLast))
+	assert.Equal(t, 0, embedder.calls)
+
+	assert.Nil(t, sc.query(withOrg(1), "", ProviderTypeOpenAI, "m", cacheTestRequest("unknown", math.SmallestNonzeroFloat32)), "embedding failures should skip the cache")
+}
+
+func TestSemanticCache_ChatCompletionStream(t *testing.T) {
+	finish := streamChunk("")
+	finish.Choices[0].FinishReason = openai.FinishReasonStop
+	inner := &fakeBackend{chunks: []ChatCompletionStreamResponse{streamChunk("Hello"), finish}}
+	sc, _ := newSemanticTestCache(newFakeVectorStore())
+	p := newCachingProvider(inner, newMemoryCache(10), sc, newCacheTestSettings())
+
+	req := cacheTestRequest("explain this alert", math.SmallestNonzeroFloat32)
+	req.Stream = true
+	c, err := p.ChatCompletionStream(withOrg(1), req)
+	require.NoError(t, err)
+	for range c {
+	}
+
+	req = cacheTestRequest("what does this alert mean", math.SmallestNonzeroFloat32)
+	req.Stream = true
+	ctx := withOrg(1)
+	c, err = p.ChatCompletionStream(ctx, req)
+	require.NoError(t, err)
+	var chunks []ChatCompletionStreamResponse
+	for chunk := range c {
+		chunks = append(chunks, chunk)
+	}
+	require.Len(t, chunks, 1)
+	assert.Equal(t, "Hello", chunks[0].Choices[0].Delta.Content)
+	assert.Equal(t, cacheSemanticHit, responseMetadataFromContext(ctx).Cache())
+	assert.Equal(t, 1, inner.calls)
+}
+
+func TestLoadSettingsSemanticCache(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{
+		JSONData: []byte(`{"cache": {"enabled": true, "semantic": {"enabled": true, "threshold": 2}}}`),
+	})
+	require.NoError(t, err)
+	assert.True(t, settings.Cache.Semantic.Enabled)
+	assert.Equal(t, defaultSemanticCacheCollection, settings.Cache.Semantic.Collection)
+	assert.Equal(t, defaultSemanticCacheThreshold, settings.Cache.Semantic.Threshold)
+
+	_, err = newSemanticCache(settings, nil)
+	assert.Error(t, err, "the semantic cache requires vector services")
+}
@@ -4,10 +4,16 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/grafana/grafana-llm-app/pkg/mcp"
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
 	"github.com/grafana/grafana-llm-app/pkg/plugin/vector"
 	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/embed"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -17,6 +23,13 @@ import (
 
 const (
 	openAIKey                = "openAIKey"
+	geminiKey                = "geminiKey"
+	geminiServiceAccountKey  = "geminiServiceAccountKey"
+	bedrockAccessKeyIDKey    = "bedrockAccessKeyId"
+	bedrockSecretKey         = "bedrockSecretAccessKey"
+	bedrockSessionTokenKey   = "bedrockSessionToken"
+	localKey                 = "localKey"
+	auditLokiPasswordKey     = "auditLokiPassword"
 	encodedTenantAndTokenKey = "base64EncodedAccessToken"
 )
 
@@ -34,6 +47,9 @@ const (
 	ProviderTypeGrafana   ProviderType = "grafana" // via llm-gateway
 	ProviderTypeTest      ProviderType = "test"
 	ProviderTypeAnthropic ProviderType = "anthropic"
+	ProviderTypeGemini    ProviderType = "gemini"
+	ProviderTypeBedrock   ProviderType = "bedrock"
+	ProviderTypeLocal     ProviderType = "local" // Ollama, vLLM and other self-hosted servers
 )
 
 // OpenAISettings contains the user-specified OpenAI connection details
@@ -55,14 +71,27 @@ type OpenAISettings struct {
 	// Model mappings required for Azure's OpenAI
 	AzureMapping [][]string `json:"azureModelMapping"`
 
+	// Embedding model mappings for Azure's OpenAI, from abstract embedding
+	// models to deployments. Only required to use embeddings.
+	AzureEmbeddingMapping [][]string `json:"azureEmbeddingMapping"`
+
 	// Disabled marks if a user has explicitly disabled LLM functionality.
 	// Deprecated: Use Settings.Disabled instead
 	Disabled bool `json:"disabled"`
 
+	// Headers are extra headers sent with every request to the OpenAI,
+	// custom or Azure provider.
+	Headers []HeaderSettings `json:"headers"`
+
 	// apiKey is the user-specified  api key needed to authenticate requests to the OpenAI
 	// provider (excluding the LLMGateway). Stored securely.
 	apiKey string
 
+	// retries is a copy of Settings.Retries.
+	retries transport.RetrySettings
+	// httpTransport is the outbound transport built from Settings.HTTP.
+	httpTransport http.RoundTripper
+
 	// TestProvider contains the settings for the test provider.
 	// Only used when Provider is ProviderTypeTest.
 	TestProvider testProvider `json:"testProvider,omitempty"`
@@ -73,9 +102,100 @@ type AnthropicSettings struct {
 	// The URL to the provider's API
 	URL string `json:"url"`
 
+	// UseMessagesAPI selects Anthropic's native Messages API instead of its
+	// OpenAI-compatible endpoint. This is required for prompt caching,
+	// extended thinking and native tool use blocks.
+	UseMessagesAPI bool `json:"useMessagesAPI"`
+
+	// PromptCaching marks the system prompt as cacheable.
+	// Only used when UseMessagesAPI is true.
+	PromptCaching bool `json:"promptCaching"`
+
+	// ThinkingBudgetTokens enables extended thinking with the given token budget
+	// when greater than zero. Only used when UseMessagesAPI is true.
+	ThinkingBudgetTokens int64 `json:"thinkingBudgetTokens"`
+
+	// Headers are extra headers sent with every request to Anthropic.
+	Headers []HeaderSettings `json:"headers"`
+
 	// apiKey is the provider-specific API key needed to authenticate requests
 	// Stored securely.
 	apiKey string
+
+	// retries is a copy of Settings.Retries.
+	retries transport.RetrySettings
+	// httpTransport is the outbound transport built from Settings.HTTP.
+	httpTransport http.RoundTripper
+	// thinking remembers the thinking blocks of responses with tool calls.
+	// It is set by NewApp, since it must outlive the providers created for
+	// each request.
+	thinking *thinkingBlocks
+}
+
+// GeminiSettings contains Google Gemini and Vertex AI specific settings
+type GeminiSettings struct {
+	// The URL to the Gemini API. Ignored for Vertex AI unless overridden.
+	URL string `json:"url"`
+
+	// VertexAI selects Vertex AI instead of the Gemini API. Requests are
+	// authenticated using a service account key rather than an API key.
+	VertexAI bool `json:"vertexAI"`
+
+	// Project is the Google Cloud project ID. Only used for Vertex AI.
+	Project string `json:"project"`
+
+	// Location is the Google Cloud region, e.g. us-central1. Only used for Vertex AI.
+	Location string `json:"location"`
+
+	// apiKey is the Gemini API key. Stored securely.
+	apiKey string
+
+	// serviceAccountJSON is the JSON key of the Google service account used
+	// for Vertex AI. Stored securely.
+	serviceAccountJSON string
+
+	// retries is a copy of Settings.Retries.
+	retries transport.RetrySettings
+	// httpTransport is the outbound transport built from Settings.HTTP.
+	httpTransport http.RoundTripper
+}
+
+// BedrockSettings contains Amazon Bedrock specific settings
+type BedrockSettings struct {
+	// Region is the AWS region to use, e.g. us-east-1.
+	Region string `json:"region"`
+
+	// URL overrides the Bedrock runtime endpoint, which otherwise is derived
+	// from the region.
+	URL string `json:"url"`
+
+	// The AWS credentials used to sign requests. Stored securely.
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+
+	// retries is a copy of Settings.Retries.
+	retries transport.RetrySettings
+	// httpTransport is the outbound transport built from Settings.HTTP.
+	httpTransport http.RoundTripper
+}
+
+// LocalSettings contains settings for self-hosted OpenAI-compatible servers
+// such as Ollama and vLLM.
+type LocalSettings struct {
+	// The URL of the server, excluding the /v1 API path.
+	URL string `json:"url"`
+
+	// apiKey is an optional API key for servers which require one. Stored securely.
+	apiKey string
+
+	// retries is a copy of Settings.Retries.
+	retries transport.RetrySettings
+	// httpTransport is the outbound transport built from Settings.HTTP.
+	httpTransport http.RoundTripper
+	// discovered remembers the models discovered on the server. It is set by
+	// NewApp, since it must outlive the providers created for each request.
+	discovered *discoveredModels
 }
 
 // Configured returns whether the provider has been configured
@@ -90,10 +210,16 @@ func (s *Settings) Configured() bool {
 	if provider == "" {
 		provider = s.OpenAI.Provider
 	}
+	return s.providerConfigured(provider)
+}
 
+// providerConfigured returns whether the given provider has been configured.
+func (s *Settings) providerConfigured(provider ProviderType) bool {
 	switch provider {
 	case ProviderTypeGrafana, ProviderTypeCustom, ProviderTypeTest:
 		return true
+	case ProviderTypeLocal:
+		return s.Local.URL != ""
 	case ProviderTypeAzure:
 		// Require some mappings for use with Azure.
 		if len(s.OpenAI.AzureMapping) == 0 {
@@ -105,11 +231,51 @@ func (s *Settings) Configured() bool {
 		return s.OpenAI.apiKey != ""
 	case ProviderTypeAnthropic:
 		return s.Anthropic.apiKey != ""
+	case ProviderTypeBedrock:
+		return s.Bedrock.Region != "" && s.Bedrock.accessKeyID != "" && s.Bedrock.secretAccessKey != ""
+	case ProviderTypeGemini:
+		if s.Gemini.VertexAI {
+			return s.Gemini.serviceAccountJSON != "" && s.Gemini.Project != ""
+		}
+		return s.Gemini.apiKey != ""
 	}
 	// Unknown or empty provider means configuration needs to be updated.
 	return false
 }
 
+// FallbackProvider is a provider to fail over to when the providers before it
+// are unavailable. It uses the settings block for its provider type.
+type FallbackProvider struct {
+	Provider ProviderType `json:"provider"`
+
+	// Models maps abstract models to this provider's models.
+	// If nil, the provider's default models are used.
+	Models *ModelSettings `json:"models"`
+}
+
+// ModelRoute routes an abstract model to a model of a specific provider,
+// using the settings block for that provider type.
+type ModelRoute struct {
+	Provider ProviderType `json:"provider"`
+
+	// Model is the provider's name for the model. If empty, the provider's
+	// default mapping for the abstract model is used.
+	Model string `json:"model"`
+}
+
+// modelSettings returns the model settings for the provider serving model.
+func (r ModelRoute) modelSettings(model Model) *ModelSettings {
+	models := defaultModelSettings(r.Provider)
+	if r.Model != "" {
+		models.Default = model
+		models.Mapping[model] = r.Model
+	}
+	if model != ModelBase && model != ModelLarge {
+		models.Tiers = []ModelTier{{ID: model}}
+	}
+	return models
+}
+
 type ModelMapping struct {
 	Model Model  `json:"model"`
 	Name  string `json:"name"`
@@ -121,6 +287,35 @@ type ModelSettings struct {
 
 	// Mapping is mapping from our abstract model names to the provider's model names.
 	Mapping map[Model]string `json:"mapping"`
+
+	// Tiers declares abstract models in addition to base and large, such as
+	// small or reasoning. Tiers should be included in Mapping, otherwise
+	// requests for them are served by the default model.
+	Tiers []ModelTier `json:"tiers"`
+
+	// EmbeddingMapping is a mapping from abstract embedding model names (base
+	// and large) to the provider's embedding models. Requests for other models
+	// use the base embedding model.
+	EmbeddingMapping map[Model]string `json:"embeddingMapping"`
+}
+
+// ModelCapability is a capability of a model tier. Admins may use any value;
+// the constants below are the ones understood by Grafana.
+type ModelCapability string
+
+const (
+	ModelCapabilityTools       ModelCapability = "tools"
+	ModelCapabilityVision      ModelCapability = "vision"
+	ModelCapabilityReasoning   ModelCapability = "reasoning"
+	ModelCapabilityLongContext ModelCapability = "long-context"
+)
+
+// ModelTier is an admin-defined abstract model.
+type ModelTier struct {
+	ID            Model             `json:"id"`
+	Description   string            `json:"description"`
+	Capabilities  []ModelCapability `json:"capabilities"`
+	ContextWindow int               `json:"contextWindow"`
 }
 
 func (c ModelSettings) getModel(model Model) string {
@@ -128,8 +323,78 @@ func (c ModelSettings) getModel(model Model) string {
 	if name, ok := c.Mapping[model]; ok {
 		return name
 	}
-	// If the model is not found, return the default model.
-	return c.getModel(c.Default)
+	// If the model is not found, return the default model, or the base model
+	// if the default model is not mapped either.
+	if model != c.Default {
+		return c.getModel(c.Default)
+	}
+	return c.Mapping[ModelBase]
+}
+
+// embeddingMapping returns the configured embedding models, or nil if c is
+// nil.
+func (c *ModelSettings) embeddingMapping() map[Model]string {
+	if c == nil {
+		return nil
+	}
+	return c.EmbeddingMapping
+}
+
+// getEmbeddingModel returns the name of the provider's embedding model for the
+// given abstract embedding model, or an empty string if none is mapped.
+func (c *ModelSettings) getEmbeddingModel(model Model) string {
+	if c == nil {
+		return ""
+	}
+	if name, ok := c.EmbeddingMapping[model]; ok {
+		return name
+	}
+	return c.EmbeddingMapping[ModelBase]
+}
+
+// models returns the abstract models which can be requested: base, large and
+// any declared tiers.
+func (c *ModelSettings) models() []Model {
+	models := []Model{ModelBase, ModelLarge}
+	if c == nil {
+		return models
+	}
+	for _, t := range c.Tiers {
+		if !slices.Contains(models, t.ID) {
+			models = append(models, t.ID)
+		}
+	}
+	return models
+}
+
+// resolve returns the given model if it can be requested, or the default model
+// otherwise.
+func (c *ModelSettings) resolve(model Model) Model {
+	if slices.Contains(c.models(), model) {
+		return model
+	}
+	resolved := Model(ModelBase)
+	if c != nil && c.Default != "" {
+		resolved = c.Default
+	}
+	log.DefaultLogger.Debug("Unknown model requested, using default model", "model", model, "default", resolved)
+	return resolved
+}
+
+// describe adds the metadata of declared tiers to the given models.
+func (c *ModelSettings) describe(models []ModelInfo) {
+	if c == nil {
+		return
+	}
+	for i, m := range models {
+		for _, t := range c.Tiers {
+			if t.ID == m.ID {
+				models[i].Description = t.Description
+				models[i].Capabilities = t.Capabilities
+				models[i].ContextWindow = t.ContextWindow
+			}
+		}
+	}
 }
 
 func defaultModelSettings(provider ProviderType) *ModelSettings {
@@ -142,6 +407,29 @@ func defaultModelSettings(provider ProviderType) *ModelSettings {
 				ModelLarge: string(anthropic.ModelClaudeSonnet4_20250514),
 			},
 		}
+	case ProviderTypeGemini:
+		return &ModelSettings{
+			Default: ModelBase,
+			Mapping: map[Model]string{
+				ModelBase:  "gemini-2.5-flash",
+				ModelLarge: "gemini-2.5-pro",
+			},
+		}
+	case ProviderTypeBedrock:
+		// Newer models can only be invoked via cross-region inference profiles.
+		return &ModelSettings{
+			Default: ModelBase,
+			Mapping: map[Model]string{
+				ModelBase:  "us.anthropic.claude-3-5-haiku-20241022-v1:0",
+				ModelLarge: "us.anthropic.claude-sonnet-4-20250514-v1:0",
+			},
+		}
+	case ProviderTypeLocal:
+		// Models are discovered from the server, so there is nothing to default to.
+		return &ModelSettings{
+			Default: ModelBase,
+			Mapping: map[Model]string{},
+		}
 	default:
 		return &ModelSettings{
 			Default: ModelBase,
@@ -149,10 +437,30 @@ func defaultModelSettings(provider ProviderType) *ModelSettings {
 				ModelBase:  openai.GPT4Dot1Mini,
 				ModelLarge: openai.GPT4Dot1,
 			},
+			EmbeddingMapping: map[Model]string{
+				ModelBase:  string(openai.SmallEmbedding3),
+				ModelLarge: string(openai.LargeEmbedding3),
+			},
 		}
 	}
 }
 
+// defaultModelPrices are the prices of the models used by default, in US
+// dollars per million tokens, as published by the providers.
+var defaultModelPrices = map[string]ModelPrice{
+	openai.GPT4Dot1Mini: {Input: 0.40, Output: 1.60, CachedInput: 0.10},
+	openai.GPT4Dot1:     {Input: 2.00, Output: 8.00, CachedInput: 0.50},
+	string(anthropic.ModelClaudeSonnet4_20250514): {Input: 3.00, Output: 15.00, CachedInput: 0.30},
+	"gemini-2.5-flash": {Input: 0.30, Output: 2.50, CachedInput: 0.075},
+	"gemini-2.5-pro":   {Input: 1.25, Output: 10.00, CachedInput: 0.31},
+	"us.anthropic.claude-3-5-haiku-20241022-v1:0": {Input: 0.80, Output: 4.00, CachedInput: 0.08},
+	"us.anthropic.claude-sonnet-4-20250514-v1:0":  {Input: 3.00, Output: 15.00, CachedInput: 0.30},
+}
+
+// defaultBudgetAlertThresholds are the fractions of the monthly budget at
+// which a warning is logged if none are configured.
+var defaultBudgetAlertThresholds = []float64{0.8}
+
 // LLMGatewaySettings contains the configuration for the Grafana Managed Key LLM solution.
 type LLMGatewaySettings struct {
 	// This is the URL of the LLM endpoint of the machine learning backend which proxies
@@ -164,6 +472,392 @@ type MCPSettings struct {
 	Disabled bool `json:"disabled"`
 	// Nil (omitted) fields default to enabled; set to false to disable.
 	Toolsets MCPToolsets `json:"toolsets"`
+	// ReadOnly registers only the tools which don't modify Grafana, such as
+	// those reading dashboards but not those updating them.
+	ReadOnly bool `json:"readOnly"`
+	// ReadOnlyToolsets overrides ReadOnly for individual toolsets.
+	ReadOnlyToolsets map[mcp.Toolset]bool `json:"readOnlyToolsets"`
+	// Agent limits the server-side agent loop used by chat completions
+	// requests which opt in to Grafana tools.
+	Agent MCPAgentSettings `json:"agent"`
+	// Guard configures guardrails against prompt injections in tool results
+	// and unconfirmed calls to sensitive tools.
+	Guard MCPGuardSettings `json:"guard"`
+	// Access restricts which tools users may use based on their role and
+	// team membership.
+	Access MCPAccessSettings `json:"access"`
+}
+
+// IsToolsetReadOnly returns whether only the tools of a toolset which don't
+// modify Grafana should be registered.
+func (s MCPSettings) IsToolsetReadOnly(toolset mcp.Toolset) bool {
+	if readOnly, ok := s.ReadOnlyToolsets[toolset]; ok {
+		return readOnly
+	}
+	return s.ReadOnly
+}
+
+const defaultMCPConfirmTimeoutSeconds = 120
+
+// MCPGuardSettings configures guardrails for MCP tool calls.
+type MCPGuardSettings struct {
+	// Envelope wraps the text of tool results in delimited envelopes marking
+	// it as data rather than instructions, flagging results which look like
+	// prompt injections.
+	Envelope bool `json:"envelope"`
+	// InjectionPatterns are regular expressions scanned for in tool results
+	// in addition to the built-in patterns.
+	InjectionPatterns []string `json:"injectionPatterns"`
+	// ConfirmTools and ConfirmToolsets are the tools, and toolsets whose
+	// tools, which the user must confirm before each call.
+	ConfirmTools    []string      `json:"confirmTools"`
+	ConfirmToolsets []mcp.Toolset `json:"confirmToolsets"`
+	// ConfirmTimeoutSeconds is how long to wait for the user to confirm a
+	// call before declining it.
+	ConfirmTimeoutSeconds int `json:"confirmTimeoutSeconds"`
+}
+
+const defaultMCPTeamCacheSeconds = 300
+
+// mcpAllToolsets grants all toolsets in an MCPAccessPolicy.
+const mcpAllToolsets mcp.Toolset = "*"
+
+// MCPAccessSettings restricts which MCP tools users may use. Tools a user may
+// not use are hidden from them and calls to them are rejected.
+type MCPAccessSettings struct {
+	Enabled bool `json:"enabled"`
+	// Roles maps the organization roles Viewer, Editor and Admin to the
+	// access they grant. Users are granted the access of their role and of
+	// the roles below it. If empty, viewers may use the tools which don't
+	// modify Grafana, editors may also use those which do, and only admins
+	// may use the admin toolset.
+	Roles map[string]MCPAccessPolicy `json:"roles"`
+	// Teams maps team names to the access they grant their members in
+	// addition to that of their role.
+	Teams map[string]MCPAccessPolicy `json:"teams"`
+	// TeamCacheSeconds is how long users' team memberships are cached.
+	TeamCacheSeconds int `json:"teamCacheSeconds"`
+}
+
+// MCPAccessPolicy grants access to MCP tools.
+type MCPAccessPolicy struct {
+	// Toolsets are the toolsets whose tools are granted, or "*" for all.
+	Toolsets []mcp.Toolset `json:"toolsets"`
+	// ExcludeToolsets are toolsets not granted even if Toolsets is "*".
+	ExcludeToolsets []mcp.Toolset `json:"excludeToolsets"`
+	// Write grants the tools of Toolsets which modify Grafana, such as
+	// those updating dashboards, as well as those which don't.
+	Write bool `json:"write"`
+	// Tools are individual tools granted regardless of their toolset, and of
+	// whether they modify Grafana.
+	Tools []string `json:"tools"`
+}
+
+const (
+	defaultAgentMaxIterations = 10
+	defaultAgentMaxTokens     = 100000
+)
+
+const (
+	cacheBackendMemory = "memory"
+
+	defaultCacheTTLSeconds = 3600
+	defaultCacheMaxEntries = 1000
+
+	defaultSemanticCacheCollection = "grafana-llm-semantic-cache"
+	defaultSemanticCacheThreshold  = 0.95
+)
+
+// CacheSettings configures the response cache, which serves identical chat
+// completions requests from a stored response. Only requests with a
+// temperature of 0, or which opt in, are cached.
+type CacheSettings struct {
+	Enabled bool `json:"enabled"`
+	// Backend is the cache backend. Only "memory" is currently supported.
+	Backend string `json:"backend"`
+	// TTLSeconds is how long responses are cached for.
+	TTLSeconds int `json:"ttlSeconds"`
+	// MaxEntries is the maximum number of responses held by the in-memory
+	// backend, after which the least recently used are evicted.
+	MaxEntries int `json:"maxEntries"`
+	// Semantic configures the semantic cache, which also serves requests
+	// whose final user message is similar to that of a cached request.
+	Semantic SemanticCacheSettings `json:"semantic"`
+}
+
+// SemanticCacheSettings configures the semantic cache. It uses the embedder and
+// vector store configured in the vector settings, which must be enabled.
+type SemanticCacheSettings struct {
+	Enabled bool `json:"enabled"`
+	// Collection is the vector store collection cached responses are stored
+	// in. It is created if it doesn't exist.
+	Collection string `json:"collection"`
+	// Threshold is the minimum cosine similarity between the final user
+	// messages of two requests for them to share a cached response.
+	Threshold float64 `json:"threshold"`
+}
+
+const defaultUsageRetentionDays = 90
+
+// UsageSettings configures metering of the tokens used by chat completions
+// requests, which is enabled by default.
+type UsageSettings struct {
+	Disabled bool `json:"disabled"`
+	// Path is a file usage is persisted to so that it survives restarts. If
+	// empty, usage is only held in memory.
+	Path string `json:"path"`
+	// RetentionDays is how long usage is kept for.
+	RetentionDays int `json:"retentionDays"`
+}
+
+// QuotaLimits are the limits of a single org, user or caller. Zero means
+// unlimited.
+type QuotaLimits struct {
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	// TokensPerDay limits the total tokens used per UTC day.
+	TokensPerDay int64 `json:"tokensPerDay"`
+}
+
+func (l QuotaLimits) enabled() bool {
+	return l.RequestsPerMinute > 0 || l.TokensPerDay > 0
+}
+
+// QuotaScopeSettings are the quotas of each org, user or caller.
+type QuotaScopeSettings struct {
+	// QuotaLimits apply to each org, user or caller without an override.
+	QuotaLimits
+	// Overrides replace the limits for specific orgs, users or callers, keyed
+	// by org ID, user login or caller respectively.
+	Overrides map[string]QuotaLimits `json:"overrides,omitempty"`
+}
+
+func (s QuotaScopeSettings) enabled() bool {
+	if s.QuotaLimits.enabled() {
+		return true
+	}
+	for _, o := range s.Overrides {
+		if o.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaSettings configures quotas on chat completions requests. Requests count
+// against the quotas of their org, their user and their caller, the plugin
+// making them as identified by Grafana's X-Plugin-Id header. The caller header
+// set by clients is only used to attribute usage, since it can't be trusted.
+type QuotaSettings struct {
+	Org    QuotaScopeSettings `json:"org"`
+	User   QuotaScopeSettings `json:"user"`
+	Caller QuotaScopeSettings `json:"caller"`
+}
+
+// enabled reports whether any quota is configured.
+func (s QuotaSettings) enabled() bool {
+	return s.Org.enabled() || s.User.enabled() || s.Caller.enabled()
+}
+
+// limits returns the limits of an org, user or caller.
+func (s QuotaSettings) limits(scope quotaScope, key string) QuotaLimits {
+	var scoped QuotaScopeSettings
+	switch scope {
+	case quotaScopeOrg:
+		scoped = s.Org
+	case quotaScopeUser:
+		scoped = s.User
+	case quotaScopeCaller:
+		scoped = s.Caller
+	}
+	if o, ok := scoped.Overrides[key]; ok {
+		return o
+	}
+	return scoped.QuotaLimits
+}
+
+// ModelPrice is the price of a model in US dollars per million tokens.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+	// CachedInput is the price of input tokens read from the provider's
+	// prompt cache. If zero, they are charged at the Input price.
+	CachedInput float64 `json:"cachedInput"`
+}
+
+// BudgetSettings configures a monthly budget for the cost of chat completions
+// requests. When it is exceeded, requests for any model are served by the base
+// model until the start of the next month (UTC).
+type BudgetSettings struct {
+	// Monthly is the budget in US dollars. Zero means no budget.
+	Monthly float64 `json:"monthly"`
+	// AlertThresholds are fractions of the budget at which a warning is
+	// logged and reported in health checks, e.g. 0.8 for 80%.
+	AlertThresholds []float64 `json:"alertThresholds"`
+}
+
+// PricingSettings configures estimating the cost of chat completions requests.
+type PricingSettings struct {
+	// Models maps provider model names to their prices, adding to or
+	// replacing the built-in prices of the default models.
+	Models map[string]ModelPrice `json:"models"`
+	Budget BudgetSettings        `json:"budget"`
+}
+
+// price returns the price of a provider model, if known.
+func (s PricingSettings) price(model string) (ModelPrice, bool) {
+	if p, ok := s.Models[model]; ok {
+		return p, true
+	}
+	p, ok := defaultModelPrices[model]
+	return p, ok
+}
+
+// Defaults for CircuitBreakerSettings.
+const (
+	defaultCircuitBreakerFailureRate      = 0.5
+	defaultCircuitBreakerMinimumRequests  = 10
+	defaultCircuitBreakerWindowSeconds    = 60
+	defaultCircuitBreakerOpenSeconds      = 30
+	defaultCircuitBreakerHalfOpenRequests = 1
+)
+
+// CircuitBreakerSettings configures the circuit breaker of each provider,
+// which is enabled by default. While a provider's circuit is open, requests to
+// it fail immediately, or fail over to the next provider, rather than waiting
+// for a degraded provider to time out.
+type CircuitBreakerSettings struct {
+	Disabled bool `json:"disabled"`
+	// FailureRate is the fraction of requests in the window which must fail
+	// with a server error, rate limit, timeout or connection error for the
+	// circuit to open.
+	FailureRate float64 `json:"failureRate"`
+	// MinimumRequests is the number of requests in the window needed before
+	// the circuit can open.
+	MinimumRequests int `json:"minimumRequests"`
+	// WindowSeconds is how far back requests are counted.
+	WindowSeconds int `json:"windowSeconds"`
+	// OpenSeconds is how long the circuit stays open before it half-opens to
+	// let probe requests through.
+	OpenSeconds int `json:"openSeconds"`
+	// HalfOpenRequests is the number of probe requests which must succeed for
+	// the circuit to close again. Any failure reopens it.
+	HalfOpenRequests int `json:"halfOpenRequests"`
+}
+
+// Defaults for AuditSettings.
+const (
+	defaultAuditMaxContentLength = 4096
+	defaultAuditRetentionDays    = 90
+	defaultAuditMaxFileSizeMB    = 100
+)
+
+// AuditContentMode is how prompts, completions and tool arguments and results
+// are recorded in the audit log.
+type AuditContentMode string
+
+const (
+	// AuditContentFull records content in full.
+	AuditContentFull AuditContentMode = "full"
+	// AuditContentTruncated records up to AuditSettings.MaxContentLength
+	// characters of each piece of content.
+	AuditContentTruncated AuditContentMode = "truncated"
+	// AuditContentHashed records the SHA-256 hash of each piece of content,
+	// so that content can be matched without being stored.
+	AuditContentHashed AuditContentMode = "hashed"
+)
+
+// AuditSettings configures the audit log of chat completions requests and MCP
+// tool calls, which is disabled by default.
+type AuditSettings struct {
+	Enabled bool `json:"enabled"`
+	// Content is how content is recorded. Defaults to truncated.
+	Content AuditContentMode `json:"content"`
+	// MaxContentLength is the number of characters of each piece of content
+	// recorded when Content is truncated.
+	MaxContentLength int `json:"maxContentLength"`
+	// RetentionDays is how long rotated audit files are kept.
+	RetentionDays int `json:"retentionDays"`
+	// File writes the audit log to a local file.
+	File AuditFileSettings `json:"file"`
+	// Loki pushes the audit log to Loki.
+	Loki AuditLokiSettings `json:"loki"`
+}
+
+// AuditFileSettings configures writing the audit log to a local file, which
+// is rotated daily or when it reaches MaxSizeMB.
+type AuditFileSettings struct {
+	// Path is the file to write to. If empty, no file is written.
+	Path      string `json:"path"`
+	MaxSizeMB int    `json:"maxSizeMB"`
+}
+
+// AuditLokiSettings configures pushing the audit log to Loki.
+type AuditLokiSettings struct {
+	// URL is the push endpoint, e.g. https://logs.example.com/loki/api/v1/push.
+	// If empty, nothing is pushed.
+	URL string `json:"url"`
+	// TenantID is sent in the X-Scope-OrgID header, if set.
+	TenantID string `json:"tenantId"`
+	// Username is the basic auth user. The password is read from the
+	// auditLokiPassword secure JSON data.
+	Username string `json:"username"`
+	// Labels are added to the stream the audit log is pushed to.
+	Labels map[string]string `json:"labels"`
+
+	password string
+}
+
+// RedactionSettings configures the redaction of personal data and secrets in
+// the messages of chat completions requests, which is disabled by default.
+// Each value found is replaced with a placeholder, and placeholders in the
+// response are replaced with the original values.
+type RedactionSettings struct {
+	Enabled bool `json:"enabled"`
+	// Detectors are the built-in detectors to use, e.g. email or jwt. All of
+	// them are used if empty.
+	Detectors []string `json:"detectors"`
+	// Patterns are additional values to redact.
+	Patterns []RedactionPattern `json:"patterns"`
+}
+
+// RedactionPattern is an admin-defined value to redact.
+type RedactionPattern struct {
+	// Name identifies the pattern in placeholders, the audit log and metrics.
+	Name string `json:"name"`
+	// Regex matches the values to redact. If it has a capturing group, only
+	// the text matched by the first group is redacted.
+	Regex string `json:"regex"`
+}
+
+// mcpSettings returns the guardrails to apply to the MCP server. Invalid
+// injection patterns are ignored.
+func (s MCPGuardSettings) mcpSettings() mcp.GuardSettings {
+	guard := mcp.GuardSettings{
+		Envelope:        s.Envelope,
+		ConfirmTools:    s.ConfirmTools,
+		ConfirmToolsets: s.ConfirmToolsets,
+		ConfirmTimeout:  time.Duration(s.ConfirmTimeoutSeconds) * time.Second,
+	}
+	for _, pattern := range s.InjectionPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.DefaultLogger.Warn("Ignoring invalid MCP injection pattern", "pattern", pattern, "err", err)
+			continue
+		}
+		guard.InjectionPatterns = append(guard.InjectionPatterns, re)
+	}
+	return guard
+}
+
+// MCPAgentSettings limits how much work a single chat completions request
+// using Grafana tools can do.
+type MCPAgentSettings struct {
+	// MaxIterations is the maximum number of requests made to the LLM
+	// provider for a single chat completions request.
+	MaxIterations int `json:"maxIterations"`
+	// MaxTokens is the maximum number of tokens used across all of those
+	// requests.
+	MaxTokens int `json:"maxTokens"`
 }
 
 // A nil pointer means the toolset is enabled by default; a pointer to false disables it.
@@ -273,12 +967,29 @@ type Settings struct {
 	// Anthropic related settings
 	Anthropic AnthropicSettings `json:"anthropic"`
 
+	// Gemini related settings
+	Gemini GeminiSettings `json:"gemini"`
+
+	// Bedrock related settings
+	Bedrock BedrockSettings `json:"bedrock"`
+
+	// Local provider related settings
+	Local LocalSettings `json:"local"`
+
 	// VectorDB settings. May rely on OpenAI settings.
 	Vector vector.VectorSettings `json:"vector"`
 
 	// Models contains the user-specified models.
 	Models *ModelSettings `json:"models"`
 
+	// Fallbacks are providers to fail over to, in order, when Provider
+	// returns a server error, is rate limited or cannot be reached.
+	Fallbacks []FallbackProvider `json:"fallbacks"`
+
+	// Routes sends requests for an abstract model to a specific provider
+	// rather than Provider, e.g. to serve the base model locally.
+	Routes map[Model]ModelRoute `json:"routes"`
+
 	// LLMGateway provides Grafana-managed OpenAI.
 	LLMGateway LLMGatewaySettings `json:"llmGateway"`
 
@@ -287,6 +998,46 @@ type Settings struct {
 
 	// MCP settings.
 	MCP MCPSettings `json:"mcp"`
+
+	// Cache configures caching of chat completions responses.
+	Cache CacheSettings `json:"cache"`
+
+	// Usage configures token usage metering.
+	Usage UsageSettings `json:"usage"`
+
+	// Quotas limit the requests and tokens of each org, user and caller.
+	Quotas QuotaSettings `json:"quotas"`
+
+	// Pricing is used to estimate the cost of requests and enforce a budget.
+	Pricing PricingSettings `json:"pricing"`
+
+	// Retries configures retries of requests to providers and embedders which
+	// fail with a connection error, a rate limit or a transient server error.
+	Retries transport.RetrySettings `json:"retries"`
+
+	// CircuitBreaker configures the circuit breaker of each provider.
+	CircuitBreaker CircuitBreakerSettings `json:"circuitBreaker"`
+
+	// Audit configures the audit log of chat completions requests and MCP
+	// tool calls.
+	Audit AuditSettings `json:"audit"`
+
+	// Redaction configures replacing personal data and secrets in chat
+	// completions requests before they are sent to providers.
+	Redaction RedactionSettings `json:"redaction"`
+
+	// HTTP configures the timeouts, proxy and TLS of outbound connections to
+	// providers, embedders, vector stores and the LLM gateway.
+	HTTP transport.HTTPSettings `json:"http"`
+
+	// httpTransport is the outbound transport built from HTTP, shared by the
+	// clients of all providers and the LLM gateway.
+	httpTransport http.RoundTripper
+
+	// breakers holds the circuit breaker of each provider, if they are
+	// enabled. It is set by NewApp, since breakers must outlive the providers
+	// which are created for each request.
+	breakers *circuitBreakers
 }
 
 func loadSettings(appSettings backend.AppInstanceSettings) (*Settings, error) {
@@ -318,6 +1069,113 @@ func loadSettings(appSettings backend.AppInstanceSettings) (*Settings, error) {
 	if settings.Anthropic.URL == "" {
 		settings.Anthropic.URL = "https://api.anthropic.com"
 	}
+	if settings.Local.URL == "" {
+		settings.Local.URL = "http://localhost:11434"
+	}
+	if settings.Gemini.URL == "" {
+		settings.Gemini.URL = defaultGeminiURL
+	}
+	if settings.Gemini.Location == "" {
+		settings.Gemini.Location = "us-central1"
+	}
+	if settings.Cache.Backend != cacheBackendMemory {
+		if settings.Cache.Backend != "" {
+			log.DefaultLogger.Warn("Unknown cache backend, using in-memory cache", "backend", settings.Cache.Backend)
+		}
+		settings.Cache.Backend = cacheBackendMemory
+	}
+	if settings.Cache.TTLSeconds <= 0 {
+		settings.Cache.TTLSeconds = defaultCacheTTLSeconds
+	}
+	if settings.Cache.MaxEntries <= 0 {
+		settings.Cache.MaxEntries = defaultCacheMaxEntries
+	}
+	if settings.Cache.Semantic.Collection == "" {
+		settings.Cache.Semantic.Collection = defaultSemanticCacheCollection
+	}
+	if settings.Cache.Semantic.Threshold <= 0 || settings.Cache.Semantic.Threshold > 1 {
+		if settings.Cache.Semantic.Threshold != 0 {
+			log.DefaultLogger.Warn("Semantic cache threshold must be between 0 and 1, using default", "threshold", settings.Cache.Semantic.Threshold)
+		}
+		settings.Cache.Semantic.Threshold = defaultSemanticCacheThreshold
+	}
+	if settings.Usage.RetentionDays <= 0 {
+		settings.Usage.RetentionDays = defaultUsageRetentionDays
+	}
+	if settings.Pricing.Budget.AlertThresholds == nil {
+		settings.Pricing.Budget.AlertThresholds = defaultBudgetAlertThresholds
+	}
+	if settings.MCP.Agent.MaxIterations <= 0 {
+		settings.MCP.Agent.MaxIterations = defaultAgentMaxIterations
+	}
+	if settings.MCP.Agent.MaxTokens <= 0 {
+		settings.MCP.Agent.MaxTokens = defaultAgentMaxTokens
+	}
+	if settings.MCP.Guard.ConfirmTimeoutSeconds <= 0 {
+		settings.MCP.Guard.ConfirmTimeoutSeconds = defaultMCPConfirmTimeoutSeconds
+	}
+	if settings.MCP.Access.TeamCacheSeconds <= 0 {
+		settings.MCP.Access.TeamCacheSeconds = defaultMCPTeamCacheSeconds
+	}
+	if settings.CircuitBreaker.FailureRate <= 0 || settings.CircuitBreaker.FailureRate > 1 {
+		if settings.CircuitBreaker.FailureRate != 0 {
+			log.DefaultLogger.Warn("Circuit breaker failure rate must be between 0 and 1, using default", "failureRate", settings.CircuitBreaker.FailureRate)
+		}
+		settings.CircuitBreaker.FailureRate = defaultCircuitBreakerFailureRate
+	}
+	if settings.CircuitBreaker.MinimumRequests <= 0 {
+		settings.CircuitBreaker.MinimumRequests = defaultCircuitBreakerMinimumRequests
+	}
+	if settings.CircuitBreaker.WindowSeconds <= 0 {
+		settings.CircuitBreaker.WindowSeconds = defaultCircuitBreakerWindowSeconds
+	}
+	if settings.CircuitBreaker.OpenSeconds <= 0 {
+		settings.CircuitBreaker.OpenSeconds = defaultCircuitBreakerOpenSeconds
+	}
+	if settings.CircuitBreaker.HalfOpenRequests <= 0 {
+		settings.CircuitBreaker.HalfOpenRequests = defaultCircuitBreakerHalfOpenRequests
+	}
+	switch settings.Audit.Content {
+	case AuditContentFull, AuditContentTruncated, AuditContentHashed:
+	default:
+		if settings.Audit.Content != "" {
+			log.DefaultLogger.Warn("Unknown audit content mode, truncating content", "content", settings.Audit.Content)
+		}
+		settings.Audit.Content = AuditContentTruncated
+	}
+	if settings.Audit.MaxContentLength <= 0 {
+		settings.Audit.MaxContentLength = defaultAuditMaxContentLength
+	}
+	if settings.Audit.RetentionDays <= 0 {
+		settings.Audit.RetentionDays = defaultAuditRetentionDays
+	}
+	if settings.Audit.File.MaxSizeMB <= 0 {
+		settings.Audit.File.MaxSizeMB = defaultAuditMaxFileSizeMB
+	}
+	if settings.Audit.Enabled && settings.Audit.File.Path == "" && settings.Audit.Loki.URL == "" {
+		log.DefaultLogger.Warn("Audit log enabled without a file or Loki URL, disabling it")
+		settings.Audit.Enabled = false
+	}
+	settings.Retries = settings.Retries.WithDefaults()
+	settings.OpenAI.retries = settings.Retries
+	settings.Anthropic.retries = settings.Retries
+	settings.Gemini.retries = settings.Retries
+	settings.Bedrock.retries = settings.Retries
+	settings.Local.retries = settings.Retries
+	settings.Vector.Embed.Retries = settings.Retries
+	settings.HTTP = settings.HTTP.WithDefaults().WithSecrets(appSettings.DecryptedSecureJSONData)
+	var err error
+	settings.httpTransport, err = transport.New(settings.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("outbound HTTP settings: %w", err)
+	}
+	settings.OpenAI.httpTransport = settings.httpTransport
+	settings.Anthropic.httpTransport = settings.httpTransport
+	settings.Gemini.httpTransport = settings.httpTransport
+	settings.Bedrock.httpTransport = settings.httpTransport
+	settings.Local.httpTransport = settings.httpTransport
+	settings.Vector.Embed.HTTP = settings.HTTP
+	settings.Vector.Store.HTTP = settings.HTTP
 	if settings.Vector.Embed.Type == embed.EmbedderOpenAI {
 		settings.Vector.Embed.OpenAI.URL = settings.OpenAI.URL
 		settings.Vector.Embed.OpenAI.AuthType = "openai-key-auth"
@@ -326,19 +1184,46 @@ func loadSettings(appSettings backend.AppInstanceSettings) (*Settings, error) {
 	provider := settings.getEffectiveProvider()
 
 	// Verify this is a known provider type
-	knownProvider := provider == ProviderTypeOpenAI ||
-		provider == ProviderTypeAzure ||
-		provider == ProviderTypeCustom ||
-		provider == ProviderTypeGrafana ||
-		provider == ProviderTypeTest ||
-		provider == ProviderTypeAnthropic
-
-	if !knownProvider {
+	if !isKnownProvider(provider) {
 		log.DefaultLogger.Warn("Unknown provider", "provider", settings.Provider)
 		settings.OpenAI.Provider = ""
 		settings.Provider = ""
 	}
 
+	fallbacks := settings.Fallbacks[:0]
+	for _, f := range settings.Fallbacks {
+		if !isKnownProvider(f.Provider) || f.Provider == ProviderTypeGrafana && settings.LLMGateway.URL == "" {
+			log.DefaultLogger.Warn("Ignoring unknown or unusable fallback provider", "provider", f.Provider)
+			continue
+		}
+		fallbacks = append(fallbacks, f)
+	}
+	settings.Fallbacks = fallbacks
+
+	if settings.Models != nil {
+		tiers := settings.Models.Tiers[:0]
+		for _, t := range settings.Models.Tiers {
+			if t.ID == "" {
+				log.DefaultLogger.Warn("Ignoring model tier without an ID")
+				continue
+			}
+			tiers = append(tiers, t)
+		}
+		settings.Models.Tiers = tiers
+	}
+
+	for model, route := range settings.Routes {
+		if !slices.Contains(settings.supportedModels(), model) {
+			log.DefaultLogger.Warn("Ignoring route for unknown model", "model", model)
+			delete(settings.Routes, model)
+			continue
+		}
+		if !isKnownProvider(route.Provider) || route.Provider == ProviderTypeGrafana && settings.LLMGateway.URL == "" {
+			log.DefaultLogger.Warn("Ignoring route to unknown or unusable provider", "model", model, "provider", route.Provider)
+			delete(settings.Routes, model)
+		}
+	}
+
 	if provider == ProviderTypeGrafana && settings.LLMGateway.URL == "" {
 		log.DefaultLogger.Warn("Cannot use LLM Gateway as no URL specified, disabling it")
 		settings.OpenAI.Provider = ""
@@ -349,6 +1234,15 @@ func loadSettings(appSettings backend.AppInstanceSettings) (*Settings, error) {
 
 	settings.OpenAI.apiKey = settings.DecryptedSecureJSONData[openAIKey]
 	settings.Anthropic.apiKey = settings.DecryptedSecureJSONData["anthropicKey"]
+	settings.Gemini.apiKey = settings.DecryptedSecureJSONData[geminiKey]
+	settings.Gemini.serviceAccountJSON = settings.DecryptedSecureJSONData[geminiServiceAccountKey]
+	settings.Bedrock.accessKeyID = settings.DecryptedSecureJSONData[bedrockAccessKeyIDKey]
+	settings.Bedrock.secretAccessKey = settings.DecryptedSecureJSONData[bedrockSecretKey]
+	settings.Bedrock.sessionToken = settings.DecryptedSecureJSONData[bedrockSessionTokenKey]
+	settings.Local.apiKey = settings.DecryptedSecureJSONData[localKey]
+	settings.Audit.Loki.password = settings.DecryptedSecureJSONData[auditLokiPasswordKey]
+	settings.OpenAI.Headers = loadHeaders(settings.OpenAI.Headers, settings.DecryptedSecureJSONData)
+	settings.Anthropic.Headers = loadHeaders(settings.Anthropic.Headers, settings.DecryptedSecureJSONData)
 
 	// TenantID and GrafanaCom token are combined as "tenantId:GComToken" and base64 encoded, the following undoes that.
 	encodedTenantAndToken := settings.DecryptedSecureJSONData[encodedTenantAndTokenKey]
@@ -375,6 +1269,70 @@ func loadSettings(appSettings backend.AppInstanceSettings) (*Settings, error) {
 	return &settings, nil
 }
 
+func isKnownProvider(provider ProviderType) bool {
+	switch provider {
+	case ProviderTypeOpenAI, ProviderTypeAzure, ProviderTypeCustom, ProviderTypeGrafana, ProviderTypeTest,
+		ProviderTypeAnthropic, ProviderTypeGemini, ProviderTypeBedrock, ProviderTypeLocal:
+		return true
+	}
+	return false
+}
+
+// supportedModels returns the abstract models which can be requested.
+func (s *Settings) supportedModels() []Model {
+	return s.Models.models()
+}
+
+// modelProvider returns the provider serving the given abstract model.
+func (s *Settings) modelProvider(model Model) ProviderType {
+	if route, ok := s.Routes[model]; ok {
+		return route.Provider
+	}
+	return s.getEffectiveProvider()
+}
+
+// resolvedModel returns the provider serving the given abstract model, and the
+// name of the model that provider uses for it.
+func (s *Settings) resolvedModel(model Model) (ProviderType, string) {
+	provider := s.modelProvider(model)
+	models := s.Models
+	if route, ok := s.Routes[model]; ok {
+		models = route.modelSettings(model)
+	}
+	if models == nil {
+		models = defaultModelSettings(provider)
+	}
+	return provider, models.getModel(model)
+}
+
+// resolvedEmbeddingModel returns the provider serving the given abstract
+// embedding model, and the name of the embedding model that provider uses for
+// it. Embeddings are always served by the primary provider, since routes only
+// apply to chat models.
+func (s *Settings) resolvedEmbeddingModel(model Model) (ProviderType, string) {
+	provider := s.getEffectiveProvider()
+	return provider, model.toEmbedding(provider, s.Models)
+}
+
+// embeddingModel returns the abstract model an embeddings request for model is
+// served as: model itself if an embedding model is configured for it, and
+// otherwise base, which providers fall back to. Clients can request any model,
+// so this bounds the models recorded in metrics and traces.
+func (s *Settings) embeddingModel(model Model) Model {
+	if _, ok := s.Models.embeddingMapping()[model]; ok {
+		return model
+	}
+	for _, m := range s.OpenAI.AzureEmbeddingMapping {
+		if len(m) != 2 {
+			continue
+		}
+		if mapped, err := ModelFromString(m[0]); err == nil && mapped == model {
+			return model
+		}
+	}
+	return ModelBase
+}
+
 // getEffectiveProvider returns the effective provider type, handling backward compatibility
 // where Provider was previously stored in OpenAI.Provider
 func (s *Settings) getEffectiveProvider() ProviderType {
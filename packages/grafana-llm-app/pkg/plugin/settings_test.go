@@ -1,7 +1,9 @@
 package plugin
 
 import (
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-llm-app/pkg/mcp"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -731,3 +733,147 @@ func TestGetEffectiveProvider(t *testing.T) {
 		})
 	}
 }
+
+func TestModelSettingsTiers(t *testing.T) {
+	models := &ModelSettings{
+		Default: ModelBase,
+		Mapping: map[Model]string{
+			ModelBase:      "gpt-4.1-mini",
+			ModelLarge:     "gpt-4.1",
+			ModelReasoning: "o3",
+		},
+		Tiers: []ModelTier{
+			{ID: ModelReasoning, Capabilities: []ModelCapability{ModelCapabilityReasoning}},
+			{ID: ModelVision},
+		},
+	}
+
+	if got := models.models(); len(got) != 4 || got[2] != ModelReasoning || got[3] != ModelVision {
+		t.Errorf("expected base, large, reasoning and vision models, got %v", got)
+	}
+
+	for _, tc := range []struct {
+		model    Model
+		settings *ModelSettings
+		expected Model
+	}{
+		{model: ModelReasoning, settings: models, expected: ModelReasoning},
+		{model: ModelSmall, settings: models, expected: ModelBase},
+		{model: "", settings: models, expected: ModelBase},
+		{model: ModelSmall, settings: &ModelSettings{Default: ModelLarge}, expected: ModelLarge},
+		{model: ModelSmall, settings: nil, expected: ModelBase},
+	} {
+		if got := tc.settings.resolve(tc.model); got != tc.expected {
+			t.Errorf("expected %q to resolve to %q, got %q", tc.model, tc.expected, got)
+		}
+	}
+
+	// A declared tier without a mapping is served by the default model.
+	if got := models.getModel(ModelVision); got != "gpt-4.1-mini" {
+		t.Errorf("expected unmapped tier to use the default model, got %q", got)
+	}
+	// An unmapped default falls back to the base model rather than recursing.
+	unmappedDefault := ModelSettings{Default: ModelVision, Mapping: map[Model]string{ModelBase: "gpt-4.1-mini"}}
+	if got := unmappedDefault.getModel(ModelVision); got != "gpt-4.1-mini" {
+		t.Errorf("expected unmapped default to use the base model, got %q", got)
+	}
+}
+
+func TestLoadSettingsTiers(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{
+		JSONData: []byte(`{
+			"provider": "openai",
+			"models": {
+				"default": "base",
+				"mapping": {"base": "gpt-4.1-mini", "large": "gpt-4.1", "vision": "gpt-4o"},
+				"tiers": [
+					{"id": "vision", "description": "Image understanding", "capabilities": ["vision", "tools"], "contextWindow": 128000},
+					{"description": "missing ID"}
+				]
+			},
+			"routes": {
+				"vision": {"provider": "anthropic"}
+			}
+		}`),
+	})
+	if err != nil {
+		t.Fatalf("load settings: %s", err)
+	}
+	if len(settings.Models.Tiers) != 1 || settings.Models.Tiers[0].ID != ModelVision {
+		t.Errorf("expected only the vision tier to be loaded, got %+v", settings.Models.Tiers)
+	}
+	if settings.modelProvider(ModelVision) != ProviderTypeAnthropic {
+		t.Errorf("expected the vision tier to be routed to anthropic, got %s", settings.modelProvider(ModelVision))
+	}
+}
+
+func TestLoadSettingsMCPGuard(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{
+		JSONData: []byte(`{
+			"mcp": {
+				"guard": {
+					"envelope": true,
+					"injectionPatterns": ["(?i)exfiltrate", "("],
+					"confirmTools": ["update_dashboard"],
+					"confirmToolsets": ["admin"]
+				}
+			}
+		}`),
+	})
+	if err != nil {
+		t.Fatalf("load settings: %s", err)
+	}
+	guard := settings.MCP.Guard.mcpSettings()
+	if !guard.Envelope {
+		t.Error("expected tool results to be enveloped")
+	}
+	if guard.ConfirmTimeout != 2*time.Minute {
+		t.Errorf("expected the default confirmation timeout, got %s", guard.ConfirmTimeout)
+	}
+	if len(guard.InjectionPatterns) != 1 {
+		t.Errorf("expected the invalid injection pattern to be ignored, got %v", guard.InjectionPatterns)
+	}
+	if !slices.Equal(guard.ConfirmToolsets, []mcp.Toolset{mcp.ToolsetAdmin}) || !slices.Equal(guard.ConfirmTools, []string{"update_dashboard"}) {
+		t.Errorf("unexpected tools to confirm: %v, %v", guard.ConfirmTools, guard.ConfirmToolsets)
+	}
+}
+
+func TestMCPSettingsIsToolsetReadOnly(t *testing.T) {
+	settings, err := loadSettings(backend.AppInstanceSettings{
+		JSONData: []byte(`{"mcp": {"readOnly": true, "readOnlyToolsets": {"annotations": false}}}`),
+	})
+	if err != nil {
+		t.Fatalf("load settings: %s", err)
+	}
+	if !settings.MCP.IsToolsetReadOnly(mcp.ToolsetDashboard) {
+		t.Error("expected the dashboard toolset to be read-only")
+	}
+	if settings.MCP.IsToolsetReadOnly(mcp.ToolsetAnnotations) {
+		t.Error("expected the annotations toolset to be writable")
+	}
+	if (MCPSettings{ReadOnlyToolsets: map[mcp.Toolset]bool{mcp.ToolsetAlerting: true}}).IsToolsetReadOnly(mcp.ToolsetDashboard) {
+		t.Error("expected toolsets to be writable by default")
+	}
+}
+
+func TestEmbeddingModel(t *testing.T) {
+	settings := &Settings{
+		Provider: ProviderTypeAzure,
+		Models:   defaultModelSettings(ProviderTypeAzure),
+		OpenAI:   OpenAISettings{AzureEmbeddingMapping: [][]string{{"base", "small-deployment"}, {"multilingual", "multilingual-deployment"}, {"invalid"}}},
+		Routes:   map[Model]ModelRoute{"code": {Provider: ProviderTypeOpenAI}},
+	}
+	settings.Models.EmbeddingMapping = map[Model]string{ModelBase: "small", ModelLarge: "large"}
+	for model, want := range map[Model]Model{
+		ModelBase:                ModelBase,
+		ModelLarge:               ModelLarge,
+		"multilingual":           "multilingual",
+		"code":                   ModelBase,
+		"text-embedding-ada-002": ModelBase,
+		"invalid":                ModelBase,
+	} {
+		if got := settings.embeddingModel(model); got != want {
+			t.Errorf("embeddingModel(%q) = %q, want %q", model, got, want)
+		}
+	}
+}
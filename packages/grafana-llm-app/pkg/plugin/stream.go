@@ -10,6 +10,7 @@ import (
 	"github.com/grafana/grafana-llm-app/pkg/mcp"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 )
 
 const (
@@ -53,19 +54,39 @@ func (a *App) runChatCompletionsStream(ctx context.Context, req *backend.RunStre
 	if err != nil {
 		return err
 	}
+	llmProvider = a.withRedaction(a.withAudit(a.withBudget(a.withCache(a.withUsage(a.withMetrics(a.withTracing(llmProvider)))))))
 
 	// Always set stream to true for streaming requests.
 	requestBody.Stream = true
+	requestBody.Model = a.settings.Models.resolve(requestBody.Model)
+
+	ctx, md := withResponseMetadata(ctx)
+	ctx = withAuditRequestID(withRequestCaller(ctx, req.GetHTTPHeader))
+	ctx, span := startRequestSpan(ctx, "runChatCompletionsStream", requestBody)
+	defer span.End()
+	if err := a.checkQuota(ctx); err != nil {
+		a.audit.recordRejected(ctx, requestBody, err)
+		return tracing.Error(span, err)
+	}
+	if len(requestBody.GrafanaTools) > 0 {
+		if err := a.runChatCompletionsStreamWithTools(ctx, llmProvider, requestBody, req, sender); err != nil {
+			return tracing.Error(span, err)
+		}
+		return sendStreamDone(sender)
+	}
 
 	// Delegate to configured provider for chat completions stream.
 	c, err := llmProvider.ChatCompletionStream(ctx, requestBody)
 	if err != nil {
-		return fmt.Errorf("establish chat completions stream: %w", err)
+		return tracing.Errorf(span, "establish chat completions stream: %w", err)
+	}
+	if provider := md.Provider(); provider != "" {
+		log.DefaultLogger.Debug("Chat completions stream established", "provider", provider)
 	}
 	// Send all messages to the sender.
 	for resp := range c {
 		if resp.Error != nil {
-			return resp.Error
+			return tracing.Error(span, resp.Error)
 		}
 		data, err := json.Marshal(resp)
 		if err != nil {
@@ -76,9 +97,40 @@ func (a *App) runChatCompletionsStream(ctx context.Context, req *backend.RunStre
 			return fmt.Errorf("send stream data: %w", err)
 		}
 	}
-	// Finish with a done message for compatibility.
-	// Clients will use this to know when to unsubscribe to the stream.
-	err = sender.SendJSON([]byte(`{"choices": [{"delta": {"done": true}}]}`))
+	return sendStreamDone(sender)
+}
+
+// runChatCompletionsStreamWithTools runs the agent loop for a streaming request
+// using Grafana tools, sending a message for each tool call followed by the
+// final answer. Tools are called as the user who subscribed to the stream.
+func (a *App) runChatCompletionsStreamWithTools(ctx context.Context, llmProvider LLMProvider, requestBody ChatCompletionRequest, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	agent, err := a.newToolAgent(llmProvider, &req.PluginContext, req.GetHTTPHeader(backend.GrafanaUserSignInTokenHeaderName))
+	if err != nil {
+		return err
+	}
+	send := func(resp ChatCompletionStreamResponse) error {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return fmt.Errorf("marshal chat completions stream response: %w", err)
+		}
+		if err := sender.SendJSON(data); err != nil {
+			return fmt.Errorf("send stream data: %w", err)
+		}
+		return nil
+	}
+	resp, err := agent.run(ctx, requestBody, func(step GrafanaToolStep) error {
+		return send(toolStepStreamResponse(step))
+	})
+	if err != nil {
+		return err
+	}
+	return send(streamResponseFromChatCompletion(resp))
+}
+
+// sendStreamDone finishes a stream with a done message for compatibility.
+// Clients will use this to know when to unsubscribe to the stream.
+func sendStreamDone(sender *backend.StreamSender) error {
+	err := sender.SendJSON([]byte(`{"choices": [{"delta": {"done": true}}]}`))
 	if err != nil {
 		return fmt.Errorf("send stream data: %w", err)
 	}
@@ -99,7 +151,19 @@ func (a *App) RunStream(ctx context.Context, req *backend.RunStreamRequest, send
 		// blindly rerun the stream without notifying the UI if we do.
 		if err := a.runChatCompletionsStream(ctx, req, sender); err != nil {
 			log.DefaultLogger.Error("error running stream", "provider", a.settings.Provider, "err", err)
-			sendError(EventError{Error: err.Error()}, sender)
+			event := EventError{Error: err.Error()}
+			var quotaErr *quotaExceededError
+			var openErr *circuitOpenError
+			if errors.As(err, &quotaErr) {
+				event.Code = "rate_limit_exceeded"
+				event.Type = quotaErr.Limit
+				event.RetryAfter = quotaErr.retryAfterSeconds()
+			} else if errors.As(err, &openErr) {
+				event.Code = "provider_unavailable"
+				event.Type = "circuit_open"
+				event.RetryAfter = openErr.retryAfterSeconds()
+			}
+			sendError(event, sender)
 		}
 		return nil
 	}
@@ -141,6 +205,11 @@ type EventDone struct {
 
 type EventError struct {
 	Error string `json:"error"`
+	// Code, Type and RetryAfter are set when a request exceeded a quota, or
+	// was rejected because the provider's circuit breaker is open.
+	Code       string `json:"code,omitempty"`
+	Type       string `json:"type,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
 }
 
 func sendError(event EventError, sender *backend.StreamSender) {
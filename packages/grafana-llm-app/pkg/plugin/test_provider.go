@@ -34,6 +34,12 @@ type testProvider struct {
 	// StreamError is an error to return from ChatCompletionStream after the first delta.
 	// If nil (the default) the stream will finish with a stop reason.
 	StreamError string `json:"streamError,omitempty"`
+
+	// EmbeddingsResponse is the response to return from Embeddings.
+	EmbeddingsResponse openai.EmbeddingResponse `json:"embeddingsResponse,omitempty"`
+	// EmbeddingsError is an error to return from Embeddings.
+	// If nil (the default) Embeddings will not return an error.
+	EmbeddingsError string `json:"embeddingsError,omitempty"`
 }
 
 func defaultTestProvider() testProvider {
@@ -64,6 +70,19 @@ func defaultTestProvider() testProvider {
 		},
 		StreamFinishReason: openai.FinishReasonStop,
 		StreamError:        "",
+
+		EmbeddingsResponse: openai.EmbeddingResponse{
+			Object: "list",
+			Data: []openai.Embedding{
+				{Object: "embedding", Embedding: []float32{0.1, 0.2, 0.3}, Index: 0},
+			},
+			Model: "tiny-embedding",
+			Usage: openai.Usage{
+				PromptTokens: 2,
+				TotalTokens:  2,
+			},
+		},
+		EmbeddingsError: "",
 	}
 }
 
@@ -139,3 +158,13 @@ func (p *testProvider) ChatCompletionStream(ctx context.Context, req ChatComplet
 	}
 	return c, nil
 }
+
+func (p *testProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	if p.EmbeddingsError != "" {
+		return openai.EmbeddingResponse{}, errors.New(p.EmbeddingsError)
+	}
+	if req.Input == nil {
+		return openai.EmbeddingResponse{}, errors.New("input is required")
+	}
+	return p.EmbeddingsResponse, nil
+}
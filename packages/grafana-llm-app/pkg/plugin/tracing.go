@@ -0,0 +1,205 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// modelAttribute is the span attribute holding the abstract model requested by
+// the caller, such as base or large. The provider model is recorded in
+// gen_ai.request.model.
+const modelAttribute = attribute.Key("grafana_llm.model")
+
+// startRequestSpan starts the span for a chat completions request handled by
+// name. ctx should already hold the caller of the request.
+func startRequestSpan(ctx context.Context, name string, req ChatCompletionRequest) (context.Context, trace.Span) {
+	toolsets := make([]string, len(req.GrafanaTools))
+	for i, t := range req.GrafanaTools {
+		toolsets[i] = string(t)
+	}
+	return tracing.DefaultTracer().Start(ctx, name, trace.WithAttributes(
+		modelAttribute.String(string(req.Model)),
+		attribute.Bool("grafana_llm.stream", req.Stream),
+		attribute.StringSlice("grafana_llm.grafana_tools", toolsets),
+		attribute.String("grafana_llm.caller", callerFromContext(ctx)),
+	))
+}
+
+// traceparentHeader is the response header holding the W3C traceparent of the
+// span for a chat completions request. Clients can pass it in the _meta of MCP
+// tool calls the model asks for, to link them to the request.
+const traceparentHeader = "X-Grafana-LLM-Traceparent"
+
+// setTraceparentHeader sets the traceparent header to the span in ctx, if it
+// is being traced.
+func setTraceparentHeader(ctx context.Context, h http.Header) {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	if tp := carrier.Get("traceparent"); tp != "" {
+		h.Set(traceparentHeader, tp)
+	}
+}
+
+// tracedTransport wraps next so that each outgoing request is traced, and the
+// trace context is propagated to the server.
+func tracedTransport(next http.RoundTripper) http.RoundTripper {
+	return httpclient.TracingMiddleware(nil).CreateMiddleware(httpclient.Options{}, next)
+}
+
+// genAIProviderName returns the gen_ai.provider.name attribute for a provider,
+// using the well-known values where there is one.
+func genAIProviderName(settings *Settings, provider ProviderType) attribute.KeyValue {
+	switch provider {
+	case ProviderTypeOpenAI:
+		return semconv.GenAIProviderNameOpenAI
+	case ProviderTypeAzure:
+		return semconv.GenAIProviderNameAzureAIOpenAI
+	case ProviderTypeAnthropic:
+		return semconv.GenAIProviderNameAnthropic
+	case ProviderTypeBedrock:
+		return semconv.GenAIProviderNameAWSBedrock
+	case ProviderTypeGemini:
+		if settings.Gemini.VertexAI {
+			return semconv.GenAIProviderNameGCPVertexAI
+		}
+		return semconv.GenAIProviderNameGCPGemini
+	default:
+		return semconv.GenAIProviderNameKey.String(string(provider))
+	}
+}
+
+// tracingProvider wraps an LLMProvider, creating a span for each request with
+// the attributes of the OpenTelemetry semantic conventions for generative AI.
+type tracingProvider struct {
+	LLMProvider
+	settings *Settings
+}
+
+// start starts the span for a request for model, named after the operation and
+// the provider model as the conventions require.
+func (p *tracingProvider) start(ctx context.Context, operation attribute.KeyValue, model Model, providerModel string) (context.Context, trace.Span) {
+	return tracing.DefaultTracer().Start(ctx, operation.Value.AsString()+" "+providerModel,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			operation,
+			semconv.GenAIRequestModel(providerModel),
+			modelAttribute.String(string(model)),
+		),
+	)
+}
+
+// end records the provider which served the request and ends span, marking it
+// as failed if err is not nil.
+func (p *tracingProvider) end(span trace.Span, provider ProviderType, err error) {
+	span.SetAttributes(genAIProviderName(p.settings, provider))
+	if err != nil {
+		//nolint:errcheck
+		tracing.Error(span, err)
+	}
+	span.End()
+}
+
+// setRequestAttributes records the parameters of a chat completions request.
+func setRequestAttributes(span trace.Span, req ChatCompletionRequest) {
+	if req.Temperature != 0 {
+		span.SetAttributes(semconv.GenAIRequestTemperature(float64(req.Temperature)))
+	}
+	if req.TopP != 0 {
+		span.SetAttributes(semconv.GenAIRequestTopP(float64(req.TopP)))
+	}
+	if maxTokens := max(req.MaxTokens, req.MaxCompletionTokens); maxTokens != 0 {
+		span.SetAttributes(semconv.GenAIRequestMaxTokens(maxTokens))
+	}
+}
+
+// setResponseAttributes records the model, finish reasons and token usage of a
+// chat completions response.
+func setResponseAttributes(span trace.Span, resp openai.ChatCompletionResponse) {
+	finishReasons := make([]string, 0, len(resp.Choices))
+	for _, choice := range resp.Choices {
+		if choice.FinishReason != "" && !slices.Contains(finishReasons, string(choice.FinishReason)) {
+			finishReasons = append(finishReasons, string(choice.FinishReason))
+		}
+	}
+	span.SetAttributes(
+		semconv.GenAIResponseID(resp.ID),
+		semconv.GenAIResponseModel(resp.Model),
+		semconv.GenAIResponseFinishReasons(finishReasons...),
+		semconv.GenAIUsageInputTokens(resp.Usage.PromptTokens),
+		semconv.GenAIUsageOutputTokens(resp.Usage.CompletionTokens),
+	)
+	if resp.Usage.PromptTokensDetails != nil && resp.Usage.PromptTokensDetails.CachedTokens > 0 {
+		span.SetAttributes(semconv.GenAIUsageCacheReadInputTokens(resp.Usage.PromptTokensDetails.CachedTokens))
+	}
+}
+
+func (p *tracingProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	_, providerModel := p.settings.resolvedModel(req.Model)
+	ctx, span := p.start(ctx, semconv.GenAIOperationNameChat, req.Model, providerModel)
+	setRequestAttributes(span, req)
+	resp, err := p.LLMProvider.ChatCompletion(ctx, req)
+	if err == nil {
+		setResponseAttributes(span, resp)
+	}
+	p.end(span, servingProvider(ctx, p.settings, req.Model), err)
+	return resp, err
+}
+
+// ChatCompletionStream ends the span when the stream is closed, with the
+// attributes of the response accumulated from its chunks.
+func (p *tracingProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	_, providerModel := p.settings.resolvedModel(req.Model)
+	ctx, span := p.start(ctx, semconv.GenAIOperationNameChat, req.Model, providerModel)
+	setRequestAttributes(span, req)
+	c, err := p.LLMProvider.ChatCompletionStream(ctx, req)
+	if err != nil {
+		p.end(span, servingProvider(ctx, p.settings, req.Model), err)
+		return nil, err
+	}
+	out := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		var (
+			acc       streamAccumulator
+			streamErr error
+		)
+		for resp := range c {
+			if resp.Error != nil {
+				streamErr = resp.Error
+			} else {
+				acc.add(resp.ChatCompletionStreamResponse)
+			}
+			if !forwardStreamResponse(ctx, out, resp, c) {
+				streamErr = ctx.Err()
+				break
+			}
+		}
+		setResponseAttributes(span, acc.resp)
+		p.end(span, servingProvider(ctx, p.settings, req.Model), streamErr)
+	}()
+	return out, nil
+}
+
+func (p *tracingProvider) Embeddings(ctx context.Context, req EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	model := p.settings.embeddingModel(req.Model)
+	_, providerModel := p.settings.resolvedEmbeddingModel(model)
+	ctx, span := p.start(ctx, semconv.GenAIOperationNameEmbeddings, model, providerModel)
+	resp, err := p.LLMProvider.Embeddings(ctx, req)
+	if err == nil {
+		span.SetAttributes(semconv.GenAIUsageInputTokens(resp.Usage.PromptTokens))
+		if len(resp.Data) > 0 {
+			span.SetAttributes(semconv.GenAIEmbeddingsDimensionCount(len(resp.Data[0].Embedding)))
+		}
+	}
+	p.end(span, servingEmbeddingsProvider(ctx, p.settings), err)
+	return resp, err
+}
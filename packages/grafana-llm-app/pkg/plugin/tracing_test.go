@@ -0,0 +1,216 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanRecorder returns the recorder of the global tracer provider, which the
+// SDK's default tracer delegates to. It can only be set once per process.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	r := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(r)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return r
+})
+
+// tracedTestContext returns a context holding a new root span, which is ended
+// when the test finishes.
+func tracedTestContext(t *testing.T, ctx context.Context) (context.Context, trace.Span) {
+	spanRecorder()
+	ctx, span := otel.Tracer("test").Start(ctx, t.Name())
+	t.Cleanup(func() { span.End() })
+	return ctx, span
+}
+
+// endedSpan returns the ended span with the given name in the given trace.
+func endedSpan(t *testing.T, traceID trace.TraceID, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	for _, s := range spanRecorder().Ended() {
+		if s.Name() == name && s.SpanContext().TraceID() == traceID {
+			return s
+		}
+	}
+	require.Failf(t, "span not found", "no span %q in trace %s", name, traceID)
+	return nil
+}
+
+func spanAttributes(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value, len(s.Attributes()))
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracingProvider_ChatCompletion(t *testing.T) {
+	ctx, root := tracedTestContext(t, context.Background())
+	inner := &scriptedProvider{responses: []openai.ChatCompletionResponse{answerResponse("4")}}
+	p := &tracingProvider{LLMProvider: inner, settings: newCacheTestSettings()}
+
+	req := cacheTestRequest("what is 2+2?", 0.5)
+	req.MaxTokens = 100
+	_, err := p.ChatCompletion(ctx, req)
+	require.NoError(t, err)
+
+	span := endedSpan(t, root.SpanContext().TraceID(), "chat gpt-4.1-mini")
+	assert.Equal(t, root.SpanContext().SpanID(), span.Parent().SpanID())
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind())
+	attrs := spanAttributes(span)
+	assert.Equal(t, "chat", attrs["gen_ai.operation.name"].AsString())
+	assert.Equal(t, "openai", attrs["gen_ai.provider.name"].AsString())
+	assert.Equal(t, "gpt-4.1-mini", attrs["gen_ai.request.model"].AsString())
+	assert.Equal(t, "base", attrs[modelAttribute].AsString())
+	assert.InDelta(t, 0.5, attrs["gen_ai.request.temperature"].AsFloat64(), 1e-6)
+	assert.Equal(t, int64(100), attrs["gen_ai.request.max_tokens"].AsInt64())
+	assert.Equal(t, "final", attrs["gen_ai.response.id"].AsString())
+	assert.Equal(t, []string{"stop"}, attrs["gen_ai.response.finish_reasons"].AsStringSlice())
+	assert.Equal(t, int64(20), attrs["gen_ai.usage.input_tokens"].AsInt64())
+	assert.Equal(t, int64(5), attrs["gen_ai.usage.output_tokens"].AsInt64())
+}
+
+func TestTracingProvider_Embeddings(t *testing.T) {
+	ctx, root := tracedTestContext(t, context.Background())
+	p := &tracingProvider{LLMProvider: &fakeBackend{}, settings: newCacheTestSettings()}
+
+	_, err := p.Embeddings(ctx, EmbeddingRequest{Model: "made-up"})
+	require.NoError(t, err)
+
+	span := endedSpan(t, root.SpanContext().TraceID(), "embeddings text-embedding-3-small")
+	attrs := spanAttributes(span)
+	assert.Equal(t, "text-embedding-3-small", attrs["gen_ai.request.model"].AsString())
+	assert.Equal(t, "base", attrs[modelAttribute].AsString(), "unknown models should be recorded as the base model serving them")
+}
+
+func TestTracingProvider_EmbeddingsIgnoreRoutes(t *testing.T) {
+	ctx, root := tracedTestContext(t, context.Background())
+	settings := newCacheTestSettings()
+	settings.Routes = map[Model]ModelRoute{ModelBase: {Provider: ProviderTypeAnthropic, Model: "claude-haiku-4-5"}}
+	p := &tracingProvider{LLMProvider: &fakeBackend{}, settings: settings}
+
+	_, err := p.Embeddings(ctx, EmbeddingRequest{Model: ModelBase})
+	require.NoError(t, err)
+
+	// Routes only apply to chat models, so the primary provider's embedding
+	// model is recorded.
+	attrs := spanAttributes(endedSpan(t, root.SpanContext().TraceID(), "embeddings text-embedding-3-small"))
+	assert.Equal(t, "text-embedding-3-small", attrs["gen_ai.request.model"].AsString())
+	assert.Equal(t, "openai", attrs["gen_ai.provider.name"].AsString())
+}
+
+func TestTracingProvider_ChatCompletionStream(t *testing.T) {
+	ctx, root := tracedTestContext(t, context.Background())
+	last := streamChunk(" there")
+	last.Choices[0].FinishReason = openai.FinishReasonLength
+	usage := ChatCompletionStreamResponse{ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+		Model: "gpt-4.1-mini-2025-04-14",
+		Usage: &openai.Usage{PromptTokens: 7, CompletionTokens: 2},
+	}}
+	inner := &fakeBackend{chunks: []ChatCompletionStreamResponse{streamChunk("Hello"), last, usage}}
+	p := &tracingProvider{LLMProvider: inner, settings: newCacheTestSettings()}
+
+	c, err := p.ChatCompletionStream(ctx, ChatCompletionRequest{Model: ModelLarge})
+	require.NoError(t, err)
+	for range c {
+	}
+
+	require.Eventually(t, func() bool {
+		for _, s := range spanRecorder().Ended() {
+			if s.SpanContext().TraceID() == root.SpanContext().TraceID() {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond, "the span should end when the stream is closed")
+	attrs := spanAttributes(endedSpan(t, root.SpanContext().TraceID(), "chat gpt-4.1"))
+	assert.Equal(t, []string{"length"}, attrs["gen_ai.response.finish_reasons"].AsStringSlice())
+	assert.Equal(t, int64(7), attrs["gen_ai.usage.input_tokens"].AsInt64())
+	assert.Equal(t, int64(2), attrs["gen_ai.usage.output_tokens"].AsInt64())
+}
+
+func TestTracingProvider_Error(t *testing.T) {
+	ctx, root := tracedTestContext(t, context.Background())
+	p := &tracingProvider{LLMProvider: &fakeBackend{err: errBadRequest}, settings: newCacheTestSettings()}
+
+	_, err := p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase})
+	require.Error(t, err)
+
+	span := endedSpan(t, root.SpanContext().TraceID(), "chat gpt-4.1-mini")
+	assert.Equal(t, codes.Error, span.Status().Code)
+}
+
+func TestTracedTransport(t *testing.T) {
+	ctx, root := tracedTestContext(t, context.Background())
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		//nolint:errcheck
+		json.NewEncoder(w).Encode(answerResponse("hi"))
+	}))
+	defer server.Close()
+
+	settings := newCacheTestSettings()
+	apiPath := "/v1"
+	provider, err := NewOpenAIProvider(OpenAISettings{URL: server.URL, APIPath: &apiPath}, settings.Models)
+	require.NoError(t, err)
+	p := &tracingProvider{LLMProvider: provider, settings: settings}
+	_, err = p.ChatCompletion(ctx, ChatCompletionRequest{Model: ModelBase, ChatCompletionRequest: openai.ChatCompletionRequest{
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+	}})
+	require.NoError(t, err)
+
+	traceID := root.SpanContext().TraceID()
+	chat := endedSpan(t, traceID, "chat gpt-4.1-mini")
+	outgoing := endedSpan(t, traceID, "HTTP Outgoing Request")
+	assert.Equal(t, chat.SpanContext().SpanID(), outgoing.Parent().SpanID(), "the HTTP request should be traced beneath the chat span")
+	assert.Equal(t, "00-"+traceID.String()+"-"+outgoing.SpanContext().SpanID().String()+"-01", traceparent, "the trace context should be propagated to the provider")
+}
+
+func TestChatCompletionsTracing(t *testing.T) {
+	settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test"}`)}
+	inst, err := NewApp(context.Background(), settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	ctx, root := tracedTestContext(t, context.Background())
+	var r mockCallResourceResponseSender
+	err = app.CallResource(ctx, &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{OrgID: 1, AppInstanceSettings: &settings},
+		Method:        http.MethodPost,
+		Path:          "/llm/v1/chat/completions",
+		Body:          []byte(`{"model": "large", "messages": [{"role": "user", "content": "hi"}]}`),
+	}, &r)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, r.response.Status, string(r.response.Body))
+
+	traceID := root.SpanContext().TraceID()
+	handler := endedSpan(t, traceID, "handleChatCompletions")
+	assert.Equal(t, "large", spanAttributes(handler)[modelAttribute].AsString())
+	chat := endedSpan(t, traceID, "chat gpt-4.1")
+	assert.Equal(t, handler.SpanContext().SpanID(), chat.Parent().SpanID())
+	assert.Equal(t, int64(5), spanAttributes(chat)["gen_ai.usage.output_tokens"].AsInt64())
+
+	assert.Equal(t,
+		"00-"+traceID.String()+"-"+handler.SpanContext().SpanID().String()+"-01",
+		http.Header(r.response.Headers).Get(traceparentHeader),
+		"the response should identify the request's span, for linking tool calls to it",
+	)
+}
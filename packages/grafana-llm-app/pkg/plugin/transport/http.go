@@ -0,0 +1,302 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Defaults for HTTPSettings.
+const (
+	DefaultConnectTimeoutSeconds    = 30
+	DefaultResponseTimeoutSeconds   = 120
+	DefaultStreamIdleTimeoutSeconds = 120
+)
+
+// Keys of the secure JSON data holding the TLS settings.
+const (
+	CACertKey     = "tlsCACert"
+	ClientCertKey = "tlsClientCert"
+	ClientKeyKey  = "tlsClientKey"
+)
+
+// HTTPSettings configures the outbound connections of the plugin to LLM
+// providers, embedders, vector stores and the LLM gateway.
+type HTTPSettings struct {
+	// ConnectTimeoutSeconds limits establishing a connection, including the
+	// TLS handshake.
+	ConnectTimeoutSeconds int `json:"connectTimeoutSeconds"`
+	// ResponseTimeoutSeconds limits waiting for the response to a request
+	// once it has been sent. Providers only respond to requests which aren't
+	// streamed once the completion is finished, so this must allow for the
+	// slowest completion.
+	ResponseTimeoutSeconds int `json:"responseTimeoutSeconds"`
+	// StreamIdleTimeoutSeconds limits the time between receiving parts of a
+	// response body, such as the chunks of a stream.
+	StreamIdleTimeoutSeconds int `json:"streamIdleTimeoutSeconds"`
+	// ProxyURL is the URL of an HTTP proxy to send requests through, which
+	// may include credentials. If empty, the proxy is taken from the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL string `json:"proxyUrl"`
+	// TLSSkipVerify disables verification of server certificates. It should
+	// only be used in test environments.
+	TLSSkipVerify bool `json:"tlsSkipVerify"`
+
+	// CACert is a PEM bundle of certificate authorities to trust in addition
+	// to the system's, read from the secure JSON data.
+	CACert string `json:"-"`
+	// ClientCert and ClientKey are a PEM certificate and key to present to
+	// servers which require mutual TLS, read from the secure JSON data.
+	ClientCert string `json:"-"`
+	ClientKey  string `json:"-"`
+}
+
+// WithDefaults returns s with defaults for any timeouts which aren't set.
+func (s HTTPSettings) WithDefaults() HTTPSettings {
+	if s.ConnectTimeoutSeconds <= 0 {
+		s.ConnectTimeoutSeconds = DefaultConnectTimeoutSeconds
+	}
+	if s.ResponseTimeoutSeconds <= 0 {
+		s.ResponseTimeoutSeconds = DefaultResponseTimeoutSeconds
+	}
+	if s.StreamIdleTimeoutSeconds <= 0 {
+		s.StreamIdleTimeoutSeconds = DefaultStreamIdleTimeoutSeconds
+	}
+	return s
+}
+
+// WithSecrets returns s with the TLS settings read from the secure JSON data.
+func (s HTTPSettings) WithSecrets(secrets map[string]string) HTTPSettings {
+	s.CACert = secrets[CACertKey]
+	s.ClientCert = secrets[ClientCertKey]
+	s.ClientKey = secrets[ClientKeyKey]
+	return s
+}
+
+// TLSConfig returns the TLS configuration for connections to servers.
+func (s HTTPSettings) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		//nolint:gosec // Only if the admin has asked for it.
+		InsecureSkipVerify: s.TLSSkipVerify,
+	}
+	if s.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(s.CACert)) {
+			return nil, errors.New("no certificates found in the CA certificate")
+		}
+		config.RootCAs = pool
+	}
+	if s.ClientCert != "" || s.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(s.ClientCert), []byte(s.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (s HTTPSettings) proxyURL() (*url.URL, error) {
+	if s.ProxyURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("proxy URL must use http or https, not %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// New returns a transport which sends requests according to s. Each call
+// returns a new transport with its own connection pool, so it should be
+// called once and the transport shared.
+func New(s HTTPSettings) (http.RoundTripper, error) {
+	s = s.WithDefaults()
+	tlsConfig, err := s.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := s.proxyURL()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: s.ConnectTimeout(), KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = s.ConnectTimeout()
+	t.ResponseHeaderTimeout = time.Duration(s.ResponseTimeoutSeconds) * time.Second
+	t.TLSClientConfig = tlsConfig
+	if proxy != nil {
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	return &idleTimeoutTransport{next: t, timeout: time.Duration(s.StreamIdleTimeoutSeconds) * time.Second}, nil
+}
+
+// ErrIdleTimeout is returned when reading a response body which hasn't
+// received any data for longer than the stream idle timeout.
+var ErrIdleTimeout = errors.New("response stream idle timeout")
+
+// idleTimeoutTransport cancels requests whose response bodies stop receiving
+// data, such as streams which have stalled.
+type idleTimeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	body := &idleTimeoutBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, timeout: t.timeout}
+	body.timer = time.AfterFunc(t.timeout, func() { cancel(ErrIdleTimeout) })
+	resp.Body = body
+	return resp, nil
+}
+
+// idleTimeoutBody is a response body which cancels its request if no data is
+// read for longer than timeout.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timeout time.Duration
+	timer   *time.Timer
+	once    sync.Once
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.timer.Stop()
+	} else if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && !errors.Is(err, io.EOF) && errors.Is(context.Cause(b.ctx), ErrIdleTimeout) {
+		err = fmt.Errorf("%w: no data received for %s", ErrIdleTimeout, b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.once.Do(func() {
+		b.timer.Stop()
+		b.cancel(nil)
+	})
+	return b.ReadCloser.Close()
+}
+
+// ConnectTimeout returns the time allowed to establish a connection.
+func (s HTTPSettings) ConnectTimeout() time.Duration {
+	return time.Duration(s.WithDefaults().ConnectTimeoutSeconds) * time.Second
+}
+
+// ProxyDialer returns a function which opens connections through the proxy,
+// for clients which aren't HTTP clients, such as gRPC clients. It returns nil
+// if no proxy is configured, in which case clients should use their default
+// dialer, which respects the proxy environment variables.
+func (s HTTPSettings) ProxyDialer() (func(ctx context.Context, addr string) (net.Conn, error), error) {
+	s = s.WithDefaults()
+	proxy, err := s.proxyURL()
+	if err != nil || proxy == nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: s.ConnectTimeout(), KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialProxy(ctx, dialer, proxy, addr)
+	}, nil
+}
+
+// dialProxy opens a tunnel to addr through an HTTP proxy using CONNECT.
+func dialProxy(ctx context.Context, dialer *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy: %w", err)
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			//nolint:errcheck
+			conn.Close()
+			return nil, fmt.Errorf("proxy TLS handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		//nolint:errcheck
+		conn.SetDeadline(deadline)
+		//nolint:errcheck
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		//nolint:errcheck
+		conn.Close()
+		return nil, fmt.Errorf("send CONNECT to proxy: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		//nolint:errcheck
+		conn.Close()
+		return nil, fmt.Errorf("read CONNECT response from proxy: %w", err)
+	}
+	//nolint:errcheck
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		//nolint:errcheck
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The server spoke first; keep what the reader has buffered.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
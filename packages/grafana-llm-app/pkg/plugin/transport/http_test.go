@@ -0,0 +1,233 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(rt http.RoundTripper, url string) (string, error) {
+	resp, err := (&http.Client{Transport: rt}).Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestNew_Timeouts(t *testing.T) {
+	rt, err := New(HTTPSettings{ConnectTimeoutSeconds: 5, ResponseTimeoutSeconds: 300})
+	require.NoError(t, err)
+	idle := rt.(*idleTimeoutTransport)
+	assert.Equal(t, DefaultStreamIdleTimeoutSeconds*time.Second, idle.timeout)
+	next := idle.next.(*http.Transport)
+	assert.Equal(t, 5*time.Second, next.TLSHandshakeTimeout)
+	assert.Equal(t, 300*time.Second, next.ResponseHeaderTimeout)
+}
+
+func TestNew_CustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	rt, err := New(HTTPSettings{})
+	require.NoError(t, err)
+	_, err = get(rt, server.URL)
+	var unknownAuthority x509.UnknownAuthorityError
+	assert.ErrorAs(t, err, &unknownAuthority, "the server's certificate should not be trusted by default")
+
+	rt, err = New(HTTPSettings{CACert: ca})
+	require.NoError(t, err)
+	body, err := get(rt, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", body)
+
+	rt, err = New(HTTPSettings{TLSSkipVerify: true})
+	require.NoError(t, err)
+	_, err = get(rt, server.URL)
+	assert.NoError(t, err)
+}
+
+// newClientCertificate returns a self-signed client certificate and its key,
+// PEM encoded.
+func newClientCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "grafana-llm-app"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return cert,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestNew_ClientCertificate(t *testing.T) {
+	cert, certPEM, keyPEM := newClientCertificate(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	rt, err := New(HTTPSettings{TLSSkipVerify: true})
+	require.NoError(t, err)
+	_, err = get(rt, server.URL)
+	assert.Error(t, err, "the server should require a client certificate")
+
+	rt, err = New(HTTPSettings{TLSSkipVerify: true, ClientCert: certPEM, ClientKey: keyPEM})
+	require.NoError(t, err)
+	body, err := get(rt, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "grafana-llm-app", body)
+}
+
+func TestNew_InvalidSettings(t *testing.T) {
+	for name, s := range map[string]HTTPSettings{
+		"CA certificate":     {CACert: "not a certificate"},
+		"client certificate": {ClientCert: "not a certificate", ClientKey: "not a key"},
+		"proxy URL":          {ProxyURL: "socks5://proxy:1080"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNew_Proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		_, _ = w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	rt, err := New(HTTPSettings{ProxyURL: proxy.URL})
+	require.NoError(t, err)
+	body, err := get(rt, "http://llm.example.com/v1/models")
+	require.NoError(t, err)
+	assert.Equal(t, "via proxy", body)
+	assert.Equal(t, "http://llm.example.com/v1/models", proxied)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for range 5 {
+			_, _ = w.Write([]byte("data: {}\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+		if r.URL.Path == "/stall" {
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+	rt := &idleTimeoutTransport{next: http.DefaultTransport, timeout: 100 * time.Millisecond}
+
+	body, err := get(rt, server.URL+"/stream")
+	require.NoError(t, err, "a stream which keeps sending data should not time out")
+	assert.Equal(t, strings.Repeat("data: {}\n\n", 5), body)
+
+	body, err = get(rt, server.URL+"/stall")
+	assert.ErrorIs(t, err, ErrIdleTimeout)
+	assert.Equal(t, strings.Repeat("data: {}\n\n", 5), body, "data received before the stream stalled should be returned")
+}
+
+// connectProxy returns an HTTP proxy which tunnels CONNECT requests, recording
+// their Proxy-Authorization header.
+func connectProxy(t *testing.T, authorization *string) *httptest.Server {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		*authorization = r.Header.Get("Proxy-Authorization")
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			defer target.Close()
+			_, _ = io.Copy(target, conn)
+		}()
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, target)
+		}()
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestProxyDialer(t *testing.T) {
+	dialer, err := HTTPSettings{}.ProxyDialer()
+	require.NoError(t, err)
+	assert.Nil(t, dialer, "without a proxy clients should use their default dialer")
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tunneled"))
+	}))
+	defer target.Close()
+	var authorization string
+	proxy := connectProxy(t, &authorization)
+
+	dialer, err = HTTPSettings{ProxyURL: strings.Replace(proxy.URL, "http://", "http://user:secret@", 1)}.ProxyDialer()
+	require.NoError(t, err)
+	conn, err := dialer(t.Context(), target.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")), authorization)
+
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "tunneled", string(body))
+}
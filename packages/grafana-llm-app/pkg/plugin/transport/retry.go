@@ -0,0 +1,188 @@
+// Package transport provides the HTTP transports shared by the clients the
+// plugin uses to call LLM providers and embedders.
+package transport
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// Defaults for RetrySettings.
+const (
+	DefaultMaxAttempts                = 3
+	DefaultInitialBackoffMilliseconds = 500
+	DefaultMaxBackoffSeconds          = 30
+)
+
+// RetrySettings configures retries of failed requests.
+type RetrySettings struct {
+	// MaxAttempts is the maximum number of attempts for each request,
+	// including the first. 1 disables retries.
+	MaxAttempts int `json:"maxAttempts"`
+	// InitialBackoffMilliseconds is the delay before the first retry. It is
+	// doubled for each further retry, and jittered.
+	InitialBackoffMilliseconds int `json:"initialBackoffMilliseconds"`
+	// MaxBackoffSeconds is the longest delay before a retry. Requests are not
+	// retried if the server asks the client to wait longer than this.
+	MaxBackoffSeconds int `json:"maxBackoffSeconds"`
+}
+
+// WithDefaults returns s with defaults for any settings which aren't set.
+func (s RetrySettings) WithDefaults() RetrySettings {
+	if s.MaxAttempts <= 0 {
+		s.MaxAttempts = DefaultMaxAttempts
+	}
+	if s.InitialBackoffMilliseconds <= 0 {
+		s.InitialBackoffMilliseconds = DefaultInitialBackoffMilliseconds
+	}
+	if s.MaxBackoffSeconds <= 0 {
+		s.MaxBackoffSeconds = DefaultMaxBackoffSeconds
+	}
+	return s
+}
+
+// retryableStatus reports whether a response with the given status is worth
+// retrying: rate limits and transient server errors.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryingTransport is an http.RoundTripper which retries failed requests with
+// exponential backoff and jitter.
+type retryingTransport struct {
+	settings RetrySettings
+	next     http.RoundTripper
+
+	// jitter returns a random duration in [0, d). It is overridden in tests.
+	jitter func(d time.Duration) time.Duration
+}
+
+// NewRetrying returns a transport which sends requests using next, retrying
+// them if they fail with a connection error, a rate limit or a transient
+// server error, up to settings.MaxAttempts times.
+//
+// The delay before each retry is taken from the Retry-After header of the
+// response if there is one, and otherwise grows exponentially from
+// settings.InitialBackoffMilliseconds with jitter.
+//
+// Only the request is retried: once a response has been returned, failures
+// reading its body, such as a stream which is interrupted, are left to the
+// caller, since its output may already have been used.
+func NewRetrying(settings RetrySettings, next http.RoundTripper) http.RoundTripper {
+	if settings.MaxAttempts <= 1 {
+		return next
+	}
+	return &retryingTransport{
+		settings: settings,
+		next:     next,
+		jitter: func(d time.Duration) time.Duration {
+			return rand.N(d)
+		},
+	}
+}
+
+func (t *retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests can only be retried if their body can be sent again.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return t.next.RoundTrip(req)
+	}
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		r := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(ctx)
+			r.Body = body
+		}
+		resp, err := t.next.RoundTrip(r)
+		if attempt >= t.settings.MaxAttempts || ctx.Err() != nil {
+			return resp, err
+		}
+		delay, retry := t.retryDelay(attempt, resp, err)
+		if !retry {
+			return resp, err
+		}
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			// Drain the body so that the connection can be reused.
+			//nolint:errcheck
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			//nolint:errcheck
+			resp.Body.Close()
+		}
+		log.DefaultLogger.Debug("Retrying request", "url", req.URL.Redacted(), "attempt", attempt, "status", status, "err", err, "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying a request after the
+// given attempt, and whether it should be retried at all.
+func (t *retryingTransport) retryDelay(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	maxBackoff := time.Duration(t.settings.MaxBackoffSeconds) * time.Second
+	if err == nil {
+		if !retryableStatus(resp.StatusCode) {
+			return 0, false
+		}
+		// OpenAI and Anthropic tell clients whether a request is worth retrying.
+		if resp.Header.Get("X-Should-Retry") == "false" {
+			return 0, false
+		}
+		if delay, ok := retryAfter(resp.Header, time.Now()); ok {
+			return delay, delay <= maxBackoff
+		}
+	}
+	backoff := time.Duration(t.settings.InitialBackoffMilliseconds) * time.Millisecond
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBackoff)
+	if backoff <= 0 {
+		return 0, true
+	}
+	// Wait for between half and all of the backoff, so that clients which
+	// failed together don't retry together.
+	return backoff/2 + t.jitter(backoff/2+1), true
+}
+
+// retryAfter returns the delay requested by the Retry-After header, or by the
+// more precise retry-after-ms header sent by OpenAI and Anthropic.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(h.Get("Retry-After-Ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
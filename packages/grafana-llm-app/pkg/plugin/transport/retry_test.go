@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTransport returns a retrying transport which doesn't wait between
+// attempts unless told to by the server.
+func newTestTransport(maxAttempts int) *retryingTransport {
+	t := NewRetrying(RetrySettings{MaxAttempts: maxAttempts, MaxBackoffSeconds: 1}, http.DefaultTransport).(*retryingTransport)
+	t.jitter = func(time.Duration) time.Duration { return 0 }
+	return t
+}
+
+// failingServer responds to the first failures requests with status and the
+// given headers, and then with 200 OK, recording the body of each request.
+func failingServer(t *testing.T, failures int32, status int, headers map[string]string) (*httptest.Server, *[]string) {
+	var (
+		calls  atomic.Int32
+		bodies []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if calls.Add(1) <= failures {
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+func post(t *testing.T, rt http.RoundTripper, url string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(`{"model": "gpt-4.1"}`))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRetryingTransport(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		status     int
+		headers    map[string]string
+		failures   int32
+		wantStatus int
+		wantCalls  int
+	}{
+		{name: "rate limited", status: http.StatusTooManyRequests, failures: 2, wantStatus: http.StatusOK, wantCalls: 3},
+		{name: "bad gateway", status: http.StatusBadGateway, failures: 1, wantStatus: http.StatusOK, wantCalls: 2},
+		{name: "attempts exhausted", status: http.StatusServiceUnavailable, failures: 5, wantStatus: http.StatusServiceUnavailable, wantCalls: 3},
+		{name: "bad request", status: http.StatusBadRequest, failures: 1, wantStatus: http.StatusBadRequest, wantCalls: 1},
+		{name: "server says not to retry", status: http.StatusTooManyRequests, headers: map[string]string{"X-Should-Retry": "false"}, failures: 1, wantStatus: http.StatusTooManyRequests, wantCalls: 1},
+		{name: "retry after too long", status: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "60"}, failures: 1, wantStatus: http.StatusTooManyRequests, wantCalls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, bodies := failingServer(t, tc.failures, tc.status, tc.headers)
+			resp := post(t, newTestTransport(3), server.URL)
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+			require.Len(t, *bodies, tc.wantCalls)
+			for _, body := range *bodies {
+				assert.Equal(t, `{"model": "gpt-4.1"}`, body, "the body should be sent with every attempt")
+			}
+		})
+	}
+}
+
+func TestRetryingTransport_RetryAfter(t *testing.T) {
+	server, bodies := failingServer(t, 1, http.StatusTooManyRequests, map[string]string{"Retry-After-Ms": "150"})
+	start := time.Now()
+	resp := post(t, newTestTransport(3), server.URL)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, *bodies, 2)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond, "the retry should wait as long as the server asked")
+}
+
+func TestRetryingTransport_Disabled(t *testing.T) {
+	assert.Equal(t, http.DefaultTransport, NewRetrying(RetrySettings{MaxAttempts: 1}, http.DefaultTransport))
+	assert.Equal(t, http.DefaultTransport, NewRetrying(RetrySettings{}, http.DefaultTransport))
+}
+
+func TestRetryingTransport_ContextCanceled(t *testing.T) {
+	server, bodies := failingServer(t, 5, http.StatusServiceUnavailable, map[string]string{"Retry-After": "1"})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	_, err = newTestTransport(3).RoundTrip(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, *bodies, 1)
+}
+
+// interruptedStream is a RoundTripper whose response body fails after some
+// output has been read.
+type interruptedStream struct {
+	calls int
+}
+
+func (s *interruptedStream) RoundTrip(*http.Request) (*http.Response, error) {
+	s.calls++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(io.MultiReader(strings.NewReader("data: {}\n\n"), errReader{})),
+	}, nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestRetryingTransport_StreamNotRetried(t *testing.T) {
+	stream := &interruptedStream{}
+	rt := NewRetrying(RetrySettings{MaxAttempts: 3}, stream)
+	req, err := http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("{}"))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	assert.Error(t, err)
+	assert.Equal(t, 1, stream.calls, "a stream which fails after output has started should not be retried")
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{header: http.Header{"Retry-After": {"3"}}, want: 3 * time.Second, ok: true},
+		{header: http.Header{"Retry-After": {now.Add(5 * time.Second).Format(http.TimeFormat)}}, want: 5 * time.Second, ok: true},
+		{header: http.Header{"Retry-After": {"3"}, "Retry-After-Ms": {"1500"}}, want: 1500 * time.Millisecond, ok: true},
+		{header: http.Header{"Retry-After": {"soon"}}},
+		{header: http.Header{}},
+	} {
+		got, ok := retryAfter(tc.header, now)
+		assert.Equal(t, tc.ok, ok, tc.header)
+		assert.Equal(t, tc.want, got, tc.header)
+	}
+}
+
+func TestRetryDelay_Backoff(t *testing.T) {
+	rt := NewRetrying(RetrySettings{MaxAttempts: 10, InitialBackoffMilliseconds: 100, MaxBackoffSeconds: 1}, http.DefaultTransport).(*retryingTransport)
+	rt.jitter = func(d time.Duration) time.Duration { return d - 1 }
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		delay, ok := rt.retryDelay(attempt, nil, errors.New("connection refused"))
+		assert.True(t, ok)
+		assert.Equal(t, want, delay, "attempt %d", attempt)
+	}
+
+	rt.jitter = func(time.Duration) time.Duration { return 0 }
+	delay, _ := rt.retryDelay(3, nil, errors.New("connection refused"))
+	assert.Equal(t, 200*time.Millisecond, delay, "jitter should wait at least half the backoff")
+}
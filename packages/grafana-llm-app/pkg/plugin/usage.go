@@ -0,0 +1,614 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// callerHeader is the request header naming the plugin or feature making
+	// an LLM request, used to attribute usage.
+	callerHeader = "X-Grafana-LLM-Caller"
+	// pluginIDHeader is set by Grafana on requests made by plugins. It is
+	// used to attribute usage if the caller header isn't set, and to enforce
+	// caller quotas, since unlike the caller header it can't be set by
+	// clients.
+	pluginIDHeader = "X-Plugin-Id"
+)
+
+// usageBucketSize is the resolution at which usage is aggregated.
+const usageBucketSize = time.Hour
+
+// usageCompactLines is the number of requests recorded after which expired
+// usage is dropped and the usage file is rewritten with just the aggregated
+// buckets.
+const usageCompactLines = 10000
+
+type callerKey struct{}
+
+type pluginIDKey struct{}
+
+// withCaller returns a context recording the plugin or feature making a request.
+func withCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// callerFromContext returns the plugin or feature making a request, if known.
+func callerFromContext(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// requestCaller returns the plugin or feature making a request from its
+// headers, given a function returning the value of a header.
+func requestCaller(header func(string) string) string {
+	if caller := strings.TrimSpace(header(callerHeader)); caller != "" {
+		return caller
+	}
+	return strings.TrimSpace(header(pluginIDHeader))
+}
+
+// withRequestCaller returns a context recording the caller of a request, for
+// attributing usage, and the plugin making it as identified by Grafana, for
+// enforcing quotas, given a function returning the value of a header.
+func withRequestCaller(ctx context.Context, header func(string) string) context.Context {
+	ctx = withCaller(ctx, requestCaller(header))
+	return context.WithValue(ctx, pluginIDKey{}, strings.TrimSpace(header(pluginIDHeader)))
+}
+
+// pluginIDFromContext returns the plugin making a request as identified by
+// Grafana, or an empty string if it wasn't made by a plugin.
+func pluginIDFromContext(ctx context.Context) string {
+	pluginID, _ := ctx.Value(pluginIDKey{}).(string)
+	return pluginID
+}
+
+// usageKey identifies who made requests, and which models served them.
+type usageKey struct {
+	OrgID  int64  `json:"org_id,omitempty"`
+	User   string `json:"user,omitempty"`
+	Caller string `json:"caller,omitempty"`
+	// Model is the abstract model requested, e.g. base or large.
+	Model Model `json:"model,omitempty"`
+	// Provider and ProviderModel are the provider and model which served the
+	// requests.
+	Provider      ProviderType `json:"provider,omitempty"`
+	ProviderModel string       `json:"provider_model,omitempty"`
+}
+
+// usageCounts are the totals for a set of requests.
+type usageCounts struct {
+	Requests int64 `json:"requests"`
+	// EstimatedRequests is the number of requests for which the provider
+	// didn't report usage, so token counts were estimated.
+	EstimatedRequests int64 `json:"estimated_requests"`
+	PromptTokens      int64 `json:"prompt_tokens"`
+	CompletionTokens  int64 `json:"completion_tokens"`
+	TotalTokens       int64 `json:"total_tokens"`
+	// Cost is the estimated cost in US dollars of the requests whose model
+	// has a known price.
+	Cost float64 `json:"cost"`
+	// UnpricedRequests is the number of requests whose model has no known
+	// price, so aren't included in Cost.
+	UnpricedRequests int64 `json:"unpriced_requests"`
+}
+
+func (c *usageCounts) add(o usageCounts) {
+	c.Requests += o.Requests
+	c.EstimatedRequests += o.EstimatedRequests
+	c.PromptTokens += o.PromptTokens
+	c.CompletionTokens += o.CompletionTokens
+	c.TotalTokens += o.TotalTokens
+	c.Cost += o.Cost
+	c.UnpricedRequests += o.UnpricedRequests
+}
+
+// usageBucket is the usage for a key within a single bucket of time. It is
+// also the format of each line of the usage file.
+type usageBucket struct {
+	Start time.Time `json:"start"`
+	usageKey
+	usageCounts
+}
+
+type usageBucketKey struct {
+	start time.Time
+	key   usageKey
+}
+
+// usageStore aggregates token usage in memory, optionally persisting it to a
+// file so that it survives restarts. It is safe for concurrent use.
+type usageStore struct {
+	mu        sync.Mutex
+	buckets   map[usageBucketKey]*usageCounts
+	retention time.Duration
+
+	// path is the file usage is appended to, if any.
+	path string
+	// appended is the number of requests recorded since the store was last
+	// compacted.
+	appended int
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+// newUsageStore creates a usage store, loading any usage persisted to the file
+// configured in settings.
+func newUsageStore(settings UsageSettings) (*usageStore, error) {
+	s := &usageStore{
+		buckets:   map[usageBucketKey]*usageCounts{},
+		retention: time.Duration(settings.RetentionDays) * 24 * time.Hour,
+		path:      settings.Path,
+		now:       time.Now,
+	}
+	if s.path == "" {
+		return s, nil
+	}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("load usage: %w", err)
+	}
+	if err := s.compact(); err != nil {
+		return nil, fmt.Errorf("compact usage: %w", err)
+	}
+	return s, nil
+}
+
+// load reads the usage file into memory. Invalid lines, e.g. a partially
+// written last line, are skipped.
+func (s *usageStore) load() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.DefaultLogger.Warn("Failed to close usage file", "err", err)
+		}
+	}()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var b usageBucket
+		if err := json.Unmarshal(scanner.Bytes(), &b); err != nil {
+			log.DefaultLogger.Warn("Skipping invalid usage record", "err", err)
+			continue
+		}
+		s.addBucket(b)
+	}
+	return scanner.Err()
+}
+
+// compact drops usage older than the retention period and rewrites the usage
+// file with just the remaining buckets. It must be called with s.mu held or
+// before s is shared.
+func (s *usageStore) compact() error {
+	cutoff := s.now().Add(-s.retention).Truncate(usageBucketSize)
+	for k := range s.buckets {
+		if k.start.Before(cutoff) {
+			delete(s.buckets, k)
+		}
+	}
+	s.appended = 0
+	if s.path == "" {
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for k, c := range s.buckets {
+		if err := enc.Encode(usageBucket{Start: k.start, usageKey: k.key, usageCounts: *c}); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *usageStore) addBucket(b usageBucket) {
+	k := usageBucketKey{start: b.Start.UTC(), key: b.usageKey}
+	c, ok := s.buckets[k]
+	if !ok {
+		c = &usageCounts{}
+		s.buckets[k] = c
+	}
+	c.add(b.usageCounts)
+}
+
+// record adds the usage of a single request.
+func (s *usageStore) record(r usageRecord) error {
+	b := usageBucket{
+		Start:    r.Time.UTC().Truncate(usageBucketSize),
+		usageKey: r.Key,
+		usageCounts: usageCounts{
+			Requests:         1,
+			PromptTokens:     int64(r.Usage.PromptTokens),
+			CompletionTokens: int64(r.Usage.CompletionTokens),
+			TotalTokens:      int64(r.Usage.TotalTokens),
+		},
+	}
+	if r.Estimated {
+		b.EstimatedRequests = 1
+	}
+	if r.Cost != nil {
+		b.Cost = *r.Cost
+	} else {
+		b.UnpricedRequests = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addBucket(b)
+	s.appended++
+	if s.appended >= usageCompactLines {
+		return s.compact()
+	}
+	if s.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Dimensions usage can be grouped by.
+const (
+	usageGroupByUser          = "user"
+	usageGroupByCaller        = "caller"
+	usageGroupByModel         = "model"
+	usageGroupByProvider      = "provider"
+	usageGroupByProviderModel = "provider_model"
+	usageGroupByHour          = "hour"
+	usageGroupByDay           = "day"
+)
+
+var usageGroupByDimensions = []string{
+	usageGroupByUser,
+	usageGroupByCaller,
+	usageGroupByModel,
+	usageGroupByProvider,
+	usageGroupByProviderModel,
+	usageGroupByHour,
+	usageGroupByDay,
+}
+
+// usageQuery selects the usage of an org within a time range.
+type usageQuery struct {
+	OrgID int64
+	// From and To bound the range of time. Usage is aggregated by hour, so
+	// From is rounded down to the start of its hour.
+	From, To time.Time
+	GroupBy  []string
+}
+
+// usageGroup is the total usage for a group of requests. Only the fields
+// which the usage was grouped by are set.
+type usageGroup struct {
+	Start time.Time `json:"start,omitzero"`
+	usageKey
+	usageCounts
+}
+
+// query returns the usage matching q, grouped by the dimensions in q.GroupBy
+// and sorted by time and then by total tokens, largest first.
+func (s *usageStore) query(q usageQuery) []usageGroup {
+	from := q.From.UTC().Truncate(usageBucketSize)
+	groups := map[usageBucketKey]*usageCounts{}
+	s.mu.Lock()
+	for k, c := range s.buckets {
+		if k.key.OrgID != q.OrgID || k.start.Before(from) || !k.start.Before(q.To) {
+			continue
+		}
+		var g usageBucketKey
+		for _, d := range q.GroupBy {
+			switch d {
+			case usageGroupByUser:
+				g.key.User = k.key.User
+			case usageGroupByCaller:
+				g.key.Caller = k.key.Caller
+			case usageGroupByModel:
+				g.key.Model = k.key.Model
+			case usageGroupByProvider:
+				g.key.Provider = k.key.Provider
+			case usageGroupByProviderModel:
+				g.key.ProviderModel = k.key.ProviderModel
+			case usageGroupByHour:
+				g.start = k.start
+			case usageGroupByDay:
+				g.start = k.start.Truncate(24 * time.Hour)
+			}
+		}
+		total, ok := groups[g]
+		if !ok {
+			total = &usageCounts{}
+			groups[g] = total
+		}
+		total.add(*c)
+	}
+	s.mu.Unlock()
+
+	result := make([]usageGroup, 0, len(groups))
+	for g, c := range groups {
+		result = append(result, usageGroup{Start: g.start, usageKey: g.key, usageCounts: *c})
+	}
+	slices.SortFunc(result, func(a, b usageGroup) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		if a.TotalTokens != b.TotalTokens {
+			if a.TotalTokens > b.TotalTokens {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(fmt.Sprint(a.usageKey), fmt.Sprint(b.usageKey))
+	})
+	return result
+}
+
+// cost returns the total estimated cost of an org's requests between from and
+// to. Usage is aggregated by hour, so from is rounded down to the start of its
+// hour.
+func (s *usageStore) cost(orgID int64, from, to time.Time) float64 {
+	from = from.UTC().Truncate(usageBucketSize)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0.0
+	for k, c := range s.buckets {
+		if k.key.OrgID == orgID && !k.start.Before(from) && k.start.Before(to) {
+			total += c.Cost
+		}
+	}
+	return total
+}
+
+// usageRecord is the usage of a single chat completions request.
+type usageRecord struct {
+	Time  time.Time
+	Key   usageKey
+	Usage openai.Usage
+	// Estimated is true if the provider didn't report usage.
+	Estimated bool
+	// Cost is the estimated cost in US dollars, or nil if the model has no
+	// known price.
+	Cost *float64
+	// PluginID is the plugin which made the request as identified by Grafana,
+	// which caller quotas are enforced against.
+	PluginID string
+}
+
+// usageRecorder is given the usage of each chat completions request sent to a
+// provider.
+type usageRecorder interface {
+	record(r usageRecord) error
+}
+
+// meteringProvider wraps an LLMProvider, passing the token usage of every chat
+// completions request to a set of usageRecorders.
+type meteringProvider struct {
+	LLMProvider
+	recorders []usageRecorder
+	settings  *Settings
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+func newMeteringProvider(provider LLMProvider, settings *Settings, recorders ...usageRecorder) *meteringProvider {
+	return &meteringProvider{LLMProvider: provider, recorders: recorders, settings: settings, now: time.Now}
+}
+
+func (p *meteringProvider) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := p.LLMProvider.ChatCompletion(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	p.record(ctx, req, resp)
+	return resp, nil
+}
+
+// ChatCompletionStream asks the provider to include usage in the stream, if
+// the providers which may serve the request accept it. The extra chunk
+// carrying it is only passed on if the caller asked for it too, in which case
+// it also carries the estimated cost.
+func (p *meteringProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	if !includeUsage && p.settings.acceptsStreamUsage(req.Model) {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	c, err := p.LLMProvider.ChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		var acc streamAccumulator
+		for resp := range c {
+			if resp.Error == nil {
+				acc.add(resp.ChatCompletionStreamResponse)
+				if resp.Usage != nil {
+					if !includeUsage && len(resp.Choices) == 0 {
+						continue
+					}
+					_, providerModel := p.servedBy(ctx, req.Model, resp.Model)
+					resp.Cost = p.cost(providerModel, *resp.Usage)
+				}
+			}
+			if !forwardStreamResponse(ctx, out, resp, c) {
+				break
+			}
+		}
+		// Partial responses are recorded too, since the provider will still
+		// have used tokens generating them.
+		if len(acc.resp.Choices) > 0 || acc.resp.Usage.TotalTokens > 0 {
+			p.record(context.WithoutCancel(ctx), req, acc.resp)
+		}
+	}()
+	return out, nil
+}
+
+// acceptsStreamUsage reports whether every provider which may serve a model,
+// including fallbacks, accepts requests asking for usage to be included in
+// streams. Older Azure API versions and many OpenAI compatible servers reject
+// them, so the usage of their streams is estimated instead. The providers with
+// their own APIs report usage in streams anyway, ignoring the option.
+func (s *Settings) acceptsStreamUsage(model Model) bool {
+	providers := []ProviderType{s.getEffectiveProvider()}
+	if route, ok := s.Routes[model]; ok {
+		providers = []ProviderType{route.Provider}
+	} else {
+		for _, f := range s.Fallbacks {
+			providers = append(providers, f.Provider)
+		}
+	}
+	for _, provider := range providers {
+		switch provider {
+		case ProviderTypeOpenAI:
+			// The Azure provider used to be configured as an OpenAI provider.
+			if s.OpenAI.Provider == ProviderTypeAzure {
+				return false
+			}
+		case ProviderTypeGrafana, ProviderTypeAnthropic, ProviderTypeGemini, ProviderTypeBedrock, ProviderTypeTest:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// record records the usage of a completed request, estimating it if the
+// provider didn't report any, and reports its cost in the response metadata.
+func (p *meteringProvider) record(ctx context.Context, req ChatCompletionRequest, resp openai.ChatCompletionResponse) {
+	r := usageRecord{Time: p.now(), Usage: resp.Usage}
+	if r.Usage.TotalTokens == 0 && r.Usage.PromptTokens == 0 && r.Usage.CompletionTokens == 0 {
+		r.Usage, r.Estimated = estimateUsage(req, resp), true
+	}
+	pCtx := backend.PluginConfigFromContext(ctx)
+	key := usageKey{
+		OrgID:  pCtx.OrgID,
+		Caller: callerFromContext(ctx),
+		Model:  req.Model,
+	}
+	if pCtx.User != nil {
+		key.User = pCtx.User.Login
+	}
+	key.Provider, key.ProviderModel = p.servedBy(ctx, req.Model, resp.Model)
+	r.Key = key
+	r.PluginID = pluginIDFromContext(ctx)
+	r.Cost = p.cost(key.ProviderModel, r.Usage)
+	if r.Cost != nil {
+		responseMetadataFromContext(ctx).setCost(*r.Cost)
+	}
+	for _, rec := range p.recorders {
+		if err := rec.record(r); err != nil {
+			log.DefaultLogger.Warn("Failed to record usage", "err", err)
+		}
+	}
+}
+
+// cost returns the estimated cost of a request to a provider model, or nil if
+// the model has no known price.
+func (p *meteringProvider) cost(providerModel string, usage openai.Usage) *float64 {
+	price, ok := p.settings.Pricing.price(providerModel)
+	if !ok {
+		return nil
+	}
+	cost := requestCost(price, usage)
+	return &cost
+}
+
+// servedBy returns the provider and provider model which served a request for
+// the given abstract model. The model reported in the response is only used if
+// the provider isn't configured with a model name, since providers often
+// report a more specific version.
+func (p *meteringProvider) servedBy(ctx context.Context, model Model, respModel string) (ProviderType, string) {
+	provider, providerModel := p.settings.resolvedModel(model)
+	served := responseMetadataFromContext(ctx).Provider()
+	if served == "" || served == provider {
+		return provider, providerModel
+	}
+	for _, f := range p.settings.Fallbacks {
+		if f.Provider != served {
+			continue
+		}
+		models := f.Models
+		if models == nil {
+			models = defaultModelSettings(f.Provider)
+		}
+		return served, models.getModel(model)
+	}
+	return served, respModel
+}
+
+// estimatedCharsPerToken is the rough number of characters per token used to
+// estimate usage when providers don't report it.
+const estimatedCharsPerToken = 4
+
+// estimateUsage estimates the token usage of a request and its response from
+// the length of their text.
+func estimateUsage(req ChatCompletionRequest, resp openai.ChatCompletionResponse) openai.Usage {
+	prompt := 0
+	for _, m := range req.Messages {
+		prompt += messageLength(m)
+	}
+	completion := 0
+	for _, c := range resp.Choices {
+		completion += messageLength(c.Message)
+	}
+	usage := openai.Usage{
+		PromptTokens:     estimateTokens(prompt),
+		CompletionTokens: estimateTokens(completion),
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+func messageLength(m openai.ChatCompletionMessage) int {
+	n := len(m.Content) + len(m.ReasoningContent)
+	for _, part := range m.MultiContent {
+		n += len(part.Text)
+	}
+	for _, tc := range m.ToolCalls {
+		n += len(tc.Function.Name) + len(tc.Function.Arguments)
+	}
+	return n
+}
+
+func estimateTokens(chars int) int {
+	return (chars + estimatedCharsPerToken - 1) / estimatedCharsPerToken
+}
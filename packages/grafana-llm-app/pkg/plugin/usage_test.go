@@ -0,0 +1,363 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var usageTestTime = time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+
+func newUsageTestStore(t *testing.T, settings UsageSettings) *usageStore {
+	t.Helper()
+	if settings.RetentionDays == 0 {
+		settings.RetentionDays = defaultUsageRetentionDays
+	}
+	s, err := newUsageStore(settings)
+	require.NoError(t, err)
+	s.now = func() time.Time { return usageTestTime }
+	return s
+}
+
+func tokens(prompt, completion int) openai.Usage {
+	return openai.Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+}
+
+func TestUsageStore_Query(t *testing.T) {
+	s := newUsageTestStore(t, UsageSettings{})
+	alice := usageKey{OrgID: 1, User: "alice", Caller: "grafana-assistant-app", Model: ModelBase, Provider: ProviderTypeOpenAI, ProviderModel: "gpt-4.1-mini"}
+	bob := usageKey{OrgID: 1, User: "bob", Model: ModelLarge, Provider: ProviderTypeOpenAI, ProviderModel: "gpt-4.1"}
+	otherOrg := usageKey{OrgID: 2, User: "alice", Model: ModelBase, Provider: ProviderTypeOpenAI, ProviderModel: "gpt-4.1-mini"}
+	require.NoError(t, s.record(usageRecord{Time: usageTestTime, Key: alice, Usage: tokens(10, 5)}))
+	require.NoError(t, s.record(usageRecord{Time: usageTestTime.Add(-time.Hour), Key: alice, Usage: tokens(20, 10), Estimated: true}))
+	cost := 0.25
+	require.NoError(t, s.record(usageRecord{Time: usageTestTime, Key: bob, Usage: tokens(100, 50), Cost: &cost}))
+	require.NoError(t, s.record(usageRecord{Time: usageTestTime, Key: otherOrg, Usage: tokens(1000, 1000)}))
+	require.NoError(t, s.record(usageRecord{Time: usageTestTime.Add(-48 * time.Hour), Key: alice, Usage: tokens(1, 1)}))
+
+	day := usageQuery{OrgID: 1, From: usageTestTime.Add(-24 * time.Hour), To: usageTestTime.Add(time.Minute)}
+
+	total := s.query(day)
+	require.Len(t, total, 1)
+	assert.Equal(t, usageCounts{Requests: 3, EstimatedRequests: 1, PromptTokens: 130, CompletionTokens: 65, TotalTokens: 195, Cost: 0.25, UnpricedRequests: 2}, total[0].usageCounts)
+	assert.Equal(t, usageKey{}, total[0].usageKey)
+
+	day.GroupBy = []string{usageGroupByUser}
+	byUser := s.query(day)
+	require.Len(t, byUser, 2)
+	assert.Equal(t, "bob", byUser[0].User, "groups should be sorted by total tokens")
+	assert.Equal(t, int64(150), byUser[0].TotalTokens)
+	assert.Equal(t, "alice", byUser[1].User)
+	assert.Equal(t, int64(2), byUser[1].Requests)
+	assert.Empty(t, byUser[1].Caller, "only grouped dimensions should be set")
+
+	day.GroupBy = []string{usageGroupByCaller, usageGroupByProviderModel, usageGroupByHour}
+	byHour := s.query(day)
+	require.Len(t, byHour, 3)
+	assert.Equal(t, usageTestTime.Add(-time.Hour).Truncate(time.Hour), byHour[0].Start)
+	assert.Equal(t, "grafana-assistant-app", byHour[0].Caller)
+	assert.Equal(t, "gpt-4.1", byHour[1].ProviderModel)
+	assert.Equal(t, usageTestTime.Truncate(time.Hour), byHour[1].Start)
+
+	lastHour := usageQuery{OrgID: 1, From: usageTestTime.Add(-10 * time.Minute), To: usageTestTime.Add(time.Minute)}
+	assert.Equal(t, int64(2), s.query(lastHour)[0].Requests, "from should be rounded down to the hour")
+
+	assert.Empty(t, s.query(usageQuery{OrgID: 3, From: day.From, To: day.To}))
+}
+
+func TestUsageStore_Persistence(t *testing.T) {
+	// Usage is loaded relative to the current time, so record it relative to
+	// the current time too.
+	now := time.Now().UTC()
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	settings := UsageSettings{Path: path, RetentionDays: 1}
+	s, err := newUsageStore(settings)
+	require.NoError(t, err)
+	key := usageKey{OrgID: 1, User: "alice", Model: ModelBase}
+	require.NoError(t, s.record(usageRecord{Time: now, Key: key, Usage: tokens(10, 5)}))
+	require.NoError(t, s.record(usageRecord{Time: now, Key: key, Usage: tokens(10, 5)}))
+	require.NoError(t, s.record(usageRecord{Time: now.Add(-72 * time.Hour), Key: key, Usage: tokens(1, 1)}))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(b)), "\n"), 3, "each request should be appended")
+
+	// Partially written lines are skipped.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"start": "2024-`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Reloading aggregates the requests, dropping usage older than the
+	// retention period, and compacts the file.
+	reloaded, err := newUsageStore(settings)
+	require.NoError(t, err)
+	result := reloaded.query(usageQuery{OrgID: 1, From: now.Add(-96 * time.Hour), To: now.Add(time.Hour)})
+	require.Len(t, result, 1)
+	assert.Equal(t, usageCounts{Requests: 2, PromptTokens: 20, CompletionTokens: 10, TotalTokens: 30, UnpricedRequests: 2}, result[0].usageCounts)
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(b)), "\n"), 1, "the file should be compacted to one line per bucket")
+}
+
+// streamOptionsProvider records the stream options of requests.
+type streamOptionsProvider struct {
+	fakeBackend
+	options *openai.StreamOptions
+}
+
+func (p *streamOptionsProvider) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (<-chan ChatCompletionStreamResponse, error) {
+	p.options = req.StreamOptions
+	return p.fakeBackend.ChatCompletionStream(ctx, req)
+}
+
+func usageTestContext() context.Context {
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{OrgID: 1, User: &backend.User{Login: "alice"}})
+	ctx, _ = withResponseMetadata(ctx)
+	return withCaller(ctx, "grafana-assistant-app")
+}
+
+func TestMeteringProvider_ChatCompletion(t *testing.T) {
+	s := newUsageTestStore(t, UsageSettings{})
+	inner := &scriptedProvider{responses: []openai.ChatCompletionResponse{answerResponse("4"), {Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: "12345678"}}}}}}
+	p := newMeteringProvider(inner, newCacheTestSettings(), s)
+	p.now = s.now
+
+	req := cacheTestRequest("what is 2+2?", 1)
+	ctx := usageTestContext()
+	_, err := p.ChatCompletion(ctx, req)
+	require.NoError(t, err)
+	cost, ok := responseMetadataFromContext(ctx).Cost()
+	require.True(t, ok, "the cost should be reported in the response metadata")
+	// The second response has no usage, so it is estimated.
+	_, err = p.ChatCompletion(usageTestContext(), req)
+	require.NoError(t, err)
+
+	result := s.query(usageQuery{OrgID: 1, From: usageTestTime.Add(-time.Hour), To: usageTestTime.Add(time.Hour), GroupBy: usageGroupByDimensions[:5]})
+	require.Len(t, result, 1)
+	assert.Equal(t, usageKey{User: "alice", Caller: "grafana-assistant-app", Model: ModelBase, Provider: ProviderTypeOpenAI, ProviderModel: "gpt-4.1-mini"}, result[0].usageKey)
+	counts := result[0].usageCounts
+	assert.InDelta(t, (23*0.40+7*1.60)/1e6, counts.Cost, 1e-12)
+	assert.Less(t, cost, counts.Cost)
+	counts.Cost = 0
+	assert.Equal(t, usageCounts{Requests: 2, EstimatedRequests: 1, PromptTokens: 23, CompletionTokens: 7, TotalTokens: 30}, counts)
+}
+
+func TestMeteringProvider_ChatCompletionStream(t *testing.T) {
+	finish := streamChunk("")
+	finish.Choices[0].FinishReason = openai.FinishReasonStop
+	usageChunk := ChatCompletionStreamResponse{ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{Usage: &openai.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}}}
+
+	for _, includeUsage := range []bool{false, true} {
+		s := newUsageTestStore(t, UsageSettings{})
+		inner := &streamOptionsProvider{fakeBackend: fakeBackend{chunks: []ChatCompletionStreamResponse{streamChunk("Hi"), finish, usageChunk}}}
+		p := newMeteringProvider(inner, newCacheTestSettings(), s)
+		p.now = s.now
+		req := cacheTestRequest("hello", 1)
+		req.Stream = true
+		if includeUsage {
+			req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+		}
+		c, err := p.ChatCompletionStream(usageTestContext(), req)
+		require.NoError(t, err)
+		var chunks []ChatCompletionStreamResponse
+		for chunk := range c {
+			chunks = append(chunks, chunk)
+		}
+		require.NotNil(t, inner.options)
+		assert.True(t, inner.options.IncludeUsage, "usage should always be requested")
+		if includeUsage {
+			require.Len(t, chunks, 3)
+			require.NotNil(t, chunks[2].Cost, "the usage chunk should carry the cost")
+			assert.InDelta(t, (3*0.40+2*1.60)/1e6, *chunks[2].Cost, 1e-12)
+		} else {
+			assert.Len(t, chunks, 2, "the usage chunk should only be sent to callers which asked for it")
+		}
+
+		result := s.query(usageQuery{OrgID: 1, From: usageTestTime.Add(-time.Hour), To: usageTestTime.Add(time.Hour)})
+		require.Len(t, result, 1)
+		counts := result[0].usageCounts
+		assert.InDelta(t, (3*0.40+2*1.60)/1e6, counts.Cost, 1e-12)
+		counts.Cost = 0
+		assert.Equal(t, usageCounts{Requests: 1, PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}, counts)
+	}
+}
+
+func TestMeteringProvider_AzureChatCompletionStream(t *testing.T) {
+	// Older Azure API versions reject requests with stream options.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if _, ok := body["stream_options"]; ok {
+			http.Error(w, `{"error": {"message": "Unrecognized request argument supplied: stream_options"}}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"choices": [{"index": 0, "delta": {"role": "assistant", "content": "Hello there"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices": [{"index": 0, "delta": {}, "finish_reason": "stop"}]}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	settings := &Settings{
+		Provider: ProviderTypeAzure,
+		OpenAI:   OpenAISettings{URL: server.URL, AzureMapping: [][]string{{"base", "gpt-4o-mini"}}, apiKey: "abcd1234"},
+		Models:   defaultModelSettings(ProviderTypeAzure),
+	}
+	azure, err := NewAzureProvider(settings.OpenAI, ModelBase)
+	require.NoError(t, err)
+	s := newUsageTestStore(t, UsageSettings{})
+	p := newMeteringProvider(azure, settings, s)
+	p.now = s.now
+
+	req := cacheTestRequest("hello", 1)
+	req.Stream = true
+	c, err := p.ChatCompletionStream(usageTestContext(), req)
+	require.NoError(t, err)
+	var content string
+	for chunk := range c {
+		require.NoError(t, chunk.Error)
+		for _, choice := range chunk.Choices {
+			content += choice.Delta.Content
+		}
+	}
+	assert.Equal(t, "Hello there", content)
+
+	result := s.query(usageQuery{OrgID: 1, From: usageTestTime.Add(-time.Hour), To: usageTestTime.Add(time.Hour)})
+	require.Len(t, result, 1)
+	assert.Equal(t, int64(1), result[0].EstimatedRequests, "the usage should be estimated")
+}
+
+func TestAcceptsStreamUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		settings Settings
+		want     bool
+	}{
+		{name: "openai", settings: Settings{Provider: ProviderTypeOpenAI}, want: true},
+		{name: "grafana", settings: Settings{Provider: ProviderTypeGrafana}, want: true},
+		{name: "anthropic", settings: Settings{Provider: ProviderTypeAnthropic}, want: true},
+		{name: "azure", settings: Settings{Provider: ProviderTypeAzure}},
+		{name: "legacy azure", settings: Settings{OpenAI: OpenAISettings{Provider: ProviderTypeAzure}}},
+		{name: "custom", settings: Settings{Provider: ProviderTypeCustom}},
+		{name: "local", settings: Settings{Provider: ProviderTypeLocal}},
+		{
+			name:     "azure fallback",
+			settings: Settings{Provider: ProviderTypeOpenAI, Fallbacks: []FallbackProvider{{Provider: ProviderTypeAzure}}},
+		},
+		{
+			name: "routed to openai",
+			settings: Settings{
+				Provider:  ProviderTypeLocal,
+				Fallbacks: []FallbackProvider{{Provider: ProviderTypeAzure}},
+				Routes:    map[Model]ModelRoute{ModelBase: {Provider: ProviderTypeOpenAI}},
+			},
+			want: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.settings.acceptsStreamUsage(ModelBase))
+		})
+	}
+}
+
+func TestServedBy(t *testing.T) {
+	settings := newCacheTestSettings()
+	settings.Fallbacks = []FallbackProvider{{Provider: ProviderTypeAnthropic}}
+	p := newMeteringProvider(&fakeBackend{}, settings)
+
+	ctx, md := withResponseMetadata(context.Background())
+	provider, model := p.servedBy(ctx, ModelBase, "gpt-4.1-mini-2025-04-14")
+	assert.Equal(t, ProviderTypeOpenAI, provider)
+	assert.Equal(t, "gpt-4.1-mini", model)
+
+	md.setProvider(ProviderTypeAnthropic)
+	provider, model = p.servedBy(ctx, ModelBase, "claude")
+	assert.Equal(t, ProviderTypeAnthropic, provider)
+	assert.Equal(t, defaultModelSettings(ProviderTypeAnthropic).getModel(ModelBase), model)
+}
+
+func TestParseUsageQuery(t *testing.T) {
+	now := usageTestTime
+	q, err := parseUsageQuery(url.Values{}, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), q.From)
+	assert.Equal(t, now, q.To)
+	assert.Empty(t, q.GroupBy)
+
+	q, err = parseUsageQuery(url.Values{
+		"from":    {"2024-01-01T00:00:00Z"},
+		"to":      {"1704153600000"},
+		"groupBy": {"user, model"},
+	}, now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), q.To)
+	assert.Equal(t, []string{"user", "model"}, q.GroupBy)
+
+	for _, params := range []url.Values{
+		{"from": {"yesterday"}},
+		{"from": {"2024-01-03T00:00:00Z"}, "to": {"2024-01-02T00:00:00Z"}},
+		{"groupBy": {"team"}},
+	} {
+		_, err := parseUsageQuery(params, now)
+		assert.Error(t, err, params)
+	}
+}
+
+func TestHandleUsage(t *testing.T) {
+	ctx := context.Background()
+	settings := backend.AppInstanceSettings{JSONData: []byte(`{"provider": "test"}`)}
+	inst, err := NewApp(ctx, settings)
+	require.NoError(t, err)
+	app := inst.(*App)
+
+	call := func(method, path string, user *backend.User, body string, headers map[string][]string) *backend.CallResourceResponse {
+		var r mockCallResourceResponseSender
+		err := app.CallResource(ctx, &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{OrgID: 1, User: user, AppInstanceSettings: &settings},
+			Method:        method,
+			Path:          path,
+			Headers:       headers,
+			Body:          []byte(body),
+		}, &r)
+		require.NoError(t, err)
+		return r.response
+	}
+
+	editor := &backend.User{Login: "editor", Role: "Editor"}
+	resp := call(http.MethodPost, "/llm/v1/chat/completions", editor, `{"messages": [{"role": "user", "content": "hi"}]}`, map[string][]string{http.CanonicalHeaderKey(callerHeader): {"grafana-assistant-app"}})
+	require.Equal(t, http.StatusOK, resp.Status, string(resp.Body))
+
+	resp = call(http.MethodGet, "/llm/v1/usage?groupBy=user,caller", editor, "", nil)
+	assert.Equal(t, http.StatusForbidden, resp.Status)
+
+	resp = call(http.MethodGet, "/llm/v1/usage?groupBy=user,caller", &backend.User{Login: "admin", Role: "Admin"}, "", nil)
+	require.Equal(t, http.StatusOK, resp.Status, string(resp.Body))
+	var usage usageResponse
+	require.NoError(t, json.Unmarshal(resp.Body, &usage))
+	assert.Equal(t, []string{"user", "caller"}, usage.GroupBy)
+	require.Len(t, usage.Usage, 1)
+	assert.Equal(t, "editor", usage.Usage[0].User)
+	assert.Equal(t, "grafana-assistant-app", usage.Usage[0].Caller)
+	assert.Equal(t, int64(1), usage.Usage[0].Requests)
+	assert.Equal(t, int64(10), usage.Usage[0].TotalTokens)
+
+	resp = call(http.MethodGet, "/llm/v1/usage?groupBy=team", &backend.User{Login: "admin", Role: "Admin"}, "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.Status)
+}
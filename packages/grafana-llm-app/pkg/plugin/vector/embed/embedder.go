@@ -3,6 +3,7 @@ package embed
 import (
 	"context"
 
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 )
 
@@ -23,6 +24,11 @@ type Settings struct {
 
 	OpenAI                   openAISettings
 	GrafanaVectorAPISettings grafanaVectorAPISettings `json:"grafanaVectorAPI"`
+
+	// Retries is a copy of the plugin's retry settings.
+	Retries transport.RetrySettings `json:"-"`
+	// HTTP is a copy of the plugin's outbound HTTP settings.
+	HTTP transport.HTTPSettings `json:"-"`
 }
 
 // NewEmbedder creates a new embedder.
@@ -30,5 +36,5 @@ func NewEmbedder(s Settings, secrets map[string]string) (Embedder, error) {
 	log.DefaultLogger.Debug("Creating OpenAI embedder")
 	// Grafana Vector API embedder is OpenAI compatible so we can reuse the client
 	// The EmbedderType is used in settings.load_settings to duplicate the correct OpenAI settings
-	return newOpenAIEmbedder(s, secrets), nil
+	return newOpenAIEmbedder(s, secrets)
 }
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 )
 
@@ -126,13 +128,23 @@ func (o *openAIClient) Health(ctx context.Context, model string) error {
 	return err
 }
 
+// newClient returns an HTTP client which connects according to the outbound
+// HTTP settings, retries failed requests and traces each attempt, propagating
+// the trace context to the embeddings API.
+func newClient(settings Settings) (*http.Client, error) {
+	base, err := transport.New(settings.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport.NewRetrying(settings.Retries, httpclient.TracingMiddleware(nil).CreateMiddleware(httpclient.Options{}, base))}, nil
+}
+
 // newOpenAIEmbedder creates a new Embedder using OpenAI's API.
-func newOpenAIEmbedder(settings Settings, secrets map[string]string) Embedder {
+func newOpenAIEmbedder(settings Settings, secrets map[string]string) (Embedder, error) {
 	var impl openAIClient
 	switch settings.Type {
 	case EmbedderOpenAI:
 		impl = openAIClient{
-			client:       &http.Client{},
 			url:          settings.OpenAI.URL,
 			authType:     string(settings.OpenAI.AuthType),
 			providerType: settings.Type,
@@ -142,7 +154,6 @@ func newOpenAIEmbedder(settings Settings, secrets map[string]string) Embedder {
 		}
 	case EmbedderGrafanaVectorAPI:
 		impl = openAIClient{
-			client:       &http.Client{},
 			url:          settings.GrafanaVectorAPISettings.URL,
 			authType:     string(settings.GrafanaVectorAPISettings.AuthType),
 			providerType: settings.Type,
@@ -152,8 +163,13 @@ func newOpenAIEmbedder(settings Settings, secrets map[string]string) Embedder {
 			},
 		}
 	default:
-		return nil
+		return nil, nil
 	}
 
-	return &impl
+	client, err := newClient(settings)
+	if err != nil {
+		return nil, err
+	}
+	impl.client = client
+	return &impl, nil
 }
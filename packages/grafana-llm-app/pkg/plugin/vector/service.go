@@ -9,6 +9,10 @@ import (
 	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/embed"
 	"github.com/grafana/grafana-llm-app/pkg/plugin/vector/store"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Service interface {
@@ -60,30 +64,38 @@ func NewService(s VectorSettings, secrets map[string]string) (Service, error) {
 }
 
 func (v *vectorService) Search(ctx context.Context, collection string, query string, topK uint64, filter map[string]interface{}) ([]store.SearchResult, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "vector.Search", trace.WithAttributes(
+		semconv.GenAIOperationNameRetrieval,
+		semconv.GenAIDataSourceID(collection),
+		semconv.GenAIRequestModel(v.model),
+		attribute.Int64("vector.top_k", int64(topK)),
+	))
+	defer span.End()
 	if query == "" {
-		return nil, fmt.Errorf("query cannot be empty")
+		return nil, tracing.Errorf(span, "query cannot be empty")
 	}
 	exists, err := v.store.CollectionExists(ctx, collection)
 	if err != nil {
-		return nil, fmt.Errorf("vector store collections: %w", err)
+		return nil, tracing.Errorf(span, "vector store collections: %w", err)
 	}
 	if !exists {
-		return nil, fmt.Errorf("collection %s not found in store", collection)
+		return nil, tracing.Errorf(span, "collection %s not found in store", collection)
 	}
 
 	log.DefaultLogger.Info("Embedding", "model", v.model, "query", query)
 	// Get the embedding for the search query.
 	e, err := v.embedder.Embed(ctx, v.model, query)
 	if err != nil {
-		return nil, fmt.Errorf("embed query: %w", err)
+		return nil, tracing.Errorf(span, "embed query: %w", err)
 	}
 
 	log.DefaultLogger.Info("Searching", "collection", collection, "query", query)
 	// Search the vector store for similar vectors.
 	results, err := v.store.Search(ctx, collection, e, topK, filter)
 	if err != nil {
-		return nil, fmt.Errorf("vector store search: %w", err)
+		return nil, tracing.Errorf(span, "vector store search: %w", err)
 	}
+	span.SetAttributes(attribute.Int("vector.results", len(results)))
 
 	return results, nil
 }
@@ -2,12 +2,15 @@ package store
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/json"
 	"fmt"
 
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	qdrant "github.com/qdrant/go-client/qdrant"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
@@ -29,11 +32,30 @@ type qdrantStore struct {
 	pointsClient      qdrant.PointsClient
 }
 
-func newQdrantStore(s qdrantSettings, secrets map[string]string) (ReadVectorStore, func(), error) {
+var _ VectorStore = (*qdrantStore)(nil)
+
+func newQdrantStore(s qdrantSettings, httpSettings transport.HTTPSettings, secrets map[string]string) (*qdrantStore, func(), error) {
 	var md *metadata.MD
-	dialOptions := []grpc.DialOption{}
+	dialOptions := []grpc.DialOption{
+		// Trace calls, propagating the trace context to Qdrant.
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: httpSettings.ConnectTimeout(),
+		}),
+	}
+	dialer, err := httpSettings.ProxyDialer()
+	if err != nil {
+		return nil, nil, err
+	}
+	if dialer != nil {
+		dialOptions = append(dialOptions, grpc.WithContextDialer(dialer))
+	}
 	if s.Secure {
-		config := &tls.Config{}
+		config, err := httpSettings.TLSConfig()
+		if err != nil {
+			return nil, nil, err
+		}
 		dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials.NewTLS(config)))
 		// Only include API key if using a secure connection.
 		if key := secrets["qdrantApiKey"]; key != "" {
@@ -242,3 +264,82 @@ func fromQdrantValue(in *qdrant.Value) any {
 	}
 	return nil
 }
+
+func (q *qdrantStore) Collections(ctx context.Context) ([]string, error) {
+	if q.md != nil {
+		ctx = metadata.NewOutgoingContext(ctx, *q.md)
+	}
+	resp, err := q.collectionsClient.List(ctx, &qdrant.ListCollectionsRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		return nil, err
+	}
+	collections := make([]string, 0, len(resp.GetCollections()))
+	for _, c := range resp.GetCollections() {
+		collections = append(collections, c.GetName())
+	}
+	return collections, nil
+}
+
+// CreateCollection creates a collection of vectors with the given size, which
+// are compared using cosine similarity.
+func (q *qdrantStore) CreateCollection(ctx context.Context, collection string, size uint64) error {
+	if q.md != nil {
+		ctx = metadata.NewOutgoingContext(ctx, *q.md)
+	}
+	_, err := q.collectionsClient.Create(ctx, &qdrant.CreateCollection{
+		CollectionName: collection,
+		VectorsConfig: qdrant.NewVectorsConfig(&qdrant.VectorParams{
+			Size:     size,
+			Distance: qdrant.Distance_Cosine,
+		}),
+	}, grpc.WaitForReady(true))
+	return err
+}
+
+func (q *qdrantStore) PointExists(ctx context.Context, collection string, id uint64) (bool, error) {
+	if q.md != nil {
+		ctx = metadata.NewOutgoingContext(ctx, *q.md)
+	}
+	resp, err := q.pointsClient.Get(ctx, &qdrant.GetPoints{
+		CollectionName: collection,
+		Ids:            []*qdrant.PointId{qdrant.NewIDNum(id)},
+	}, grpc.WaitForReady(true))
+	if err != nil {
+		return false, err
+	}
+	return len(resp.GetResult()) > 0, nil
+}
+
+// UpsertColumnar inserts or replaces points. The slices must all have the
+// same length, and each payload must be a JSON object.
+func (q *qdrantStore) UpsertColumnar(ctx context.Context, collection string, ids []uint64, embeddings [][]float32, payloadJSONs []string) error {
+	if len(embeddings) != len(ids) || len(payloadJSONs) != len(ids) {
+		return fmt.Errorf("upsert: got %d ids, %d embeddings and %d payloads", len(ids), len(embeddings), len(payloadJSONs))
+	}
+	if q.md != nil {
+		ctx = metadata.NewOutgoingContext(ctx, *q.md)
+	}
+	points := make([]*qdrant.PointStruct, 0, len(ids))
+	for i, id := range ids {
+		var payload map[string]any
+		if err := json.Unmarshal([]byte(payloadJSONs[i]), &payload); err != nil {
+			return fmt.Errorf("unmarshal payload for point %d: %w", id, err)
+		}
+		values, err := qdrant.TryValueMap(payload)
+		if err != nil {
+			return fmt.Errorf("convert payload for point %d: %w", id, err)
+		}
+		points = append(points, &qdrant.PointStruct{
+			Id:      qdrant.NewIDNum(id),
+			Vectors: qdrant.NewVectors(embeddings[i]...),
+			Payload: values,
+		})
+	}
+	wait := true
+	_, err := q.pointsClient.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: collection,
+		Wait:           &wait,
+		Points:         points,
+	}, grpc.WaitForReady(true))
+	return err
+}
@@ -2,7 +2,9 @@ package store
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 )
 
@@ -52,22 +54,42 @@ type Settings struct {
 	GrafanaVectorAPI GrafanaVectorAPISettings `json:"grafanaVectorAPI"`
 
 	Qdrant qdrantSettings `json:"qdrant"`
+
+	// HTTP is a copy of the plugin's outbound HTTP settings, which also
+	// apply to gRPC connections to Qdrant.
+	HTTP transport.HTTPSettings `json:"-"`
 }
 
 func NewReadVectorStore(s Settings, secrets map[string]string) (ReadVectorStore, context.CancelFunc, error) {
 	switch s.Type {
 	case VectorStoreTypeGrafanaVectorAPI:
 		log.DefaultLogger.Debug("Creating Grafana Vector API store")
-		vectorStore, err := newGrafanaVectorAPI(s.GrafanaVectorAPI, secrets)
+		vectorStore, err := newGrafanaVectorAPI(s.GrafanaVectorAPI, s.HTTP, secrets)
 		return vectorStore, func() {}, err
 	case VectorStoreTypeQdrant:
 		log.DefaultLogger.Debug("Creating Qdrant store")
-		return newQdrantStore(s.Qdrant, secrets)
+		qdrantStore, cancel, err := newQdrantStore(s.Qdrant, s.HTTP, secrets)
+		if err != nil {
+			return nil, nil, err
+		}
+		return qdrantStore, cancel, nil
 	}
 	return nil, nil, nil
 }
 
-func NewVectorStore(s Settings) (VectorStore, error) {
-	// TODO: Implement write vector store.
-	return nil, nil
+// NewVectorStore creates a vector store which can also be written to. Only
+// Qdrant currently supports writes.
+func NewVectorStore(s Settings, secrets map[string]string) (VectorStore, context.CancelFunc, error) {
+	switch s.Type {
+	case VectorStoreTypeQdrant:
+		log.DefaultLogger.Debug("Creating writable Qdrant store")
+		qdrantStore, cancel, err := newQdrantStore(s.Qdrant, s.HTTP, secrets)
+		if err != nil {
+			return nil, nil, err
+		}
+		return qdrantStore, cancel, nil
+	case VectorStoreTypeGrafanaVectorAPI:
+		return nil, nil, fmt.Errorf("vector store %s does not support writes", s.Type)
+	}
+	return nil, nil, nil
 }
@@ -8,6 +8,8 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/grafana/grafana-llm-app/pkg/plugin/transport"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 )
 
@@ -37,7 +39,7 @@ func (g *grafanaVectorAPI) setAuth(req *http.Request) {
 }
 
 func (g *grafanaVectorAPI) CollectionExists(ctx context.Context, collection string) (bool, error) {
-	req, err := http.NewRequest("GET", g.url+"/v1/collections/"+collection, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", g.url+"/v1/collections/"+collection, nil)
 	if err != nil {
 		return false, fmt.Errorf("get collection: %w", err)
 	}
@@ -69,7 +71,7 @@ func (g *grafanaVectorAPI) Search(ctx context.Context, collection string, vector
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", g.url+"/v1/collections/"+collection+"/query", bytes.NewReader(reqJSON))
+	req, err := http.NewRequestWithContext(ctx, "POST", g.url+"/v1/collections/"+collection+"/query", bytes.NewReader(reqJSON))
 	if err != nil {
 		return nil, fmt.Errorf("get collections: %w", err)
 	}
@@ -115,7 +117,7 @@ func (g *grafanaVectorAPI) Search(ctx context.Context, collection string, vector
 }
 
 func (g *grafanaVectorAPI) Health(ctx context.Context) error {
-	req, err := http.NewRequest("GET", g.url+"/healthz", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", g.url+"/healthz", nil)
 	if err != nil {
 		return fmt.Errorf("get health: %w", err)
 	}
@@ -130,9 +132,14 @@ func (g *grafanaVectorAPI) Health(ctx context.Context) error {
 	return nil
 }
 
-func newGrafanaVectorAPI(s GrafanaVectorAPISettings, secrets map[string]string) (ReadVectorStore, error) {
+func newGrafanaVectorAPI(s GrafanaVectorAPISettings, httpSettings transport.HTTPSettings, secrets map[string]string) (ReadVectorStore, error) {
+	base, err := transport.New(httpSettings)
+	if err != nil {
+		return nil, err
+	}
 	return &grafanaVectorAPI{
-		client:   &http.Client{},
+		// Trace requests, propagating the trace context to the vector API.
+		client:   &http.Client{Transport: httpclient.TracingMiddleware(nil).CreateMiddleware(httpclient.Options{}, base)},
 		url:      s.URL,
 		authType: VectorStoreAuthType(s.AuthType),
 		authSettings: grafanaVectorAPIAuthSettings{